@@ -0,0 +1,175 @@
+package main
+
+import (
+	_ "embed"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+	jsoniter "github.com/json-iterator/go"
+)
+
+//adminPage is the single page admin ui served at /admin/ui. it holds no data itself, everything is
+//fetched from the admin api with the api key entered on the page
+//
+//go:embed ui/admin.html
+var adminPage []byte
+
+//defaultDecisionsLimit is how many recent decisions are returned when no limit is passed
+const defaultDecisionsLimit = 50
+
+//PolicyTest is the decision a policy would make for an ip, returned without recording it anywhere
+type PolicyTest struct {
+	Policy   string  `json:"policy"`
+	Version  int     `json:"version"`
+	IP       string  `json:"ip"`
+	Decision string  `json:"decision"`
+	Country  Country `json:"country"`
+	ASN      *ASN    `json:"asn,omitempty"`
+}
+
+//DatabaseInfo describes the data of a loaded provider or mmdb file
+type DatabaseInfo struct {
+	Provider   string    `json:"provider,omitempty"`
+	Type       string    `json:"type"`
+	IPVersion  uint      `json:"ip_version"`
+	BuildEpoch uint      `json:"build_epoch"`
+	Built      time.Time `json:"built"`
+	Age        string    `json:"age"`
+	NodeCount  uint      `json:"node_count"`
+	Healthy    bool      `json:"healthy"`
+	Error      string    `json:"error,omitempty"`
+}
+
+//DatabaseStatus is the version and health of the loaded databases. stale is set when the country
+//database is older than the webhooks database max age
+type DatabaseStatus struct {
+	Country DatabaseInfo  `json:"country"`
+	ASN     *DatabaseInfo `json:"asn,omitempty"`
+	MaxAge  string        `json:"max_age"`
+	Stale   bool          `json:"stale"`
+}
+
+//adminUIHandler serves the admin ui. the page can't be framed by other sites, and only loads
+//scripts and styles from itself
+func adminUIHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Add("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Content-Security-Policy", "default-src 'self'; script-src 'unsafe-inline'; style-src 'unsafe-inline'; frame-ancestors 'none'")
+	w.Header().Set("X-Frame-Options", "DENY")
+	w.Write(adminPage)
+}
+
+//countriesHandler returns every country in the loaded database sorted by name
+func countriesHandler(w http.ResponseWriter, r *http.Request) {
+	known, err := KnownCountries()
+	if err != nil {
+		respondError(w, r, http.StatusInternalServerError, err)
+		return
+	}
+	countries := make([]Country, 0, len(known))
+	for _, country := range known {
+		countries = append(countries, country)
+	}
+	sort.Slice(countries, func(i, j int) bool { return countries[i].Name < countries[j].Name })
+	w.Header().Add("Content-Type", "application/json")
+	jsoniter.NewEncoder(w).Encode(countries)
+}
+
+//testPolicyHandler decides the ip in the path against the caller's policy named in the path. the decision
+//is audited as a test, but unlike a check it isn't notified or compared against shadows, and shadow
+//policies can be tested too
+func testPolicyHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	policy, ok := GetPolicy(RequestTenant(r), vars["name"])
+	if !ok {
+		respondError(w, r, http.StatusNotFound, fmt.Errorf("policy %v not found", vars["name"]))
+		return
+	}
+	ip := vars["ip"]
+	if _, err := ParseAddr(ip); err != nil {
+		respondError(w, r, http.StatusBadRequest, err)
+		return
+	}
+	decision, err := EvaluatePolicy(ip, policy)
+	if err != nil {
+		respondError(w, r, http.StatusInternalServerError, err)
+		return
+	}
+	test := PolicyTest{Policy: policy.Name, Version: policy.Version, IP: ip, Decision: decisionName(decision.Allowed),
+		Country: decision.Country}
+	if decision.ASN.Number != 0 {
+		test.ASN = &decision.ASN
+	}
+	recordPolicyTest(r, ip, policy, decision)
+	w.Header().Add("Content-Type", "application/json")
+	jsoniter.NewEncoder(w).Encode(test)
+}
+
+//decisionsHandler returns the caller's latest decisions, newest first, up to the limit query value
+func decisionsHandler(w http.ResponseWriter, r *http.Request) {
+	limit := defaultDecisionsLimit
+	if value := r.URL.Query().Get("limit"); value != "" {
+		parsed, err := strconv.Atoi(value)
+		if err != nil || parsed <= 0 || parsed > recentDecisionsSize {
+			respondError(w, r, http.StatusBadRequest, fmt.Errorf("limit must be a number between 1 and %v", recentDecisionsSize))
+			return
+		}
+		limit = parsed
+	}
+	w.Header().Add("Content-Type", "application/json")
+	jsoniter.NewEncoder(w).Encode(RecentDecisions(RequestTenant(r), limit))
+}
+
+//databaseHandler returns the version and health of the loaded databases
+func databaseHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Add("Content-Type", "application/json")
+	jsoniter.NewEncoder(w).Encode(GetDatabaseStatus(time.Now()))
+}
+
+//GetDatabaseStatus describes the loaded databases as of now
+func GetDatabaseStatus(now time.Time) DatabaseStatus {
+	activeConfig.Lock()
+	maxAge := activeConfig.config.Webhooks.DatabaseMaxAge
+	if activeConfig.revision == 0 {
+		maxAge = defaultConfig.Webhooks.DatabaseMaxAge
+	}
+	activeConfig.Unlock()
+
+	provider, _ := loadedProvider()
+	status := DatabaseStatus{Country: databaseInfo(provider, now)}
+	if ASNDatabase != nil {
+		//the asn database is always an mmdb file, read through the maxmind provider for its metadata
+		asn := databaseInfo(&maxmindProvider{reader: ASNDatabase}, now)
+		status.ASN = &asn
+	}
+	if maxAge > 0 {
+		status.MaxAge = maxAge.String()
+		status.Stale = status.Country.Healthy && now.Sub(status.Country.Built) > maxAge
+	}
+	return status
+}
+
+//databaseInfo reads the metadata of a provider. it is healthy when it is loaded and can be read
+func databaseInfo(provider LocationProvider, now time.Time) DatabaseInfo {
+	if provider == nil {
+		return DatabaseInfo{Error: "no country database loaded"}
+	}
+	info, err := provider.Info()
+	if err != nil {
+		return DatabaseInfo{Error: err.Error()}
+	}
+	built := time.Unix(int64(info.BuildEpoch), 0).UTC()
+	return DatabaseInfo{
+		Provider:   info.Provider,
+		Type:       info.Type,
+		IPVersion:  info.IPVersion,
+		BuildEpoch: info.BuildEpoch,
+		Built:      built,
+		Age:        now.Sub(built).Truncate(time.Second).String(),
+		NodeCount:  info.NodeCount,
+		Healthy:    true,
+	}
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	jsoniter "github.com/json-iterator/go"
+	log "github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/suite"
+)
+
+func TestAdminUISuite(t *testing.T) {
+	adminUISuite := new(AdminUISuite)
+	suite.Run(t, adminUISuite)
+}
+
+type AdminUISuite struct {
+	suite.Suite
+	dir string
+}
+
+func (suite *AdminUISuite) SetupSuite() {
+	setLogPath("./logs/")
+	Log(log.InfoLevel, "=============== Running AdminUI Suite ======================", true)
+	setupDB("./test-data/test-data.mmdb")
+	suite.dir, _ = os.MkdirTemp("", "adminui-test")
+}
+
+func (suite *AdminUISuite) SetupTest() {
+	os.Remove(filepath.Join(suite.dir, "policies.json"))
+	setupPolicies(filepath.Join(suite.dir, "policies.json"))
+	recentDecisions.tenants = map[string]*decisionRing{}
+}
+
+func (suite *AdminUISuite) TearDownSuite() {
+	setupPolicies("")
+	compiling.Wait()
+	testProvider().Close()
+	os.RemoveAll(suite.dir)
+	Log(log.InfoLevel, "========== AdminUI Testsuite completed ===========", true)
+	fmt.Println("========== AdminUI Testsuite completed ===========")
+}
+
+func (suite *AdminUISuite) TestAdminUIHandler() {
+	Log(log.InfoLevel, "====== Running TestAdminUIHandler ===========", true)
+	rec := serveRequest(http.MethodGet, "/admin/ui", "")
+	suite.Equal(http.StatusOK, rec.Code)
+	suite.Equal("text/html; charset=utf-8", rec.Header().Get("Content-Type"))
+	suite.Contains(rec.Header().Get("Content-Security-Policy"), "frame-ancestors 'none'")
+	suite.Contains(rec.Body.String(), "whitelist_service admin")
+}
+
+func (suite *AdminUISuite) TestCountries() {
+	Log(log.InfoLevel, "====== Running TestCountries ===========", true)
+	rec := serveRequest(http.MethodGet, "/admin/countries", "")
+	suite.Equal(http.StatusOK, rec.Code)
+	var countries []Country
+	jsoniter.NewDecoder(rec.Body).Decode(&countries)
+	suite.Contains(countries, Country{Name: "China", IsoCode: "CN", Source: SourceMaxMind})
+	suite.Contains(countries, Country{Name: "Japan", IsoCode: "JP", Source: SourceMaxMind})
+	for i := 1; i < len(countries); i++ {
+		suite.LessOrEqual(countries[i-1].Name, countries[i].Name, "countries should be sorted by name")
+	}
+}
+
+func (suite *AdminUISuite) TestTestPolicy() {
+	Log(log.InfoLevel, "====== Running TestTestPolicy ===========", true)
+	SavePolicy(Policy{Name: "asia", Whitelist: []string{"japan"}})
+
+	tt := []struct {
+		testName string
+		path     string
+		status   int
+		decision string
+		iso      string
+	}{
+		{"Allowed", "/admin/policies/asia/test/1.0.16.1", http.StatusOK, "allow", "JP"},
+		{"Denied", "/admin/policies/asia/test/1.207.235.255", http.StatusOK, "deny", "CN"},
+		{"Unknown Policy", "/admin/policies/emea/test/1.0.16.1", http.StatusNotFound, "", ""},
+		{"Invalid IP", "/admin/policies/asia/test/1.0.16", http.StatusBadRequest, "", ""},
+	}
+	for _, tc := range tt {
+		rec := serveRequest(http.MethodGet, tc.path, "")
+		if !suite.Equal(tc.status, rec.Code, "was expecting status %v on %v, received %v", tc.status, tc.testName, rec.Code) {
+			Log(log.InfoLevel, fmt.Sprintf("was expecting status %v on %v, received %v", tc.status, tc.testName, rec.Code), true)
+		}
+		if tc.decision == "" {
+			continue
+		}
+		var test PolicyTest
+		jsoniter.NewDecoder(rec.Body).Decode(&test)
+		suite.Equal(tc.decision, test.Decision, "unexpected decision on %v", tc.testName)
+		suite.Equal(tc.iso, test.Country.IsoCode, "unexpected country on %v", tc.testName)
+		suite.Equal(1, test.Version)
+	}
+	decisions := RecentDecisions(DefaultTenant, recentDecisionsSize)
+	if suite.Len(decisions, 2, "was expecting the successful tests to be recorded") {
+		suite.Equal([]string{"deny", "allow"}, []string{decisions[0].Decision, decisions[1].Decision})
+		suite.Equal([]string{AuditKindTest, AuditKindTest}, []string{decisions[0].Kind, decisions[1].Kind})
+	}
+}
+
+func (suite *AdminUISuite) TestRecentDecisions() {
+	Log(log.InfoLevel, "====== Running TestRecentDecisions ===========", true)
+	serveRequest(http.MethodGet, "/checkWhitelist/1.0.16.1", `{"whitelisted_countries": ["japan"]}`)
+	serveRequest(http.MethodGet, "/checkWhitelist/1.207.235.255", `{"whitelisted_countries": ["japan"]}`)
+
+	rec := serveRequest(http.MethodGet, "/admin/decisions?limit=1", "")
+	suite.Equal(http.StatusOK, rec.Code)
+	var decisions []AuditEntry
+	jsoniter.NewDecoder(rec.Body).Decode(&decisions)
+	if suite.Len(decisions, 1) {
+		suite.Equal("1.207.235.255", decisions[0].IP, "the newest decision should come first")
+		suite.Equal("deny", decisions[0].Decision)
+	}
+	suite.Equal(http.StatusBadRequest, serveRequest(http.MethodGet, "/admin/decisions?limit=0", "").Code)
+
+	//the ring keeps the latest decisions once it is full, without evicting other tenants' decisions
+	addRecentDecision(AuditEntry{IP: "10.1.0.0", Tenant: "acme"})
+	for i := 0; i < recentDecisionsSize+10; i++ {
+		addRecentDecision(AuditEntry{IP: fmt.Sprintf("10.0.%v.%v", i/256, i%256)})
+	}
+	latest := RecentDecisions(DefaultTenant, recentDecisionsSize)
+	suite.Len(latest, recentDecisionsSize)
+	suite.Equal(fmt.Sprintf("10.0.0.%v", recentDecisionsSize+9), latest[0].IP)
+	suite.Equal("10.0.0.10", latest[recentDecisionsSize-1].IP)
+	suite.Equal([]AuditEntry{{IP: "10.1.0.0", Tenant: "acme"}}, RecentDecisions("acme", 10))
+	suite.Empty(RecentDecisions("globex", 10))
+}
+
+func (suite *AdminUISuite) TestDatabaseStatus() {
+	Log(log.InfoLevel, "====== Running TestDatabaseStatus ===========", true)
+	info, err := testProvider().Info()
+	suite.NoError(err)
+	built := time.Unix(int64(info.BuildEpoch), 0).UTC()
+
+	status := GetDatabaseStatus(built.Add(time.Hour))
+	suite.True(status.Country.Healthy)
+	suite.Equal(info.Type, status.Country.Type)
+	suite.Equal(ProviderMaxMind, status.Country.Provider)
+	suite.Equal(built, status.Country.Built)
+	suite.Equal("1h0m0s", status.Country.Age)
+	suite.False(status.Stale)
+	suite.Nil(status.ASN)
+
+	status = GetDatabaseStatus(built.Add(defaultConfig.Webhooks.DatabaseMaxAge + time.Hour))
+	suite.True(status.Stale, "a database older than the max age should be stale")
+
+	missing := databaseInfo(nil, time.Now())
+	suite.False(missing.Healthy)
+	suite.Equal("no country database loaded", missing.Error)
+
+	rec := serveRequest(http.MethodGet, "/admin/database", "")
+	suite.Equal(http.StatusOK, rec.Code)
+	suite.Contains(rec.Body.String(), `"healthy":true`)
+}
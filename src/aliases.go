@@ -0,0 +1,197 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+)
+
+//AppliedAlias is a whitelist/blacklist entry that was normalised to a country before matching,
+//either through the alias table or because it is an iso code
+type AppliedAlias struct {
+	Entry   string `json:"entry"`
+	IsoCode string `json:"iso_code"`
+	Country string `json:"country,omitempty"`
+}
+
+//builtinCountryAliases maps common names, abbreviations and former names to the iso code of the
+//country they refer to. keys are in the form normaliseAlias produces. the GeoLite2 english names
+//and two letter iso codes match without an entry here
+var builtinCountryAliases = map[string]string{
+	"USA":                                   "US",
+	"US OF A":                               "US",
+	"UNITED STATES OF AMERICA":              "US",
+	"AMERICA":                               "US",
+	"UK":                                    "GB",
+	"GREAT BRITAIN":                         "GB",
+	"BRITAIN":                               "GB",
+	"ENGLAND":                               "GB",
+	"SCOTLAND":                              "GB",
+	"WALES":                                 "GB",
+	"NORTHERN IRELAND":                      "GB",
+	"RUSSIAN FEDERATION":                    "RU",
+	"UAE":                                   "AE",
+	"EMIRATES":                              "AE",
+	"PRC":                                   "CN",
+	"PEOPLE'S REPUBLIC OF CHINA":            "CN",
+	"MAINLAND CHINA":                        "CN",
+	"KOREA":                                 "KR",
+	"REPUBLIC OF KOREA":                     "KR",
+	"DPRK":                                  "KP",
+	"DEMOCRATIC PEOPLE'S REPUBLIC OF KOREA": "KP",
+	"VIET NAM":                              "VN",
+	"LAO PDR":                               "LA",
+	"SYRIAN ARAB REPUBLIC":                  "SY",
+	"PERSIA":                                "IR",
+	"ISLAMIC REPUBLIC OF IRAN":              "IR",
+	"BURMA":                                 "MM",
+	"CEYLON":                                "LK",
+	"SIAM":                                  "TH",
+	"TÜRKIYE":                               "TR",
+	"TURKIYE":                               "TR",
+	"HOLLAND":                               "NL",
+	"THE NETHERLANDS":                       "NL",
+	"CZECH REPUBLIC":                        "CZ",
+	"MACEDONIA":                             "MK",
+	"SWAZILAND":                             "SZ",
+	"CAPE VERDE":                            "CV",
+	"CÔTE D'IVOIRE":                         "CI",
+	"COTE D'IVOIRE":                         "CI",
+	"TIMOR-LESTE":                           "TL",
+	"ZAIRE":                                 "CD",
+	"DRC":                                   "CD",
+	"DEMOCRATIC REPUBLIC OF THE CONGO":      "CD",
+	"CONGO-KINSHASA":                        "CD",
+	"REPUBLIC OF THE CONGO":                 "CG",
+	"CONGO-BRAZZAVILLE":                     "CG",
+	"VATICAN":                               "VA",
+	"HOLY SEE":                              "VA",
+	"MICRONESIA":                            "FM",
+	"SAINT KITTS AND NEVIS":                 "KN",
+	"MACAU":                                 "MO",
+	"BRUNEI DARUSSALAM":                     "BN",
+	"MOLDOVA, REPUBLIC OF":                  "MD",
+	"TANZANIA, UNITED REPUBLIC OF":          "TZ",
+	"BOLIVIA, PLURINATIONAL STATE OF":       "BO",
+	"VENEZUELA, BOLIVARIAN REPUBLIC OF":     "VE",
+	"STATE OF PALESTINE":                    "PS",
+	"REPUBLIC OF IRELAND":                   "IE",
+	"EIRE":                                  "IE",
+}
+
+//countryAliases is the active alias table, the built-in aliases with the configured overrides
+var countryAliases = struct {
+	sync.RWMutex
+	entries    map[string]string
+	generation int
+}{entries: builtinCountryAliases}
+
+//normaliseAlias puts an entry in the form alias table keys use: upper case, without dots and with
+//single spaces, so "U.S.A." and "usa" are the same alias
+func normaliseAlias(entry string) string {
+	entry = strings.ReplaceAll(strings.ToUpper(entry), ".", "")
+	return strings.Join(strings.Fields(entry), " ")
+}
+
+//countryAliasTable merges alias overrides from the configuration into the built-in table. an
+//override with an empty iso code removes a built-in alias
+func countryAliasTable(overrides map[string]string) (map[string]string, error) {
+	table := make(map[string]string, len(builtinCountryAliases)+len(overrides))
+	for alias, iso := range builtinCountryAliases {
+		table[alias] = iso
+	}
+	//sorted so the first invalid override reported is always the same one
+	aliases := make([]string, 0, len(overrides))
+	for alias := range overrides {
+		aliases = append(aliases, alias)
+	}
+	sort.Strings(aliases)
+	for _, alias := range aliases {
+		iso := strings.ToUpper(strings.TrimSpace(overrides[alias]))
+		key := normaliseAlias(alias)
+		switch {
+		case key == "":
+			return nil, fmt.Errorf("country aliases can't be empty")
+		case iso == "":
+			delete(table, key)
+		case !isIsoCode(iso):
+			return nil, fmt.Errorf("country alias %q must map to a two letter iso code, got %q", alias, overrides[alias])
+		default:
+			table[key] = iso
+		}
+	}
+	return table, nil
+}
+
+//setupCountryAliases applies the configured alias overrides. compiled policies depend on the table,
+//so it has to be set up before the policies are (re)compiled
+func setupCountryAliases(overrides map[string]string) error {
+	table, err := countryAliasTable(overrides)
+	if err != nil {
+		return err
+	}
+	countryAliases.Lock()
+	countryAliases.entries = table
+	countryAliases.generation++
+	countryAliases.Unlock()
+	return nil
+}
+
+//aliasGeneration returns a counter bumped on every alias table change, so compiled tables built
+//against an older table are recognised as stale
+func aliasGeneration() int {
+	countryAliases.RLock()
+	defer countryAliases.RUnlock()
+	return countryAliases.generation
+}
+
+//isIsoCode reports whether value is two ascii letters
+func isIsoCode(value string) bool {
+	if len(value) != 2 {
+		return false
+	}
+	for _, c := range strings.ToUpper(value) {
+		if c < 'A' || c > 'Z' {
+			return false
+		}
+	}
+	return true
+}
+
+//resolveCountryAlias returns the iso code of the country an entry names through the alias table,
+//or as a two letter iso code. it reports false for everything else, which is matched by name
+func resolveCountryAlias(entry string) (string, bool) {
+	key := normaliseAlias(entry)
+	countryAliases.RLock()
+	iso, ok := countryAliases.entries[key]
+	countryAliases.RUnlock()
+	if ok {
+		return iso, true
+	}
+	if isIsoCode(key) {
+		return key, true
+	}
+	return "", false
+}
+
+//AppliedAliases returns the entries of the lists that are matched through an alias or as an iso
+//code, with the name of the country they resolve to in the loaded database
+func AppliedAliases(whitelist []string, blacklist []string) []AppliedAlias {
+	var applied []AppliedAlias
+	for _, entry := range append(append([]string{}, whitelist...), blacklist...) {
+		if strings.HasPrefix(strings.ToLower(strings.TrimSpace(entry)), asnEntryPrefix) {
+			continue
+		}
+		iso, ok := resolveCountryAlias(entry)
+		if !ok {
+			continue
+		}
+		alias := AppliedAlias{Entry: entry, IsoCode: iso}
+		if countries, err := KnownCountries(); err == nil {
+			alias.Country = countries[iso].Name
+		}
+		applied = append(applied, alias)
+	}
+	return applied
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	jsoniter "github.com/json-iterator/go"
+	log "github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/suite"
+)
+
+func TestAliasesSuite(t *testing.T) {
+	aliasesSuite := new(AliasesSuite)
+	suite.Run(t, aliasesSuite)
+}
+
+type AliasesSuite struct {
+	suite.Suite
+	dir string
+}
+
+func (suite *AliasesSuite) SetupSuite() {
+	setLogPath("./logs/")
+	Log(log.InfoLevel, "=============== Running Aliases Suite ======================", true)
+	setupDB("./test-data/test-data.mmdb")
+	suite.dir, _ = os.MkdirTemp("", "aliases-test")
+}
+
+func (suite *AliasesSuite) SetupTest() {
+	setupCountryAliases(nil)
+}
+
+func (suite *AliasesSuite) TearDownSuite() {
+	setupCountryAliases(nil)
+	setupPolicies("")
+	compiling.Wait()
+	testProvider().Close()
+	os.RemoveAll(suite.dir)
+	Log(log.InfoLevel, "========== Aliases Testsuite completed ===========", true)
+	fmt.Println("========== Aliases Testsuite completed ===========")
+}
+
+func (suite *AliasesSuite) TestMatchAliases() {
+	Log(log.InfoLevel, "====== Running TestMatchAliases ===========", true)
+	tt := []struct {
+		testName  string
+		ip        string
+		whitelist []string
+		allowed   bool
+	}{
+		{"English Name", "1.207.235.255", []string{"China"}, true},
+		{"ISO Code", "1.207.235.255", []string{"cn"}, true},
+		{"Alias", "1.207.235.255", []string{"PRC"}, true},
+		{"Alias With Dots", "1.207.235.255", []string{"p.r.c."}, true},
+		{"Alias Of Another Country", "1.207.235.255", []string{"USA", "uk", "Burma"}, false},
+		{"ISO Code Of Another Country", "1.0.16.1", []string{"CN"}, false},
+		{"Unknown Entry", "1.0.16.1", []string{"Nippon"}, false},
+	}
+	for _, tc := range tt {
+		allowed, err := CheckRules(tc.ip, tc.whitelist, nil)
+		suite.NoError(err, "was expecting no error on %v, returned %v", tc.testName, err)
+		if !suite.Equal(tc.allowed, allowed, "was expecting %v on %v, received %v", tc.allowed, tc.testName, allowed) {
+			Log(log.InfoLevel, fmt.Sprintf("was expecting %v on %v, received %v", tc.allowed, tc.testName, allowed), true)
+		}
+	}
+	allowed, _ := CheckRules("1.207.235.255", nil, []string{"People's Republic of China"})
+	suite.False(allowed, "aliases should match blacklist entries too")
+}
+
+func (suite *AliasesSuite) TestOverrides() {
+	Log(log.InfoLevel, "====== Running TestOverrides ===========", true)
+	err := setupCountryAliases(map[string]string{"Nippon": "jp", "prc": ""})
+	if !suite.NoError(err, "was expecting no error, returned %v", err) {
+		Log(log.InfoLevel, fmt.Sprintf("was expecting no error, returned %v", err), true)
+	}
+	allowed, _ := CheckRules("1.0.16.1", []string{"nippon"}, nil)
+	suite.True(allowed, "an added alias should match")
+	allowed, _ = CheckRules("1.207.235.255", []string{"PRC"}, nil)
+	suite.False(allowed, "a removed built-in alias shouldn't match")
+	allowed, _ = CheckRules("1.207.235.255", []string{"cn"}, nil)
+	suite.True(allowed, "iso codes should match without an alias")
+
+	tt := []struct {
+		testName  string
+		overrides map[string]string
+	}{
+		{"Invalid ISO Code", map[string]string{"nippon": "japan"}},
+		{"Empty Alias", map[string]string{" . ": "JP"}},
+	}
+	for _, tc := range tt {
+		err := setupCountryAliases(tc.overrides)
+		if !suite.Error(err, "was expecting an error on %v, returned ok", tc.testName) {
+			Log(log.InfoLevel, fmt.Sprintf("was expecting an error on %v, returned ok", tc.testName), true)
+		}
+	}
+	_, ok := resolveCountryAlias("nippon")
+	suite.True(ok, "an invalid table shouldn't replace the active one")
+}
+
+func (suite *AliasesSuite) TestAppliedAliases() {
+	Log(log.InfoLevel, "====== Running TestAppliedAliases ===========", true)
+	applied := AppliedAliases([]string{"China", "prc", "asn:13335"}, []string{"jp"})
+	suite.Equal([]AppliedAlias{
+		{Entry: "prc", IsoCode: "CN", Country: "China"},
+		{Entry: "jp", IsoCode: "JP", Country: "Japan"},
+	}, applied)
+	suite.Empty(AppliedAliases([]string{"China"}, nil))
+}
+
+func (suite *AliasesSuite) TestCheckResponse() {
+	Log(log.InfoLevel, "====== Running TestCheckResponse ===========", true)
+	setupPolicies(filepath.Join(suite.dir, "policies.json"))
+	SavePolicy(Policy{Name: "asia", Whitelist: []string{"Mainland China", "Japan"}})
+	compiling.Wait()
+
+	tt := []struct {
+		testName string
+		body     string
+		response string
+		aliases  []AppliedAlias
+	}{
+		{"Inline Alias", `{"whitelisted_countries": ["PRC"]}`, "whitelisted", []AppliedAlias{{Entry: "PRC", IsoCode: "CN", Country: "China"}}},
+		{"Inline Name", `{"whitelisted_countries": ["japan"]}`, "not whitelisted", nil},
+		{"Policy Alias", `{"policy": "asia"}`, "whitelisted", []AppliedAlias{{Entry: "Mainland China", IsoCode: "CN", Country: "China"}}},
+	}
+	for _, tc := range tt {
+		req := httptest.NewRequest(http.MethodGet, "/checkWhitelist/1.207.235.255", strings.NewReader(tc.body))
+		rec := httptest.NewRecorder()
+		setupRouter().ServeHTTP(rec, req)
+		var response ResponseStruct
+		jsoniter.NewDecoder(rec.Body).Decode(&response)
+		if !suite.Equal(tc.response, response.Response, "was expecting %v on %v, received %v", tc.response, tc.testName, response.Response) {
+			Log(log.InfoLevel, fmt.Sprintf("was expecting %v on %v, received %v", tc.response, tc.testName, response.Response), true)
+		}
+		suite.Equal(tc.aliases, response.Aliases, "unexpected aliases on %v", tc.testName)
+	}
+}
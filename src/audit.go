@@ -0,0 +1,423 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	jsoniter "github.com/json-iterator/go"
+	log "github.com/sirupsen/logrus"
+)
+
+//genesisHash is the previous hash of the very first audit entry
+var genesisHash = strings.Repeat("0", sha256.Size*2)
+
+//AuditEntry is one decision in the audit log. every entry carries the hash of the one before it, so
+//editing, removing or reordering entries breaks the chain from that point on
+type AuditEntry struct {
+	Sequence      uint64    `json:"seq"`
+	Time          time.Time `json:"time"`
+	IP            string    `json:"ip"`
+	Country       string    `json:"country"`
+	IsoCode       string    `json:"iso_code"`
+	Source        string    `json:"source"`
+	BuildEpoch    uint      `json:"database_build_epoch"`
+	Policy        string    `json:"policy"`
+	PolicyVersion int       `json:"policy_version"`
+	Whitelist     []string  `json:"whitelist,omitempty"`
+	Blacklist     []string  `json:"blacklist,omitempty"`
+	Decision      string    `json:"decision"`
+	Kind          string    `json:"kind,omitempty"`
+	Caller        string    `json:"caller"`
+	CallerIP      string    `json:"caller_ip"`
+	Tenant        string    `json:"tenant,omitempty"`
+	PrevHash      string    `json:"prev_hash"`
+	Hash          string    `json:"hash"`
+}
+
+//auditLog appends hash chained entries to size rotated segment files named audit-000001.log,
+//audit-000002.log, ... in its directory
+type auditLog struct {
+	mu       sync.Mutex
+	dir      string
+	maxSize  int64
+	segment  int
+	file     *os.File
+	size     int64
+	seq      uint64
+	lastHash string
+	closed   bool
+	//torn is set when a failed write couldn't be cut off the segment yet
+	torn bool
+}
+
+//kinds of audited decisions other than ip checks, which have no kind
+const (
+	AuditKindRange = "range"
+	AuditKindTest  = "test"
+)
+
+//recentDecisionsSize is how many decisions of each tenant are kept in memory for the admin ui
+const recentDecisionsSize = 200
+
+//decisionRing holds the latest decisions of one tenant, replacing the oldest once it is full
+type decisionRing struct {
+	entries []AuditEntry
+	next    int
+}
+
+//recentDecisions holds a ring of the latest decisions per tenant, kept whether or not auditing is
+//enabled, so a busy tenant doesn't push out the history of the others. the entries have no sequence
+//or hashes, those only exist in the audit log
+var recentDecisions = struct {
+	sync.Mutex
+	tenants map[string]*decisionRing
+}{tenants: map[string]*decisionRing{}}
+
+//setupAuditLog opens the audit log in dir and makes it the active one. an empty dir disables auditing
+func setupAuditLog(dir string, maxSegmentSize int64) error {
+	audit, err := openAuditLog(dir, maxSegmentSize)
+	if err != nil {
+		return err
+	}
+	updateRuntime(func(state *runtimeState) { state.auditLog = audit })
+	return nil
+}
+
+//openAuditLog opens the audit log in dir, continuing the chain from the last entry of the newest
+//segment. an empty dir returns no log
+func openAuditLog(dir string, maxSegmentSize int64) (*auditLog, error) {
+	if dir != "" && maxSegmentSize <= 0 {
+		return nil, fmt.Errorf("audit max segment size must be positive")
+	}
+	if dir == "" {
+		return nil, nil
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	audit := &auditLog{dir: dir, maxSize: maxSegmentSize, segment: 1, lastHash: genesisHash}
+	segments, err := auditSegments(dir)
+	if err != nil {
+		return nil, err
+	}
+	if len(segments) > 0 {
+		latest := segments[len(segments)-1]
+		fmt.Sscanf(filepath.Base(latest), "audit-%06d.log", &audit.segment)
+		last, err := lastAuditEntry(segments)
+		if err != nil {
+			return nil, err
+		}
+		if last != nil {
+			audit.seq = last.Sequence
+			audit.lastHash = last.Hash
+		}
+	}
+	if audit.file, audit.size, err = audit.openSegment(audit.segment); err != nil {
+		return nil, err
+	}
+	return audit, nil
+}
+
+//auditSegments returns the segment files in dir in chain order
+func auditSegments(dir string) ([]string, error) {
+	segments, err := filepath.Glob(filepath.Join(dir, "audit-*.log"))
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(segments)
+	return segments, nil
+}
+
+//lastAuditEntry returns the newest entry across the segments, skipping trailing empty segments
+func lastAuditEntry(segments []string) (*AuditEntry, error) {
+	for i := len(segments) - 1; i >= 0; i-- {
+		var last *AuditEntry
+		err := readAuditSegment(segments[i], func(line int, entry AuditEntry) error {
+			last = &entry
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+		if last != nil {
+			return last, nil
+		}
+	}
+	return nil, nil
+}
+
+//readAuditSegment calls fn for every entry in a segment file
+func readAuditSegment(path string, fn func(line int, entry AuditEntry) error) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	line := 0
+	for scanner.Scan() {
+		line++
+		var entry AuditEntry
+		if err := jsoniter.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			return fmt.Errorf("%v line %v: unreadable entry: %v", filepath.Base(path), line, err)
+		}
+		if err := fn(line, entry); err != nil {
+			return err
+		}
+	}
+	return scanner.Err()
+}
+
+//openSegment opens a segment for appending and returns it with its size
+func (a *auditLog) openSegment(segment int) (*os.File, int64, error) {
+	path := filepath.Join(a.dir, fmt.Sprintf("audit-%06d.log", segment))
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, 0, err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, 0, err
+	}
+	return f, info.Size(), nil
+}
+
+//hashAuditEntry returns the chain hash of an entry: sha256 over its json encoding with an empty hash
+func hashAuditEntry(entry AuditEntry) (string, error) {
+	entry.Hash = ""
+	data, err := jsoniter.Marshal(entry)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+//Record chains the entry to the previous one and appends it, starting a new segment once the
+//current one reaches the maximum size. entries of requests that started before a reload replaced
+//the log are recorded in the active one, or dropped when the reload disabled auditing
+func (a *auditLog) Record(entry AuditEntry) error {
+	a.mu.Lock()
+	if a.closed {
+		a.mu.Unlock()
+		active := currentRuntime().auditLog
+		if active == a {
+			return fmt.Errorf("audit log is closed")
+		}
+		if active == nil {
+			return nil
+		}
+		return active.Record(entry)
+	}
+	defer a.mu.Unlock()
+
+	entry.Sequence = a.seq + 1
+	entry.Time = entry.Time.UTC()
+	entry.PrevHash = a.lastHash
+	hash, err := hashAuditEntry(entry)
+	if err != nil {
+		return err
+	}
+	entry.Hash = hash
+	data, err := jsoniter.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	data = append(data, '\n')
+
+	if a.torn {
+		if err := a.file.Truncate(a.size); err != nil {
+			return fmt.Errorf("failed to remove a partly written audit entry: %v", err)
+		}
+		a.torn = false
+	}
+	if a.size > 0 && a.size+int64(len(data)) > a.maxSize {
+		//the next segment is opened before the current one is closed, so a failed rotation leaves the
+		//current segment open and the next entry tries again
+		f, size, err := a.openSegment(a.segment + 1)
+		if err != nil {
+			return err
+		}
+		a.file.Close()
+		a.segment++
+		a.file, a.size = f, size
+	}
+	if _, err := a.file.Write(data); err != nil {
+		//a short write leaves part of the entry behind, which is cut off so the next entry starts on its
+		//own line and the chain stays verifiable
+		a.torn = a.file.Truncate(a.size) != nil
+		return err
+	}
+	a.size += int64(len(data))
+	a.seq = entry.Sequence
+	a.lastHash = entry.Hash
+	return nil
+}
+
+//setMaxSize changes the size segments rotate at, from the next entry on
+func (a *auditLog) setMaxSize(maxSize int64) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.maxSize = maxSize
+}
+
+//Close closes the current segment
+func (a *auditLog) Close() error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.closed = true
+	return a.file.Close()
+}
+
+//VerifyAuditLog walks every segment in dir and checks sequence numbers, the hash of every entry and
+//the link to the previous entry. it returns how many entries were verified before the first problem
+func VerifyAuditLog(dir string) (uint64, error) {
+	segments, err := auditSegments(dir)
+	if err != nil {
+		return 0, err
+	}
+	if len(segments) == 0 {
+		return 0, fmt.Errorf("no audit segments found in %v", dir)
+	}
+	var verified uint64
+	previous := genesisHash
+	for _, segment := range segments {
+		err := readAuditSegment(segment, func(line int, entry AuditEntry) error {
+			where := fmt.Sprintf("%v line %v", filepath.Base(segment), line)
+			if entry.Sequence != verified+1 {
+				return fmt.Errorf("%v: expected sequence %v, found %v", where, verified+1, entry.Sequence)
+			}
+			if entry.PrevHash != previous {
+				return fmt.Errorf("%v: entry %v doesn't link to the previous entry", where, entry.Sequence)
+			}
+			hash, err := hashAuditEntry(entry)
+			if err != nil {
+				return err
+			}
+			if hash != entry.Hash {
+				return fmt.Errorf("%v: entry %v has been modified", where, entry.Sequence)
+			}
+			previous = entry.Hash
+			verified++
+			return nil
+		})
+		if err != nil {
+			return verified, err
+		}
+	}
+	return verified, nil
+}
+
+//recordDecision writes a check decision to the audit log and the recent decisions. policy is empty
+//for checks made with inline whitelist/blacklist entries, which are recorded instead
+func recordDecision(r *http.Request, ip string, policy *Policy, req WhitelistRequest, decision Decision) {
+	writeDecision(r, decisionEntry(r, ip, policy, req, decision))
+}
+
+//recordPolicyTest writes the decision of a policy test, which is audited like a check of the ip
+//against the policy but marked as a test
+func recordPolicyTest(r *http.Request, ip string, policy Policy, decision Decision) {
+	entry := decisionEntry(r, ip, &policy, WhitelistRequest{}, decision)
+	entry.Kind = AuditKindTest
+	writeDecision(r, entry)
+}
+
+//recordRangeCheck writes the decision of a range check. the range is recorded in place of the ip,
+//without a country since its networks can be in several, and partially allowed ranges as partial
+func recordRangeCheck(r *http.Request, check RangeCheck, policy *Policy, req WhitelistRequest) {
+	entry := decisionEntry(r, check.Network, policy, req, Decision{})
+	entry.Kind = AuditKindRange
+	switch check.Response {
+	case "whitelisted":
+		entry.Decision = decisionName(true)
+	case "partially whitelisted":
+		entry.Decision = "partial"
+	}
+	writeDecision(r, entry)
+}
+
+//decisionEntry builds the audit entry of a decision
+func decisionEntry(r *http.Request, ip string, policy *Policy, req WhitelistRequest, decision Decision) AuditEntry {
+	entry := AuditEntry{
+		Time:     time.Now(),
+		IP:       ip,
+		Country:  decision.Country.Name,
+		IsoCode:  decision.Country.IsoCode,
+		Source:   decision.Country.Source,
+		Decision: decisionName(decision.Allowed),
+		Caller:   RequestIdentity(r),
+		Tenant:   RequestTenant(r),
+	}
+	if provider, err := loadedProvider(); err == nil {
+		if info, err := provider.Info(); err == nil {
+			entry.BuildEpoch = info.BuildEpoch
+		}
+	}
+	if policy != nil {
+		entry.Policy = policy.Name
+		entry.PolicyVersion = policy.Version
+	} else {
+		entry.Whitelist = req.WhitelistedCountries
+		entry.Blacklist = req.BlacklistedCountries
+	}
+	entry.CallerIP, _ = ClientIP(r)
+	return entry
+}
+
+//writeDecision adds an entry to the recent decisions and the audit log of the request
+func writeDecision(r *http.Request, entry AuditEntry) {
+	addRecentDecision(entry)
+	audit := requestRuntime(r).auditLog
+	if audit == nil {
+		return
+	}
+	if err := audit.Record(entry); err != nil {
+		Log(log.ErrorLevel, fmt.Sprintf("failed to write audit entry: %v", err), flag.Lookup("test.v") == nil)
+	}
+}
+
+//addRecentDecision adds a decision to its tenant's ring, replacing the oldest once it is full
+func addRecentDecision(entry AuditEntry) {
+	recentDecisions.Lock()
+	defer recentDecisions.Unlock()
+	ring, ok := recentDecisions.tenants[entry.Tenant]
+	if !ok {
+		ring = &decisionRing{}
+		recentDecisions.tenants[entry.Tenant] = ring
+	}
+	if len(ring.entries) < recentDecisionsSize {
+		ring.entries = append(ring.entries, entry)
+		return
+	}
+	ring.entries[ring.next] = entry
+	ring.next = (ring.next + 1) % recentDecisionsSize
+}
+
+//RecentDecisions returns up to limit of the tenant's latest decisions, newest first
+func RecentDecisions(tenant string, limit int) []AuditEntry {
+	recentDecisions.Lock()
+	defer recentDecisions.Unlock()
+	list := []AuditEntry{}
+	ring, ok := recentDecisions.tenants[tenant]
+	if !ok {
+		return list
+	}
+	count := len(ring.entries)
+	for i := 0; i < count && len(list) < limit; i++ {
+		//next is the oldest entry once the ring is full, so the newest is just before it
+		list = append(list, ring.entries[(ring.next-1-i+count)%count])
+	}
+	return list
+}
@@ -0,0 +1,237 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/suite"
+)
+
+func TestAuditSuite(t *testing.T) {
+	auditSuite := new(AuditSuite)
+	suite.Run(t, auditSuite)
+}
+
+type AuditSuite struct {
+	suite.Suite
+	dir string
+}
+
+func (suite *AuditSuite) SetupSuite() {
+	setLogPath("./logs/")
+	Log(log.InfoLevel, "=============== Running Audit Suite ======================", true)
+}
+
+func (suite *AuditSuite) SetupTest() {
+	suite.dir, _ = os.MkdirTemp("", "audit-test")
+}
+
+func (suite *AuditSuite) TearDownTest() {
+	setupAuditLog("", 0)
+	os.RemoveAll(suite.dir)
+}
+
+func (suite *AuditSuite) TearDownSuite() {
+	Log(log.InfoLevel, "========== Audit Testsuite completed ===========", true)
+	fmt.Println("========== Audit Testsuite completed ===========")
+}
+
+//writeEntries records count entries to the active audit log
+func (suite *AuditSuite) writeEntries(count int) {
+	for i := 0; i < count; i++ {
+		err := currentRuntime().auditLog.Record(AuditEntry{
+			Time:     time.Now(),
+			IP:       fmt.Sprintf("1.207.235.%v", i),
+			Country:  "China",
+			IsoCode:  "CN",
+			Policy:   "asia",
+			Decision: "allow",
+		})
+		if !suite.NoError(err, "was expecting no error, returned %v", err) {
+			Log(log.InfoLevel, fmt.Sprintf("was expecting no error, returned %v", err), true)
+		}
+	}
+}
+
+func (suite *AuditSuite) TestRecordAndVerify() {
+	Log(log.InfoLevel, "====== Running TestRecordAndVerify ===========", true)
+	suite.NoError(setupAuditLog(suite.dir, 1024*1024))
+	suite.writeEntries(5)
+
+	verified, err := VerifyAuditLog(suite.dir)
+	if !suite.NoError(err, "was expecting no error, returned %v", err) {
+		Log(log.InfoLevel, fmt.Sprintf("was expecting no error, returned %v", err), true)
+	}
+	suite.Equal(uint64(5), verified)
+
+	//reopening continues the chain instead of starting a new one
+	suite.NoError(setupAuditLog(suite.dir, 1024*1024))
+	suite.writeEntries(2)
+	verified, err = VerifyAuditLog(suite.dir)
+	suite.NoError(err)
+	suite.Equal(uint64(7), verified)
+}
+
+func (suite *AuditSuite) TestRotation() {
+	Log(log.InfoLevel, "====== Running TestRotation ===========", true)
+	suite.NoError(setupAuditLog(suite.dir, 600))
+	suite.writeEntries(10)
+
+	segments, _ := auditSegments(suite.dir)
+	if !suite.Greater(len(segments), 1, "was expecting the log to rotate into several segments") {
+		Log(log.InfoLevel, "was expecting the log to rotate into several segments", true)
+	}
+	for _, segment := range segments {
+		info, _ := os.Stat(segment)
+		suite.LessOrEqual(info.Size(), int64(600))
+	}
+	verified, err := VerifyAuditLog(suite.dir)
+	suite.NoError(err, "was expecting the chain to continue across segments")
+	suite.Equal(uint64(10), verified)
+}
+
+//TestFailedWrites validates a failed rotation keeps the current segment and a failed write leaves
+//nothing behind that would break the chain
+func (suite *AuditSuite) TestFailedWrites() {
+	Log(log.InfoLevel, "====== Running TestFailedWrites ===========", true)
+	suite.NoError(setupAuditLog(suite.dir, 600))
+	audit := currentRuntime().auditLog
+	suite.writeEntries(1)
+
+	//the next segment can't be opened while a directory holds its name
+	next := filepath.Join(suite.dir, "audit-000002.log")
+	os.Mkdir(next, 0700)
+	audit.setMaxSize(1)
+	err := audit.Record(AuditEntry{Time: time.Now(), IP: "1.0.16.1", Decision: "deny"})
+	if !suite.Error(err, "was expecting the rotation to fail") {
+		Log(log.InfoLevel, "was expecting the rotation to fail", true)
+	}
+	os.Remove(next)
+	suite.writeEntries(1)
+	audit.setMaxSize(1024 * 1024)
+
+	//a write through a read only handle fails, then the torn bytes it could have left are cut off
+	segment := filepath.Join(suite.dir, "audit-000002.log")
+	writable := audit.file
+	audit.file, _ = os.Open(segment)
+	suite.Error(audit.Record(AuditEntry{Time: time.Now(), IP: "1.0.16.1", Decision: "deny"}))
+	audit.file.Close()
+	audit.file = writable
+	torn, _ := os.OpenFile(segment, os.O_WRONLY|os.O_APPEND, 0600)
+	torn.WriteString(`{"seq":3,"ti`)
+	torn.Close()
+	suite.writeEntries(1)
+
+	verified, err := VerifyAuditLog(suite.dir)
+	if !suite.NoError(err, "was expecting the chain to survive failed writes, returned %v", err) {
+		Log(log.InfoLevel, fmt.Sprintf("was expecting the chain to survive failed writes, returned %v", err), true)
+	}
+	suite.Equal(uint64(3), verified)
+}
+
+//TestTamperDetection modifies, removes and reorders entries and validates verification fails
+func (suite *AuditSuite) TestTamperDetection() {
+	Log(log.InfoLevel, "====== Running TestTamperDetection ===========", true)
+	suite.NoError(setupAuditLog(suite.dir, 1024*1024))
+	suite.writeEntries(4)
+	setupAuditLog("", 0)
+	segment := filepath.Join(suite.dir, "audit-000001.log")
+	original, _ := os.ReadFile(segment)
+	lines := strings.SplitAfter(strings.TrimSuffix(string(original), "\n"), "\n")
+
+	tt := []struct {
+		testName string
+		contents string
+		expected string
+	}{
+		{"Modified Decision", strings.Replace(string(original), `"decision":"allow"`, `"decision":"deny"`, 1), "entry 1 has been modified"},
+		{"Removed Entry", lines[0] + lines[2] + lines[3], "expected sequence 2, found 3"},
+		{"Reordered Entries", lines[1] + lines[0] + lines[2] + lines[3], "expected sequence 1, found 2"},
+		{"Garbage Line", lines[0] + "INVALID#!\n", "unreadable entry"},
+	}
+	for _, tc := range tt {
+		os.WriteFile(segment, []byte(tc.contents), 0600)
+		_, err := VerifyAuditLog(suite.dir)
+		if !suite.Error(err, "was expecting an error on %v, returned ok", tc.testName) {
+			Log(log.InfoLevel, fmt.Sprintf("was expecting an error on %v, returned ok", tc.testName), true)
+			continue
+		}
+		suite.Contains(err.Error(), tc.expected, "unexpected error on %v", tc.testName)
+	}
+
+	_, err := VerifyAuditLog(filepath.Join(suite.dir, "missing"))
+	suite.Error(err)
+}
+
+//TestRecordDecision runs a check through the handler and validates it is audited
+func (suite *AuditSuite) TestRecordDecision() {
+	Log(log.InfoLevel, "====== Running TestRecordDecision ===========", true)
+	setupDB("./test-data/test-data.mmdb")
+	defer testProvider().Close()
+	suite.NoError(setupAuditLog(suite.dir, 1024*1024))
+
+	req := httptest.NewRequest(http.MethodGet, "/checkWhitelist/1.207.235.255", bytes.NewBufferString(`{"whitelisted_countries": ["china"]}`))
+	req.RemoteAddr = "8.8.8.8:4000"
+	setupRouter().ServeHTTP(httptest.NewRecorder(), req)
+
+	var entries []AuditEntry
+	readAuditSegment(filepath.Join(suite.dir, "audit-000001.log"), func(line int, entry AuditEntry) error {
+		entries = append(entries, entry)
+		return nil
+	})
+	if suite.Len(entries, 1) {
+		entry := entries[0]
+		suite.Equal("1.207.235.255", entry.IP)
+		suite.Equal("CN", entry.IsoCode)
+		suite.Equal("allow", entry.Decision)
+		suite.Equal([]string{"china"}, entry.Whitelist)
+		suite.Equal("8.8.8.8", entry.CallerIP)
+		info, _ := testProvider().Info()
+		suite.Equal(info.BuildEpoch, entry.BuildEpoch)
+		suite.Equal(genesisHash, entry.PrevHash)
+	}
+}
+
+func (suite *AuditSuite) TestRecordRangeAndPolicyTest() {
+	Log(log.InfoLevel, "====== Running TestRecordRangeAndPolicyTest ===========", true)
+	setupDB("./test-data/test-data.mmdb")
+	defer testProvider().Close()
+	setupPolicies(filepath.Join(suite.dir, "policies.json"))
+	defer setupPolicies("")
+	defer compiling.Wait()
+	suite.NoError(setupAuditLog(filepath.Join(suite.dir, "audit"), 1024*1024))
+	_, err := SavePolicy(Policy{Name: "asia", Whitelist: []string{"China"}})
+	suite.NoError(err)
+
+	for _, path := range []string{"/checkWhitelist/range/1.0.16.0/20", "/admin/policies/asia/test/1.207.235.255"} {
+		req := httptest.NewRequest(http.MethodGet, path, bytes.NewBufferString(`{"whitelisted_countries": ["japan"]}`))
+		rec := httptest.NewRecorder()
+		setupRouter().ServeHTTP(rec, req)
+		suite.Equal(http.StatusOK, rec.Code, "unexpected status on %v: %v", path, rec.Body.String())
+	}
+
+	var entries []AuditEntry
+	readAuditSegment(filepath.Join(suite.dir, "audit", "audit-000001.log"), func(line int, entry AuditEntry) error {
+		entries = append(entries, entry)
+		return nil
+	})
+	if suite.Len(entries, 2) {
+		suite.Equal(AuditEntry{IP: "1.0.16.0/20", Kind: AuditKindRange, Decision: "allow", Whitelist: []string{"japan"}},
+			AuditEntry{IP: entries[0].IP, Kind: entries[0].Kind, Decision: entries[0].Decision, Whitelist: entries[0].Whitelist})
+		suite.Equal(AuditEntry{IP: "1.207.235.255", Kind: AuditKindTest, Decision: "allow", IsoCode: "CN", Policy: "asia", PolicyVersion: 1},
+			AuditEntry{IP: entries[1].IP, Kind: entries[1].Kind, Decision: entries[1].Decision, IsoCode: entries[1].IsoCode,
+				Policy: entries[1].Policy, PolicyVersion: entries[1].PolicyVersion})
+	}
+
+	//the verify command finds the log through the configured audit path
+	suite.Equal(0, runCommand([]string{"audit", "verify", "-config", "./config.yaml", "-audit-path", filepath.Join(suite.dir, "audit")}))
+	suite.Equal(1, runCommand([]string{"audit", "verify", "-config", filepath.Join(suite.dir, "missing.yaml")}))
+}
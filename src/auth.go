@@ -0,0 +1,253 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	jsoniter "github.com/json-iterator/go"
+	log "github.com/sirupsen/logrus"
+)
+
+//scopes that can be granted to an api key
+const (
+	ScopeCheck   = "check"
+	ScopeLookup  = "lookup"
+	ScopeAdmin   = "admin"
+	ScopeMetrics = "metrics"
+)
+
+//routeScopes maps a route's path template to the scope a key needs to call it. routes missing from
+//this map (the status heartbeat) stay open
+var routeScopes = map[string]string{
+	"/checkWhitelist/{ip}": ScopeCheck,
+	"/checkWhitelist":      ScopeCheck,
+	"/lookup/{ip}":         ScopeLookup,
+	"/metrics":             ScopeMetrics,
+
+	"/checkWhitelist/range/{network:.+}": ScopeCheck,
+	"/lookup/range/{network:.+}":         ScopeLookup,
+
+	"/admin/corrections":                   ScopeAdmin,
+	"/admin/corrections/{network:.+}":      ScopeAdmin,
+	"/admin/policies":                      ScopeAdmin,
+	"/admin/policies/{name}":               ScopeAdmin,
+	"/admin/policies/{name}/shadow-report": ScopeAdmin,
+	"/admin/policies/{name}/export":        ScopeAdmin,
+	"/admin/schedule":                      ScopeAdmin,
+	"/admin/usage":                         ScopeAdmin,
+	"/admin/countries":                     ScopeAdmin,
+	"/admin/policies/{name}/test/{ip}":     ScopeAdmin,
+	"/admin/decisions":                     ScopeAdmin,
+	"/admin/database":                      ScopeAdmin,
+}
+
+//APIKey is an entry in the api keys file. only the sha256 of the key is stored, never the key itself.
+//a key only sees and changes the policies, corrections and metrics of its tenant
+type APIKey struct {
+	ID      string     `json:"id"`
+	Hash    string     `json:"hash"`
+	Scopes  []string   `json:"scopes"`
+	Expires *time.Time `json:"expires,omitempty"`
+	Tenant  string     `json:"tenant,omitempty"`
+}
+
+type contextKey string
+
+const (
+	identityContextKey contextKey = "identity"
+	tenantContextKey   contextKey = "tenant"
+	apiKeyContextKey   contextKey = "api key"
+)
+
+//setupAPIKeys loads the api keys file and makes its keys the active ones. an empty path disables
+//authentication
+func setupAPIKeys(path string) error {
+	keys, err := loadAPIKeys(path)
+	if err != nil {
+		return err
+	}
+	updateRuntime(func(state *runtimeState) { state.apiKeys = keys })
+	return nil
+}
+
+//loadAPIKeys reads the api keys file into a map indexed by hash. an empty path returns a nil map
+func loadAPIKeys(path string) (map[string]APIKey, error) {
+	if path == "" {
+		return nil, nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var keys []APIKey
+	if err := jsoniter.Unmarshal(data, &keys); err != nil {
+		return nil, fmt.Errorf("failed to parse api keys file: %v", err)
+	}
+	loaded := map[string]APIKey{}
+	for _, key := range keys {
+		hash := strings.ToLower(key.Hash)
+		if key.ID == "" || len(hash) != sha256.Size*2 {
+			return nil, fmt.Errorf("api key %q must have an id and a sha256 hex hash", key.ID)
+		}
+		//tenant names end up in store keys and metric labels, and are matched case-insensitively
+		key.Tenant = strings.ToLower(key.Tenant)
+		if key.Tenant != DefaultTenant && !policyNamePattern.MatchString(key.Tenant) {
+			return nil, fmt.Errorf("api key %q has an invalid tenant name %q", key.ID, key.Tenant)
+		}
+		loaded[hash] = key
+	}
+	return loaded, nil
+}
+
+//HashAPIKey returns the value stored in the api keys file for a raw key
+func HashAPIKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+//HasScope reports whether the key was granted the scope
+func (k APIKey) HasScope(scope string) bool {
+	for _, s := range k.Scopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+//findAPIKey looks up a raw key in the loaded keys. every stored hash is compared in constant time so
+//response timing doesn't leak how close a guess was
+func findAPIKey(keys map[string]APIKey, raw string) (APIKey, bool) {
+	hash := []byte(HashAPIKey(raw))
+	var found APIKey
+	ok := false
+	for stored, key := range keys {
+		if subtle.ConstantTimeCompare(hash, []byte(stored)) == 1 {
+			found = key
+			ok = true
+		}
+	}
+	return found, ok
+}
+
+//requestAPIKey extracts the raw key from the X-API-Key header or a bearer token
+func requestAPIKey(r *http.Request) string {
+	if key := r.Header.Get("X-API-Key"); key != "" {
+		return key
+	}
+	auth := r.Header.Get("Authorization")
+	if len(auth) > 7 && strings.EqualFold(auth[:7], "bearer ") {
+		return strings.TrimSpace(auth[7:])
+	}
+	return ""
+}
+
+//authMiddleware rejects requests to scoped routes that don't carry a valid, unexpired key with the
+//route's scope, and attaches the key id and tenant to the request context for logs, metrics and
+//the stores
+func authMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		state := requestRuntime(r)
+		if state.apiKeys == nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+		scope, template := "", ""
+		if route := mux.CurrentRoute(r); route != nil {
+			template, _ = route.GetPathTemplate()
+			scope = routeScopes[template]
+		}
+		if scope == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		//auth runs before the rate limiter, so failed attempts are limited here by client ip
+		limiter, client := state.rateLimiter, ""
+		if limiter != nil {
+			if client, _ = ClientIP(r); client == "" {
+				client = r.RemoteAddr
+			}
+			if locked, retry := limiter.authLocked(client); locked {
+				IncCounter("whitelist_rate_limited_total", map[string]string{"route": template})
+				rejectRequest(w, r, http.StatusTooManyRequests, retry, fmt.Errorf("too many failed api key attempts"))
+				return
+			}
+		}
+
+		raw := requestAPIKey(r)
+		key, ok := findAPIKey(state.apiKeys, raw)
+		var err error
+		status := http.StatusUnauthorized
+		switch {
+		case raw == "":
+			err = fmt.Errorf("missing api key")
+		case !ok:
+			err = fmt.Errorf("invalid api key")
+			if limiter != nil {
+				limiter.recordAuthFailure(client)
+			}
+		case key.Expires != nil && time.Now().After(*key.Expires):
+			err = fmt.Errorf("api key %v has expired", key.ID)
+		case !key.HasScope(scope):
+			status = http.StatusForbidden
+			err = fmt.Errorf("api key %v lacks the %v scope", key.ID, scope)
+		}
+		if err != nil {
+			Log(log.ErrorLevel, err.Error(), flag.Lookup("test.v") == nil)
+			IncCounter("whitelist_auth_failures_total", map[string]string{"status": strconv.Itoa(status)})
+			w.Header().Add("Content-Type", "application/json")
+			w.WriteHeader(status)
+			jsoniter.NewEncoder(w).Encode(ResponseStruct{Response: err.Error()})
+			return
+		}
+		ctx := context.WithValue(r.Context(), identityContextKey, key.ID)
+		ctx = context.WithValue(ctx, apiKeyContextKey, key)
+		next.ServeHTTP(w, r.WithContext(context.WithValue(ctx, tenantContextKey, key.Tenant)))
+	})
+}
+
+//RequestIdentity returns who made the request: the api key id when authenticated, otherwise the
+//client certificate subject, otherwise an empty string
+func RequestIdentity(r *http.Request) string {
+	if id, ok := r.Context().Value(identityContextKey).(string); ok {
+		return id
+	}
+	return ClientCertSubject(r)
+}
+
+//RequestTenant returns the tenant of the api key that made the request, the default tenant for
+//anonymous callers and when authentication is disabled
+func RequestTenant(r *http.Request) string {
+	if tenant, ok := r.Context().Value(tenantContextKey).(string); ok {
+		return tenant
+	}
+	return DefaultTenant
+}
+
+//RequestHasScope reports whether the api key that made the request was granted the scope. every
+//scope is granted when authentication is disabled, none to anonymous callers of unscoped routes
+func RequestHasScope(r *http.Request, scope string) bool {
+	if key, ok := r.Context().Value(apiKeyContextKey).(APIKey); ok {
+		return key.HasScope(scope)
+	}
+	return requestRuntime(r).apiKeys == nil
+}
+
+//logRequest logs msg tagged with the identity of the caller, when there is one
+func logRequest(r *http.Request, level log.Level, msg string) {
+	if identity := RequestIdentity(r); identity != "" {
+		msg = fmt.Sprintf("[%v] %v", identity, msg)
+	}
+	Log(level, msg, flag.Lookup("test.v") == nil)
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	jsoniter "github.com/json-iterator/go"
+	log "github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/suite"
+)
+
+func TestAuthSuite(t *testing.T) {
+	authSuite := new(AuthSuite)
+	suite.Run(t, authSuite)
+}
+
+type AuthSuite struct {
+	suite.Suite
+	dir string
+}
+
+func (suite *AuthSuite) SetupSuite() {
+	setLogPath("./logs/")
+	Log(log.InfoLevel, "=============== Running Auth Suite ======================", true)
+	setupDB("./test-data/test-data.mmdb")
+	suite.dir, _ = os.MkdirTemp("", "auth-test")
+	keys := fmt.Sprintf(`[
+		{"id": "billing", "hash": %q, "scopes": ["check"]},
+		{"id": "ops", "hash": %q, "scopes": ["check", "lookup", "metrics", "admin"]},
+		{"id": "retired", "hash": %q, "scopes": ["check"], "expires": "2020-01-01T00:00:00Z"}
+	]`, HashAPIKey("billing-key"), HashAPIKey("ops-key"), HashAPIKey("retired-key"))
+	os.WriteFile(filepath.Join(suite.dir, "keys.json"), []byte(keys), 0600)
+}
+
+func (suite *AuthSuite) TearDownSuite() {
+	setupAPIKeys("")
+	os.RemoveAll(suite.dir)
+	testProvider().Close()
+	Log(log.InfoLevel, "========== Auth Testsuite completed ===========", true)
+	fmt.Println("========== Auth Testsuite completed ===========")
+}
+
+func (suite *AuthSuite) TestSetupAPIKeys() {
+	Log(log.InfoLevel, "====== Running TestSetupAPIKeys ===========", true)
+	defer setupAPIKeys("")
+
+	err := setupAPIKeys(filepath.Join(suite.dir, "keys.json"))
+	if !suite.NoError(err, "was expecting no error, returned %v", err) {
+		Log(log.InfoLevel, fmt.Sprintf("was expecting no error, returned %v", err), true)
+	}
+	suite.Len(currentRuntime().apiKeys, 3)
+
+	invalid := filepath.Join(suite.dir, "invalid.json")
+	os.WriteFile(invalid, []byte(`[{"id": "plain", "hash": "not-a-hash"}]`), 0600)
+	tt := []struct {
+		testName string
+		path     string
+	}{
+		{"Missing File", "INVALIDPATH#!"},
+		{"Unhashed Key", invalid},
+	}
+	for _, tc := range tt {
+		err := setupAPIKeys(tc.path)
+		if !suite.Error(err, "was expecting an error on %v, returned ok", tc.testName) {
+			Log(log.InfoLevel, fmt.Sprintf("was expecting an error on %v, returned ok", tc.testName), true)
+		}
+	}
+
+	err = setupAPIKeys("")
+	suite.NoError(err)
+	suite.Nil(currentRuntime().apiKeys, "an empty path should disable authentication")
+}
+
+//TestAuthMiddleware runs requests through the router and validates keys, scopes and expiry
+func (suite *AuthSuite) TestAuthMiddleware() {
+	Log(log.InfoLevel, "====== Running TestAuthMiddleware ===========", true)
+	setupAPIKeys(filepath.Join(suite.dir, "keys.json"))
+	defer setupAPIKeys("")
+	router := setupRouter()
+
+	tt := []struct {
+		testName string
+		path     string
+		headers  map[string]string
+		status   int
+		expected string
+	}{
+		{"Open Status Route", "/", nil, http.StatusOK, ""},
+		{"Missing Key", "/lookup/1.207.235.255", nil, http.StatusUnauthorized, "missing api key"},
+		{"Invalid Key", "/lookup/1.207.235.255", map[string]string{"X-API-Key": "guess"}, http.StatusUnauthorized, "invalid api key"},
+		{"Expired Key", "/lookup/1.207.235.255", map[string]string{"X-API-Key": "retired-key"}, http.StatusUnauthorized, "api key retired has expired"},
+		{"Missing Scope", "/lookup/1.207.235.255", map[string]string{"X-API-Key": "billing-key"}, http.StatusForbidden, "api key billing lacks the lookup scope"},
+		{"Header Key", "/lookup/1.207.235.255", map[string]string{"X-API-Key": "ops-key"}, http.StatusOK, ""},
+		{"Bearer Key", "/lookup/1.207.235.255", map[string]string{"Authorization": "Bearer ops-key"}, http.StatusOK, ""},
+	}
+
+	for _, tc := range tt {
+		req := httptest.NewRequest(http.MethodGet, tc.path, nil)
+		for k, v := range tc.headers {
+			req.Header.Set(k, v)
+		}
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, req)
+
+		if !suite.Equal(tc.status, rec.Code, "was expecting status %v on %v, received %v", tc.status, tc.testName, rec.Code) {
+			Log(log.InfoLevel, fmt.Sprintf("was expecting status %v on %v, received %v", tc.status, tc.testName, rec.Code), true)
+		}
+		if tc.expected != "" {
+			var resp ResponseStruct
+			jsoniter.NewDecoder(rec.Body).Decode(&resp)
+			suite.Equal(tc.expected, resp.Response, "unexpected response on %v", tc.testName)
+		}
+	}
+
+	//the authenticated identity is attached to the request metrics
+	labels := map[string]string{"route": "/lookup/{ip}", "identity": "ops", "status": "200"}
+	suite.GreaterOrEqual(CounterValue("whitelist_requests_total", labels), uint64(2))
+}
+
+func (suite *AuthSuite) TestRequestIdentity() {
+	Log(log.InfoLevel, "====== Running TestRequestIdentity ===========", true)
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	suite.Equal("", RequestIdentity(req))
+
+	var identity string
+	router := setupRouter()
+	router.HandleFunc("/identity", func(w http.ResponseWriter, r *http.Request) {
+		identity = RequestIdentity(r)
+	})
+	routeScopes["/identity"] = ScopeCheck
+	defer delete(routeScopes, "/identity")
+	setupAPIKeys(filepath.Join(suite.dir, "keys.json"))
+	defer setupAPIKeys("")
+
+	req = httptest.NewRequest(http.MethodGet, "/identity", nil)
+	req.Header.Set("X-API-Key", "billing-key")
+	router.ServeHTTP(httptest.NewRecorder(), req)
+	suite.Equal("billing", identity)
+}
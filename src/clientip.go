@@ -0,0 +1,310 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+//forwarded headers. a deployment's proxies report the client chain in one of them, and the other
+//is ignored since a client can send it through a proxy that doesn't strip it
+const (
+	ForwardedHeaderStandard = "forwarded"
+	ForwardedHeaderXFF      = "xff"
+)
+
+//ProxyProtocol enables PROXY protocol v1/v2 parsing for connections accepted from trusted proxies
+var ProxyProtocol bool
+
+//proxyHeaderTimeout bounds how long a trusted proxy has to send its PROXY preamble
+const proxyHeaderTimeout = 5 * time.Second
+
+//proxyV2Signature is the fixed 12 byte prefix of every PROXY protocol v2 header
+var proxyV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+//setupTrustedProxies makes the configured trusted proxy list the active one
+func setupTrustedProxies(entries []string) error {
+	networks, err := parseTrustedProxies(entries)
+	if err != nil {
+		return err
+	}
+	updateRuntime(func(state *runtimeState) { state.trustedProxies = networks })
+	return nil
+}
+
+//parseTrustedProxies parses a trusted proxy list. entries can either be CIDRs or single addresses,
+//which are treated as a /32 or /128
+func parseTrustedProxies(entries []string) ([]*net.IPNet, error) {
+	var networks []*net.IPNet
+	for _, entry := range entries {
+		entry = strings.TrimSpace(entry)
+		if !strings.Contains(entry, "/") {
+			ip := net.ParseIP(entry)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid trusted proxy %q", entry)
+			}
+			bits := 128
+			if ip.To4() != nil {
+				ip = ip.To4()
+				bits = 32
+			}
+			networks = append(networks, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, network, err := net.ParseCIDR(entry)
+		if err != nil {
+			return nil, fmt.Errorf("invalid trusted proxy %q: %v", entry, err)
+		}
+		networks = append(networks, network)
+	}
+	return networks, nil
+}
+
+//checkForwardedHeader validates the forwarded header setting
+func checkForwardedHeader(name string) error {
+	if name != ForwardedHeaderStandard && name != ForwardedHeaderXFF {
+		return fmt.Errorf("must be %v or %v, got %q", ForwardedHeaderStandard, ForwardedHeaderXFF, name)
+	}
+	return nil
+}
+
+//isTrustedProxy reports whether the ip belongs to one of the trusted proxy networks
+func isTrustedProxy(networks []*net.IPNet, ip net.IP) bool {
+	for _, network := range networks {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+//ClientIP resolves the address of the caller for a request. the connecting address is used unless
+//it is a trusted proxy, in which case the forwarded chain is walked right-to-left and the first
+//address that is not a trusted proxy is returned. only the configured forwarded header is read
+func ClientIP(r *http.Request) (string, error) {
+	remote := net.ParseIP(stripPort(r.RemoteAddr))
+	if remote == nil && !unixSocketRequest(r) {
+		return "", fmt.Errorf("unable to determine client ip")
+	}
+	//callers on the unix socket are local peers, trusted like a proxy to report the client address
+	state := requestRuntime(r)
+	if remote != nil && !isTrustedProxy(state.trustedProxies, remote) {
+		return remote.String(), nil
+	}
+
+	chain := forwardedChain(r.Header, state.forwardedHeader)
+	for i := len(chain) - 1; i >= 0; i-- {
+		ip := net.ParseIP(chain[i])
+		if ip == nil {
+			//obfuscated identifiers and "unknown" stop the walk, anything further left is unverifiable
+			return "", fmt.Errorf("unable to determine client ip from forwarded value %q", chain[i])
+		}
+		if !isTrustedProxy(state.trustedProxies, ip) {
+			return ip.String(), nil
+		}
+	}
+	//every hop is one of ours, so the furthest known hop is the best answer we have
+	if len(chain) > 0 {
+		return net.ParseIP(chain[0]).String(), nil
+	}
+	if remote == nil {
+		return "", fmt.Errorf("unable to determine client ip, unix socket callers must send the forwarded header")
+	}
+	return remote.String(), nil
+}
+
+//unixSocketRequest reports whether the request was accepted on a unix socket listener
+func unixSocketRequest(r *http.Request) bool {
+	addr, ok := r.Context().Value(http.LocalAddrContextKey).(net.Addr)
+	return ok && addr.Network() == "unix"
+}
+
+//forwardedChain returns the forwarded addresses from the source header, ordered from the original
+//client to the closest proxy
+func forwardedChain(header http.Header, source string) []string {
+	var chain []string
+	if source == ForwardedHeaderStandard {
+		for _, value := range header.Values("Forwarded") {
+			for _, element := range strings.Split(value, ",") {
+				for _, pair := range strings.Split(element, ";") {
+					kv := strings.SplitN(strings.TrimSpace(pair), "=", 2)
+					if len(kv) != 2 || !strings.EqualFold(kv[0], "for") {
+						continue
+					}
+					chain = append(chain, stripPort(strings.Trim(kv[1], "\"")))
+				}
+			}
+		}
+		return chain
+	}
+	for _, value := range header.Values("X-Forwarded-For") {
+		for _, hop := range strings.Split(value, ",") {
+			hop = strings.TrimSpace(hop)
+			if hop != "" {
+				chain = append(chain, stripPort(hop))
+			}
+		}
+	}
+	return chain
+}
+
+//stripPort removes an optional port and the brackets around an IPv6 literal from a host value
+func stripPort(host string) string {
+	host = strings.TrimSpace(host)
+	if strings.HasPrefix(host, "[") {
+		if end := strings.Index(host, "]"); end > 0 {
+			return host[1:end]
+		}
+		return host
+	}
+	if strings.Count(host, ":") == 1 {
+		return host[:strings.Index(host, ":")]
+	}
+	return host
+}
+
+//proxyListener wraps a listener so connections from trusted proxies have their PROXY protocol
+//header consumed and the advertised source address reported as the remote address
+type proxyListener struct {
+	net.Listener
+}
+
+//Accept wraps the accepted connection. the header itself is read lazily on first use so a slow
+//proxy can't block the accept loop
+func (l *proxyListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return &proxyConn{Conn: conn, reader: bufio.NewReader(conn)}, nil
+}
+
+type proxyConn struct {
+	net.Conn
+	reader *bufio.Reader
+	once   sync.Once
+	remote net.Addr
+	err    error
+}
+
+//readHeader consumes the PROXY header if the peer is a trusted proxy
+func (c *proxyConn) readHeader() {
+	c.once.Do(func() {
+		c.remote = c.Conn.RemoteAddr()
+		tcpAddr, ok := c.remote.(*net.TCPAddr)
+		if !ok || !isTrustedProxy(currentRuntime().trustedProxies, tcpAddr.IP) {
+			return
+		}
+		c.Conn.SetReadDeadline(time.Now().Add(proxyHeaderTimeout))
+		addr, err := readProxyHeader(c.reader)
+		c.Conn.SetReadDeadline(time.Time{})
+		if err != nil {
+			c.err = err
+			return
+		}
+		if addr != nil {
+			c.remote = addr
+		}
+	})
+}
+
+func (c *proxyConn) Read(b []byte) (int, error) {
+	c.readHeader()
+	if c.err != nil {
+		return 0, c.err
+	}
+	return c.reader.Read(b)
+}
+
+func (c *proxyConn) RemoteAddr() net.Addr {
+	c.readHeader()
+	return c.remote
+}
+
+//readProxyHeader parses a PROXY protocol v1 or v2 header. a nil address with no error means the
+//header was valid but carried no usable source (UNKNOWN, LOCAL or a non-inet family)
+func readProxyHeader(r *bufio.Reader) (net.Addr, error) {
+	prefix, err := r.Peek(len(proxyV2Signature))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read proxy protocol header: %v", err)
+	}
+	switch {
+	case bytes.Equal(prefix, proxyV2Signature):
+		return readProxyHeaderV2(r)
+	case bytes.HasPrefix(prefix, []byte("PROXY ")):
+		return readProxyHeaderV1(r)
+	}
+	return nil, fmt.Errorf("missing proxy protocol header")
+}
+
+//readProxyHeaderV1 parses the text form: PROXY TCP4 <src> <dst> <srcport> <dstport>\r\n
+func readProxyHeaderV1(r *bufio.Reader) (net.Addr, error) {
+	//the spec caps a v1 header at 107 bytes including the CRLF
+	var line []byte
+	for len(line) < 107 {
+		b, err := r.ReadByte()
+		if err != nil {
+			return nil, fmt.Errorf("failed to read proxy protocol header: %v", err)
+		}
+		line = append(line, b)
+		if b == '\n' {
+			break
+		}
+	}
+	if !bytes.HasSuffix(line, []byte("\r\n")) {
+		return nil, fmt.Errorf("invalid proxy protocol v1 header")
+	}
+	fields := strings.Fields(string(line))
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return nil, nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, fmt.Errorf("invalid proxy protocol v1 header")
+	}
+	ip := net.ParseIP(fields[2])
+	port, err := strconv.Atoi(fields[4])
+	if ip == nil || err != nil || port < 0 || port > 65535 {
+		return nil, fmt.Errorf("invalid proxy protocol v1 source address")
+	}
+	return &net.TCPAddr{IP: ip, Port: port}, nil
+}
+
+//readProxyHeaderV2 parses the binary form described in section 2.2 of the PROXY protocol spec
+func readProxyHeaderV2(r *bufio.Reader) (net.Addr, error) {
+	header := make([]byte, 16)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, fmt.Errorf("failed to read proxy protocol header: %v", err)
+	}
+	if header[12]>>4 != 2 {
+		return nil, fmt.Errorf("unsupported proxy protocol version %d", header[12]>>4)
+	}
+	payload := make([]byte, binary.BigEndian.Uint16(header[14:16]))
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return nil, fmt.Errorf("failed to read proxy protocol header: %v", err)
+	}
+	//LOCAL commands are health checks from the proxy itself, keep the real peer
+	if header[12]&0x0F == 0 {
+		return nil, nil
+	}
+	switch header[13] {
+	case 0x11:
+		if len(payload) < 12 {
+			return nil, fmt.Errorf("truncated proxy protocol v2 address block")
+		}
+		return &net.TCPAddr{IP: net.IP(payload[0:4]), Port: int(binary.BigEndian.Uint16(payload[8:10]))}, nil
+	case 0x21:
+		if len(payload) < 36 {
+			return nil, fmt.Errorf("truncated proxy protocol v2 address block")
+		}
+		return &net.TCPAddr{IP: net.IP(payload[0:16]), Port: int(binary.BigEndian.Uint16(payload[32:34]))}, nil
+	}
+	return nil, nil
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"net/http"
+	"testing"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/suite"
+)
+
+func TestClientIPSuite(t *testing.T) {
+	clientIPSuite := new(ClientIPSuite)
+	suite.Run(t, clientIPSuite)
+}
+
+type ClientIPSuite struct {
+	suite.Suite
+}
+
+func (suite *ClientIPSuite) SetupSuite() {
+	setLogPath("./logs/")
+	Log(log.InfoLevel, "=============== Running Client IP Suite ======================", true)
+	setupTrustedProxies([]string{"10.0.0.0/8", "192.0.2.1", "2001:db8::/32"})
+}
+
+func (suite *ClientIPSuite) TearDownSuite() {
+	setupTrustedProxies(nil)
+	Log(log.InfoLevel, "========== Client IP Testsuite completed ===========", true)
+	fmt.Println("========== Client IP Testsuite completed ===========")
+}
+
+func (suite *ClientIPSuite) TestSetupTrustedProxies() {
+	Log(log.InfoLevel, "====== Running TestSetupTrustedProxies ===========", true)
+	defer setupTrustedProxies([]string{"10.0.0.0/8", "192.0.2.1", "2001:db8::/32"})
+
+	err := setupTrustedProxies([]string{"10.0.0.0/8", "::1"})
+	if !suite.NoError(err, "was expecting no error, returned %v", err) {
+		Log(log.InfoLevel, fmt.Sprintf("was expecting no error, returned %v", err), true)
+	}
+	suite.Len(currentRuntime().trustedProxies, 2)
+
+	err = setupTrustedProxies([]string{"not a proxy"})
+	if !suite.Error(err, "was expecting an error, returned ok") {
+		Log(log.InfoLevel, "was expecting an error, returned ok", true)
+	}
+}
+
+func (suite *ClientIPSuite) TestClientIP() {
+	Log(log.InfoLevel, "====== Running TestClientIP ===========", true)
+	tt := []struct {
+		testName   string
+		remoteAddr string
+		source     string
+		headers    map[string]string
+		expected   string
+		expectErr  bool
+	}{
+		{"Direct Caller", "1.207.235.255:5000", ForwardedHeaderXFF, nil, "1.207.235.255", false},
+		{"Untrusted Caller Spoofing XFF", "1.207.235.255:5000", ForwardedHeaderXFF, map[string]string{"X-Forwarded-For": "8.8.8.8"}, "1.207.235.255", false},
+		{"Trusted Proxy XFF", "10.1.1.1:5000", ForwardedHeaderXFF, map[string]string{"X-Forwarded-For": "8.8.8.8"}, "8.8.8.8", false},
+		{"XFF Chain Right To Left", "10.1.1.1:5000", ForwardedHeaderXFF, map[string]string{"X-Forwarded-For": "6.6.6.6, 8.8.8.8, 10.2.2.2"}, "8.8.8.8", false},
+		{"XFF All Trusted", "10.1.1.1:5000", ForwardedHeaderXFF, map[string]string{"X-Forwarded-For": "10.3.3.3, 10.2.2.2"}, "10.3.3.3", false},
+		{"Forged Forwarded Through XFF Proxy", "10.1.1.1:5000", ForwardedHeaderXFF, map[string]string{"Forwarded": "for=1.207.235.255", "X-Forwarded-For": "8.8.8.8"}, "8.8.8.8", false},
+		{"Forged Forwarded Without XFF", "10.1.1.1:5000", ForwardedHeaderXFF, map[string]string{"Forwarded": "for=1.207.235.255"}, "10.1.1.1", false},
+		{"Forwarded Header", "192.0.2.1:5000", ForwardedHeaderStandard, map[string]string{"Forwarded": "for=8.8.8.8;proto=https, for=\"[2001:db8::5]:4711\""}, "8.8.8.8", false},
+		{"Forged XFF Through Forwarded Proxy", "192.0.2.1:5000", ForwardedHeaderStandard, map[string]string{"Forwarded": "for=1.1.1.1", "X-Forwarded-For": "8.8.8.8"}, "1.1.1.1", false},
+		{"Forwarded Unknown", "192.0.2.1:5000", ForwardedHeaderStandard, map[string]string{"Forwarded": "for=unknown"}, "", true},
+		{"Trusted Proxy Without Headers", "10.1.1.1:5000", ForwardedHeaderXFF, nil, "10.1.1.1", false},
+		{"IPv6 Caller", "[2a00:1450::1]:443", ForwardedHeaderXFF, nil, "2a00:1450::1", false},
+		{"Empty Remote", "", ForwardedHeaderXFF, nil, "", true},
+	}
+	defer updateRuntime(func(state *runtimeState) { state.forwardedHeader = defaultConfig.ForwardedHeader })
+
+	for _, tc := range tt {
+		updateRuntime(func(state *runtimeState) { state.forwardedHeader = tc.source })
+		req, _ := http.NewRequest(http.MethodGet, "/checkWhitelist", nil)
+		req.RemoteAddr = tc.remoteAddr
+		for k, v := range tc.headers {
+			req.Header.Set(k, v)
+		}
+		ip, err := ClientIP(req)
+		if tc.expectErr {
+			if !suite.Error(err, "was expecting an error on %v, returned ok", tc.testName) {
+				Log(log.InfoLevel, fmt.Sprintf("was expecting an error on %v, returned ok", tc.testName), true)
+			}
+			continue
+		}
+		if !suite.NoError(err, "was expecting no error on %v, returned %v", tc.testName, err) {
+			Log(log.InfoLevel, fmt.Sprintf("was expecting no error on %v, returned %v", tc.testName, err), true)
+		}
+		if !suite.Equal(tc.expected, ip, "was expecting %v on %v, received %v", tc.expected, tc.testName, ip) {
+			Log(log.InfoLevel, fmt.Sprintf("was expecting %v on %v, received %v", tc.expected, tc.testName, ip), true)
+		}
+	}
+}
+
+func (suite *ClientIPSuite) TestReadProxyHeader() {
+	Log(log.InfoLevel, "====== Running TestReadProxyHeader ===========", true)
+	v2 := func(command byte, family byte, addr []byte) []byte {
+		header := append([]byte{}, proxyV2Signature...)
+		header = append(header, 0x20|command, family, 0, 0)
+		binary.BigEndian.PutUint16(header[14:16], uint16(len(addr)))
+		return append(header, addr...)
+	}
+	tcp4 := []byte{8, 8, 8, 8, 10, 0, 0, 1, 0x1F, 0x90, 0x00, 0x50}
+
+	tt := []struct {
+		testName  string
+		header    []byte
+		expected  string
+		expectErr bool
+	}{
+		{"V1 TCP4", []byte("PROXY TCP4 8.8.8.8 10.0.0.1 8080 80\r\nGET / HTTP/1.1\r\n"), "8.8.8.8:8080", false},
+		{"V1 TCP6", []byte("PROXY TCP6 2001:4860::1 2001:db8::1 8080 80\r\n"), "[2001:4860::1]:8080", false},
+		{"V1 Unknown", []byte("PROXY UNKNOWN\r\n"), "", false},
+		{"V1 Malformed", []byte("PROXY TCP4 8.8.8.8\r\n\r\n\r\n"), "", true},
+		{"V2 TCP4", v2(1, 0x11, tcp4), "8.8.8.8:8080", false},
+		{"V2 Local", v2(0, 0x11, tcp4), "", false},
+		{"V2 Truncated", v2(1, 0x11, tcp4[:4]), "", true},
+		{"Missing Header", []byte("GET / HTTP/1.1\r\nHost: x\r\n"), "", true},
+	}
+
+	for _, tc := range tt {
+		addr, err := readProxyHeader(bufio.NewReader(bytes.NewReader(tc.header)))
+		if tc.expectErr {
+			if !suite.Error(err, "was expecting an error on %v, returned ok", tc.testName) {
+				Log(log.InfoLevel, fmt.Sprintf("was expecting an error on %v, returned ok", tc.testName), true)
+			}
+			continue
+		}
+		if !suite.NoError(err, "was expecting no error on %v, returned %v", tc.testName, err) {
+			Log(log.InfoLevel, fmt.Sprintf("was expecting no error on %v, returned %v", tc.testName, err), true)
+		}
+		received := ""
+		if addr != nil {
+			received = addr.String()
+		}
+		if !suite.Equal(tc.expected, received, "was expecting %v on %v, received %v", tc.expected, tc.testName, received) {
+			Log(log.InfoLevel, fmt.Sprintf("was expecting %v on %v, received %v", tc.expected, tc.testName, received), true)
+		}
+	}
+}
+
+//TestProxyListener runs a real listener and validates the PROXY source replaces the peer address
+func (suite *ClientIPSuite) TestProxyListener() {
+	Log(log.InfoLevel, "====== Running TestProxyListener ===========", true)
+	defer setupTrustedProxies([]string{"10.0.0.0/8", "192.0.2.1", "2001:db8::/32"})
+	setupTrustedProxies([]string{"127.0.0.1"})
+
+	inner, err := net.Listen("tcp", "127.0.0.1:0")
+	if !suite.NoError(err, "was expecting no error, returned %v", err) {
+		return
+	}
+	listener := &proxyListener{Listener: inner}
+	defer listener.Close()
+
+	go func() {
+		conn, err := net.Dial("tcp", inner.Addr().String())
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		conn.Write([]byte("PROXY TCP4 8.8.8.8 127.0.0.1 4000 80\r\nhello"))
+	}()
+
+	conn, err := listener.Accept()
+	if !suite.NoError(err, "was expecting no error, returned %v", err) {
+		return
+	}
+	defer conn.Close()
+	suite.Equal("8.8.8.8:4000", conn.RemoteAddr().String())
+	buf := make([]byte, 5)
+	n, _ := conn.Read(buf)
+	suite.Equal("hello", string(buf[:n]))
+}
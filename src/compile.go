@@ -0,0 +1,256 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"net"
+	"net/netip"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+//decisionInterval is a contiguous address range with a single country. addresses are stored in
+//their 16 byte form so IPv4 and IPv6 share one sorted table
+type decisionInterval struct {
+	start   [16]byte
+	end     [16]byte
+	country uint16
+}
+
+//networkTable maps every network of a provider to its country, with adjacent networks of the same
+//country merged into single intervals. it is built once when the provider is loaded and shared by
+//every compiled policy, so a check is a binary search instead of a record decode and entry loop
+type networkTable struct {
+	intervals []decisionInterval
+	countries []Country
+	//known holds every country of the provider keyed by iso code, nameless ones included
+	known map[string]Country
+}
+
+//compiledPolicy holds whether each country of the loaded provider's network table is allowed by one
+//version of a policy
+type compiledPolicy struct {
+	version   int
+	database  *providerDatabase
+	decisions atomic.Pointer[countryDecisions]
+}
+
+//countryDecisions holds whether each country of a network table is allowed by the entries of the
+//policy that apply in one schedule state, matched through one alias table generation, so a
+//scheduled entry or alias change only decides the countries again
+type countryDecisions struct {
+	state   string
+	aliases int
+	allowed []bool
+}
+
+//compiledPolicies holds the latest compiled decisions per policy, keyed by policyKey
+var compiledPolicies = struct {
+	sync.RWMutex
+	entries map[string]*compiledPolicy
+}{entries: map[string]*compiledPolicy{}}
+
+//compiling tracks background builds so they can be waited on
+var compiling sync.WaitGroup
+
+//recompilePolicies decides the countries of every policy again in the background. it is called
+//whenever the policies or the country database are (re)loaded. until a build finishes, checks fall
+//back to evaluating the policy directly
+func recompilePolicies() {
+	for _, policy := range allPolicies() {
+		compileInBackground(policy)
+	}
+}
+
+//compileInBackground runs compilePolicy on its own goroutine
+func compileInBackground(policy Policy) {
+	compiling.Add(1)
+	go func() {
+		defer compiling.Done()
+		compilePolicy(policy)
+	}()
+}
+
+//compilePolicy decides every country of the loaded provider's network table against a policy and
+//stores the decisions. policies with asn entries, scheduled ones included, are left uncompiled since
+//their decision doesn't only depend on the country database
+func compilePolicy(policy Policy) {
+	key := policyKey(policy.Tenant, policy.Name)
+	if hasASNEntry(policy.allEntries()) {
+		dropCompiledPolicy(key)
+		return
+	}
+	start := time.Now()
+	database, err := loadedDatabase()
+	if err != nil {
+		Log(log.ErrorLevel, fmt.Sprintf("failed to compile policy %v: %v", policy.Name, err), flag.Lookup("test.v") == nil)
+		return
+	}
+	compiled := &compiledPolicy{version: policy.Version, database: database}
+	decisions, err := compiled.decide(policy, policy.currentScheduleState())
+	if err != nil {
+		Log(log.ErrorLevel, fmt.Sprintf("failed to compile policy %v: %v", policy.Name, err), flag.Lookup("test.v") == nil)
+		return
+	}
+	compiled.decisions.Store(decisions)
+
+	//the policy may have changed while this version was building
+	if current, ok := GetPolicy(policy.Tenant, policy.Name); !ok || current.Version != policy.Version {
+		return
+	}
+	compiledPolicies.Lock()
+	defer compiledPolicies.Unlock()
+	if existing, ok := compiledPolicies.entries[key]; ok && existing.version > compiled.version {
+		return
+	}
+	compiledPolicies.entries[key] = compiled
+	Log(log.InfoLevel, fmt.Sprintf("compiled policy %v version %v for %v countries in %v",
+		policy.Name, policy.Version, len(decisions.allowed), time.Since(start)), flag.Lookup("test.v") == nil)
+}
+
+//dropCompiledPolicy removes the compiled decisions stored under a policy key
+func dropCompiledPolicy(key string) {
+	compiledPolicies.Lock()
+	delete(compiledPolicies.entries, key)
+	compiledPolicies.Unlock()
+}
+
+//buildNetworkTable walks every network of the provider once, indexing its countries and merging
+//adjacent networks with the same country into single intervals
+func buildNetworkTable(provider LocationProvider) (*networkTable, error) {
+	table := &networkTable{known: map[string]Country{}}
+	countryIndexes := map[string]uint16{}
+
+	err := provider.Networks(netip.Prefix{}, func(network netip.Prefix, country Country) error {
+		if _, ok := table.known[country.IsoCode]; !ok {
+			table.known[country.IsoCode] = country
+		}
+		//networks without a country name are left out so they fall back to the regular lookup and its error
+		if country.Name == "" {
+			return nil
+		}
+		index, ok := countryIndexes[country.IsoCode]
+		if !ok {
+			index = uint16(len(table.countries))
+			countryIndexes[country.IsoCode] = index
+			table.countries = append(table.countries, country)
+		}
+
+		interval := decisionInterval{country: index}
+		interval.start, interval.end = networkBounds(network)
+		if n := len(table.intervals); n > 0 {
+			previous := &table.intervals[n-1]
+			if previous.country == index && isNext(previous.end, interval.start) {
+				previous.end = interval.end
+				return nil
+			}
+		}
+		table.intervals = append(table.intervals, interval)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	//the database tree is walked in address order, but sort anyway so lookups never depend on it
+	sort.Slice(table.intervals, func(i, j int) bool {
+		return bytes.Compare(table.intervals[i].start[:], table.intervals[j].start[:]) < 0
+	})
+	return table, nil
+}
+
+//decide decides every country of the network table against the entries of the policy applying in
+//state, through the current alias table
+func (c *compiledPolicy) decide(policy Policy, state string) (*countryDecisions, error) {
+	whitelist, blacklist := policy.entriesIn(state)
+	countries := c.database.networks.countries
+	decisions := &countryDecisions{state: state, aliases: aliasGeneration(), allowed: make([]bool, len(countries))}
+	for i, country := range countries {
+		allowed, err := decide(whitelist, blacklist, country, ASN{})
+		if err != nil {
+			return nil, err
+		}
+		decisions.allowed[i] = allowed
+	}
+	return decisions, nil
+}
+
+//networkBounds returns the first and last address of a network in 16 byte form. IPv4 networks are
+//in their IPv4-mapped form, the same as net.IP.To16 gives for the addresses checked against them
+func networkBounds(network netip.Prefix) ([16]byte, [16]byte) {
+	return network.Masked().Addr().As16(), lastAddr(network).As16()
+}
+
+//isNext reports whether b is the address immediately after a
+func isNext(a [16]byte, b [16]byte) bool {
+	for i := 15; i >= 0; i-- {
+		a[i]++
+		if a[i] != 0 {
+			break
+		}
+	}
+	return a == b
+}
+
+//lookup finds the interval containing ip
+func (t *networkTable) lookup(ip net.IP) (decisionInterval, bool) {
+	var key [16]byte
+	copy(key[:], ip.To16())
+	i := sort.Search(len(t.intervals), func(i int) bool {
+		return bytes.Compare(t.intervals[i].start[:], key[:]) > 0
+	})
+	if i == 0 {
+		return decisionInterval{}, false
+	}
+	interval := t.intervals[i-1]
+	if bytes.Compare(key[:], interval.end[:]) > 0 {
+		return decisionInterval{}, false
+	}
+	return interval, true
+}
+
+//lookupCompiled returns the decision for ip from the policy's compiled decisions. it reports false
+//when there are no decisions for this policy version and the loaded provider, the ip is covered by
+//the tenant's corrections overlay, or the ip isn't in the network table, in which case the policy
+//must be evaluated directly. decisions made before a scheduled entry or the alias table changed are
+//made again
+func lookupCompiled(policy Policy, ip net.IP) (Decision, bool) {
+	compiledPolicies.RLock()
+	compiled, ok := compiledPolicies.entries[policyKey(policy.Tenant, policy.Name)]
+	compiledPolicies.RUnlock()
+	database, err := loadedDatabase()
+	if !ok || err != nil || compiled.version != policy.Version || compiled.database != database {
+		return Decision{}, false
+	}
+	if _, corrected := findCorrection(policy.Tenant, ip); corrected {
+		return Decision{}, false
+	}
+	interval, ok := database.networks.lookup(ip)
+	if !ok {
+		return Decision{}, false
+	}
+	decisions := compiled.decisions.Load()
+	if state := policy.currentScheduleState(); decisions.state != state || decisions.aliases != aliasGeneration() {
+		if decisions, err = compiled.decide(policy, state); err != nil {
+			return Decision{}, false
+		}
+		compiled.decisions.Store(decisions)
+	}
+	return Decision{Allowed: decisions.allowed[interval.country], Country: database.networks.countries[interval.country]}, true
+}
+
+//EvaluatePolicy validates an ip against a named policy with its tenant's corrections, through its
+//compiled table when available
+func EvaluatePolicy(ipString string, policy Policy) (Decision, error) {
+	if addr, err := ParseAddr(ipString); err == nil {
+		if decision, ok := lookupCompiled(policy, net.IP(addr.AsSlice())); ok {
+			return decision, nil
+		}
+	}
+	whitelist, blacklist := policy.activeEntries(Clock())
+	return EvaluateTenant(policy.Tenant, ipString, whitelist, blacklist)
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"testing"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/suite"
+)
+
+func TestCompileSuite(t *testing.T) {
+	compileSuite := new(CompileSuite)
+	suite.Run(t, compileSuite)
+}
+
+type CompileSuite struct {
+	suite.Suite
+	dir string
+}
+
+func (suite *CompileSuite) SetupSuite() {
+	setLogPath("./logs/")
+	Log(log.InfoLevel, "=============== Running Compile Suite ======================", true)
+	setupDB("./test-data/test-data.mmdb")
+	suite.dir, _ = os.MkdirTemp("", "compile-test")
+	setupPolicies(filepath.Join(suite.dir, "policies.json"))
+}
+
+func (suite *CompileSuite) TearDownSuite() {
+	setupPolicies("")
+	setupCorrections("")
+	compiling.Wait()
+	os.RemoveAll(suite.dir)
+	testProvider().Close()
+	Log(log.InfoLevel, "========== Compile Testsuite completed ===========", true)
+	fmt.Println("========== Compile Testsuite completed ===========")
+}
+
+func (suite *CompileSuite) TestNetworkBounds() {
+	Log(log.InfoLevel, "====== Running TestNetworkBounds ===========", true)
+	tt := []struct {
+		cidr  string
+		first string
+		last  string
+	}{
+		{"1.0.0.0/24", "1.0.0.0", "1.0.0.255"},
+		{"1.0.4.0/22", "1.0.4.0", "1.0.7.255"},
+		{"10.1.2.3/32", "10.1.2.3", "10.1.2.3"},
+		{"2001:db8::/33", "2001:db8::", "2001:db8:7fff:ffff:ffff:ffff:ffff:ffff"},
+	}
+	for _, tc := range tt {
+		first, last := networkBounds(netip.MustParsePrefix(tc.cidr))
+		suite.Equal(tc.first, netip.AddrFrom16(first).Unmap().String(), "unexpected first address for %v", tc.cidr)
+		suite.Equal(tc.last, netip.AddrFrom16(last).Unmap().String(), "unexpected last address for %v", tc.cidr)
+	}
+
+	suite.True(isNext([16]byte{15: 0xFF}, [16]byte{14: 1}))
+	suite.False(isNext([16]byte{15: 1}, [16]byte{15: 3}))
+}
+
+//TestCompiledMatchesEvaluate validates the compiled table gives the same answer as evaluating the
+//policy directly, and that checks stop using it once the policy changes
+func (suite *CompileSuite) TestCompiledMatchesEvaluate() {
+	Log(log.InfoLevel, "====== Running TestCompiledMatchesEvaluate ===========", true)
+	policy, err := SavePolicy(Policy{Name: "compiled", Whitelist: []string{"china", "australia"}, Blacklist: []string{"japan"}})
+	suite.NoError(err)
+	compilePolicy(policy)
+
+	ips := []string{"1.0.0.1", "1.0.1.1", "1.207.235.255", "1.0.16.1", "8.8.8.8", "2001:4860::8888", "2400:cb00::1", "203.0.113.1"}
+	compiledCount := 0
+	for _, ip := range ips {
+		expected, expectedErr := Evaluate(ip, policy.Whitelist, policy.Blacklist)
+		decision, compiled := lookupCompiled(policy, net.ParseIP(ip))
+		if !compiled {
+			suite.Error(expectedErr, "was expecting %v to be in the compiled table", ip)
+			continue
+		}
+		compiledCount++
+		if !suite.Equal(expected, decision, "compiled decision differs for %v", ip) {
+			Log(log.InfoLevel, fmt.Sprintf("compiled decision %v differs from %v for %v", decision, expected, ip), true)
+		}
+	}
+	suite.GreaterOrEqual(compiledCount, 6)
+
+	//a correction takes the ip out of the compiled path
+	setupCorrections(filepath.Join(suite.dir, "corrections.json"))
+	AddCorrection(Correction{Network: "1.207.235.0/24", IsoCode: "JP", Name: "Japan"})
+	_, compiled := lookupCompiled(policy, net.ParseIP("1.207.235.255"))
+	suite.False(compiled, "was expecting corrected networks to skip the compiled table")
+	decision, err := EvaluatePolicy("1.207.235.255", policy)
+	suite.NoError(err)
+	suite.False(decision.Allowed)
+	setupCorrections("")
+
+	//a new version isn't served from the old table
+	updated, _ := SavePolicy(Policy{Name: "compiled", Whitelist: []string{"japan"}})
+	_, compiled = lookupCompiled(updated, net.ParseIP("1.0.1.1"))
+	if compiled {
+		compiledPolicies.RLock()
+		suite.Equal(updated.Version, compiledPolicies.entries[policyKey(DefaultTenant, "compiled")].version)
+		compiledPolicies.RUnlock()
+	}
+	compilePolicy(updated)
+	decision, compiled = lookupCompiled(updated, net.ParseIP("1.0.1.1"))
+	suite.True(compiled)
+	suite.False(decision.Allowed)
+
+	//decisions made against other aliases are made again once the alias table changes
+	suite.NoError(setupCountryAliases(map[string]string{"zipangu": "JP"}))
+	aliased, _ := SavePolicy(Policy{Name: "compiled", Whitelist: []string{"zipangu"}})
+	compilePolicy(aliased)
+	decision, compiled = lookupCompiled(aliased, net.ParseIP("1.0.16.1"))
+	suite.True(compiled)
+	suite.True(decision.Allowed)
+	suite.NoError(setupCountryAliases(nil))
+	decision, compiled = lookupCompiled(aliased, net.ParseIP("1.0.16.1"))
+	suite.True(compiled)
+	if !suite.False(decision.Allowed, "was expecting an alias change to change the compiled decision") {
+		Log(log.InfoLevel, "was expecting an alias change to change the compiled decision", true)
+	}
+
+	//every policy shares the network table of the loaded provider
+	other, _ := SavePolicy(Policy{Name: "other", Whitelist: []string{"japan"}})
+	compilePolicy(other)
+	compiledPolicies.RLock()
+	suite.Same(compiledPolicies.entries[policyKey(DefaultTenant, "compiled")].database, compiledPolicies.entries[policyKey(DefaultTenant, "other")].database)
+	compiledPolicies.RUnlock()
+
+	//a reloaded policies file starts its versions over without keeping the old decisions
+	setupPolicies(filepath.Join(suite.dir, "reloaded.json"))
+	reloaded, _ := SavePolicy(Policy{Name: "compiled", Whitelist: []string{"japan"}})
+	suite.Less(reloaded.Version, aliased.Version)
+	compiling.Wait()
+	_, compiled = lookupCompiled(reloaded, net.ParseIP("1.0.16.1"))
+	suite.True(compiled, "was expecting a reloaded policy to be compiled again")
+
+	//asn policies are never compiled
+	asnPolicy, _ := SavePolicy(Policy{Name: "compiled", Whitelist: []string{"asn:13335"}})
+	compilePolicy(asnPolicy)
+	_, compiled = lookupCompiled(asnPolicy, net.ParseIP("1.0.1.1"))
+	suite.False(compiled)
+}
@@ -0,0 +1,331 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	jsoniter "github.com/json-iterator/go"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+//Config is the typed form of config.yaml. keys are the mapstructure tags, and keys of nested
+//sections are joined with a dot, e.g. "rate limit.burst"
+type Config struct {
+	Port                string            `mapstructure:"port"`
+	SocketPath          string            `mapstructure:"socket path"`
+	SocketMode          string            `mapstructure:"socket mode"`
+	DatabasePath        string            `mapstructure:"database path"`
+	Provider            string            `mapstructure:"provider"`
+	LogPath             string            `mapstructure:"log path"`
+	LogLevel            string            `mapstructure:"log level"`
+	TrustedProxies      []string          `mapstructure:"trusted proxies"`
+	ForwardedHeader     string            `mapstructure:"forwarded header"`
+	ProxyProtocol       bool              `mapstructure:"proxy protocol"`
+	TLSCertPath         string            `mapstructure:"tls cert path"`
+	TLSKeyPath          string            `mapstructure:"tls key path"`
+	TLSMinVersion       string            `mapstructure:"tls min version"`
+	TLSClientCAPath     string            `mapstructure:"tls client ca path"`
+	APIKeysPath         string            `mapstructure:"api keys path"`
+	RateLimit           RateLimitConfig   `mapstructure:"rate limit"`
+	ASNDatabasePath     string            `mapstructure:"asn database path"`
+	CorrectionsPath     string            `mapstructure:"corrections path"`
+	PoliciesPath        string            `mapstructure:"policies path"`
+	AuditPath           string            `mapstructure:"audit path"`
+	AuditMaxSegmentSize int64             `mapstructure:"audit max segment size"`
+	ShadowPath          string            `mapstructure:"shadow path"`
+	Webhooks            WebhookConfig     `mapstructure:"webhooks"`
+	Server              ServerConfig      `mapstructure:"server"`
+	Tenants             TenantConfig      `mapstructure:"tenants"`
+	CountryAliases      map[string]string `mapstructure:"country aliases"`
+	UnknownEntries      string            `mapstructure:"unknown entries"`
+	Resolver            ResolverConfig    `mapstructure:"resolver"`
+}
+
+//defaultConfig holds the values used for keys missing from the config file and environment
+var defaultConfig = Config{
+	Port:            "8080",
+	SocketMode:      "0660",
+	DatabasePath:    "./data/GeoLite2-Country.mmdb",
+	Provider:        ProviderMaxMind,
+	LogPath:         "./logs/",
+	LogLevel:        "info",
+	ForwardedHeader: ForwardedHeaderXFF,
+	TLSMinVersion:   "1.2",
+	RateLimit: RateLimitConfig{
+		AuthFailures: RateLimit{RequestsPerSecond: 0.1, Burst: 10},
+	},
+	CorrectionsPath:     "./data/corrections.json",
+	PoliciesPath:        "./data/policies.json",
+	AuditPath:           "./logs/audit/",
+	AuditMaxSegmentSize: 10 * 1024 * 1024,
+	ShadowPath:          "./logs/shadow.log",
+	Webhooks: WebhookConfig{
+		QueuePath:       "./data/webhooks/",
+		MaxAttempts:     10,
+		DatabaseMaxAge:  30 * 24 * time.Hour,
+		DeniedThreshold: 1,
+		DeniedWindow:    time.Minute,
+	},
+	Server: ServerConfig{
+		ReadHeaderTimeout: 5 * time.Second,
+		ReadTimeout:       10 * time.Second,
+		WriteTimeout:      10 * time.Second,
+		IdleTimeout:       2 * time.Minute,
+		MaxHeaderBytes:    64 * 1024,
+		MaxBodyBytes:      1024 * 1024,
+		MaxEntries:        1000,
+	},
+	Tenants:        TenantConfig{TenantQuota: TenantQuota{Period: 24 * time.Hour}},
+	UnknownEntries: UnknownEntriesReject,
+	Resolver:       ResolverConfig{Timeout: 2 * time.Second, Rule: HostRuleAll},
+}
+
+//envPrefix prefixes environment overrides. the rest of the name is the key in upper case with spaces
+//and dots replaced by underscores, e.g. WHITELIST_RATE_LIMIT_BURST
+const envPrefix = "WHITELIST"
+
+//configSetting is one leaf key of a config and its value
+type configSetting struct {
+	key   string
+	value reflect.Value
+}
+
+//configSettings flattens a config struct into its leaf keys in field order
+func configSettings(value reflect.Value, prefix string) []configSetting {
+	var settings []configSetting
+	for i := 0; i < value.NumField(); i++ {
+		field := value.Type().Field(i)
+		name, options, _ := strings.Cut(field.Tag.Get("mapstructure"), ",")
+		switch {
+		case options == "squash":
+			settings = append(settings, configSettings(value.Field(i), prefix)...)
+		case field.Type.Kind() == reflect.Struct:
+			settings = append(settings, configSettings(value.Field(i), prefix+name+".")...)
+		default:
+			settings = append(settings, configSetting{key: prefix + name, value: value.Field(i)})
+		}
+	}
+	return settings
+}
+
+//overridable reports whether a setting can be set from a single environment variable or flag value:
+//scalars and string lists (comma separated)
+func (setting configSetting) overridable() bool {
+	switch setting.value.Kind() {
+	case reflect.Map:
+		return false
+	case reflect.Slice:
+		return setting.value.Type().Elem().Kind() == reflect.String
+	}
+	return true
+}
+
+//loadConfig reads the config file, then applies WHITELIST_* environment variables and finally the
+//command line flags, which take precedence. every overridable key has a flag named after it with
+//dashes, e.g. -rate-limit-burst, and -config points at a different config file. keys the Config
+//struct doesn't know about are an error
+func loadConfig(args []string) (Config, error) {
+	config, _, err := readConfig(args)
+	return config, err
+}
+
+//readConfig loads the config like loadConfig and also returns the viper instance it was read with
+func readConfig(args []string) (Config, *viper.Viper, error) {
+	var config Config
+	v := viper.New()
+	flags := flag.NewFlagSet("whitelist_service", flag.ContinueOnError)
+	configPathFlag := flags.String("config", "", "path to the configuration file (default ./config.yaml)")
+	flagKeys := map[string]string{}
+	for _, setting := range configSettings(reflect.ValueOf(defaultConfig), "") {
+		if !setting.overridable() {
+			continue
+		}
+		//defaults also make every key known to viper, which env overrides rely on
+		v.SetDefault(setting.key, setting.value.Interface())
+		name := strings.NewReplacer(" ", "-", ".", "-").Replace(setting.key)
+		flags.String(name, "", fmt.Sprintf("overrides %q", setting.key))
+		flagKeys[name] = setting.key
+	}
+	if err := flags.Parse(args); err != nil {
+		return config, v, err
+	}
+	if flags.NArg() > 0 {
+		return config, v, fmt.Errorf("unexpected argument %q", flags.Arg(0))
+	}
+
+	if *configPathFlag != "" {
+		v.SetConfigFile(*configPathFlag)
+	} else {
+		v.AddConfigPath(configPath)
+		v.SetConfigName(configFile)
+	}
+	if err := v.ReadInConfig(); err != nil {
+		//without an explicit -config, the file is optional and everything can come from the environment
+		var notFound viper.ConfigFileNotFoundError
+		if *configPathFlag != "" || !errors.As(err, &notFound) {
+			return config, v, fmt.Errorf("failed to read config: %v", err)
+		}
+	}
+	v.SetEnvPrefix(envPrefix)
+	v.SetEnvKeyReplacer(strings.NewReplacer(" ", "_", ".", "_"))
+	v.AutomaticEnv()
+	flags.Visit(func(f *flag.Flag) {
+		if key, ok := flagKeys[f.Name]; ok {
+			v.Set(key, f.Value.String())
+		}
+	})
+
+	if err := v.UnmarshalExact(&config); err != nil {
+		return config, v, fmt.Errorf("invalid configuration: %v", err)
+	}
+	return config, v, nil
+}
+
+//validateConfig checks required keys, the port and that configured files exist, reporting every
+//problem at once
+func validateConfig(config Config) error {
+	var problems []string
+	problem := func(key string, format string, args ...interface{}) {
+		problems = append(problems, fmt.Sprintf("%v: %v", key, fmt.Sprintf(format, args...)))
+	}
+	requireFile := func(key string, path string, required bool) {
+		if path == "" {
+			if required {
+				problem(key, "is required")
+			}
+			return
+		}
+		if info, err := os.Stat(path); err != nil {
+			problem(key, "%v", err)
+		} else if info.IsDir() {
+			problem(key, "%v is a directory", path)
+		}
+	}
+	requireDir := func(key string, path string) {
+		if info, err := os.Stat(path); err != nil {
+			problem(key, "%v", err)
+		} else if !info.IsDir() {
+			problem(key, "%v is not a directory", path)
+		}
+	}
+
+	if config.Port == "" {
+		if config.SocketPath == "" && !socketActivated() {
+			problem("port", "is required unless socket path is set or the service is socket activated")
+		}
+	} else if port, err := strconv.Atoi(config.Port); err != nil || port < 1 || port > 65535 {
+		problem("port", "must be a number between 1 and 65535, got %q", config.Port)
+	}
+	if config.SocketPath != "" {
+		requireDir("socket path", filepath.Dir(config.SocketPath))
+		if _, err := parseSocketMode(config.SocketMode); err != nil {
+			problem("socket mode", "%v", err)
+		}
+	}
+	requireFile("database path", config.DatabasePath, true)
+	if err := checkProviderName(config.Provider); err != nil {
+		problem("provider", "%v", err)
+	}
+	if config.LogPath == "" {
+		problem("log path", "is required")
+	} else {
+		requireDir("log path", config.LogPath)
+	}
+	if _, err := log.ParseLevel(config.LogLevel); err != nil {
+		problem("log level", "%v", err)
+	}
+	if err := checkForwardedHeader(config.ForwardedHeader); err != nil {
+		problem("forwarded header", "%v", err)
+	}
+	if (config.TLSCertPath == "") != (config.TLSKeyPath == "") {
+		problem("tls cert path", "tls cert path and tls key path must be set together")
+	}
+	requireFile("tls cert path", config.TLSCertPath, false)
+	requireFile("tls key path", config.TLSKeyPath, false)
+	requireFile("tls client ca path", config.TLSClientCAPath, false)
+	if _, err := tlsVersion(config.TLSMinVersion); err != nil {
+		problem("tls min version", "%v", err)
+	}
+	requireFile("api keys path", config.APIKeysPath, false)
+	requireFile("asn database path", config.ASNDatabasePath, false)
+	//the stores are created on their first change, so only their directory has to exist
+	if config.CorrectionsPath != "" {
+		requireDir("corrections path", filepath.Dir(config.CorrectionsPath))
+	}
+	if config.PoliciesPath != "" {
+		requireDir("policies path", filepath.Dir(config.PoliciesPath))
+	}
+	if config.ShadowPath != "" {
+		requireDir("shadow path", filepath.Dir(config.ShadowPath))
+	}
+	if config.AuditPath != "" && config.AuditMaxSegmentSize <= 0 {
+		problem("audit max segment size", "must be positive")
+	}
+	if len(config.Webhooks.Endpoints) > 0 && config.Webhooks.MaxAttempts <= 0 {
+		problem("webhooks.max attempts", "must be positive")
+	}
+	if len(config.Webhooks.Endpoints) > 0 && config.Webhooks.DeniedThreshold <= 0 {
+		problem("webhooks.denied threshold", "must be positive")
+	}
+	if len(config.Webhooks.Endpoints) > 0 && config.Webhooks.DeniedWindow <= 0 {
+		problem("webhooks.denied window", "must be positive")
+	}
+	if _, err := tenantQuotas(config.Tenants); err != nil {
+		problem("tenants", "%v", err)
+	}
+	if _, err := countryAliasTable(config.CountryAliases); err != nil {
+		problem("country aliases", "%v", err)
+	}
+	if config.UnknownEntries != UnknownEntriesReject && config.UnknownEntries != UnknownEntriesWarn {
+		problem("unknown entries", "must be %v or %v, got %q", UnknownEntriesReject, UnknownEntriesWarn, config.UnknownEntries)
+	}
+	if err := checkResolverConfig(config.Resolver); err != nil {
+		problem("resolver", "%v", err)
+	}
+
+	//every server setting is a timeout or a size, where 0 is unlimited
+	for _, setting := range configSettings(reflect.ValueOf(config.Server), "server.") {
+		if setting.value.Int() < 0 {
+			problem(setting.key, "must not be negative")
+		}
+	}
+
+	if len(problems) > 0 {
+		return fmt.Errorf("invalid configuration:\n  %v", strings.Join(problems, "\n  "))
+	}
+	return nil
+}
+
+//configJSON encodes config values with their config file key names
+var configJSON = jsoniter.Config{TagKey: "mapstructure"}.Froze()
+
+//printConfig writes every key of the effective configuration, with webhook secrets masked
+func printConfig(w io.Writer, config Config) {
+	endpoints := make([]WebhookEndpoint, len(config.Webhooks.Endpoints))
+	for i, endpoint := range config.Webhooks.Endpoints {
+		endpoint.Secret = "********"
+		endpoints[i] = endpoint
+	}
+	config.Webhooks.Endpoints = endpoints
+
+	settings := configSettings(reflect.ValueOf(config), "")
+	sort.SliceStable(settings, func(i, j int) bool { return settings[i].key < settings[j].key })
+	for _, setting := range settings {
+		value := setting.value.Interface()
+		if duration, ok := value.(time.Duration); ok {
+			value = duration.String()
+		}
+		encoded, _ := configJSON.Marshal(value)
+		fmt.Fprintf(w, "%v: %s\n", setting.key, encoded)
+	}
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/suite"
+)
+
+func TestConfigSuite(t *testing.T) {
+	configSuite := new(ConfigSuite)
+	suite.Run(t, configSuite)
+}
+
+type ConfigSuite struct {
+	suite.Suite
+	dir string
+}
+
+func (suite *ConfigSuite) SetupSuite() {
+	setLogPath("./logs/")
+	Log(log.InfoLevel, "=============== Running Config Suite ======================", true)
+	suite.dir, _ = os.MkdirTemp("", "config-test")
+}
+
+func (suite *ConfigSuite) TearDownSuite() {
+	os.RemoveAll(suite.dir)
+	Log(log.InfoLevel, "========== Config Testsuite completed ===========", true)
+	fmt.Println("========== Config Testsuite completed ===========")
+}
+
+//writeConfig writes a named config file to the test directory and returns its path
+func (suite *ConfigSuite) writeConfig(name string, contents string) string {
+	path := filepath.Join(suite.dir, name+".yaml")
+	os.WriteFile(path, []byte(contents), 0644)
+	return path
+}
+
+//TestLoadConfig validates the shipped config.yaml loads and that every value in it is read
+func (suite *ConfigSuite) TestLoadConfig() {
+	Log(log.InfoLevel, "====== Running TestLoadConfig ===========", true)
+	config, err := loadConfig([]string{"-config", "./config.yaml"})
+	if !suite.NoError(err, "was expecting no error, returned %v", err) {
+		Log(log.InfoLevel, fmt.Sprintf("was expecting no error, returned %v", err), true)
+	}
+	suite.Equal("8080", config.Port)
+	suite.Equal("./logs/", config.LogPath, "was expecting the log path to be read from the log path key")
+	suite.Equal("./data/GeoLite2-Country.mmdb", config.DatabasePath)
+	suite.Equal(720*time.Hour, config.Webhooks.DatabaseMaxAge)
+
+	//missing keys fall back to the defaults
+	config, err = loadConfig([]string{"-config", suite.writeConfig("defaults", `port: "9000"`)})
+	suite.NoError(err)
+	suite.Equal("9000", config.Port)
+	suite.Equal(defaultConfig.LogPath, config.LogPath)
+	suite.Equal(defaultConfig.Webhooks.MaxAttempts, config.Webhooks.MaxAttempts)
+
+	tt := []struct {
+		testName string
+		args     []string
+		expected string
+	}{
+		{"Unknown Key", []string{"-config", suite.writeConfig("unknown", "port: \"8080\"\nLogPath: \"./logs/\"")}, "logpath"},
+		{"Unknown Nested Key", []string{"-config", suite.writeConfig("nested", "rate limit:\n  requests per minute: 5")}, "requests per minute"},
+		{"Invalid Yaml", []string{"-config", suite.writeConfig("yaml", "port: [\"8080\"")}, "failed to read config"},
+		{"Missing File", []string{"-config", filepath.Join(suite.dir, "missing.yaml")}, "failed to read config"},
+		{"Unknown Flag", []string{"-LogPath", "./logs/"}, "not defined"},
+		{"Wrong Type", []string{"-config", suite.writeConfig("type", `proxy protocol: "sometimes"`)}, "proxy protocol"},
+	}
+	for _, tc := range tt {
+		_, err := loadConfig(tc.args)
+		if !suite.Error(err, "was expecting an error on %v, returned ok", tc.testName) {
+			Log(log.InfoLevel, fmt.Sprintf("was expecting an error on %v, returned ok", tc.testName), true)
+			continue
+		}
+		suite.Contains(err.Error(), tc.expected, "unexpected error on %v", tc.testName)
+	}
+}
+
+//TestConfigOverrides validates environment variables override the file and flags override both
+func (suite *ConfigSuite) TestConfigOverrides() {
+	Log(log.InfoLevel, "====== Running TestConfigOverrides ===========", true)
+	path := suite.writeConfig("overrides", "port: \"8080\"\nrate limit:\n  burst: 5\n")
+	os.Setenv("WHITELIST_PORT", "9090")
+	os.Setenv("WHITELIST_RATE_LIMIT_BURST", "20")
+	os.Setenv("WHITELIST_TRUSTED_PROXIES", "10.0.0.0/8,192.168.0.1")
+	os.Setenv("WHITELIST_WEBHOOKS_DATABASE_MAX_AGE", "48h")
+	defer func() {
+		for _, name := range []string{"WHITELIST_PORT", "WHITELIST_RATE_LIMIT_BURST", "WHITELIST_TRUSTED_PROXIES", "WHITELIST_WEBHOOKS_DATABASE_MAX_AGE"} {
+			os.Unsetenv(name)
+		}
+	}()
+
+	config, err := loadConfig([]string{"-config", path})
+	if !suite.NoError(err, "was expecting no error, returned %v", err) {
+		Log(log.InfoLevel, fmt.Sprintf("was expecting no error, returned %v", err), true)
+	}
+	suite.Equal("9090", config.Port)
+	suite.Equal(20, config.RateLimit.Burst)
+	suite.Equal([]string{"10.0.0.0/8", "192.168.0.1"}, config.TrustedProxies)
+	suite.Equal(48*time.Hour, config.Webhooks.DatabaseMaxAge)
+
+	config, err = loadConfig([]string{"-config", path, "-port", "7070", "-rate-limit-burst", "1", "-proxy-protocol", "true"})
+	suite.NoError(err)
+	suite.Equal("7070", config.Port, "was expecting the flag to override the environment")
+	suite.Equal(1, config.RateLimit.Burst)
+	suite.True(config.ProxyProtocol)
+	suite.Equal(48*time.Hour, config.Webhooks.DatabaseMaxAge)
+}
+
+func (suite *ConfigSuite) TestValidateConfig() {
+	Log(log.InfoLevel, "====== Running TestValidateConfig ===========", true)
+	valid := defaultConfig
+	valid.DatabasePath = "./test-data/test-data.mmdb"
+	valid.CorrectionsPath = filepath.Join(suite.dir, "corrections.json")
+	valid.PoliciesPath = filepath.Join(suite.dir, "policies.json")
+	err := validateConfig(valid)
+	if !suite.NoError(err, "was expecting no error, returned %v", err) {
+		Log(log.InfoLevel, fmt.Sprintf("was expecting no error, returned %v", err), true)
+	}
+
+	tt := []struct {
+		testName string
+		modify   func(config *Config)
+		expected string
+	}{
+		{"Missing Port", func(config *Config) { config.Port = "" }, "port: is required"},
+		{"Invalid Port", func(config *Config) { config.Port = "http" }, "port: must be a number"},
+		{"Port Out Of Range", func(config *Config) { config.Port = "70000" }, "port: must be a number"},
+		{"Invalid Socket Mode", func(config *Config) { config.SocketPath = "./whitelist.sock"; config.SocketMode = "999" }, "socket mode: must be octal"},
+		{"Missing Socket Directory", func(config *Config) { config.SocketPath = "./missing/whitelist.sock" }, "socket path"},
+		{"Missing Log Path", func(config *Config) { config.LogPath = "" }, "log path: is required"},
+		{"Log Path Not A Directory", func(config *Config) { config.LogPath = "./config.yaml" }, "log path: ./config.yaml is not a directory"},
+		{"Missing Database", func(config *Config) { config.DatabasePath = "./test-data/missing.mmdb" }, "database path: stat ./test-data/missing.mmdb"},
+		{"Database Is Directory", func(config *Config) { config.DatabasePath = "./test-data" }, "database path: ./test-data is a directory"},
+		{"Forwarded Header", func(config *Config) { config.ForwardedHeader = "x-real-ip" }, "forwarded header: must be forwarded or xff"},
+		{"TLS Key Without Cert", func(config *Config) { config.TLSKeyPath = "./config.yaml" }, "must be set together"},
+		{"TLS Version", func(config *Config) { config.TLSMinVersion = "1.4" }, "tls min version"},
+		{"Missing API Keys", func(config *Config) { config.APIKeysPath = "./keys.json" }, "api keys path"},
+		{"Missing Policies Directory", func(config *Config) { config.PoliciesPath = "./missing/policies.json" }, "policies path"},
+		{"Negative Timeout", func(config *Config) { config.Server.WriteTimeout = -time.Second }, "server.write timeout: must not be negative"},
+		{"Negative Max Entries", func(config *Config) { config.Server.MaxEntries = -1 }, "server.max entries: must not be negative"},
+		{"Audit Segment Size", func(config *Config) { config.AuditMaxSegmentSize = 0 }, "audit max segment size"},
+	}
+	for _, tc := range tt {
+		config := valid
+		tc.modify(&config)
+		err := validateConfig(config)
+		if !suite.Error(err, "was expecting an error on %v, returned ok", tc.testName) {
+			Log(log.InfoLevel, fmt.Sprintf("was expecting an error on %v, returned ok", tc.testName), true)
+			continue
+		}
+		suite.Contains(err.Error(), tc.expected, "unexpected error on %v", tc.testName)
+	}
+
+	//a unix socket can replace the tcp port
+	socketOnly := valid
+	socketOnly.Port = ""
+	socketOnly.SocketPath = filepath.Join(suite.dir, "whitelist.sock")
+	suite.NoError(validateConfig(socketOnly))
+
+	//every problem is reported at once
+	invalid := valid
+	invalid.Port = ""
+	invalid.LogPath = ""
+	err = validateConfig(invalid)
+	suite.Contains(err.Error(), "port: is required")
+	suite.Contains(err.Error(), "log path: is required")
+}
+
+func (suite *ConfigSuite) TestPrintConfig() {
+	Log(log.InfoLevel, "====== Running TestPrintConfig ===========", true)
+	config := defaultConfig
+	config.Webhooks.Endpoints = []WebhookEndpoint{{URL: "https://hooks.example.com", Secret: "hunter2"}}
+	var out bytes.Buffer
+	printConfig(&out, config)
+
+	suite.Contains(out.String(), "port: \"8080\"\n")
+	suite.Contains(out.String(), "log path: \"./logs/\"\n")
+	suite.Contains(out.String(), "rate limit.burst: 0\n")
+	suite.Contains(out.String(), "webhooks.database max age: \"720h0m0s\"\n")
+	suite.Contains(out.String(), "https://hooks.example.com")
+	suite.NotContains(out.String(), "hunter2", "was expecting webhook secrets to be masked")
+	suite.Equal("hunter2", config.Webhooks.Endpoints[0].Secret, "was expecting the config to be left untouched")
+}
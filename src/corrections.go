@@ -0,0 +1,232 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	jsoniter "github.com/json-iterator/go"
+)
+
+//country data sources reported in responses
+const (
+	SourceMaxMind = "maxmind"
+	SourceOverlay = "overlay"
+)
+
+//Correction overrides the country for a network that GeoLite2 places in the wrong country until
+//the upstream data is fixed. name is filled in from the loaded database when it isn't passed. a
+//correction only applies to the checks and lookups of its tenant
+type Correction struct {
+	Network string     `json:"network"`
+	IsoCode string     `json:"iso_code"`
+	Name    string     `json:"name"`
+	Note    string     `json:"note"`
+	Expires *time.Time `json:"expires,omitempty"`
+	Tenant  string     `json:"tenant,omitempty"`
+
+	network *net.IPNet
+}
+
+//corrections is the overlay consulted by GetCountryData before the mmdb file. entries are kept
+//sorted from the longest prefix to the shortest so the first match is the most specific one
+var corrections = struct {
+	sync.RWMutex
+	path    string
+	entries []Correction
+}{}
+
+//setupCorrections loads the corrections file. a missing file is an empty overlay, it is created on
+//the first change made through the admin api. entries without a name get it from the loaded
+//provider, so the provider has to be loaded first
+func setupCorrections(path string) error {
+	var entries []Correction
+	data, err := os.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if len(data) > 0 {
+		if err := jsoniter.Unmarshal(data, &entries); err != nil {
+			return fmt.Errorf("failed to parse corrections file: %v", err)
+		}
+	}
+	for i := range entries {
+		if err := entries[i].parse(); err != nil {
+			return err
+		}
+		if err := entries[i].fillName(); err != nil {
+			return err
+		}
+	}
+	corrections.Lock()
+	defer corrections.Unlock()
+	corrections.path = path
+	corrections.entries = nil
+	for _, entry := range entries {
+		insertCorrection(entry)
+	}
+	return nil
+}
+
+//parse validates the correction and normalises its network and iso code
+func (c *Correction) parse() error {
+	_, network, err := net.ParseCIDR(strings.TrimSpace(c.Network))
+	if err != nil {
+		return fmt.Errorf("invalid correction network %q", c.Network)
+	}
+	c.IsoCode = strings.ToUpper(strings.TrimSpace(c.IsoCode))
+	if len(c.IsoCode) != 2 {
+		return fmt.Errorf("invalid correction iso code %q for %v", c.IsoCode, c.Network)
+	}
+	if c.Tenant != DefaultTenant && !policyNamePattern.MatchString(c.Tenant) {
+		return fmt.Errorf("invalid tenant name %q for correction %v", c.Tenant, c.Network)
+	}
+	c.network = network
+	c.Network = network.String()
+	return nil
+}
+
+//fillName sets the english name of the correction's country from the loaded provider when it
+//isn't set, so name entries match the correction the same as the country it stands in for
+func (c *Correction) fillName() error {
+	if c.Name != "" {
+		return nil
+	}
+	countries, err := KnownCountries()
+	if err != nil {
+		return err
+	}
+	country, ok := countries[c.IsoCode]
+	if !ok {
+		return fmt.Errorf("unknown country iso code %v", c.IsoCode)
+	}
+	c.Name = country.Name
+	return nil
+}
+
+//expired reports whether the correction no longer applies
+func (c Correction) expired(now time.Time) bool {
+	return c.Expires != nil && now.After(*c.Expires)
+}
+
+//insertCorrection replaces any entry of the same tenant for the same network and keeps the longest
+//prefix first. callers must hold the write lock
+func insertCorrection(correction Correction) {
+	ones, _ := correction.network.Mask.Size()
+	entries := corrections.entries[:0:0]
+	inserted := false
+	for _, entry := range corrections.entries {
+		if entry.Network == correction.Network && entry.Tenant == correction.Tenant {
+			continue
+		}
+		if entryOnes, _ := entry.network.Mask.Size(); !inserted && ones > entryOnes {
+			entries = append(entries, correction)
+			inserted = true
+		}
+		entries = append(entries, entry)
+	}
+	if !inserted {
+		entries = append(entries, correction)
+	}
+	corrections.entries = entries
+}
+
+//findCorrection returns the tenant's most specific unexpired correction containing the ip
+func findCorrection(tenant string, ip net.IP) (Correction, bool) {
+	corrections.RLock()
+	defer corrections.RUnlock()
+	now := time.Now()
+	for _, entry := range corrections.entries {
+		if entry.Tenant == tenant && entry.network.Contains(ip) && !entry.expired(now) {
+			return entry, true
+		}
+	}
+	return Correction{}, false
+}
+
+//ListCorrections returns every correction of the tenant, including expired ones, most specific first
+func ListCorrections(tenant string) []Correction {
+	corrections.RLock()
+	defer corrections.RUnlock()
+	list := []Correction{}
+	for _, entry := range corrections.entries {
+		if entry.Tenant == tenant {
+			list = append(list, entry)
+		}
+	}
+	return list
+}
+
+//AddCorrection validates and stores a correction, replacing any existing one of its tenant for the
+//same network. adding one for a new network fails with a QuotaError when the tenant has no room left
+func AddCorrection(correction Correction) (Correction, error) {
+	if err := correction.parse(); err != nil {
+		return correction, err
+	}
+	if err := correction.fillName(); err != nil {
+		return correction, err
+	}
+	corrections.Lock()
+	defer corrections.Unlock()
+	count, replaces := 0, false
+	for _, entry := range corrections.entries {
+		if entry.Tenant == correction.Tenant {
+			count++
+			replaces = replaces || entry.Network == correction.Network
+		}
+	}
+	if !replaces {
+		if err := checkTenantQuota(correction.Tenant, "corrections", count); err != nil {
+			return correction, err
+		}
+	}
+	previous := corrections.entries
+	insertCorrection(correction)
+	if err := saveCorrections(); err != nil {
+		corrections.entries = previous
+		return correction, err
+	}
+	return correction, nil
+}
+
+//RemoveCorrection deletes the tenant's correction for a network
+func RemoveCorrection(tenant string, network string) error {
+	_, parsed, err := net.ParseCIDR(strings.TrimSpace(network))
+	if err != nil {
+		return fmt.Errorf("invalid correction network %q", network)
+	}
+	corrections.Lock()
+	defer corrections.Unlock()
+	for i, entry := range corrections.entries {
+		if entry.Network == parsed.String() && entry.Tenant == tenant {
+			previous := corrections.entries
+			corrections.entries = append(corrections.entries[:i:i], corrections.entries[i+1:]...)
+			if err := saveCorrections(); err != nil {
+				corrections.entries = previous
+				return err
+			}
+			return nil
+		}
+	}
+	return fmt.Errorf("no correction found for %v", parsed)
+}
+
+//saveCorrections writes the overlay back to its file through a temp file so a crash can't leave it
+//half written. callers must hold the write lock
+func saveCorrections() error {
+	if corrections.path == "" {
+		return fmt.Errorf("no corrections path configured")
+	}
+	data, err := jsoniter.MarshalIndent(corrections.entries, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := corrections.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, corrections.path)
+}
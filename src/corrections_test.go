@@ -0,0 +1,167 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/suite"
+)
+
+func TestCorrectionsSuite(t *testing.T) {
+	correctionsSuite := new(CorrectionsSuite)
+	suite.Run(t, correctionsSuite)
+}
+
+type CorrectionsSuite struct {
+	suite.Suite
+	dir string
+}
+
+func (suite *CorrectionsSuite) SetupSuite() {
+	setLogPath("./logs/")
+	Log(log.InfoLevel, "=============== Running Corrections Suite ======================", true)
+	setupDB("./test-data/test-data.mmdb")
+	suite.dir, _ = os.MkdirTemp("", "corrections-test")
+}
+
+func (suite *CorrectionsSuite) SetupTest() {
+	os.Remove(filepath.Join(suite.dir, "corrections.json"))
+	setupCorrections(filepath.Join(suite.dir, "corrections.json"))
+}
+
+func (suite *CorrectionsSuite) TearDownSuite() {
+	setupCorrections("")
+	os.RemoveAll(suite.dir)
+	testProvider().Close()
+	Log(log.InfoLevel, "========== Corrections Testsuite completed ===========", true)
+	fmt.Println("========== Corrections Testsuite completed ===========")
+}
+
+func (suite *CorrectionsSuite) TestSetupCorrections() {
+	Log(log.InfoLevel, "====== Running TestSetupCorrections ===========", true)
+	path := filepath.Join(suite.dir, "load.json")
+	os.WriteFile(path, []byte(`[
+		{"network": "1.207.0.0/16", "iso_code": "us", "name": "United States", "note": "ticket 12"},
+		{"network": "1.207.235.0/24", "iso_code": "CA", "name": "Canada"},
+		{"network": "1.0.16.0/20", "iso_code": "de"}
+	]`), 0644)
+	err := setupCorrections(path)
+	if !suite.NoError(err, "was expecting no error, returned %v", err) {
+		Log(log.InfoLevel, fmt.Sprintf("was expecting no error, returned %v", err), true)
+	}
+	list := ListCorrections(DefaultTenant)
+	if suite.Len(list, 3) {
+		suite.Equal("1.207.235.0/24", list[0].Network, "was expecting the most specific network first")
+		suite.Equal("Germany", list[1].Name, "was expecting the name to be filled in from the database")
+		suite.Equal("US", list[2].IsoCode)
+	}
+	//a name entry matches a correction loaded from the file without a name
+	country, err := GetCountryData("1.0.16.1")
+	suite.NoError(err)
+	suite.Equal(Country{Name: "Germany", IsoCode: "DE", Source: SourceOverlay}, country)
+	allowed, err := CheckRules("1.0.16.1", []string{"Germany"}, nil)
+	suite.NoError(err)
+	suite.True(allowed, "was expecting the Germany entry to match the file correction")
+
+	invalid := filepath.Join(suite.dir, "invalid.json")
+	os.WriteFile(invalid, []byte(`[{"network": "not a network", "iso_code": "US"}]`), 0644)
+	unknown := filepath.Join(suite.dir, "unknown.json")
+	os.WriteFile(unknown, []byte(`[{"network": "1.0.16.0/20", "iso_code": "ZZ"}]`), 0644)
+	tt := []struct {
+		testName string
+		path     string
+	}{
+		{"Invalid Network", invalid},
+		{"Unknown Iso Code", unknown},
+		{"Unreadable Path", suite.dir},
+	}
+	for _, tc := range tt {
+		err := setupCorrections(tc.path)
+		if !suite.Error(err, "was expecting an error on %v, returned ok", tc.testName) {
+			Log(log.InfoLevel, fmt.Sprintf("was expecting an error on %v, returned ok", tc.testName), true)
+		}
+	}
+}
+
+//TestLongestPrefix validates the most specific unexpired correction overrides the database
+func (suite *CorrectionsSuite) TestLongestPrefix() {
+	Log(log.InfoLevel, "====== Running TestLongestPrefix ===========", true)
+	past := time.Now().Add(-time.Hour)
+	for _, correction := range []Correction{
+		{Network: "1.207.0.0/16", IsoCode: "US"},
+		{Network: "1.207.235.0/24", IsoCode: "CA"},
+		{Network: "1.207.235.255/32", IsoCode: "MX", Expires: &past},
+	} {
+		_, err := AddCorrection(correction)
+		if !suite.NoError(err, "was expecting no error, returned %v", err) {
+			Log(log.InfoLevel, fmt.Sprintf("was expecting no error, returned %v", err), true)
+		}
+	}
+
+	tt := []struct {
+		testName string
+		ip       string
+		expected Country
+	}{
+		{"Most Specific Wins Over Expired", "1.207.235.255", Country{Name: "Canada", IsoCode: "CA", Source: SourceOverlay}},
+		{"Shorter Prefix", "1.207.1.1", Country{Name: "United States", IsoCode: "US", Source: SourceOverlay}},
+		{"No Correction", "1.0.1.1", Country{Name: "China", IsoCode: "CN", Source: SourceMaxMind}},
+	}
+	for _, tc := range tt {
+		country, err := GetCountryData(tc.ip)
+		suite.NoError(err)
+		if !suite.Equal(tc.expected, country, "unexpected country on %v", tc.testName) {
+			Log(log.InfoLevel, fmt.Sprintf("was expecting %v, received %v on %v", tc.expected, country, tc.testName), true)
+		}
+	}
+
+	_, found := findCorrection(DefaultTenant, net.ParseIP("2001:db8::1"))
+	suite.False(found)
+}
+
+func (suite *CorrectionsSuite) TestAddRemoveCorrection() {
+	Log(log.InfoLevel, "====== Running TestAddRemoveCorrection ===========", true)
+	tt := []struct {
+		testName   string
+		correction Correction
+		expectErr  bool
+	}{
+		{"Valid", Correction{Network: "8.8.8.0/24", IsoCode: "de", Note: "moved"}, false},
+		{"Replace Same Network", Correction{Network: "8.8.8.10/24", IsoCode: "FR"}, false},
+		{"Invalid Network", Correction{Network: "8.8.8.8", IsoCode: "DE"}, true},
+		{"Invalid ISO Code", Correction{Network: "8.8.8.0/24", IsoCode: "GER"}, true},
+		{"Unknown ISO Code", Correction{Network: "8.8.8.0/24", IsoCode: "ZZ"}, true},
+	}
+	for _, tc := range tt {
+		_, err := AddCorrection(tc.correction)
+		if tc.expectErr {
+			if !suite.Error(err, "was expecting an error on %v, returned ok", tc.testName) {
+				Log(log.InfoLevel, fmt.Sprintf("was expecting an error on %v, returned ok", tc.testName), true)
+			}
+			continue
+		}
+		suite.NoError(err, "was expecting no error on %v, returned %v", tc.testName, err)
+	}
+
+	list := ListCorrections(DefaultTenant)
+	if suite.Len(list, 1) {
+		suite.Equal(Correction{Network: "8.8.8.0/24", IsoCode: "FR", Name: "France", network: list[0].network}, list[0])
+	}
+
+	//changes are persisted and survive a reload
+	setupCorrections(filepath.Join(suite.dir, "corrections.json"))
+	suite.Len(ListCorrections(DefaultTenant), 1)
+
+	err := RemoveCorrection(DefaultTenant, "8.8.8.0/24")
+	suite.NoError(err)
+	suite.Len(ListCorrections(DefaultTenant), 0)
+	err = RemoveCorrection(DefaultTenant, "8.8.8.0/24")
+	if !suite.Error(err, "was expecting an error removing a missing correction, returned ok") {
+		Log(log.InfoLevel, "was expecting an error removing a missing correction, returned ok", true)
+	}
+}
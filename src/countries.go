@@ -0,0 +1,11 @@
+package main
+
+//KnownCountries returns every country present in the loaded provider keyed by iso code. the index is
+//built when the provider is loaded, callers must not change it
+func KnownCountries() (map[string]Country, error) {
+	database, err := loadedDatabase()
+	if err != nil {
+		return nil, err
+	}
+	return database.networks.known, nil
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+//unknown entries modes. reject answers a request with unknown entries with a 400, warn goes ahead
+//and returns the unknown entries as warnings
+const (
+	UnknownEntriesReject = "reject"
+	UnknownEntriesWarn   = "warn"
+)
+
+//maxSuggestions is the most countries suggested for an unknown entry
+const maxSuggestions = 3
+
+//UnknownEntry is a whitelist/blacklist entry that doesn't name a country in the loaded database,
+//with the countries it is closest to. field is the request body field it was found in
+type UnknownEntry struct {
+	Field       string   `json:"field"`
+	Entry       string   `json:"entry"`
+	Suggestions []string `json:"suggestions,omitempty"`
+}
+
+//entryList is a list of entries to check, with the format of the request body field of each entry
+//given the index of the entry, e.g. "whitelist[%v]"
+type entryList struct {
+	field   string
+	entries []string
+}
+
+//UnknownEntriesError rejects a request with unknown entries
+type UnknownEntriesError struct {
+	Entries []UnknownEntry
+}
+
+func (e *UnknownEntriesError) Error() string {
+	described := make([]string, len(e.Entries))
+	for i, unknown := range e.Entries {
+		described[i] = fmt.Sprintf("%v %q", unknown.Field, unknown.Entry)
+		if len(unknown.Suggestions) > 0 {
+			described[i] += fmt.Sprintf(" (did you mean %v?)", strings.Join(unknown.Suggestions, ", "))
+		}
+	}
+	return fmt.Sprintf("unknown countries: %v", strings.Join(described, ", "))
+}
+
+//checkUnknownEntries finds the entries of the lists that don't name a known country. in warn mode,
+//or when the request has a true lenient query value, they are returned as warnings, otherwise as an
+//UnknownEntriesError
+func checkUnknownEntries(r *http.Request, lists ...entryList) ([]UnknownEntry, error) {
+	var unknown []UnknownEntry
+	for _, list := range lists {
+		unknown = append(unknown, findUnknownEntries(list)...)
+	}
+	if len(unknown) == 0 {
+		return nil, nil
+	}
+	lenient, _ := strconv.ParseBool(r.URL.Query().Get("lenient"))
+	if requestRuntime(r).unknownEntries == UnknownEntriesWarn || lenient {
+		return unknown, nil
+	}
+	return nil, &UnknownEntriesError{Entries: unknown}
+}
+
+//findUnknownEntries returns the entries that are neither a country name in the loaded database, an
+//alias or iso code of one, nor an asn entry with a valid number. nothing is reported when no database is loaded
+func findUnknownEntries(list entryList) []UnknownEntry {
+	countries, err := KnownCountries()
+	if err != nil {
+		return nil
+	}
+	var unknown []UnknownEntry
+	for i, entry := range list.entries {
+		if knownEntry(entry, countries) {
+			continue
+		}
+		unknown = append(unknown, UnknownEntry{Field: fmt.Sprintf(list.field, i), Entry: entry,
+			Suggestions: suggestCountries(entry, countries)})
+	}
+	return unknown
+}
+
+//knownEntry reports whether an entry would match a country of the loaded database, the same way
+//matchEntry compares them
+func knownEntry(entry string, countries map[string]Country) bool {
+	if _, ok, err := parseASNEntry(entry); ok {
+		return err == nil
+	}
+	if iso, ok := resolveCountryAlias(entry); ok {
+		_, known := countries[iso]
+		return known
+	}
+	for _, country := range countries {
+		if strings.EqualFold(entry, country.Name) {
+			return true
+		}
+	}
+	return false
+}
+
+//suggestCountries returns the names of the countries whose name or alias is within a few edits of
+//the entry, closest first
+func suggestCountries(entry string, countries map[string]Country) []string {
+	target := normaliseAlias(entry)
+	//a quarter of the entry's length is allowed to differ, so short entries only match close typos
+	maxDistance := len([]rune(target))/4 + 1
+	distances := map[string]int{}
+	consider := func(candidate string, name string) {
+		distance := editDistance(target, normaliseAlias(candidate))
+		if previous, ok := distances[name]; distance <= maxDistance && (!ok || distance < previous) {
+			distances[name] = distance
+		}
+	}
+	for _, country := range countries {
+		consider(country.Name, country.Name)
+	}
+	countryAliases.RLock()
+	for alias, iso := range countryAliases.entries {
+		if country, ok := countries[iso]; ok {
+			consider(alias, country.Name)
+		}
+	}
+	countryAliases.RUnlock()
+
+	var suggestions []string
+	for name := range distances {
+		suggestions = append(suggestions, name)
+	}
+	sort.Slice(suggestions, func(i, j int) bool {
+		if distances[suggestions[i]] != distances[suggestions[j]] {
+			return distances[suggestions[i]] < distances[suggestions[j]]
+		}
+		return suggestions[i] < suggestions[j]
+	})
+	if len(suggestions) > maxSuggestions {
+		suggestions = suggestions[:maxSuggestions]
+	}
+	return suggestions
+}
+
+//editDistance is the levenshtein distance between two strings, counted in runes
+func editDistance(a string, b string) int {
+	source, target := []rune(a), []rune(b)
+	previous := make([]int, len(target)+1)
+	current := make([]int, len(target)+1)
+	for j := range previous {
+		previous[j] = j
+	}
+	for i := 1; i <= len(source); i++ {
+		current[0] = i
+		for j := 1; j <= len(target); j++ {
+			cost := 1
+			if source[i-1] == target[j-1] {
+				cost = 0
+			}
+			current[j] = previous[j-1] + cost
+			if previous[j]+1 < current[j] {
+				current[j] = previous[j] + 1
+			}
+			if current[j-1]+1 < current[j] {
+				current[j] = current[j-1] + 1
+			}
+		}
+		previous, current = current, previous
+	}
+	return previous[len(target)]
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/suite"
+)
+
+func TestEntriesSuite(t *testing.T) {
+	entriesSuite := new(EntriesSuite)
+	suite.Run(t, entriesSuite)
+}
+
+type EntriesSuite struct {
+	suite.Suite
+	dir string
+}
+
+func (suite *EntriesSuite) SetupSuite() {
+	setLogPath("./logs/")
+	Log(log.InfoLevel, "=============== Running Entries Suite ======================", true)
+	setupDB("./test-data/test-data.mmdb")
+	suite.dir, _ = os.MkdirTemp("", "entries-test")
+}
+
+func (suite *EntriesSuite) SetupTest() {
+	os.Remove(filepath.Join(suite.dir, "policies.json"))
+	setupPolicies(filepath.Join(suite.dir, "policies.json"))
+	updateRuntime(func(state *runtimeState) { state.unknownEntries = UnknownEntriesReject })
+	recentDecisions.tenants = map[string]*decisionRing{}
+}
+
+func (suite *EntriesSuite) TearDownSuite() {
+	updateRuntime(func(state *runtimeState) { state.unknownEntries = defaultConfig.UnknownEntries })
+	setupPolicies("")
+	compiling.Wait()
+	testProvider().Close()
+	os.RemoveAll(suite.dir)
+	Log(log.InfoLevel, "========== Entries Testsuite completed ===========", true)
+	fmt.Println("========== Entries Testsuite completed ===========")
+}
+
+func (suite *EntriesSuite) TestFindUnknownEntries() {
+	Log(log.InfoLevel, "====== Running TestFindUnknownEntries ===========", true)
+	tt := []struct {
+		testName    string
+		entry       string
+		unknown     bool
+		suggestions []string
+	}{
+		{"Country Name", "brazil", false, nil},
+		{"ISO Code", "BR", false, nil},
+		{"Alias", "U.S.A.", false, nil},
+		{"ASN", "asn:13335", false, nil},
+		{"Malformed ASN", "asn:cloudflare", true, nil},
+		{"ASN Out Of Range", "ASN:4294967296", true, nil},
+		{"Typo", "Brasil", true, []string{"Brazil"}},
+		{"Typo Of An Alias", "Burmaa", true, []string{"Myanmar"}},
+		{"Unknown ISO Code", "ZZ", true, nil},
+		{"Nothing Close", "Atlantis", true, nil},
+	}
+	for _, tc := range tt {
+		unknown := findUnknownEntries(entryList{"whitelist[%v]", []string{tc.entry}})
+		if !tc.unknown {
+			if !suite.Empty(unknown, "was expecting %v to be known on %v", tc.entry, tc.testName) {
+				Log(log.InfoLevel, fmt.Sprintf("was expecting %v to be known on %v", tc.entry, tc.testName), true)
+			}
+			continue
+		}
+		if suite.Len(unknown, 1, "was expecting %v to be unknown on %v", tc.entry, tc.testName) {
+			suite.Equal(UnknownEntry{Field: "whitelist[0]", Entry: tc.entry, Suggestions: tc.suggestions}, unknown[0],
+				"unexpected unknown entry on %v", tc.testName)
+		}
+	}
+}
+
+func (suite *EntriesSuite) TestEditDistance() {
+	Log(log.InfoLevel, "====== Running TestEditDistance ===========", true)
+	suite.Equal(0, editDistance("BRAZIL", "BRAZIL"))
+	suite.Equal(1, editDistance("BRASIL", "BRAZIL"))
+	suite.Equal(2, editDistance("CHNIA", "CHINA"))
+	suite.Equal(3, editDistance("", "USA"))
+	suite.Equal(1, editDistance("TÜRKIYE", "TURKIYE"), "distances should be counted in runes")
+}
+
+func (suite *EntriesSuite) TestCheckRejectsUnknownEntries() {
+	Log(log.InfoLevel, "====== Running TestCheckRejectsUnknownEntries ===========", true)
+	body := `{"whitelisted_countries": ["China", "Brasil"], "blacklisted_countries": ["Atlantis"]}`
+
+	var response ResponseStruct
+	status := serveJSON(http.MethodGet, "/checkWhitelist/1.207.235.255", body, &response)
+	if !suite.Equal(http.StatusBadRequest, status, "was expecting status 400, received %v", status) {
+		Log(log.InfoLevel, fmt.Sprintf("was expecting status 400, received %v", status), true)
+	}
+	expected := []UnknownEntry{
+		{Field: "whitelisted_countries[1]", Entry: "Brasil", Suggestions: []string{"Brazil"}},
+		{Field: "blacklisted_countries[0]", Entry: "Atlantis"},
+	}
+	suite.Equal(expected, response.UnknownEntries)
+	suite.Contains(response.Response, `whitelisted_countries[1] "Brasil" (did you mean Brazil?)`)
+	suite.Empty(RecentDecisions(DefaultTenant, 1), "a rejected check shouldn't be decided")
+
+	tt := []struct {
+		testName string
+		path     string
+		mode     string
+	}{
+		{"Lenient Query", "/checkWhitelist/1.207.235.255?lenient=true", UnknownEntriesReject},
+		{"Warn Mode", "/checkWhitelist/1.207.235.255", UnknownEntriesWarn},
+	}
+	for _, tc := range tt {
+		updateRuntime(func(state *runtimeState) { state.unknownEntries = tc.mode })
+		response = ResponseStruct{}
+		status := serveJSON(http.MethodGet, tc.path, body, &response)
+		if !suite.Equal(http.StatusOK, status, "was expecting status 200 on %v, received %v", tc.testName, status) {
+			Log(log.InfoLevel, fmt.Sprintf("was expecting status 200 on %v, received %v", tc.testName, status), true)
+		}
+		suite.Equal("whitelisted", response.Response, "unexpected response on %v", tc.testName)
+		suite.Equal(expected, response.Warnings, "unexpected warnings on %v", tc.testName)
+		suite.Empty(response.UnknownEntries)
+	}
+}
+
+func (suite *EntriesSuite) TestPolicyRejectsUnknownEntries() {
+	Log(log.InfoLevel, "====== Running TestPolicyRejectsUnknownEntries ===========", true)
+	body := `{"whitelist": ["japan"], "schedules": [{"list": "blacklist", "entry": "Chna", "cron": "0 9 * * *", "duration": "1h"}]}`
+	expected := []UnknownEntry{{Field: "schedules[0].entry", Entry: "Chna", Suggestions: []string{"China", "Chad", "Cuba"}}}
+
+	var response ResponseStruct
+	status := serveJSON(http.MethodPut, "/admin/policies/asia", body, &response)
+	suite.Equal(http.StatusBadRequest, status)
+	suite.Equal(expected, response.UnknownEntries)
+	_, ok := GetPolicy(DefaultTenant, "asia")
+	suite.False(ok, "a policy with unknown entries shouldn't be saved")
+
+	var saved SavedPolicy
+	status = serveJSON(http.MethodPut, "/admin/policies/asia?lenient=true", body, &saved)
+	suite.Equal(http.StatusOK, status)
+	suite.Equal(1, saved.Version)
+	suite.Equal(expected, saved.Warnings)
+
+	saved = SavedPolicy{}
+	serveJSON(http.MethodPut, "/admin/policies/asia", `{"whitelist": ["japan", "cn"]}`, &saved)
+	suite.Equal(2, saved.Version)
+	suite.Empty(saved.Warnings)
+}
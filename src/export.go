@@ -0,0 +1,313 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net/http"
+	"net/netip"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+//export formats
+const (
+	ExportCIDR     = "cidr"
+	ExportHAProxy  = "haproxy"
+	ExportIPSet    = "ipset"
+	ExportNftables = "nftables"
+	ExportNginx    = "nginx"
+)
+
+//exportTable is the nftables table the exported sets are declared in
+const exportTable = "whitelist"
+
+//maxIPSetName is the longest name ipset accepts for a set
+const maxIPSetName = 31
+
+//PolicyExport is the smallest set of networks that covers exactly the addresses a policy allows,
+//split by family. build epoch is the database the networks were collected from
+type PolicyExport struct {
+	Policy     Policy
+	BuildEpoch uint
+	Generated  time.Time
+	IPv4       []netip.Prefix
+	IPv6       []netip.Prefix
+}
+
+//exportRenderers write an export in each format
+var exportRenderers = map[string]func(io.Writer, PolicyExport) error{
+	ExportCIDR:     renderCIDR,
+	ExportHAProxy:  renderHAProxy,
+	ExportIPSet:    renderIPSet,
+	ExportNftables: renderNftables,
+	ExportNginx:    renderNginx,
+}
+
+//ExportFormats returns the names of the export formats, sorted
+func ExportFormats() []string {
+	formats := make([]string, 0, len(exportRenderers))
+	for format := range exportRenderers {
+		formats = append(formats, format)
+	}
+	sort.Strings(formats)
+	return formats
+}
+
+//checkExportFormat rejects a format there is no renderer for
+func checkExportFormat(format string) error {
+	if _, ok := exportRenderers[format]; !ok {
+		return fmt.Errorf("unknown export format %q, expected one of %v", format, strings.Join(ExportFormats(), ", "))
+	}
+	return nil
+}
+
+//checkExportable rejects policies with asn entries, scheduled ones included, since the networks of an
+//asn aren't in the country database
+func checkExportable(policy Policy) error {
+	if hasASNEntry(policy.allEntries()) {
+		return fmt.Errorf("policies with asn entries can't be exported")
+	}
+	return nil
+}
+
+//ExportPolicy walks every network of the database, decides it against the entries of the policy
+//active now, with its tenant's corrections applied, and aggregates the allowed networks. networks
+//without a country are never allowed
+func ExportPolicy(policy Policy) (PolicyExport, error) {
+	if err := checkExportable(policy); err != nil {
+		return PolicyExport{}, err
+	}
+	whitelist, blacklist := policy.activeEntries(Clock())
+	provider, err := loadedProvider()
+	if err != nil {
+		return PolicyExport{}, err
+	}
+	ranges, err := databaseRanges(provider, policy.Tenant)
+	if err != nil {
+		return PolicyExport{}, err
+	}
+	info, err := provider.Info()
+	if err != nil {
+		return PolicyExport{}, err
+	}
+	export := PolicyExport{Policy: policy, BuildEpoch: info.BuildEpoch, Generated: time.Now().UTC()}
+	decisions := map[Country]bool{}
+	var allowed []addrRange
+	for _, r := range ranges {
+		decision, ok := decisions[r.country]
+		if !ok {
+			decision, err = decide(whitelist, blacklist, r.country, ASN{})
+			if err != nil {
+				return PolicyExport{}, err
+			}
+			decisions[r.country] = decision
+		}
+		if !decision {
+			continue
+		}
+		//neighbouring allowed networks are merged so they aggregate across countries
+		if n := len(allowed); n > 0 && allowed[n-1].last.Next() == r.first {
+			allowed[n-1].last = r.last
+			continue
+		}
+		allowed = append(allowed, r)
+	}
+	for _, r := range allowed {
+		for _, prefix := range rangePrefixes(r.first, r.last) {
+			if prefix.Addr().Is4() {
+				export.IPv4 = append(export.IPv4, prefix)
+			} else {
+				export.IPv6 = append(export.IPv6, prefix)
+			}
+		}
+	}
+	return export, nil
+}
+
+//databaseRanges returns the country of every network of the provider with the tenant's corrections
+//painted over them, in address order. IPv4 networks are in their IPv4 form, not the ::/96 subtree
+//an IPv6 database keeps them in
+func databaseRanges(provider LocationProvider, tenant string) ([]addrRange, error) {
+	var ranges []addrRange
+	err := provider.Networks(netip.Prefix{}, func(network netip.Prefix, country Country) error {
+		ranges = append(ranges, addrRange{first: network.Addr(), last: lastAddr(network), country: country})
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(ranges, func(i, j int) bool { return ranges[i].first.Less(ranges[j].first) })
+
+	now := time.Now()
+	corrections := ListCorrections(tenant)
+	//corrections are listed most specific first, so they are painted in reverse
+	for i := len(corrections) - 1; i >= 0; i-- {
+		correction := corrections[i]
+		network, err := netip.ParsePrefix(correction.Network)
+		if err != nil || correction.expired(now) {
+			continue
+		}
+		ranges = paintRange(ranges, addrRange{first: network.Masked().Addr(), last: lastAddr(network),
+			country: Country{Name: correction.Name, IsoCode: correction.IsoCode, Source: SourceOverlay}})
+	}
+	return ranges, nil
+}
+
+//RenderExport writes an export in a format
+func RenderExport(w io.Writer, export PolicyExport, format string) error {
+	if err := checkExportFormat(format); err != nil {
+		return err
+	}
+	render := exportRenderers[format]
+	buffered := bufio.NewWriter(w)
+	if err := render(buffered, export); err != nil {
+		return err
+	}
+	return buffered.Flush()
+}
+
+//exportName is the name of the policy in identifiers of the rendered configs, which don't allow dashes
+func exportName(export PolicyExport) string {
+	return strings.ReplaceAll(export.Policy.Name, "-", "_")
+}
+
+//exportHeader writes a comment describing where the export came from, for formats that allow comments
+func exportHeader(w io.Writer, export PolicyExport) {
+	fmt.Fprintf(w, "# networks allowed by policy %v version %v", export.Policy.Name, export.Policy.Version)
+	if export.Policy.Tenant != DefaultTenant {
+		fmt.Fprintf(w, " of tenant %v", export.Policy.Tenant)
+	}
+	fmt.Fprintf(w, "\n# database build epoch %v, generated %v\n", export.BuildEpoch, export.Generated.Format(time.RFC3339))
+}
+
+//exportPrefixes returns the IPv4 networks of an export followed by the IPv6 ones
+func exportPrefixes(export PolicyExport) []netip.Prefix {
+	return append(append([]netip.Prefix{}, export.IPv4...), export.IPv6...)
+}
+
+//renderCIDR writes one network per line
+func renderCIDR(w io.Writer, export PolicyExport) error {
+	for _, prefix := range exportPrefixes(export) {
+		fmt.Fprintln(w, prefix)
+	}
+	return nil
+}
+
+//renderHAProxy writes an acl file, e.g. for acl allowed src -f policy.acl
+func renderHAProxy(w io.Writer, export PolicyExport) error {
+	exportHeader(w, export)
+	return renderCIDR(w, export)
+}
+
+//renderNginx writes a geo block setting $whitelist_<policy> to 1 for allowed clients and 0 otherwise
+func renderNginx(w io.Writer, export PolicyExport) error {
+	exportHeader(w, export)
+	fmt.Fprintf(w, "geo $whitelist_%v {\n\tdefault 0;\n", exportName(export))
+	for _, prefix := range exportPrefixes(export) {
+		fmt.Fprintf(w, "\t%v 1;\n", prefix)
+	}
+	fmt.Fprintln(w, "}")
+	return nil
+}
+
+//renderNftables writes an interval set per family in the inet whitelist table. the sets are flushed
+//before the elements are added, so loading the file again with nft -f replaces them
+func renderNftables(w io.Writer, export PolicyExport) error {
+	exportHeader(w, export)
+	sets := []struct {
+		suffix   string
+		kind     string
+		prefixes []netip.Prefix
+	}{{"v4", "ipv4_addr", export.IPv4}, {"v6", "ipv6_addr", export.IPv6}}
+	fmt.Fprintf(w, "table inet %v {\n", exportTable)
+	for _, set := range sets {
+		fmt.Fprintf(w, "\tset %v_%v {\n\t\ttype %v\n\t\tflags interval\n\t}\n", exportName(export), set.suffix, set.kind)
+	}
+	fmt.Fprintln(w, "}")
+	for _, set := range sets {
+		name := fmt.Sprintf("%v_%v", exportName(export), set.suffix)
+		fmt.Fprintf(w, "flush set inet %v %v\n", exportTable, name)
+		//nft rejects an empty element list
+		if len(set.prefixes) == 0 {
+			continue
+		}
+		fmt.Fprintf(w, "add element inet %v %v {\n", exportTable, name)
+		for i, prefix := range set.prefixes {
+			separator := ","
+			if i == len(set.prefixes)-1 {
+				separator = ""
+			}
+			fmt.Fprintf(w, "\t%v%v\n", prefix, separator)
+		}
+		fmt.Fprintln(w, "}")
+	}
+	return nil
+}
+
+//renderIPSet writes an ipset restore file with a hash:net set per family. the sets are created if
+//missing and flushed, so ipset restore can load the file again to replace them. restore files
+//can't hold comments, so there is no header
+func renderIPSet(w io.Writer, export PolicyExport) error {
+	sets := []struct {
+		suffix   string
+		family   string
+		prefixes []netip.Prefix
+	}{{"v4", "inet", export.IPv4}, {"v6", "inet6", export.IPv6}}
+	for _, set := range sets {
+		name := fmt.Sprintf("%v_%v", exportName(export), set.suffix)
+		if len(name) > maxIPSetName {
+			return fmt.Errorf("ipset set name %v is longer than %v characters", name, maxIPSetName)
+		}
+		//the default maximum of 65536 elements is raised for sets that need more
+		maxElements := 65536
+		if len(set.prefixes) > maxElements {
+			maxElements = len(set.prefixes)
+		}
+		fmt.Fprintf(w, "create %v hash:net family %v maxelem %v -exist\n", name, set.family, maxElements)
+		fmt.Fprintf(w, "flush %v\n", name)
+		for _, prefix := range set.prefixes {
+			fmt.Fprintf(w, "add %v %v\n", name, prefix)
+		}
+	}
+	return nil
+}
+
+//exportPolicyHandler renders the networks the caller's policy named in the path allows in the
+//format of the format query value, a plain cidr list by default
+func exportPolicyHandler(w http.ResponseWriter, r *http.Request) {
+	name := mux.Vars(r)["name"]
+	policy, ok := GetPolicy(RequestTenant(r), name)
+	if !ok {
+		respondError(w, r, http.StatusNotFound, fmt.Errorf("policy %v not found", name))
+		return
+	}
+	format := r.URL.Query().Get("format")
+	if format == "" {
+		format = ExportCIDR
+	}
+	err := checkExportFormat(format)
+	if err == nil {
+		err = checkExportable(policy)
+	}
+	if err != nil {
+		respondError(w, r, http.StatusBadRequest, err)
+		return
+	}
+	export, err := ExportPolicy(policy)
+	if err != nil {
+		respondError(w, r, http.StatusInternalServerError, err)
+		return
+	}
+	//rendered to a buffer first, so a failing render can still be answered with an error
+	var rendered strings.Builder
+	if err := RenderExport(&rendered, export, format); err != nil {
+		respondError(w, r, http.StatusBadRequest, err)
+		return
+	}
+	w.Header().Add("Content-Type", "text/plain; charset=utf-8")
+	io.WriteString(w, rendered.String())
+}
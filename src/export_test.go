@@ -0,0 +1,233 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/suite"
+)
+
+func TestExportSuite(t *testing.T) {
+	exportSuite := new(ExportSuite)
+	suite.Run(t, exportSuite)
+}
+
+type ExportSuite struct {
+	suite.Suite
+	dir string
+}
+
+func (suite *ExportSuite) SetupSuite() {
+	setLogPath("./logs/")
+	Log(log.InfoLevel, "=============== Running Export Suite ======================", true)
+	setupDB("./test-data/test-data.mmdb")
+	suite.dir, _ = os.MkdirTemp("", "export-test")
+}
+
+func (suite *ExportSuite) SetupTest() {
+	os.Remove(filepath.Join(suite.dir, "corrections.json"))
+	setupCorrections(filepath.Join(suite.dir, "corrections.json"))
+	os.Remove(filepath.Join(suite.dir, "policies.json"))
+	setupPolicies(filepath.Join(suite.dir, "policies.json"))
+}
+
+func (suite *ExportSuite) TearDownSuite() {
+	setupCorrections("")
+	setupPolicies("")
+	compiling.Wait()
+	testProvider().Close()
+	os.RemoveAll(suite.dir)
+	Log(log.InfoLevel, "========== Export Testsuite completed ===========", true)
+	fmt.Println("========== Export Testsuite completed ===========")
+}
+
+//exported returns the networks of an export in their cidr form
+func exported(export PolicyExport) []string {
+	return prefixStrings(exportPrefixes(export))
+}
+
+func (suite *ExportSuite) TestExportPolicy() {
+	Log(log.InfoLevel, "====== Running TestExportPolicy ===========", true)
+	tt := []struct {
+		testName  string
+		whitelist []string
+		blacklist []string
+		included  []string
+		excluded  []string
+	}{
+		{"Whitelist", []string{"Japan"}, nil, []string{"1.0.16.0/20", "1.0.64.0/18", "2001:200::/32"}, []string{"1.0.1.0/24", "2001:220::/32"}},
+		{"Neighbouring Countries Are Aggregated", []string{"Australia", "China"}, nil, []string{"1.0.0.0/20"}, []string{"1.0.0.0/24", "1.0.1.0/24", "1.0.16.0/20"}},
+		{"Blacklist", nil, []string{"Japan"}, []string{"1.0.0.0/20", "2001:220::/32"}, []string{"1.0.16.0/20", "2001:200::/32"}},
+	}
+	for _, tc := range tt {
+		export, err := ExportPolicy(Policy{Name: "edge", Version: 1, Whitelist: tc.whitelist, Blacklist: tc.blacklist})
+		if !suite.NoError(err, "was expecting no error on %v, returned %v", tc.testName, err) {
+			Log(log.InfoLevel, fmt.Sprintf("was expecting no error on %v, returned %v", tc.testName, err), true)
+			continue
+		}
+		networks := exported(export)
+		for _, network := range tc.included {
+			suite.Contains(networks, network, "was expecting %v to be exported on %v", network, tc.testName)
+		}
+		for _, network := range tc.excluded {
+			suite.NotContains(networks, network, "wasn't expecting %v to be exported on %v", network, tc.testName)
+		}
+		for _, prefix := range export.IPv4 {
+			suite.True(prefix.Addr().Is4(), "was expecting only IPv4 networks in the IPv4 list on %v, found %v", tc.testName, prefix)
+		}
+
+		//the set is minimal when no network overlaps or touches the next one in a way a shorter prefix could cover
+		prefixes := exportPrefixes(export)
+		for i := 1; i < len(prefixes); i++ {
+			previous, current := prefixes[i-1], prefixes[i]
+			suite.True(lastAddr(previous).Less(current.Addr()), "%v and %v overlap or are out of order on %v", previous, current, tc.testName)
+			if previous.Bits() == current.Bits() && previous.Bits() > 0 {
+				parent := netip.PrefixFrom(previous.Addr(), previous.Bits()-1).Masked()
+				suite.False(parent.Addr() == previous.Addr() && parent.Contains(current.Addr()),
+					"%v and %v should have been aggregated to %v on %v", previous, current, parent, tc.testName)
+			}
+		}
+	}
+}
+
+func (suite *ExportSuite) TestExportCorrections() {
+	Log(log.InfoLevel, "====== Running TestExportCorrections ===========", true)
+	_, err := AddCorrection(Correction{Network: "1.0.16.0/24", IsoCode: "AU", Name: "Australia"})
+	suite.NoError(err)
+	_, err = AddCorrection(Correction{Network: "1.0.0.0/24", IsoCode: "AU", Name: "Australia", Tenant: "acme"})
+	suite.NoError(err)
+
+	export, err := ExportPolicy(Policy{Name: "edge", Whitelist: []string{"Australia", "China"}})
+	suite.NoError(err)
+	networks := exported(export)
+	suite.Contains(networks, "1.0.0.0/20")
+	suite.Contains(networks, "1.0.16.0/24", "a corrected network should be exported with its corrected country")
+
+	export, _ = ExportPolicy(Policy{Name: "edge", Whitelist: []string{"Japan"}})
+	networks = exported(export)
+	suite.NotContains(networks, "1.0.16.0/20")
+	suite.Contains(networks, "1.0.17.0/24")
+
+	export, _ = ExportPolicy(Policy{Name: "edge", Tenant: "acme", Whitelist: []string{"Japan"}})
+	suite.Contains(exported(export), "1.0.16.0/20", "another tenant's corrections shouldn't apply")
+}
+
+func (suite *ExportSuite) TestExportRejectsASNEntries() {
+	Log(log.InfoLevel, "====== Running TestExportRejectsASNEntries ===========", true)
+	policies := []Policy{
+		{Name: "edge", Whitelist: []string{"Japan", "asn:13335"}},
+		{Name: "edge", Whitelist: []string{"Japan"}, Schedules: []ScheduledEntry{{List: "blacklist", Entry: "ASN:13335", Cron: "0 9 * * *", Duration: "1h"}}},
+	}
+	for _, policy := range policies {
+		_, err := ExportPolicy(policy)
+		if !suite.Error(err, "was expecting an error for %v", policy) {
+			Log(log.InfoLevel, fmt.Sprintf("was expecting an error for %v", policy), true)
+		}
+	}
+}
+
+func (suite *ExportSuite) TestRenderExport() {
+	Log(log.InfoLevel, "====== Running TestRenderExport ===========", true)
+	export := PolicyExport{
+		Policy:     Policy{Name: "edge-eu", Version: 3},
+		BuildEpoch: 1600000000,
+		Generated:  time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC),
+		IPv4:       []netip.Prefix{netip.MustParsePrefix("1.0.0.0/20"), netip.MustParsePrefix("2.0.0.0/8")},
+		IPv6:       []netip.Prefix{netip.MustParsePrefix("2001:200::/32")},
+	}
+	header := "# networks allowed by policy edge-eu version 3\n# database build epoch 1600000000, generated 2024-01-02T03:04:05Z\n"
+	tt := []struct {
+		format   string
+		rendered string
+	}{
+		{ExportCIDR, "1.0.0.0/20\n2.0.0.0/8\n2001:200::/32\n"},
+		{ExportHAProxy, header + "1.0.0.0/20\n2.0.0.0/8\n2001:200::/32\n"},
+		{ExportNginx, header + "geo $whitelist_edge_eu {\n\tdefault 0;\n\t1.0.0.0/20 1;\n\t2.0.0.0/8 1;\n\t2001:200::/32 1;\n}\n"},
+		{ExportNftables, header + "table inet whitelist {\n" +
+			"\tset edge_eu_v4 {\n\t\ttype ipv4_addr\n\t\tflags interval\n\t}\n" +
+			"\tset edge_eu_v6 {\n\t\ttype ipv6_addr\n\t\tflags interval\n\t}\n}\n" +
+			"flush set inet whitelist edge_eu_v4\nadd element inet whitelist edge_eu_v4 {\n\t1.0.0.0/20,\n\t2.0.0.0/8\n}\n" +
+			"flush set inet whitelist edge_eu_v6\nadd element inet whitelist edge_eu_v6 {\n\t2001:200::/32\n}\n"},
+		{ExportIPSet, "create edge_eu_v4 hash:net family inet maxelem 65536 -exist\nflush edge_eu_v4\nadd edge_eu_v4 1.0.0.0/20\nadd edge_eu_v4 2.0.0.0/8\n" +
+			"create edge_eu_v6 hash:net family inet6 maxelem 65536 -exist\nflush edge_eu_v6\nadd edge_eu_v6 2001:200::/32\n"},
+	}
+	for _, tc := range tt {
+		var rendered strings.Builder
+		err := RenderExport(&rendered, export, tc.format)
+		suite.NoError(err, "was expecting no error on %v, returned %v", tc.format, err)
+		if !suite.Equal(tc.rendered, rendered.String(), "unexpected %v export", tc.format) {
+			Log(log.InfoLevel, fmt.Sprintf("unexpected %v export: %v", tc.format, rendered.String()), true)
+		}
+	}
+
+	var rendered strings.Builder
+	export.IPv6 = nil
+	RenderExport(&rendered, export, ExportNftables)
+	suite.Contains(rendered.String(), "flush set inet whitelist edge_eu_v6\n")
+	suite.NotContains(rendered.String(), "add element inet whitelist edge_eu_v6", "nft rejects an empty element list")
+
+	suite.Error(RenderExport(&rendered, export, "iptables"), "was expecting an unknown format to be rejected")
+	export.Policy.Name = strings.Repeat("a", 29)
+	suite.Error(RenderExport(&rendered, export, ExportIPSet), "was expecting a set name longer than ipset allows to be rejected")
+}
+
+func (suite *ExportSuite) TestExportPolicyHandler() {
+	Log(log.InfoLevel, "====== Running TestExportPolicyHandler ===========", true)
+	SavePolicy(Policy{Name: "asia", Whitelist: []string{"Japan"}})
+	SavePolicy(Policy{Name: "networks", Whitelist: []string{"asn:13335"}})
+	tt := []struct {
+		testName string
+		path     string
+		status   int
+		contains string
+	}{
+		{"Default Format", "/admin/policies/asia/export", http.StatusOK, "\n1.0.64.0/18\n"},
+		{"Nginx", "/admin/policies/asia/export?format=nginx", http.StatusOK, "geo $whitelist_asia {"},
+		{"Unknown Format", "/admin/policies/asia/export?format=pf", http.StatusBadRequest, "unknown export format"},
+		{"ASN Entries", "/admin/policies/networks/export", http.StatusBadRequest, "asn entries"},
+		{"Unknown Policy", "/admin/policies/europe/export", http.StatusNotFound, "not found"},
+	}
+	for _, tc := range tt {
+		req := httptest.NewRequest(http.MethodGet, tc.path, nil)
+		rec := httptest.NewRecorder()
+		setupRouter().ServeHTTP(rec, req)
+		if !suite.Equal(tc.status, rec.Code, "was expecting status %v on %v, received %v", tc.status, tc.testName, rec.Code) {
+			Log(log.InfoLevel, fmt.Sprintf("was expecting status %v on %v, received %v", tc.status, tc.testName, rec.Code), true)
+		}
+		suite.Contains(rec.Body.String(), tc.contains, "unexpected body on %v", tc.testName)
+	}
+}
+
+func (suite *ExportSuite) TestExportCommand() {
+	Log(log.InfoLevel, "====== Running TestExportCommand ===========", true)
+	policiesPath := filepath.Join(suite.dir, "command-policies.json")
+	os.WriteFile(policiesPath, []byte(`[{"name": "asia", "version": 1, "whitelist": ["Japan"]},
+		{"name": "asia", "version": 1, "whitelist": ["China"], "tenant": "acme"}]`), 0644)
+	args := []string{"-config", "./config.yaml", "-database-path", "./test-data/test-data.mmdb",
+		"-policies-path", policiesPath, "-corrections-path", filepath.Join(suite.dir, "command-corrections.json")}
+	//the command opens its own database, the suite's is closed once it is replaced
+	previous := testProvider()
+	defer previous.Close()
+
+	var output strings.Builder
+	err := exportCommand(&output, "asia", ExportCIDR, args)
+	if !suite.NoError(err, "was expecting no error, returned %v", err) {
+		Log(log.InfoLevel, fmt.Sprintf("was expecting no error, returned %v", err), true)
+	}
+	suite.Contains(output.String(), "\n1.0.64.0/18\n")
+
+	output.Reset()
+	suite.NoError(exportCommand(&output, "acme/asia", ExportCIDR, args))
+	suite.Contains(output.String(), "\n1.0.32.0/19\n", "was expecting the tenant's policy")
+
+	suite.Error(exportCommand(&output, "europe", ExportCIDR, args), "was expecting an unknown policy to be rejected")
+	suite.Error(exportCommand(&output, "asia", "pf", args), "was expecting an unknown format to be rejected")
+}
@@ -1,10 +1,12 @@
 package main
 
 import (
-	"flag"
+	"errors"
 	"fmt"
 	"net/http"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/gorilla/mux"
 	jsoniter "github.com/json-iterator/go"
@@ -14,58 +16,130 @@ import (
 //WhitelistRequest is the request format to validate an IP's country and if it belongs in the passed whitelist
 type WhitelistRequest struct {
 	WhitelistedCountries []string `json:"whitelisted_countries"`
+	BlacklistedCountries []string `json:"blacklisted_countries"`
+	Policy               string   `json:"policy"`
 }
 
-//ResponseStruct is the return response for application handlers
+//LookupResponse is the return response for the lookup handler. asn is only set when an asn database
+//is loaded. ip and error are only set for the addresses of a hostname
+type LookupResponse struct {
+	Country
+	ASN   *ASN   `json:"asn,omitempty"`
+	IP    string `json:"ip,omitempty"`
+	Error string `json:"error,omitempty"`
+}
+
+//ResponseStruct is the return response for application handlers. aliases lists the entries of a
+//check that were matched as a country alias or iso code. entries that name no known country are
+//listed under unknown entries when the request is rejected, and under warnings when it isn't. checks
+//of a hostname list the decision for each of its addresses and the rule they were combined with
 type ResponseStruct struct {
-	Response string `json:"response"`
+	Response       string         `json:"response"`
+	Source         string         `json:"source,omitempty"`
+	Field          string         `json:"field,omitempty"`
+	Aliases        []AppliedAlias `json:"aliases,omitempty"`
+	UnknownEntries []UnknownEntry `json:"unknown_entries,omitempty"`
+	Warnings       []UnknownEntry `json:"warnings,omitempty"`
+	Host           string         `json:"host,omitempty"`
+	Rule           string         `json:"rule,omitempty"`
+	Addresses      []HostAddress  `json:"addresses,omitempty"`
+}
+
+//SavedPolicy is the response to saving a policy, with the entries that name no known country when
+//they didn't stop it being saved
+type SavedPolicy struct {
+	Policy
+	Warnings []UnknownEntry `json:"warnings,omitempty"`
 }
 
 //checkWhitelistHandler decodes the request and calls the CheckWhitelist function to validate
-//if the passed ip is a whitelisted country
+//if the passed ip (or the caller's own ip when none is passed) is a whitelisted country. a hostname
+//is resolved and checked by checkHost
 func checkWhitelistHandler(w http.ResponseWriter, r *http.Request) {
-	var req WhitelistRequest
 	w.Header().Add("Content-Type", "application/json")
 	if !strings.EqualFold(r.Method, "Get") {
 		w.WriteHeader(http.StatusMethodNotAllowed)
 		err := fmt.Errorf("invalid request type")
-		Log(log.ErrorLevel, err.Error(), flag.Lookup("test.v") == nil)
+		logRequest(r, log.ErrorLevel, err.Error())
 		response := ResponseStruct{Response: err.Error()}
 		jsoniter.NewEncoder(w).Encode(response)
 		return
 	}
 	vars := mux.Vars(r)
-	// we will need to extract the `id` of the article we
-	// wish to delete
-	ip := vars["ip"]
+	//when called without an {ip} the caller itself is checked, resolved through any trusted proxies
+	ip, ok := vars["ip"]
+	if !ok {
+		clientIP, err := ClientIP(r)
+		if err != nil {
+			logRequest(r, log.ErrorLevel, err.Error())
+			w.WriteHeader(http.StatusBadRequest)
+			response := ResponseStruct{Response: err.Error()}
+			jsoniter.NewEncoder(w).Encode(response)
+			return
+		}
+		ip = clientIP
+	}
 
-	err := jsoniter.NewDecoder(r.Body).Decode(&req)
+	req, warnings, err := decodeWhitelistRequest(r)
 	if err != nil {
-		Log(log.ErrorLevel, err.Error(), flag.Lookup("test.v") == nil)
-		w.WriteHeader(http.StatusBadRequest)
-		response := ResponseStruct{Response: err.Error()}
-		jsoniter.NewEncoder(w).Encode(response)
+		respondError(w, r, http.StatusBadRequest, err)
 		return
 	}
 
 	if ip == "" {
 		w.WriteHeader(http.StatusBadRequest)
 		err := fmt.Errorf("empty ip value")
-		Log(log.ErrorLevel, err.Error(), flag.Lookup("test.v") == nil)
+		logRequest(r, log.ErrorLevel, err.Error())
 		response := ResponseStruct{Response: err.Error()}
 		jsoniter.NewEncoder(w).Encode(response)
 		return
 	}
-	found, err := CheckWhitelist(ip, req.WhitelistedCountries)
-	if err != nil {
-		Log(log.ErrorLevel, err.Error(), flag.Lookup("test.v") == nil)
-		w.WriteHeader(http.StatusInternalServerError)
+	//the path value is only logged quoted and truncated, it is whatever the caller sent
+	_, err = ParseAddr(ip)
+	host, isHost := "", false
+	if err != nil && ok {
+		host, isHost = ParseHostname(ip)
+	}
+	if err != nil && !isHost {
+		logRequest(r, log.ErrorLevel, fmt.Sprintf("%v %v", err, sanitizeLogValue(ip)))
+		w.WriteHeader(http.StatusBadRequest)
 		response := ResponseStruct{Response: err.Error()}
 		jsoniter.NewEncoder(w).Encode(response)
 		return
 	}
-	response := ResponseStruct{}
-	switch found {
+	policy, err := requestPolicy(r, req)
+	if err != nil {
+		respondError(w, r, http.StatusBadRequest, err)
+		return
+	}
+	if isHost {
+		checkHost(w, r, host, policy, req, warnings)
+		return
+	}
+	var decision Decision
+	if policy != nil {
+		decision, err = EvaluatePolicy(ip, *policy)
+	} else {
+		decision, err = EvaluateTenant(RequestTenant(r), ip, req.WhitelistedCountries, req.BlacklistedCountries)
+	}
+	if err != nil {
+		respondError(w, r, http.StatusInternalServerError, err)
+		return
+	}
+	recordDecision(r, ip, policy, req, decision)
+	if policy != nil {
+		evaluateShadows(r, ip, *policy, decision)
+	}
+	if !decision.Allowed {
+		notifyDenied(r, ip, policy, decision)
+	}
+	response := ResponseStruct{Source: decision.Country.Source, Warnings: warnings}
+	if policy != nil {
+		response.Aliases = AppliedAliases(policy.activeEntries(Clock()))
+	} else {
+		response.Aliases = AppliedAliases(req.WhitelistedCountries, req.BlacklistedCountries)
+	}
+	switch decision.Allowed {
 	case true:
 		w.WriteHeader(http.StatusOK)
 		response.Response = "whitelisted"
@@ -77,6 +151,90 @@ func checkWhitelistHandler(w http.ResponseWriter, r *http.Request) {
 	return
 }
 
+//decodeWhitelistRequest decodes and validates the body of a check, returning the entries that name no
+//known country when they don't reject it
+func decodeWhitelistRequest(r *http.Request) (WhitelistRequest, []UnknownEntry, error) {
+	var req WhitelistRequest
+	err := decodeRequest(r, "WhitelistRequest", &req)
+	if err == nil {
+		err = checkEntryCount(r, "whitelisted_countries", req.WhitelistedCountries)
+	}
+	if err == nil {
+		err = checkEntryCount(r, "blacklisted_countries", req.BlacklistedCountries)
+	}
+	if err != nil {
+		return req, nil, err
+	}
+	warnings, err := checkUnknownEntries(r, entryList{"whitelisted_countries[%v]", req.WhitelistedCountries},
+		entryList{"blacklisted_countries[%v]", req.BlacklistedCountries})
+	return req, warnings, err
+}
+
+//requestPolicy returns the caller's policy named by a check, or nil when the check passes entries
+//instead. shadow policies are never enforced, so they can't be checked against
+func requestPolicy(r *http.Request, req WhitelistRequest) (*Policy, error) {
+	if req.Policy == "" {
+		return nil, nil
+	}
+	named, ok := GetPolicy(RequestTenant(r), req.Policy)
+	switch {
+	case !ok:
+		return nil, fmt.Errorf("policy %v not found", req.Policy)
+	case named.Shadow != "":
+		return nil, fmt.Errorf("policy %v is a shadow of %v and is never enforced", req.Policy, named.Shadow)
+	case len(req.WhitelistedCountries) > 0 || len(req.BlacklistedCountries) > 0:
+		return nil, fmt.Errorf("pass either a policy or whitelist/blacklist entries, not both")
+	}
+	return &named, nil
+}
+
+//lookupHandler returns the country and autonomous system data for the passed ip, or of every
+//address of the passed hostname
+func lookupHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Add("Content-Type", "application/json")
+	if !strings.EqualFold(r.Method, "Get") {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		err := fmt.Errorf("invalid request type")
+		logRequest(r, log.ErrorLevel, err.Error())
+		response := ResponseStruct{Response: err.Error()}
+		jsoniter.NewEncoder(w).Encode(response)
+		return
+	}
+	ip := mux.Vars(r)["ip"]
+	if _, err := ParseAddr(ip); err != nil {
+		if host, ok := ParseHostname(ip); ok {
+			lookupHost(w, r, host)
+			return
+		}
+		w.WriteHeader(http.StatusBadRequest)
+		logRequest(r, log.ErrorLevel, fmt.Sprintf("%v %v", err, sanitizeLogValue(ip)))
+		response := ResponseStruct{Response: err.Error()}
+		jsoniter.NewEncoder(w).Encode(response)
+		return
+	}
+	country, err := GetTenantCountryData(RequestTenant(r), ip)
+	if err != nil {
+		logRequest(r, log.ErrorLevel, err.Error())
+		w.WriteHeader(http.StatusInternalServerError)
+		response := ResponseStruct{Response: err.Error()}
+		jsoniter.NewEncoder(w).Encode(response)
+		return
+	}
+	response := LookupResponse{Country: country}
+	if ASNDatabase != nil {
+		asn, err := GetASNData(ip)
+		if err != nil {
+			logRequest(r, log.ErrorLevel, err.Error())
+			w.WriteHeader(http.StatusInternalServerError)
+			response := ResponseStruct{Response: err.Error()}
+			jsoniter.NewEncoder(w).Encode(response)
+			return
+		}
+		response.ASN = &asn
+	}
+	jsoniter.NewEncoder(w).Encode(response)
+}
+
 //getStatusHandler returns the status/heartbeat of the application. in future implementations, we can
 //update this to throw different status' based on if the server is updating, there are issues reading
 //data, etc.
@@ -85,7 +243,182 @@ func getStatusHandler(w http.ResponseWriter, r *http.Request) {
 	w.Header().Add("Content-Type", "application/json")
 
 	statusReturn["status"] = "200 - OK"
+	if revision, loaded := ConfigRevision(); revision > 0 {
+		statusReturn["config_revision"] = strconv.Itoa(revision)
+		statusReturn["config_loaded"] = loaded.UTC().Format(time.RFC3339)
+	}
 
 	jsoniter.NewEncoder(w).Encode(statusReturn)
 	return
 }
+
+//respondError writes err as a ResponseStruct with the given status and logs it against the caller.
+//request body errors also name the failing field, bodies over the size limit are always a 413,
+//changes over a tenant quota a 403 and entries that can't be matched a 400
+func respondError(w http.ResponseWriter, r *http.Request, status int, err error) {
+	logRequest(r, log.ErrorLevel, err.Error())
+	var tooLarge *http.MaxBytesError
+	var overQuota *QuotaError
+	var unknown *UnknownEntriesError
+	var badEntry *EntryError
+	if errors.As(err, &tooLarge) {
+		status = http.StatusRequestEntityTooLarge
+	} else if errors.As(err, &overQuota) {
+		status = http.StatusForbidden
+	} else if errors.As(err, &badEntry) {
+		status = http.StatusBadRequest
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	response := ResponseStruct{Response: err.Error()}
+	if fieldErr, ok := err.(*FieldError); ok {
+		response.Field = fieldErr.Field
+	}
+	if errors.As(err, &unknown) {
+		response.UnknownEntries = unknown.Entries
+	}
+	jsoniter.NewEncoder(w).Encode(response)
+}
+
+//listCorrectionsHandler returns every entry in the caller's corrections overlay
+func listCorrectionsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Add("Content-Type", "application/json")
+	jsoniter.NewEncoder(w).Encode(ListCorrections(RequestTenant(r)))
+}
+
+//addCorrectionHandler adds or replaces a correction for a network in the caller's overlay
+func addCorrectionHandler(w http.ResponseWriter, r *http.Request) {
+	var correction Correction
+	if err := decodeRequest(r, "Correction", &correction); err != nil {
+		respondError(w, r, http.StatusBadRequest, err)
+		return
+	}
+	correction.Tenant = RequestTenant(r)
+	correction, err := AddCorrection(correction)
+	if err != nil {
+		respondError(w, r, http.StatusBadRequest, err)
+		return
+	}
+	logRequest(r, log.InfoLevel, fmt.Sprintf("correction added for %v: %v", correction.Network, correction.IsoCode))
+	w.Header().Add("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	jsoniter.NewEncoder(w).Encode(correction)
+}
+
+//removeCorrectionHandler removes the caller's correction for the network in the path
+func removeCorrectionHandler(w http.ResponseWriter, r *http.Request) {
+	network := mux.Vars(r)["network"]
+	if err := RemoveCorrection(RequestTenant(r), network); err != nil {
+		respondError(w, r, http.StatusNotFound, err)
+		return
+	}
+	logRequest(r, log.InfoLevel, fmt.Sprintf("correction removed for %v", network))
+	w.Header().Add("Content-Type", "application/json")
+	jsoniter.NewEncoder(w).Encode(ResponseStruct{Response: "removed"})
+}
+
+//listPoliciesHandler returns every policy of the caller's tenant
+func listPoliciesHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Add("Content-Type", "application/json")
+	jsoniter.NewEncoder(w).Encode(ListPolicies(RequestTenant(r)))
+}
+
+//getPolicyHandler returns the caller's policy named in the path
+func getPolicyHandler(w http.ResponseWriter, r *http.Request) {
+	name := mux.Vars(r)["name"]
+	policy, ok := GetPolicy(RequestTenant(r), name)
+	if !ok {
+		respondError(w, r, http.StatusNotFound, fmt.Errorf("policy %v not found", name))
+		return
+	}
+	w.Header().Add("Content-Type", "application/json")
+	jsoniter.NewEncoder(w).Encode(policy)
+}
+
+//savePolicyHandler creates or replaces the caller's policy named in the path
+func savePolicyHandler(w http.ResponseWriter, r *http.Request) {
+	var policy Policy
+	err := decodeRequest(r, "Policy", &policy)
+	if err == nil {
+		err = checkEntryCount(r, "whitelist", policy.Whitelist)
+	}
+	if err == nil {
+		err = checkEntryCount(r, "blacklist", policy.Blacklist)
+	}
+	var warnings []UnknownEntry
+	if err == nil {
+		scheduled := make([]string, len(policy.Schedules))
+		for i, schedule := range policy.Schedules {
+			scheduled[i] = schedule.Entry
+		}
+		warnings, err = checkUnknownEntries(r, entryList{"whitelist[%v]", policy.Whitelist}, entryList{"blacklist[%v]", policy.Blacklist},
+			entryList{"schedules[%v].entry", scheduled})
+	}
+	if err != nil {
+		respondError(w, r, http.StatusBadRequest, err)
+		return
+	}
+	policy.Name = mux.Vars(r)["name"]
+	policy.Tenant = RequestTenant(r)
+	policy, err = SavePolicy(policy)
+	if err != nil {
+		respondError(w, r, http.StatusBadRequest, err)
+		return
+	}
+	logRequest(r, log.InfoLevel, fmt.Sprintf("policy %v updated to version %v", policy.Name, policy.Version))
+	EmitEvent(EventPolicyUpdated, map[string]interface{}{"policy": policy.Name, "version": policy.Version, "caller": RequestIdentity(r),
+		"tenant": policy.Tenant})
+	w.Header().Add("Content-Type", "application/json")
+	jsoniter.NewEncoder(w).Encode(SavedPolicy{Policy: policy, Warnings: warnings})
+}
+
+//shadowReportHandler returns the report of the caller's shadow policy named in the path
+func shadowReportHandler(w http.ResponseWriter, r *http.Request) {
+	name := mux.Vars(r)["name"]
+	policy, ok := GetPolicy(RequestTenant(r), name)
+	if !ok {
+		respondError(w, r, http.StatusNotFound, fmt.Errorf("policy %v not found", name))
+		return
+	}
+	if policy.Shadow == "" {
+		respondError(w, r, http.StatusBadRequest, fmt.Errorf("policy %v is not a shadow policy", name))
+		return
+	}
+	w.Header().Add("Content-Type", "application/json")
+	jsoniter.NewEncoder(w).Encode(GetShadowReport(policy))
+}
+
+//scheduleHandler returns the upcoming scheduled changes of the caller's policies, or of the one named
+//in the policy query value, within the duration in the within query value (a week by default)
+func scheduleHandler(w http.ResponseWriter, r *http.Request) {
+	within := 7 * 24 * time.Hour
+	if value := r.URL.Query().Get("within"); value != "" {
+		parsed, err := time.ParseDuration(value)
+		if err != nil || parsed <= 0 || parsed > maxScheduleWindow {
+			respondError(w, r, http.StatusBadRequest, fmt.Errorf("within must be a positive duration up to %v", maxScheduleWindow))
+			return
+		}
+		within = parsed
+	}
+	tenant, name := RequestTenant(r), r.URL.Query().Get("policy")
+	if _, ok := GetPolicy(tenant, name); name != "" && !ok {
+		respondError(w, r, http.StatusNotFound, fmt.Errorf("policy %v not found", name))
+		return
+	}
+	w.Header().Add("Content-Type", "application/json")
+	jsoniter.NewEncoder(w).Encode(UpcomingChanges(tenant, name, within))
+}
+
+//deletePolicyHandler removes the caller's policy named in the path
+func deletePolicyHandler(w http.ResponseWriter, r *http.Request) {
+	name := mux.Vars(r)["name"]
+	if err := DeletePolicy(RequestTenant(r), name); err != nil {
+		respondError(w, r, http.StatusNotFound, err)
+		return
+	}
+	logRequest(r, log.InfoLevel, fmt.Sprintf("policy %v deleted", name))
+	EmitEvent(EventPolicyUpdated, map[string]interface{}{"policy": name, "deleted": true, "caller": RequestIdentity(r),
+		"tenant": RequestTenant(r)})
+	w.Header().Add("Content-Type", "application/json")
+	jsoniter.NewEncoder(w).Encode(ResponseStruct{Response: "removed"})
+}
@@ -3,9 +3,11 @@ package main
 import (
 	"bytes"
 	"fmt"
-	"net"
 	"net/http"
 	"net/http/httptest"
+	"net/netip"
+	"os"
+	"path/filepath"
 	"testing"
 
 	"github.com/gorilla/mux"
@@ -25,7 +27,7 @@ type HandlerSuite struct {
 }
 
 func (suite *HandlerSuite) SetupSuite() {
-	LogPath = "./logs/"
+	setLogPath("./logs/")
 	Log(log.InfoLevel, "=============== Running Handlers Suite ======================", true)
 	setupDB("./test-data/test-data.mmdb")
 	Port = "8080"
@@ -34,7 +36,7 @@ func (suite *HandlerSuite) SetupSuite() {
 func (suite *HandlerSuite) TearDownSuite() {
 	Log(log.InfoLevel, fmt.Sprintf("========== Handlers Testsuite completed ==========="), true)
 	fmt.Println("========== Handlers Testsuite completed ===========")
-	CountryDatabase.Close()
+	testProvider().Close()
 }
 
 func (suite *HandlerSuite) TestCheckWhitelistHandler() {
@@ -52,14 +54,14 @@ func (suite *HandlerSuite) TestCheckWhitelistHandler() {
 		{"Not Found", suite.Request, "not whitelisted"},
 		{"Not Get", suite.Request, "invalid request type"},
 		{"Found", suite.Request, "whitelisted"},
-		{"Invalid Json", suite.Request, "readObjectStart: expect { or n, but found \", error found in #1 byte of ...|\"INVALID#!#|..., bigger context ...|\"INVALID#!#!\"|..."},
+		{"Invalid Json", suite.Request, "invalid request body: must be an object, got string"},
 		{"Closed database", suite.Request, "cannot call Lookup on a closed database"},
 	}
 
 	// Edit variables so they are realated to tc
 	for _, tc := range tt {
-		err := CountryDatabase.Lookup(net.ParseIP("1.207.235.255"), nil)
-		if err.Error() == "cannot call Lookup on a closed database" {
+		_, err := testProvider().Lookup(netip.MustParseAddr("1.207.235.255"))
+		if err != nil && err.Error() == "cannot call Lookup on a closed database" {
 			setupDB("./test-data/test-data.mmdb")
 		}
 		httpMethod := http.MethodGet
@@ -91,7 +93,7 @@ func (suite *HandlerSuite) TestCheckWhitelistHandler() {
 			ip = "1.207.235.255"
 			request.WhitelistedCountries = []string{"China", "Brazil"}
 			wl = request
-			CountryDatabase.Close()
+			testProvider().Close()
 		}
 
 		toSend, err := jsoniter.Marshal(wl)
@@ -130,6 +132,173 @@ func (suite *HandlerSuite) TestCheckWhitelistHandler() {
 	fmt.Println("============== TestCheckWhitelistHandler Completed ================")
 }
 
+//TestCheckWhitelistCallerHandler validates the handler checks the caller's own ip when no {ip} is passed
+func (suite *HandlerSuite) TestCheckWhitelistCallerHandler() {
+	Log(log.InfoLevel, fmt.Sprintf("====== Running TestCheckWhitelistCallerHandler ==========="), true)
+	tt := []struct {
+		testName   string
+		remoteAddr string
+		expected   string
+	}{
+		{"Caller Found", "1.207.235.255:5000", "whitelisted"},
+		{"Caller Not Found", "8.8.8.8:5000", "not whitelisted"},
+		{"Caller Unknown", "", "unable to determine client ip"},
+	}
+
+	for _, tc := range tt {
+		toSend, _ := jsoniter.Marshal(WhitelistRequest{WhitelistedCountries: []string{"China"}})
+		req, err := http.NewRequest(http.MethodGet, fmt.Sprintf("localhost:%v/checkWhitelist", Port), bytes.NewBuffer(toSend))
+		if err != nil {
+			fmt.Printf("%v error in %v request to %v\n", err, "GET", fmt.Sprintf("localhost:%v/checkWhitelist", Port))
+		}
+		req.RemoteAddr = tc.remoteAddr
+		rec := httptest.NewRecorder()
+
+		checkWhitelistHandler(rec, req)
+
+		var resp ResponseStruct
+		jsoniter.NewDecoder(rec.Body).Decode(&resp)
+		if !suite.Equal(tc.expected, resp.Response,
+			fmt.Sprintf("Received a response other than %v, received %v instead from %v", tc.expected, resp.Response, tc.testName)) {
+			Log(log.InfoLevel, fmt.Sprintf("Received a response other than %v, received %v instead from %v", tc.expected, resp.Response, tc.testName), true)
+		}
+	}
+
+	fmt.Println("============== TestCheckWhitelistCallerHandler Completed ================")
+}
+
+func (suite *HandlerSuite) TestLookupHandler() {
+	Log(log.InfoLevel, fmt.Sprintf("====== Running TestLookupHandler ==========="), true)
+	//TestCheckWhitelistHandler leaves the database closed
+	setupDB("./test-data/test-data.mmdb")
+	tt := []struct {
+		testName string
+		method   string
+		ip       string
+		status   int
+		expected string
+	}{
+		{"Found", http.MethodGet, "1.207.235.255", http.StatusOK, "China"},
+		{"Invalid IP", http.MethodGet, "INVALID#!", http.StatusBadRequest, "invalid ip value"},
+		{"Not Get", http.MethodPost, "1.207.235.255", http.StatusMethodNotAllowed, "invalid request type"},
+	}
+
+	for _, tc := range tt {
+		req, err := http.NewRequest(tc.method, fmt.Sprintf("localhost:%v/lookup/%v", Port, tc.ip), nil)
+		if err != nil {
+			fmt.Printf("%v error in %v request to %v\n", err, tc.method, fmt.Sprintf("localhost:%v/lookup/%v", Port, tc.ip))
+		}
+		req = mux.SetURLVars(req, map[string]string{
+			"ip": tc.ip,
+		})
+		rec := httptest.NewRecorder()
+
+		lookupHandler(rec, req)
+
+		var resp map[string]interface{}
+		jsoniter.NewDecoder(rec.Body).Decode(&resp)
+		received := resp["response"]
+		if tc.status == http.StatusOK {
+			received = resp["name"]
+		}
+		if !suite.Equal(tc.status, rec.Code) || !suite.Equal(tc.expected, received) {
+			Log(log.InfoLevel, fmt.Sprintf("Received a response other than %v, received %v instead from %v", tc.expected, received, tc.testName), true)
+		}
+	}
+
+	fmt.Println("============== TestLookupHandler Completed ================")
+}
+
+//TestCorrectionHandlers adds, lists and removes a correction through the admin routes
+func (suite *HandlerSuite) TestCorrectionHandlers() {
+	Log(log.InfoLevel, fmt.Sprintf("====== Running TestCorrectionHandlers ==========="), true)
+	setupDB("./test-data/test-data.mmdb")
+	dir, _ := os.MkdirTemp("", "correction-handlers")
+	defer os.RemoveAll(dir)
+	setupCorrections(filepath.Join(dir, "corrections.json"))
+	defer setupCorrections("")
+	router := setupRouter()
+
+	tt := []struct {
+		testName string
+		method   string
+		path     string
+		body     string
+		status   int
+	}{
+		{"Add", http.MethodPost, "/admin/corrections", `{"network": "1.207.235.0/24", "iso_code": "US"}`, http.StatusCreated},
+		{"Add Invalid", http.MethodPost, "/admin/corrections", `{"network": "1.207.235.0", "iso_code": "US"}`, http.StatusBadRequest},
+		{"Add Invalid Json", http.MethodPost, "/admin/corrections", `INVALID#!`, http.StatusBadRequest},
+		{"List", http.MethodGet, "/admin/corrections", "", http.StatusOK},
+		{"Remove", http.MethodDelete, "/admin/corrections/1.207.235.0/24", "", http.StatusOK},
+		{"Remove Missing", http.MethodDelete, "/admin/corrections/1.207.235.0/24", "", http.StatusNotFound},
+	}
+	for _, tc := range tt {
+		req := httptest.NewRequest(tc.method, tc.path, bytes.NewBufferString(tc.body))
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, req)
+		if !suite.Equal(tc.status, rec.Code, "unexpected status from %v: %v", tc.testName, rec.Body.String()) {
+			Log(log.InfoLevel, fmt.Sprintf("Received a status other than %v, received %v instead from %v", tc.status, rec.Code, tc.testName), true)
+		}
+		if tc.testName == "Add" {
+			//the correction is reported as the source of the check
+			toSend, _ := jsoniter.Marshal(WhitelistRequest{WhitelistedCountries: []string{"United States"}})
+			checkRec := httptest.NewRecorder()
+			router.ServeHTTP(checkRec, httptest.NewRequest(http.MethodGet, "/checkWhitelist/1.207.235.255", bytes.NewBuffer(toSend)))
+			var resp ResponseStruct
+			jsoniter.NewDecoder(checkRec.Body).Decode(&resp)
+			suite.Equal(ResponseStruct{Response: "whitelisted", Source: SourceOverlay}, resp)
+		}
+	}
+
+	fmt.Println("============== TestCorrectionHandlers Completed ================")
+}
+
+//TestPolicyHandlers manages a policy through the admin routes and checks ips against it
+func (suite *HandlerSuite) TestPolicyHandlers() {
+	Log(log.InfoLevel, fmt.Sprintf("====== Running TestPolicyHandlers ==========="), true)
+	setupDB("./test-data/test-data.mmdb")
+	dir, _ := os.MkdirTemp("", "policy-handlers")
+	defer os.RemoveAll(dir)
+	setupPolicies(filepath.Join(dir, "policies.json"))
+	defer compiling.Wait()
+	defer setupPolicies("")
+	router := setupRouter()
+
+	tt := []struct {
+		testName string
+		method   string
+		path     string
+		body     string
+		status   int
+		expected string
+	}{
+		{"Save", http.MethodPut, "/admin/policies/asia", `{"whitelist": ["china", "japan"]}`, http.StatusOK, ""},
+		{"Save Invalid Name", http.MethodPut, "/admin/policies/a.b", `{"whitelist": ["china"]}`, http.StatusBadRequest, "invalid policy name \"a.b\""},
+		{"Get", http.MethodGet, "/admin/policies/asia", "", http.StatusOK, ""},
+		{"List", http.MethodGet, "/admin/policies", "", http.StatusOK, ""},
+		{"Check Policy", http.MethodGet, "/checkWhitelist/1.207.235.255", `{"policy": "asia"}`, http.StatusOK, "whitelisted"},
+		{"Check Policy And Entries", http.MethodGet, "/checkWhitelist/1.207.235.255", `{"policy": "asia", "whitelisted_countries": ["china"]}`, http.StatusBadRequest, "pass either a policy or whitelist/blacklist entries, not both"},
+		{"Delete", http.MethodDelete, "/admin/policies/asia", "", http.StatusOK, "removed"},
+		{"Get Missing", http.MethodGet, "/admin/policies/asia", "", http.StatusNotFound, "policy asia not found"},
+		{"Check Missing Policy", http.MethodGet, "/checkWhitelist/1.207.235.255", `{"policy": "asia"}`, http.StatusBadRequest, "policy asia not found"},
+	}
+	for _, tc := range tt {
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, httptest.NewRequest(tc.method, tc.path, bytes.NewBufferString(tc.body)))
+		if !suite.Equal(tc.status, rec.Code, "unexpected status from %v: %v", tc.testName, rec.Body.String()) {
+			Log(log.InfoLevel, fmt.Sprintf("Received a status other than %v, received %v instead from %v", tc.status, rec.Code, tc.testName), true)
+		}
+		if tc.expected != "" {
+			var resp ResponseStruct
+			jsoniter.NewDecoder(rec.Body).Decode(&resp)
+			suite.Equal(tc.expected, resp.Response, "unexpected response from %v", tc.testName)
+		}
+	}
+
+	fmt.Println("============== TestPolicyHandlers Completed ================")
+}
+
 func (suite *HandlerSuite) TestStatusHandler() {
 	Log(log.InfoLevel, fmt.Sprintf("====== Running TesStatusHandler ==========="), true)
 	req, err := http.NewRequest(http.MethodGet, "localhost:"+Port+"/", nil)
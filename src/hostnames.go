@@ -0,0 +1,285 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	jsoniter "github.com/json-iterator/go"
+	log "github.com/sirupsen/logrus"
+)
+
+//host rules. a hostname is allowed under any when one of its addresses is allowed, and under all only
+//when every one of them is
+const (
+	HostRuleAny = "any"
+	HostRuleAll = "all"
+)
+
+//maxHostAddresses is the most addresses of a hostname that are decided
+const maxHostAddresses = 32
+
+//hostnamePattern matches fully qualified hostnames. the last label has to start with a letter so ip
+//addresses that fail to parse aren't resolved as hostnames
+var hostnamePattern = regexp.MustCompile(`^([a-z0-9]([a-z0-9-]{0,61}[a-z0-9])?\.)+[a-z]([a-z0-9-]{0,61}[a-z0-9])?$`)
+
+//Resolver resolves a hostname to its addresses. *net.Resolver implements it, tests swap in a fake
+type Resolver interface {
+	LookupNetIP(ctx context.Context, network string, host string) ([]netip.Addr, error)
+}
+
+//ResolverConfig configures hostname resolution. address is the dns server to ask, as host:port, the
+//system resolver is used when it is empty. rule is the default host rule
+type ResolverConfig struct {
+	Address string        `mapstructure:"address"`
+	Timeout time.Duration `mapstructure:"timeout"`
+	Rule    string        `mapstructure:"rule"`
+}
+
+//hostResolver is the resolver and settings hostnames are resolved with
+var hostResolver = struct {
+	sync.RWMutex
+	resolver Resolver
+	timeout  time.Duration
+	rule     string
+}{resolver: net.DefaultResolver, timeout: defaultConfig.Resolver.Timeout, rule: defaultConfig.Resolver.Rule}
+
+//HostAddress is the decision for one address a hostname resolved to. addresses that couldn't be
+//decided are never allowed and carry the error instead of a country
+type HostAddress struct {
+	IP      string   `json:"ip"`
+	Country *Country `json:"country,omitempty"`
+	Allowed bool     `json:"allowed"`
+	Error   string   `json:"error,omitempty"`
+}
+
+//HostLookup is the country data of every address a hostname resolved to
+type HostLookup struct {
+	Host      string           `json:"host"`
+	Addresses []LookupResponse `json:"addresses"`
+}
+
+//HostNotFoundError rejects a hostname that has no addresses
+type HostNotFoundError struct {
+	Host string
+}
+
+func (e *HostNotFoundError) Error() string {
+	return fmt.Sprintf("host %v has no addresses", e.Host)
+}
+
+//checkResolverConfig validates the resolver section of the config
+func checkResolverConfig(config ResolverConfig) error {
+	if config.Address != "" {
+		if _, _, err := net.SplitHostPort(config.Address); err != nil {
+			return fmt.Errorf("address must be host:port, got %q", config.Address)
+		}
+	}
+	if config.Timeout < 0 {
+		return fmt.Errorf("timeout must not be negative")
+	}
+	if config.Rule != HostRuleAny && config.Rule != HostRuleAll {
+		return fmt.Errorf("rule must be %v or %v, got %q", HostRuleAny, HostRuleAll, config.Rule)
+	}
+	return nil
+}
+
+//setupResolver replaces the resolver hostnames are resolved with. a configured address sends every
+//query to that dns server instead of the ones the system is set up with
+func setupResolver(config ResolverConfig) error {
+	if err := checkResolverConfig(config); err != nil {
+		return err
+	}
+	var resolver Resolver = net.DefaultResolver
+	if config.Address != "" {
+		dialer := net.Dialer{}
+		resolver = &net.Resolver{PreferGo: true, Dial: func(ctx context.Context, network string, _ string) (net.Conn, error) {
+			return dialer.DialContext(ctx, network, config.Address)
+		}}
+	}
+	setResolver(resolver, config.Timeout, config.Rule)
+	return nil
+}
+
+//setResolver swaps the resolver and its settings
+func setResolver(resolver Resolver, timeout time.Duration, rule string) {
+	hostResolver.Lock()
+	defer hostResolver.Unlock()
+	hostResolver.resolver = resolver
+	hostResolver.timeout = timeout
+	hostResolver.rule = rule
+}
+
+//ParseHostname returns the lower cased form of a fully qualified hostname, without a trailing dot
+func ParseHostname(value string) (string, bool) {
+	host := strings.TrimSuffix(strings.ToLower(value), ".")
+	if len(host) > 253 || !hostnamePattern.MatchString(host) {
+		return "", false
+	}
+	return host, true
+}
+
+//ResolveHost returns the distinct addresses of a hostname in address order, IPv4-mapped ones unmapped.
+//at most maxHostAddresses are returned
+func ResolveHost(ctx context.Context, host string) ([]netip.Addr, error) {
+	hostResolver.RLock()
+	resolver, timeout := hostResolver.resolver, hostResolver.timeout
+	hostResolver.RUnlock()
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	resolved, err := resolver.LookupNetIP(ctx, "ip", host)
+	var dnsErr *net.DNSError
+	if errors.As(err, &dnsErr) && dnsErr.IsNotFound {
+		return nil, &HostNotFoundError{Host: host}
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to resolve %v: %v", host, err)
+	}
+	seen := map[netip.Addr]bool{}
+	var addrs []netip.Addr
+	for _, addr := range resolved {
+		addr = addr.Unmap()
+		if !seen[addr] {
+			seen[addr] = true
+			addrs = append(addrs, addr)
+		}
+	}
+	if len(addrs) == 0 {
+		return nil, &HostNotFoundError{Host: host}
+	}
+	sort.Slice(addrs, func(i, j int) bool { return addrs[i].Less(addrs[j]) })
+	if len(addrs) > maxHostAddresses {
+		addrs = addrs[:maxHostAddresses]
+	}
+	return addrs, nil
+}
+
+//hostRule returns the host rule of a request, the rule query value or the configured one
+func hostRule(r *http.Request) (string, error) {
+	rule := r.URL.Query().Get("rule")
+	if rule == "" {
+		hostResolver.RLock()
+		defer hostResolver.RUnlock()
+		return hostResolver.rule, nil
+	}
+	if rule != HostRuleAny && rule != HostRuleAll {
+		return "", fmt.Errorf("rule must be %v or %v, got %q", HostRuleAny, HostRuleAll, rule)
+	}
+	return rule, nil
+}
+
+//resolveErrorStatus is the status for an error resolving a hostname. a hostname without addresses is
+//the caller's to fix, anything else is the resolver's
+func resolveErrorStatus(err error) int {
+	var notFound *HostNotFoundError
+	if errors.As(err, &notFound) {
+		return http.StatusBadRequest
+	}
+	return http.StatusBadGateway
+}
+
+//checkHost resolves a hostname and decides every address against the policy or entries of the check,
+//answering for the hostname as a whole under the host rule. each decided address is audited like a
+//check of that address
+func checkHost(w http.ResponseWriter, r *http.Request, host string, policy *Policy, req WhitelistRequest, warnings []UnknownEntry) {
+	rule, err := hostRule(r)
+	if err != nil {
+		respondError(w, r, http.StatusBadRequest, err)
+		return
+	}
+	addrs, err := ResolveHost(r.Context(), host)
+	if err != nil {
+		respondError(w, r, resolveErrorStatus(err), err)
+		return
+	}
+	response := ResponseStruct{Host: host, Rule: rule, Warnings: warnings}
+	allowed, denied := false, false
+	for _, addr := range addrs {
+		ip := addr.String()
+		address := HostAddress{IP: ip}
+		decision, err := decideAddress(r, ip, policy, req)
+		var badEntry *EntryError
+		if errors.As(err, &badEntry) {
+			//the entries are at fault rather than the address, so no address could be decided
+			respondError(w, r, http.StatusBadRequest, err)
+			return
+		}
+		if err != nil {
+			logRequest(r, log.ErrorLevel, fmt.Sprintf("failed to decide %v of %v: %v", ip, host, err))
+			address.Error = err.Error()
+		} else {
+			country := decision.Country
+			address.Country, address.Allowed = &country, decision.Allowed
+			recordDecision(r, ip, policy, req, decision)
+			if policy != nil {
+				evaluateShadows(r, ip, *policy, decision)
+			}
+			if !decision.Allowed {
+				notifyDenied(r, ip, policy, decision)
+			}
+		}
+		allowed, denied = allowed || address.Allowed, denied || !address.Allowed
+		response.Addresses = append(response.Addresses, address)
+	}
+	if policy != nil {
+		response.Aliases = AppliedAliases(policy.activeEntries(Clock()))
+	} else {
+		response.Aliases = AppliedAliases(req.WhitelistedCountries, req.BlacklistedCountries)
+	}
+	response.Response = "not whitelisted"
+	if (rule == HostRuleAny && allowed) || (rule == HostRuleAll && !denied) {
+		response.Response = "whitelisted"
+	}
+	w.Header().Set("Content-Type", "application/json")
+	jsoniter.NewEncoder(w).Encode(response)
+}
+
+//decideAddress decides one address against the policy or entries of a check
+func decideAddress(r *http.Request, ip string, policy *Policy, req WhitelistRequest) (Decision, error) {
+	if policy != nil {
+		return EvaluatePolicy(ip, *policy)
+	}
+	return EvaluateTenant(RequestTenant(r), ip, req.WhitelistedCountries, req.BlacklistedCountries)
+}
+
+//lookupHost resolves a hostname and returns the country and asn data of every address
+func lookupHost(w http.ResponseWriter, r *http.Request, host string) {
+	addrs, err := ResolveHost(r.Context(), host)
+	if err != nil {
+		respondError(w, r, resolveErrorStatus(err), err)
+		return
+	}
+	lookup := HostLookup{Host: host}
+	for _, addr := range addrs {
+		ip := addr.String()
+		response := LookupResponse{IP: ip}
+		country, err := GetTenantCountryData(RequestTenant(r), ip)
+		if err == nil {
+			response.Country = country
+			if ASNDatabase != nil {
+				var asn ASN
+				if asn, err = GetASNData(ip); err == nil {
+					response.ASN = &asn
+				}
+			}
+		}
+		if err != nil {
+			logRequest(r, log.ErrorLevel, fmt.Sprintf("failed to look up %v of %v: %v", ip, host, err))
+			response.Error = err.Error()
+		}
+		lookup.Addresses = append(lookup.Addresses, response)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	jsoniter.NewEncoder(w).Encode(lookup)
+}
@@ -0,0 +1,227 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/suite"
+)
+
+func TestHostnamesSuite(t *testing.T) {
+	hostnamesSuite := new(HostnamesSuite)
+	suite.Run(t, hostnamesSuite)
+}
+
+type HostnamesSuite struct {
+	suite.Suite
+	dir string
+}
+
+//fakeResolver answers from a table of hostnames. hosts missing from it aren't found, and a host
+//mapped to nil fails as if the dns server was unreachable
+type fakeResolver map[string][]netip.Addr
+
+func (f fakeResolver) LookupNetIP(ctx context.Context, network string, host string) ([]netip.Addr, error) {
+	addrs, ok := f[host]
+	if !ok {
+		return nil, &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+	}
+	if addrs == nil {
+		return nil, &net.DNSError{Err: "server misbehaving", Name: host, IsTemporary: true}
+	}
+	return addrs, nil
+}
+
+var testResolver = fakeResolver{
+	//China and Japan, with the China address repeated in its IPv4-mapped form
+	"partner.example.com": {netip.MustParseAddr("1.207.235.255"), netip.MustParseAddr("1.0.16.1"), netip.MustParseAddr("::ffff:1.207.235.255")},
+	"cn.example.com":      {netip.MustParseAddr("1.207.235.255")},
+	"private.example.com": {netip.MustParseAddr("1.207.235.255"), netip.MustParseAddr("10.0.0.1")},
+	"broken.example.com":  nil,
+}
+
+func (suite *HostnamesSuite) SetupSuite() {
+	setLogPath("./logs/")
+	Log(log.InfoLevel, "=============== Running Hostnames Suite ======================", true)
+	setupDB("./test-data/test-data.mmdb")
+	suite.dir, _ = os.MkdirTemp("", "hostnames-test")
+}
+
+func (suite *HostnamesSuite) SetupTest() {
+	setResolver(testResolver, time.Second, HostRuleAll)
+	os.Remove(filepath.Join(suite.dir, "policies.json"))
+	setupPolicies(filepath.Join(suite.dir, "policies.json"))
+}
+
+func (suite *HostnamesSuite) TearDownSuite() {
+	setupResolver(defaultConfig.Resolver)
+	setupPolicies("")
+	compiling.Wait()
+	testProvider().Close()
+	os.RemoveAll(suite.dir)
+	Log(log.InfoLevel, "========== Hostnames Testsuite completed ===========", true)
+	fmt.Println("========== Hostnames Testsuite completed ===========")
+}
+
+func (suite *HostnamesSuite) TestParseHostname() {
+	Log(log.InfoLevel, "====== Running TestParseHostname ===========", true)
+	tt := []struct {
+		testName string
+		value    string
+		host     string
+		ok       bool
+	}{
+		{"Hostname", "partner.example.com", "partner.example.com", true},
+		{"Upper Case And Trailing Dot", "Partner.Example.COM.", "partner.example.com", true},
+		{"Dashes And Digits", "edge-01.partner2.example.com", "edge-01.partner2.example.com", true},
+		{"Single Label", "localhost", "", false},
+		{"Invalid IP", "1.2.3.256", "", false},
+		{"Leading Dash", "-partner.example.com", "", false},
+		{"Underscore", "partner_1.example.com", "", false},
+		{"Forged Line", "partner.example.com\nlevel=info", "", false},
+		{"Too Long Label", strings.Repeat("a", 64) + ".example.com", "", false},
+	}
+	for _, tc := range tt {
+		host, ok := ParseHostname(tc.value)
+		if !suite.Equal(tc.ok, ok, "was expecting %v on %v, received %v", tc.ok, tc.testName, ok) {
+			Log(log.InfoLevel, fmt.Sprintf("was expecting %v on %v, received %v", tc.ok, tc.testName, ok), true)
+		}
+		suite.Equal(tc.host, host, "unexpected host on %v", tc.testName)
+	}
+}
+
+func (suite *HostnamesSuite) TestResolveHost() {
+	Log(log.InfoLevel, "====== Running TestResolveHost ===========", true)
+	addrs, err := ResolveHost(context.Background(), "partner.example.com")
+	suite.NoError(err)
+	suite.Equal([]netip.Addr{netip.MustParseAddr("1.0.16.1"), netip.MustParseAddr("1.207.235.255")}, addrs,
+		"was expecting the addresses unmapped, without duplicates and sorted")
+
+	_, err = ResolveHost(context.Background(), "missing.example.com")
+	var notFound *HostNotFoundError
+	suite.ErrorAs(err, &notFound)
+	suite.Equal(http.StatusBadRequest, resolveErrorStatus(err))
+
+	_, err = ResolveHost(context.Background(), "broken.example.com")
+	suite.Error(err)
+	suite.Equal(http.StatusBadGateway, resolveErrorStatus(err))
+}
+
+func (suite *HostnamesSuite) TestCheckHost() {
+	Log(log.InfoLevel, "====== Running TestCheckHost ===========", true)
+	body := `{"whitelisted_countries": ["China"]}`
+	tt := []struct {
+		testName string
+		path     string
+		rule     string
+		status   int
+		response string
+	}{
+		{"All Rule", "/checkWhitelist/partner.example.com", "", http.StatusOK, "not whitelisted"},
+		{"Any Rule", "/checkWhitelist/partner.example.com?rule=any", "", http.StatusOK, "whitelisted"},
+		{"Configured Any Rule", "/checkWhitelist/partner.example.com", HostRuleAny, http.StatusOK, "whitelisted"},
+		{"Every Address Allowed", "/checkWhitelist/cn.example.com", "", http.StatusOK, "whitelisted"},
+		{"Undecided Address", "/checkWhitelist/private.example.com", "", http.StatusOK, "not whitelisted"},
+		{"Invalid Rule", "/checkWhitelist/partner.example.com?rule=most", "", http.StatusBadRequest, `rule must be any or all, got "most"`},
+		{"Not Found", "/checkWhitelist/missing.example.com", "", http.StatusBadRequest, "host missing.example.com has no addresses"},
+		{"Resolver Failure", "/checkWhitelist/broken.example.com", "", http.StatusBadGateway, "failed to resolve broken.example.com"},
+	}
+	for _, tc := range tt {
+		rule := HostRuleAll
+		if tc.rule != "" {
+			rule = tc.rule
+		}
+		setResolver(testResolver, time.Second, rule)
+		var response ResponseStruct
+		status := serveJSON(http.MethodGet, tc.path, body, &response)
+		if !suite.Equal(tc.status, status, "was expecting status %v on %v, received %v", tc.status, tc.testName, status) {
+			Log(log.InfoLevel, fmt.Sprintf("was expecting status %v on %v, received %v", tc.status, tc.testName, status), true)
+		}
+		suite.True(strings.HasPrefix(response.Response, tc.response), "was expecting %v on %v, received %v", tc.response, tc.testName, response.Response)
+	}
+
+	setResolver(testResolver, time.Second, HostRuleAll)
+	var response ResponseStruct
+	serveJSON(http.MethodGet, "/checkWhitelist/partner.example.com", body, &response)
+	suite.Equal("partner.example.com", response.Host)
+	suite.Equal(HostRuleAll, response.Rule)
+	if suite.Len(response.Addresses, 2) {
+		suite.Equal(HostAddress{IP: "1.0.16.1", Country: &Country{Name: "Japan", IsoCode: "JP", Source: SourceMaxMind}}, response.Addresses[0])
+		suite.Equal(HostAddress{IP: "1.207.235.255", Country: &Country{Name: "China", IsoCode: "CN", Source: SourceMaxMind}, Allowed: true}, response.Addresses[1])
+	}
+
+	response = ResponseStruct{}
+	serveJSON(http.MethodGet, "/checkWhitelist/private.example.com?rule=any", body, &response)
+	suite.Equal("whitelisted", response.Response, "an undecided address shouldn't stop the any rule")
+	if suite.Len(response.Addresses, 2) {
+		suite.False(response.Addresses[1].Allowed)
+		suite.Nil(response.Addresses[1].Country)
+		suite.NotEmpty(response.Addresses[1].Error, "was expecting the address without a country to carry its error")
+	}
+}
+
+func (suite *HostnamesSuite) TestCheckHostPolicy() {
+	Log(log.InfoLevel, "====== Running TestCheckHostPolicy ===========", true)
+	SavePolicy(Policy{Name: "asia", Whitelist: []string{"China", "Japan"}})
+	compiling.Wait()
+	var response ResponseStruct
+	status := serveJSON(http.MethodGet, "/checkWhitelist/partner.example.com", `{"policy": "asia"}`, &response)
+	suite.Equal(http.StatusOK, status)
+	suite.Equal("whitelisted", response.Response)
+	suite.Len(response.Addresses, 2)
+
+	status = serveJSON(http.MethodGet, "/checkWhitelist/partner.example.com", `{"policy": "europe"}`, &response)
+	suite.Equal(http.StatusBadRequest, status, "was expecting an unknown policy to be rejected before resolving")
+}
+
+func (suite *HostnamesSuite) TestLookupHost() {
+	Log(log.InfoLevel, "====== Running TestLookupHost ===========", true)
+	var lookup HostLookup
+	status := serveJSON(http.MethodGet, "/lookup/private.example.com", "", &lookup)
+	if !suite.Equal(http.StatusOK, status, "was expecting status 200, received %v", status) {
+		Log(log.InfoLevel, fmt.Sprintf("was expecting status 200, received %v", status), true)
+	}
+	suite.Equal("private.example.com", lookup.Host)
+	if suite.Len(lookup.Addresses, 2) {
+		suite.Equal("1.207.235.255", lookup.Addresses[0].IP)
+		suite.Equal("CN", lookup.Addresses[0].IsoCode)
+		suite.Empty(lookup.Addresses[0].Error)
+		suite.Equal("10.0.0.1", lookup.Addresses[1].IP)
+		suite.NotEmpty(lookup.Addresses[1].Error)
+	}
+
+	var response ResponseStruct
+	status = serveJSON(http.MethodGet, "/lookup/missing.example.com", "", &response)
+	suite.Equal(http.StatusBadRequest, status)
+	suite.Equal("host missing.example.com has no addresses", response.Response)
+}
+
+func (suite *HostnamesSuite) TestResolverConfig() {
+	Log(log.InfoLevel, "====== Running TestResolverConfig ===========", true)
+	tt := []struct {
+		testName string
+		config   ResolverConfig
+		valid    bool
+	}{
+		{"Defaults", defaultConfig.Resolver, true},
+		{"DNS Server", ResolverConfig{Address: "1.1.1.1:53", Timeout: time.Second, Rule: HostRuleAny}, true},
+		{"Address Without Port", ResolverConfig{Address: "1.1.1.1", Rule: HostRuleAll}, false},
+		{"Negative Timeout", ResolverConfig{Timeout: -time.Second, Rule: HostRuleAll}, false},
+		{"Unknown Rule", ResolverConfig{Rule: "most"}, false},
+	}
+	for _, tc := range tt {
+		err := setupResolver(tc.config)
+		if !suite.Equal(tc.valid, err == nil, "unexpected validation on %v: %v", tc.testName, err) {
+			Log(log.InfoLevel, fmt.Sprintf("unexpected validation on %v: %v", tc.testName, err), true)
+		}
+	}
+}
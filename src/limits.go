@@ -0,0 +1,68 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+	"unicode/utf8"
+)
+
+//ServerConfig bounds how long and how much of the server a single client can hold. a zero timeout or
+//limit is unlimited
+type ServerConfig struct {
+	ReadHeaderTimeout time.Duration `mapstructure:"read header timeout"`
+	ReadTimeout       time.Duration `mapstructure:"read timeout"`
+	WriteTimeout      time.Duration `mapstructure:"write timeout"`
+	IdleTimeout       time.Duration `mapstructure:"idle timeout"`
+	MaxHeaderBytes    int           `mapstructure:"max header bytes"`
+	MaxBodyBytes      int64         `mapstructure:"max body bytes"`
+	MaxEntries        int           `mapstructure:"max entries"`
+}
+
+//maxLoggedValue is how much of a caller supplied value is written to the logs
+const maxLoggedValue = 64
+
+//newServer builds the http server with the configured timeouts and header limit
+func newServer(handler http.Handler, config ServerConfig) *http.Server {
+	return &http.Server{
+		Handler:           handler,
+		ReadHeaderTimeout: config.ReadHeaderTimeout,
+		ReadTimeout:       config.ReadTimeout,
+		WriteTimeout:      config.WriteTimeout,
+		IdleTimeout:       config.IdleTimeout,
+		MaxHeaderBytes:    config.MaxHeaderBytes,
+	}
+}
+
+//limitBodyMiddleware caps every request body at the max body bytes. reading past the cap fails and
+//the connection is closed once the response is written
+func limitBodyMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if maxBodyBytes := requestRuntime(r).maxBodyBytes; maxBodyBytes > 0 && r.Body != nil {
+			r.Body = http.MaxBytesReader(w, r.Body, maxBodyBytes)
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+//checkEntryCount rejects a whitelist or blacklist of a request with more than the max entries
+func checkEntryCount(r *http.Request, field string, entries []string) error {
+	if maxEntries := requestRuntime(r).maxEntries; maxEntries > 0 && len(entries) > maxEntries {
+		return &FieldError{Field: field, Message: fmt.Sprintf("must have at most %v entries, got %v", maxEntries, len(entries))}
+	}
+	return nil
+}
+
+//sanitizeLogValue makes a caller supplied value safe to write to the logs. it is cut to
+//maxLoggedValue bytes and quoted, so control characters and newlines can't forge log lines
+func sanitizeLogValue(value string) string {
+	if len(value) > maxLoggedValue {
+		cut := maxLoggedValue
+		for cut > 0 && !utf8.RuneStart(value[cut]) {
+			cut--
+		}
+		return strconv.Quote(value[:cut]) + "..."
+	}
+	return strconv.Quote(value)
+}
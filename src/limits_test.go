@@ -0,0 +1,148 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/suite"
+)
+
+func TestLimitsSuite(t *testing.T) {
+	limitsSuite := new(LimitsSuite)
+	suite.Run(t, limitsSuite)
+}
+
+type LimitsSuite struct {
+	suite.Suite
+}
+
+func (suite *LimitsSuite) SetupSuite() {
+	setLogPath("./logs/")
+	Log(log.InfoLevel, "=============== Running Limits Suite ======================", true)
+	setupDB("./test-data/test-data.mmdb")
+}
+
+func (suite *LimitsSuite) TearDownTest() {
+	updateRuntime(func(state *runtimeState) {
+		state.maxBodyBytes = defaultConfig.Server.MaxBodyBytes
+		state.maxEntries = defaultConfig.Server.MaxEntries
+	})
+}
+
+func (suite *LimitsSuite) TearDownSuite() {
+	compiling.Wait()
+	testProvider().Close()
+	Log(log.InfoLevel, "========== Limits Testsuite completed ===========", true)
+	fmt.Println("========== Limits Testsuite completed ===========")
+}
+
+func (suite *LimitsSuite) TestNewServer() {
+	Log(log.InfoLevel, "====== Running TestNewServer ===========", true)
+	srv := newServer(http.NotFoundHandler(), defaultConfig.Server)
+	suite.Equal(5*time.Second, srv.ReadHeaderTimeout)
+	suite.Equal(10*time.Second, srv.ReadTimeout)
+	suite.Equal(10*time.Second, srv.WriteTimeout)
+	suite.Equal(2*time.Minute, srv.IdleTimeout)
+	suite.Equal(64*1024, srv.MaxHeaderBytes)
+}
+
+func (suite *LimitsSuite) TestBodyLimit() {
+	Log(log.InfoLevel, "====== Running TestBodyLimit ===========", true)
+	updateRuntime(func(state *runtimeState) { state.maxBodyBytes = 64 })
+	large := `{"whitelisted_countries": ["` + strings.Repeat("china", 20) + `"]}`
+	tt := []struct {
+		testName string
+		method   string
+		path     string
+		body     string
+		status   int
+		expected string
+	}{
+		{"Within Limit", http.MethodGet, "/checkWhitelist/1.207.235.255", `{"whitelisted_countries": ["china"]}`, http.StatusOK, "whitelisted"},
+		{"Check Over Limit", http.MethodGet, "/checkWhitelist/1.207.235.255", large, http.StatusRequestEntityTooLarge, "invalid request body: must be at most 64 bytes"},
+		{"Policy Over Limit", http.MethodPut, "/admin/policies/asia", large, http.StatusRequestEntityTooLarge, "invalid request body: must be at most 64 bytes"},
+		{"Correction Over Limit", http.MethodPost, "/admin/corrections", large, http.StatusRequestEntityTooLarge, "invalid request body: must be at most 64 bytes"},
+	}
+	for _, tc := range tt {
+		var resp ResponseStruct
+		status := serveJSON(tc.method, tc.path, tc.body, &resp)
+		if !suite.Equal(tc.status, status, "unexpected status on %v", tc.testName) {
+			Log(log.InfoLevel, fmt.Sprintf("unexpected status on %v: %v", tc.testName, status), true)
+		}
+		suite.Equal(tc.expected, resp.Response, "unexpected response on %v", tc.testName)
+	}
+}
+
+func (suite *LimitsSuite) TestEntryLimit() {
+	Log(log.InfoLevel, "====== Running TestEntryLimit ===========", true)
+	updateRuntime(func(state *runtimeState) { state.maxEntries = 2 })
+	tt := []struct {
+		testName string
+		method   string
+		path     string
+		body     string
+		status   int
+		field    string
+		expected string
+	}{
+		{"Within Limit", http.MethodGet, "/checkWhitelist/1.207.235.255", `{"whitelisted_countries": ["china", "japan"]}`, http.StatusOK, "", "whitelisted"},
+		{"Whitelist Over Limit", http.MethodGet, "/checkWhitelist/1.207.235.255", `{"whitelisted_countries": ["china", "japan", "brazil"]}`, http.StatusBadRequest,
+			"whitelisted_countries", "invalid request body: whitelisted_countries must have at most 2 entries, got 3"},
+		{"Blacklist Over Limit", http.MethodGet, "/checkWhitelist/1.207.235.255", `{"blacklisted_countries": ["china", "japan", "brazil"]}`, http.StatusBadRequest,
+			"blacklisted_countries", "invalid request body: blacklisted_countries must have at most 2 entries, got 3"},
+		{"Policy Over Limit", http.MethodPut, "/admin/policies/asia", `{"blacklist": ["china", "japan", "brazil"]}`, http.StatusBadRequest,
+			"blacklist", "invalid request body: blacklist must have at most 2 entries, got 3"},
+	}
+	for _, tc := range tt {
+		var resp ResponseStruct
+		status := serveJSON(tc.method, tc.path, tc.body, &resp)
+		if !suite.Equal(tc.status, status, "unexpected status on %v", tc.testName) {
+			Log(log.InfoLevel, fmt.Sprintf("unexpected status on %v: %v", tc.testName, status), true)
+		}
+		suite.Equal(tc.field, resp.Field, "unexpected field on %v", tc.testName)
+		suite.Equal(tc.expected, resp.Response, "unexpected response on %v", tc.testName)
+	}
+}
+
+//TestInvalidIP validates an {ip} that isn't an address is rejected before it is looked up
+func (suite *LimitsSuite) TestInvalidIP() {
+	Log(log.InfoLevel, "====== Running TestInvalidIP ===========", true)
+	for _, path := range []string{"/checkWhitelist/not%0Aan%25s-ip", "/lookup/not%0Aan%25s-ip"} {
+		var resp ResponseStruct
+		status := serveJSON(http.MethodGet, path, `{"whitelisted_countries": ["china"]}`, &resp)
+		suite.Equal(http.StatusBadRequest, status, "unexpected status on %v", path)
+		suite.Equal("invalid ip value", resp.Response, "unexpected response on %v", path)
+	}
+	//the zone is whatever the caller sent too, so it isn't echoed back
+	for _, path := range []string{"/checkWhitelist/fe80::1%25eth0%0Aforged", "/lookup/fe80::1%25eth0%0Aforged"} {
+		var resp ResponseStruct
+		status := serveJSON(http.MethodGet, path, `{"whitelisted_countries": ["china"]}`, &resp)
+		suite.Equal(http.StatusBadRequest, status, "unexpected status on %v", path)
+		suite.Equal("ip addresses with a zone aren't supported", resp.Response, "unexpected response on %v", path)
+	}
+}
+
+func (suite *LimitsSuite) TestSanitizeLogValue() {
+	Log(log.InfoLevel, "====== Running TestSanitizeLogValue ===========", true)
+	tt := []struct {
+		testName string
+		value    string
+		expected string
+	}{
+		{"Address", "1.207.235.255", `"1.207.235.255"`},
+		{"Forged Line", "1.2.3.4\nlevel=info msg=forged", `"1.2.3.4\nlevel=info msg=forged"`},
+		{"Control Characters", "1.2.3.4\x1b[2J\r", `"1.2.3.4\x1b[2J\r"`},
+		{"Format Verbs", "%s%v", `"%s%v"`},
+		{"Too Long", strings.Repeat("a", 100), `"` + strings.Repeat("a", 64) + `"...`},
+		{"Cut Rune", strings.Repeat("a", 63) + "é", `"` + strings.Repeat("a", 63) + `"...`},
+	}
+	for _, tc := range tt {
+		if !suite.Equal(tc.expected, sanitizeLogValue(tc.value), "unexpected value on %v", tc.testName) {
+			Log(log.InfoLevel, fmt.Sprintf("unexpected value on %v", tc.testName), true)
+		}
+	}
+}
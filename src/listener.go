@@ -0,0 +1,148 @@
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+//listenFDsStart is the first file descriptor systemd passes to a socket activated process
+var listenFDsStart = 3
+
+//socketActivated reports whether systemd passed listening sockets to this process
+func socketActivated() bool {
+	pid, err := strconv.Atoi(os.Getenv("LISTEN_PID"))
+	if err != nil || pid != os.Getpid() {
+		return false
+	}
+	count, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	return err == nil && count > 0
+}
+
+//setupListeners opens the listeners the server accepts connections on. sockets passed by systemd
+//socket activation replace the configured ones; otherwise the tcp port and the unix socket are
+//opened when set
+func setupListeners(config Config) ([]net.Listener, error) {
+	listeners, err := systemdListeners()
+	if err != nil || len(listeners) > 0 {
+		return listeners, err
+	}
+	if config.Port != "" {
+		listener, err := net.Listen("tcp", ":"+config.Port)
+		if err != nil {
+			return nil, err
+		}
+		listeners = append(listeners, listener)
+	}
+	if config.SocketPath != "" {
+		mode, err := parseSocketMode(config.SocketMode)
+		if err != nil {
+			closeListeners(listeners)
+			return nil, fmt.Errorf("socket mode: %v", err)
+		}
+		listener, err := listenUnix(config.SocketPath, mode)
+		if err != nil {
+			closeListeners(listeners)
+			return nil, fmt.Errorf("socket path: %v", err)
+		}
+		listeners = append(listeners, listener)
+	}
+	return listeners, nil
+}
+
+//systemdListeners returns the sockets passed with LISTEN_PID, LISTEN_FDS and LISTEN_FDNAMES, or
+//none when the process wasn't socket activated. the variables are cleared so child processes don't
+//think the sockets are theirs
+func systemdListeners() ([]net.Listener, error) {
+	if !socketActivated() {
+		return nil, nil
+	}
+	count, _ := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	names := strings.Split(os.Getenv("LISTEN_FDNAMES"), ":")
+	os.Unsetenv("LISTEN_PID")
+	os.Unsetenv("LISTEN_FDS")
+	os.Unsetenv("LISTEN_FDNAMES")
+
+	var listeners []net.Listener
+	for i := 0; i < count; i++ {
+		fd := listenFDsStart + i
+		syscall.CloseOnExec(fd)
+		name := fmt.Sprintf("fd %v", fd)
+		if i < len(names) && names[i] != "" {
+			name = names[i]
+		}
+		file := os.NewFile(uintptr(fd), name)
+		listener, err := net.FileListener(file)
+		file.Close()
+		if err != nil {
+			closeListeners(listeners)
+			return nil, fmt.Errorf("socket activation %v: %v", name, err)
+		}
+		listeners = append(listeners, listener)
+	}
+	return listeners, nil
+}
+
+//listenUnix listens on a unix socket at path with the given permissions. the socket is created with
+//no permissions and then opened up, so it is never reachable with looser ones. a socket left behind
+//by a previous run is replaced, but not one that is still accepting connections or a file that
+//isn't a socket
+func listenUnix(path string, mode os.FileMode) (net.Listener, error) {
+	if info, err := os.Lstat(path); err == nil {
+		if info.Mode()&os.ModeSocket == 0 {
+			return nil, fmt.Errorf("%v exists and is not a socket", path)
+		}
+		if conn, err := net.Dial("unix", path); err == nil {
+			conn.Close()
+			return nil, fmt.Errorf("%v is in use", path)
+		}
+		os.Remove(path)
+	}
+	umask := syscall.Umask(0777)
+	listener, err := net.Listen("unix", path)
+	syscall.Umask(umask)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Chmod(path, mode); err != nil {
+		listener.Close()
+		return nil, err
+	}
+	return listener, nil
+}
+
+//parseSocketMode parses octal permission bits such as 0660
+func parseSocketMode(value string) (os.FileMode, error) {
+	mode, err := strconv.ParseUint(value, 8, 32)
+	if err != nil || mode > 0777 {
+		return 0, fmt.Errorf("must be octal permissions such as 0660, got %q", value)
+	}
+	return os.FileMode(mode), nil
+}
+
+//wrapListener adds PROXY protocol parsing and tls to tcp listeners. unix sockets are local, so they
+//are served as they are
+func wrapListener(listener net.Listener, tlsConfig *tls.Config) net.Listener {
+	if listener.Addr().Network() != "tcp" {
+		return listener
+	}
+	if ProxyProtocol {
+		listener = &proxyListener{Listener: listener}
+	}
+	//the PROXY header precedes the tls handshake, so tls wraps the proxy listener
+	if tlsConfig != nil {
+		listener = tls.NewListener(listener, tlsConfig)
+	}
+	return listener
+}
+
+//closeListeners closes listeners opened before a later one failed
+func closeListeners(listeners []net.Listener) {
+	for _, listener := range listeners {
+		listener.Close()
+	}
+}
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"syscall"
+	"testing"
+
+	jsoniter "github.com/json-iterator/go"
+	log "github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/suite"
+)
+
+func TestListenerSuite(t *testing.T) {
+	listenerSuite := new(ListenerSuite)
+	suite.Run(t, listenerSuite)
+}
+
+type ListenerSuite struct {
+	suite.Suite
+	dir string
+}
+
+func (suite *ListenerSuite) SetupSuite() {
+	setLogPath("./logs/")
+	Log(log.InfoLevel, "=============== Running Listener Suite ======================", true)
+	setupDB("./test-data/test-data.mmdb")
+	suite.dir, _ = os.MkdirTemp("", "listener-test")
+}
+
+func (suite *ListenerSuite) TearDownSuite() {
+	compiling.Wait()
+	testProvider().Close()
+	os.RemoveAll(suite.dir)
+	Log(log.InfoLevel, "========== Listener Testsuite completed ===========", true)
+	fmt.Println("========== Listener Testsuite completed ===========")
+}
+
+//unixClient returns an http client that sends every request to the unix socket at path, which is how
+//go clients connect when the service listens on a socket
+func unixClient(path string) *http.Client {
+	return &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			return (&net.Dialer{}).DialContext(ctx, "unix", path)
+		},
+	}}
+}
+
+//TestUnixSocket validates the router is served on a unix socket with the configured permissions, and
+//that the checked ip of socket callers comes from the forwarding headers
+func (suite *ListenerSuite) TestUnixSocket() {
+	Log(log.InfoLevel, "====== Running TestUnixSocket ===========", true)
+	path := filepath.Join(suite.dir, "whitelist.sock")
+	listener, err := listenUnix(path, 0600)
+	if !suite.NoError(err, "was expecting no error, returned %v", err) {
+		Log(log.InfoLevel, fmt.Sprintf("was expecting no error, returned %v", err), true)
+		return
+	}
+	info, _ := os.Stat(path)
+	suite.Equal(os.FileMode(0600), info.Mode().Perm())
+	suite.NotZero(info.Mode() & os.ModeSocket)
+
+	srv := &http.Server{Handler: setupRouter()}
+	go srv.Serve(listener)
+	defer srv.Close()
+	client := unixClient(path)
+
+	resp, err := client.Get("http://whitelist/")
+	suite.Require().NoError(err)
+	resp.Body.Close()
+	suite.Equal(http.StatusOK, resp.StatusCode)
+
+	tt := []struct {
+		testName  string
+		forwarded string
+		status    int
+		expected  string
+	}{
+		{"Forwarded Caller", "1.207.235.255", http.StatusOK, "whitelisted"},
+		{"Forwarded Chain", "1.0.16.1, 1.207.235.255", http.StatusOK, "whitelisted"},
+		{"No Forwarded Header", "", http.StatusBadRequest, "unable to determine client ip, unix socket callers must send the forwarded header"},
+	}
+	for _, tc := range tt {
+		req, _ := http.NewRequest(http.MethodGet, "http://whitelist/checkWhitelist", bytes.NewBufferString(`{"whitelisted_countries": ["china"]}`))
+		if tc.forwarded != "" {
+			req.Header.Set("X-Forwarded-For", tc.forwarded)
+		}
+		resp, err := client.Do(req)
+		if !suite.NoError(err, "was expecting no error on %v, returned %v", tc.testName, err) {
+			Log(log.InfoLevel, fmt.Sprintf("was expecting no error on %v, returned %v", tc.testName, err), true)
+			continue
+		}
+		var body ResponseStruct
+		jsoniter.NewDecoder(resp.Body).Decode(&body)
+		resp.Body.Close()
+		suite.Equal(tc.status, resp.StatusCode, "unexpected status on %v", tc.testName)
+		suite.Equal(tc.expected, body.Response, "unexpected response on %v", tc.testName)
+	}
+
+	//a socket that is still being served isn't replaced
+	_, err = listenUnix(path, 0600)
+	if !suite.Error(err, "was expecting an error on a socket in use, returned ok") {
+		Log(log.InfoLevel, "was expecting an error on a socket in use, returned ok", true)
+	}
+}
+
+//TestStaleSocket validates a socket left behind by a previous run is replaced and other files are not
+func (suite *ListenerSuite) TestStaleSocket() {
+	Log(log.InfoLevel, "====== Running TestStaleSocket ===========", true)
+	path := filepath.Join(suite.dir, "stale.sock")
+	stale, _ := net.Listen("unix", path)
+	stale.(*net.UnixListener).SetUnlinkOnClose(false)
+	stale.Close()
+
+	listener, err := listenUnix(path, 0660)
+	if !suite.NoError(err, "was expecting a stale socket to be replaced, returned %v", err) {
+		Log(log.InfoLevel, fmt.Sprintf("was expecting a stale socket to be replaced, returned %v", err), true)
+		return
+	}
+	listener.Close()
+	_, err = os.Stat(path)
+	suite.True(os.IsNotExist(err), "was expecting the socket to be removed on close")
+
+	file := filepath.Join(suite.dir, "file.sock")
+	os.WriteFile(file, []byte("data"), 0644)
+	_, err = listenUnix(file, 0660)
+	if !suite.Error(err, "was expecting an error on a regular file, returned ok") {
+		Log(log.InfoLevel, "was expecting an error on a regular file, returned ok", true)
+	}
+	contents, _ := os.ReadFile(file)
+	suite.Equal("data", string(contents))
+}
+
+func (suite *ListenerSuite) TestSetupListeners() {
+	Log(log.InfoLevel, "====== Running TestSetupListeners ===========", true)
+	path := filepath.Join(suite.dir, "both.sock")
+	listeners, err := setupListeners(Config{Port: "0", SocketPath: path, SocketMode: "0660"})
+	suite.Require().NoError(err)
+	suite.Len(listeners, 2)
+	suite.Equal("tcp", listeners[0].Addr().Network())
+	suite.Equal("unix", listeners[1].Addr().Network())
+	closeListeners(listeners)
+
+	listeners, err = setupListeners(Config{SocketPath: path, SocketMode: "0660"})
+	suite.Require().NoError(err)
+	suite.Len(listeners, 1, "was expecting no tcp listener without a port")
+	closeListeners(listeners)
+
+	_, err = setupListeners(Config{SocketPath: path, SocketMode: "rw-rw----"})
+	if !suite.Error(err, "was expecting an error on an invalid socket mode, returned ok") {
+		Log(log.InfoLevel, "was expecting an error on an invalid socket mode, returned ok", true)
+	}
+	suite.Contains(err.Error(), "socket mode")
+}
+
+//TestSocketActivation validates sockets passed by systemd replace the configured listeners
+func (suite *ListenerSuite) TestSocketActivation() {
+	Log(log.InfoLevel, "====== Running TestSocketActivation ===========", true)
+	activated, err := net.Listen("tcp", "127.0.0.1:0")
+	suite.Require().NoError(err)
+	defer activated.Close()
+	file, err := activated.(*net.TCPListener).File()
+	suite.Require().NoError(err)
+
+	//the passed socket sits wherever Dup put it rather than at fd 3. setupListeners takes ownership of
+	//it, so file is closed here rather than by its finalizer, which would close whatever reused the fd
+	fd, err := syscall.Dup(int(file.Fd()))
+	file.Close()
+	suite.Require().NoError(err)
+	start := listenFDsStart
+	listenFDsStart = fd
+	defer func() { listenFDsStart = start }()
+	suite.False(socketActivated())
+	os.Setenv("LISTEN_PID", strconv.Itoa(os.Getpid()))
+	os.Setenv("LISTEN_FDS", "1")
+	os.Setenv("LISTEN_FDNAMES", "whitelist.socket")
+	suite.True(socketActivated())
+
+	listeners, err := setupListeners(Config{Port: "0", SocketPath: filepath.Join(suite.dir, "ignored.sock"), SocketMode: "0660"})
+	if !suite.NoError(err, "was expecting no error, returned %v", err) {
+		Log(log.InfoLevel, fmt.Sprintf("was expecting no error, returned %v", err), true)
+		return
+	}
+	defer closeListeners(listeners)
+	suite.Len(listeners, 1)
+	suite.Equal(activated.Addr().String(), listeners[0].Addr().String())
+	_, err = os.Stat(filepath.Join(suite.dir, "ignored.sock"))
+	suite.True(os.IsNotExist(err), "was expecting the configured socket to be left alone")
+	suite.Empty(os.Getenv("LISTEN_FDS"), "was expecting the activation variables to be cleared")
+	suite.False(socketActivated())
+}
@@ -1,14 +1,18 @@
 package main
 
 import (
+	"crypto/tls"
 	"flag"
 	"fmt"
+	"io"
+	"net"
 	"net/http"
+	"os"
+	"strings"
 
 	"github.com/gorilla/mux"
 	"github.com/oschwald/maxminddb-golang"
 	log "github.com/sirupsen/logrus"
-	"github.com/spf13/viper"
 )
 
 //config paths for application
@@ -18,44 +22,231 @@ const configFile = "config"
 //Port that server is listening on
 var Port string
 
-//LogPath is the directory for logs
-var LogPath string
-
 func main() {
-	viper.AddConfigPath(configPath)
-	viper.SetConfigName(configFile)
-	err := viper.ReadInConfig()
+	//subcommands run instead of the server, flags override config values
+	if len(os.Args) > 1 && !strings.HasPrefix(os.Args[1], "-") {
+		os.Exit(runCommand(os.Args[1:]))
+	}
+
+	config, v, err := readConfig(os.Args[1:])
+	if err == nil {
+		err = validateConfig(config)
+	}
 	if err != nil {
+		fmt.Println(err)
 		Log(log.FatalLevel, err.Error(), flag.Lookup("test.v") == nil)
 	}
 
-	//read in config values
-	Port = viper.GetString("port")
-	databasePath := viper.GetString("database path")
-	LogPath = viper.GetString("LogPath")
-	err = setupDB(databasePath)
+	//read in config values. the database, listener and tls settings are read once, everything else
+	//is applied by startConfig and reloaded on SIGHUP or when the config file changes
+	Port = config.Port
+	setLogPath(config.LogPath)
+	ProxyProtocol = config.ProxyProtocol
+	err = setupServer(config, os.Args[1:])
 	if err != nil {
 		Log(log.FatalLevel, err.Error(), flag.Lookup("test.v") == nil)
 	}
+	watchConfig(v)
 
 	router := setupRouter()
-	srv := &http.Server{
-		Addr:    ":" + Port,
-		Handler: router,
+	srv := newServer(router, config.Server)
+
+	var tlsConfig *tls.Config
+	if config.TLSCertPath != "" {
+		tlsConfig, err = setupTLS(config.TLSCertPath, config.TLSKeyPath, config.TLSMinVersion, config.TLSClientCAPath)
+		if err != nil {
+			Log(log.FatalLevel, err.Error(), flag.Lookup("test.v") == nil)
+		}
+		srv.TLSConfig = tlsConfig
+	}
+	listeners, err := setupListeners(config)
+	if err != nil {
+		Log(log.FatalLevel, err.Error(), flag.Lookup("test.v") == nil)
 	}
 
-	fmt.Printf("------- project is now listening on %v --------- \n", Port)
-	log.Fatal(srv.ListenAndServe())
+	//every listener shares the server, the first one to fail stops the process
+	served := make(chan error, len(listeners))
+	for _, listener := range listeners {
+		fmt.Printf("------- project is now listening on %v %v --------- \n", listener.Addr().Network(), listener.Addr())
+		go func(listener net.Listener) {
+			served <- srv.Serve(wrapListener(listener, tlsConfig))
+		}(listener)
+	}
+	log.Fatal(<-served)
 }
 
 //setupRouter is a basic router function that sets up the application handlers
 func setupRouter() *mux.Router {
 	router := mux.NewRouter()
 	router.HandleFunc("/checkWhitelist/{ip}", checkWhitelistHandler)
+	router.HandleFunc("/checkWhitelist", checkWhitelistHandler)
+	router.HandleFunc("/lookup/{ip}", lookupHandler)
+	router.HandleFunc("/checkWhitelist/range/{network:.+}", checkRangeHandler).Methods(http.MethodGet)
+	router.HandleFunc("/lookup/range/{network:.+}", lookupRangeHandler).Methods(http.MethodGet)
+	router.HandleFunc("/metrics", metricsHandler)
+	router.HandleFunc("/admin/corrections", listCorrectionsHandler).Methods(http.MethodGet)
+	router.HandleFunc("/admin/corrections", addCorrectionHandler).Methods(http.MethodPost)
+	router.HandleFunc("/admin/corrections/{network:.+}", removeCorrectionHandler).Methods(http.MethodDelete)
+	router.HandleFunc("/admin/policies", listPoliciesHandler).Methods(http.MethodGet)
+	router.HandleFunc("/admin/policies/{name}", getPolicyHandler).Methods(http.MethodGet)
+	router.HandleFunc("/admin/policies/{name}", savePolicyHandler).Methods(http.MethodPut)
+	router.HandleFunc("/admin/policies/{name}", deletePolicyHandler).Methods(http.MethodDelete)
+	router.HandleFunc("/admin/policies/{name}/shadow-report", shadowReportHandler).Methods(http.MethodGet)
+	router.HandleFunc("/admin/policies/{name}/export", exportPolicyHandler).Methods(http.MethodGet)
+	router.HandleFunc("/admin/schedule", scheduleHandler).Methods(http.MethodGet)
+	router.HandleFunc("/admin/usage", usageHandler).Methods(http.MethodGet)
+	router.HandleFunc("/admin/countries", countriesHandler).Methods(http.MethodGet)
+	router.HandleFunc("/admin/policies/{name}/test/{ip}", testPolicyHandler).Methods(http.MethodGet)
+	router.HandleFunc("/admin/decisions", decisionsHandler).Methods(http.MethodGet)
+	router.HandleFunc("/admin/database", databaseHandler).Methods(http.MethodGet)
+	router.HandleFunc("/admin/ui", adminUIHandler).Methods(http.MethodGet)
+	router.HandleFunc("/openapi.json", openAPIHandler).Methods(http.MethodGet)
+	router.HandleFunc("/docs", docsHandler).Methods(http.MethodGet)
 	router.HandleFunc("/", getStatusHandler)
+	//the runtime state is loaded first so the whole request sees one config. bodies are capped before anything reads them. auth runs next so metrics and rate limits see the caller identity, and metrics wraps the
+	//rate limiter so rejected requests are still counted. auth limits its own failures by client ip
+	router.Use(runtimeMiddleware, limitBodyMiddleware, authMiddleware, metricsMiddleware, rateLimitMiddleware, tenantQuotaMiddleware)
 	return router
 }
 
+//setupServer loads the databases and applies the reloadable config. database.reloaded is emitted
+//only once startConfig has set up the webhooks, so endpoints hear about the database loaded at startup
+func setupServer(config Config, args []string) error {
+	if err := setupProvider(config.Provider, config.DatabasePath); err != nil {
+		return err
+	}
+	if config.ASNDatabasePath != "" {
+		if err := setupASNDB(config.ASNDatabasePath); err != nil {
+			return err
+		}
+	}
+	if err := startConfig(config, args); err != nil {
+		return err
+	}
+	provider, err := loadedProvider()
+	if err != nil {
+		return err
+	}
+	info, _ := provider.Info()
+	EmitEvent(EventDatabaseReloaded, map[string]interface{}{"path": config.DatabasePath, "build_epoch": info.BuildEpoch})
+	return nil
+}
+
+//runCommand runs a command line subcommand and returns the process exit code
+func runCommand(args []string) int {
+	switch args[0] {
+	case "hash-key":
+		//prints the value to store in the api keys file for a raw key
+		if len(args) != 2 {
+			fmt.Println("usage: whitelist_service hash-key <key>")
+			return 2
+		}
+		fmt.Println(HashAPIKey(args[1]))
+		return 0
+	case "audit":
+		//verifies the hash chain of the audit log, defaulting to the configured location
+		if len(args) < 2 || args[1] != "verify" {
+			fmt.Println("usage: whitelist_service audit verify [audit path | -config path -key value ...]")
+			return 2
+		}
+		var dir string
+		if len(args) > 2 && !strings.HasPrefix(args[2], "-") {
+			dir = args[2]
+		} else {
+			config, err := loadConfig(args[2:])
+			if err != nil {
+				fmt.Println(err)
+				return 1
+			}
+			dir = config.AuditPath
+		}
+		verified, err := VerifyAuditLog(dir)
+		if err != nil {
+			fmt.Printf("audit log verification failed after %v entries: %v\n", verified, err)
+			return 1
+		}
+		fmt.Printf("audit log verified: %v entries\n", verified)
+		return 0
+	case "config":
+		//validates the configuration the server would start with and prints it
+		if len(args) < 2 || args[1] != "check" {
+			fmt.Println("usage: whitelist_service config check [-config path] [-key value ...]")
+			return 2
+		}
+		config, err := loadConfig(args[2:])
+		if err != nil {
+			fmt.Println(err)
+			return 1
+		}
+		printConfig(os.Stdout, config)
+		if err := validateConfig(config); err != nil {
+			fmt.Println(err)
+			return 1
+		}
+		fmt.Println("configuration ok")
+		return 0
+	case "export":
+		//prints the networks a policy allows in a firewall or proxy format. the policy is read from the
+		//configured policies file, prefixed with tenant/ for a tenant's policy
+		if len(args) < 3 || strings.HasPrefix(args[1], "-") || strings.HasPrefix(args[2], "-") {
+			fmt.Printf("usage: whitelist_service export [tenant/]<policy> <%v> [-config path] [-key value ...]\n",
+				strings.Join(ExportFormats(), "|"))
+			return 2
+		}
+		if err := exportCommand(os.Stdout, args[1], args[2], args[3:]); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		return 0
+	}
+	fmt.Printf("unknown command %v\n", args[0])
+	return 2
+}
+
+//exportCommand loads the database, aliases, corrections and policies of the config the server would
+//start with and writes the export of a policy to w
+func exportCommand(w io.Writer, name string, format string, args []string) error {
+	if err := checkExportFormat(format); err != nil {
+		return err
+	}
+	config, err := loadConfig(args)
+	if err == nil {
+		err = validateConfig(config)
+	}
+	if err != nil {
+		return err
+	}
+	setLogPath(config.LogPath)
+	tenant := DefaultTenant
+	if i := strings.Index(name, "/"); i >= 0 {
+		tenant, name = name[:i], name[i+1:]
+	}
+	//corrections take their country names from the provider, so it is loaded first
+	if err := setupProvider(config.Provider, config.DatabasePath); err != nil {
+		return err
+	}
+	if err := setupCountryAliases(config.CountryAliases); err != nil {
+		return err
+	}
+	if err := setupCorrections(config.CorrectionsPath); err != nil {
+		return err
+	}
+	//the policies file is read directly, loading it into the store would compile every policy
+	list, err := readPolicies(config.PoliciesPath)
+	if err != nil {
+		return err
+	}
+	policy, ok := list[policyKey(tenant, name)]
+	if !ok {
+		return fmt.Errorf("policy %v not found in %v", name, config.PoliciesPath)
+	}
+	export, err := ExportPolicy(policy)
+	if err != nil {
+		return err
+	}
+	return RenderExport(w, export, format)
+}
+
 //setupDB reads the database file from a specified mmdb path.
 //for future releases, we can run a curl job via a cron job or a background
 //process that can download and place files into the stage folder. from that point
@@ -64,10 +255,16 @@ func setupRouter() *mux.Router {
 //function. the curl we would want to run against:
 //https://download.maxmind.com/app/geoip_download?edition_id=GeoLite2-Country&license_key=YOUR_LICENSE_KEY&suffix=tar.gz
 func setupDB(databasePath string) error {
+	return setupProvider(ProviderMaxMind, databasePath)
+}
+
+//setupASNDB reads the optional GeoLite2-ASN database used for asn lookups and asn:<number> entries.
+//it can be downloaded the same way as the country database with edition_id=GeoLite2-ASN
+func setupASNDB(databasePath string) error {
 	db, err := maxminddb.Open(databasePath)
 	if err != nil {
 		return err
 	}
-	CountryDatabase = db
+	ASNDatabase = db
 	return nil
 }
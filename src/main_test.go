@@ -3,9 +3,12 @@ package main
 import (
 	"fmt"
 	"net/http"
+	"net/http/httptest"
+	"strings"
 	"testing"
 
 	"github.com/gorilla/mux"
+	jsoniter "github.com/json-iterator/go"
 	log "github.com/sirupsen/logrus"
 	"github.com/stretchr/testify/suite"
 )
@@ -20,8 +23,27 @@ type MainSuite struct {
 	suite.Suite
 }
 
+//serveRequest sends a request through the router with the headers, given as name and value pairs, and
+//returns the recorded response
+func serveRequest(method string, path string, body string, headers ...string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, path, strings.NewReader(body))
+	for i := 0; i+1 < len(headers); i += 2 {
+		req.Header.Set(headers[i], headers[i+1])
+	}
+	rec := httptest.NewRecorder()
+	setupRouter().ServeHTTP(rec, req)
+	return rec
+}
+
+//serveJSON sends a request through the router, decodes the response into v and returns its status
+func serveJSON(method string, path string, body string, v interface{}) int {
+	rec := serveRequest(method, path, body)
+	jsoniter.NewDecoder(rec.Body).Decode(v)
+	return rec.Code
+}
+
 func (suite *MainSuite) SetupSuite() {
-	LogPath = "./logs/"
+	setLogPath("./logs/")
 	Log(log.InfoLevel, "=============== Running Main Test Suite ======================", true)
 	Port = "8080"
 }
@@ -64,6 +86,23 @@ func (suite *MainSuite) TestSetupDB() {
 
 }
 
+//TestSetupASNDB runs setupASNDB against valid and invalid asn mmdb paths
+func (suite *MainSuite) TestSetupASNDB() {
+	Log(log.InfoLevel, fmt.Sprintf("====== Running TestSetupASNDB ==========="), true)
+	err := setupASNDB("./test-data/test-asn.mmdb")
+	if !suite.NoError(err, "was expecting no Error, returned error") {
+		Log(log.InfoLevel, fmt.Sprintf("was expecting no Error, returned error %v", err), true)
+	}
+	ASNDatabase.Close()
+	ASNDatabase = nil
+
+	err = setupASNDB("INVALIDPATH#!")
+	if !suite.Error(err, "was expecting an error, returned ok") {
+		Log(log.InfoLevel, "was expecting an error, returned ok", true)
+	}
+	suite.Nil(ASNDatabase)
+}
+
 //TestCreateRouter Runs setupRouter and validates it returns information
 func (suite *MainSuite) TestSetupRouter() {
 	Log(log.InfoLevel, fmt.Sprintf("====== Running TestSetupRouter ==========="), true)
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/netip"
+	"sync"
+
+	maxminddb "github.com/oschwald/maxminddb-golang"
+)
+
+//maxmindProvider looks countries up in a MaxMind GeoIP2/GeoLite2 country mmdb file. reading a
+//closed reader reads unmapped memory, so every read holds the read lock and checks closed, and Close
+//waits for the reads in progress
+type maxmindProvider struct {
+	mu     sync.RWMutex
+	reader *maxminddb.Reader
+	closed bool
+}
+
+//countryRecord is the subset of a GeoLite2-Country record needed to index the database. decoding
+//into a struct instead of a map keeps a full walk of the database cheap
+type countryRecord struct {
+	Country struct {
+		IsoCode string            `maxminddb:"iso_code"`
+		Names   map[string]string `maxminddb:"names"`
+	} `maxminddb:"country"`
+}
+
+//openMaxMindProvider opens the mmdb file at path
+func openMaxMindProvider(path string) (LocationProvider, error) {
+	reader, err := maxminddb.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	return &maxmindProvider{reader: reader}, nil
+}
+
+//Lookup returns the country of the record covering addr
+func (p *maxmindProvider) Lookup(addr netip.Addr) (Country, error) {
+	var country Country
+	var record map[string]interface{}
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	if err := p.checkOpen("Lookup"); err != nil {
+		return country, err
+	}
+	if err := checkIPVersion(p.reader, addr); err != nil {
+		return country, err
+	}
+	if err := p.reader.Lookup(net.IP(addr.AsSlice()), &record); err != nil {
+		return country, err
+	}
+
+	//this solution is assuming that the maxmind records will always have this uniform data structure on returning,
+	// the way this is implemented, it allows for safe unboxing in the off-chance that there are missing map values
+	countryData, ok := record["country"].(map[string]interface{})
+	if !ok {
+		return country, fmt.Errorf("failed to find country value")
+	}
+	countryNames, ok := countryData["names"].(map[string]interface{})
+	if !ok {
+		return country, fmt.Errorf("failed to find country names value")
+	}
+	name, ok := countryNames["en"].(string)
+	if !ok {
+		return country, fmt.Errorf("failed to find country name english value")
+	}
+
+	country.Name = name
+	country.Source = SourceMaxMind
+
+	//version 1.0.0 calls for a list of regular names, so this data is supplementary; however
+	//we may want to look toward this in the future since it seems to be a more uniform datatype,
+	//allowing universal support for non-english users
+	isoCode, ok := countryData["iso_code"].(string)
+	if !ok {
+		country.IsoCode = "UNKNOWN"
+	} else {
+		country.IsoCode = isoCode
+	}
+	return country, nil
+}
+
+//Networks walks the search tree, skipping the aliases of the IPv4 subtree an IPv6 database has
+func (p *maxmindProvider) Networks(within netip.Prefix, fn func(network netip.Prefix, country Country) error) error {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	if err := p.checkOpen("Networks"); err != nil {
+		return err
+	}
+	var networks *maxminddb.Networks
+	if within.IsValid() {
+		ipNet := &net.IPNet{IP: net.IP(within.Addr().AsSlice()), Mask: net.CIDRMask(within.Bits(), within.Addr().BitLen())}
+		networks = p.reader.NetworksWithin(ipNet, maxminddb.SkipAliasedNetworks)
+	} else {
+		networks = p.reader.Networks(maxminddb.SkipAliasedNetworks)
+	}
+	for networks.Next() {
+		var record countryRecord
+		network, err := networks.Network(&record)
+		if err != nil {
+			return err
+		}
+		if record.Country.IsoCode == "" {
+			continue
+		}
+		country := Country{Name: record.Country.Names["en"], IsoCode: record.Country.IsoCode, Source: SourceMaxMind}
+		if err := fn(networkPrefix(network, within.IsValid() && within.Addr().Is6()), country); err != nil {
+			return err
+		}
+	}
+	return networks.Err()
+}
+
+//Info reads the metadata of the database
+func (p *maxmindProvider) Info() (ProviderInfo, error) {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	if err := p.checkOpen("Info"); err != nil {
+		return ProviderInfo{}, err
+	}
+	return ProviderInfo{
+		Provider:   ProviderMaxMind,
+		Type:       p.reader.Metadata.DatabaseType,
+		IPVersion:  p.reader.Metadata.IPVersion,
+		BuildEpoch: p.reader.Metadata.BuildEpoch,
+		NodeCount:  p.reader.Metadata.NodeCount,
+	}, nil
+}
+
+//Close unmaps the database file once the reads in progress are done
+func (p *maxmindProvider) Close() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.closed {
+		return nil
+	}
+	p.closed = true
+	return p.reader.Close()
+}
+
+//checkOpen fails once the provider is closed. callers must hold the read lock
+func (p *maxmindProvider) checkOpen(method string) error {
+	if p.closed {
+		return fmt.Errorf("cannot call %v on a closed database", method)
+	}
+	return nil
+}
+
+//networkPrefix returns a network walked from the database as a prefix. IPv4 networks are returned
+//with 4 byte addresses, in6 puts them in the ::/96 subtree that holds them instead
+func networkPrefix(network *net.IPNet, in6 bool) netip.Prefix {
+	addr, _ := netip.AddrFromSlice(network.IP)
+	bits, _ := network.Mask.Size()
+	if in6 && addr.Is4() {
+		var mapped [16]byte
+		copy(mapped[12:], network.IP.To4())
+		addr, bits = netip.AddrFrom16(mapped), bits+96
+	}
+	return netip.PrefixFrom(addr, bits)
+}
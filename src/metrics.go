@@ -0,0 +1,110 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/gorilla/mux"
+)
+
+//metrics are the in-process counters exposed on /metrics in the prometheus text format
+var metrics = struct {
+	sync.Mutex
+	counters map[string]uint64
+}{counters: map[string]uint64{}}
+
+//IncCounter increments the counter identified by name and its label pairs
+func IncCounter(name string, labels map[string]string) {
+	AddCounter(name, labels, 1)
+}
+
+//AddCounter adds delta to the counter identified by name and its label pairs
+func AddCounter(name string, labels map[string]string, delta uint64) {
+	key := metricKey(name, labels)
+	metrics.Lock()
+	metrics.counters[key] += delta
+	metrics.Unlock()
+}
+
+//CounterValue returns the current value of a counter
+func CounterValue(name string, labels map[string]string) uint64 {
+	key := metricKey(name, labels)
+	metrics.Lock()
+	defer metrics.Unlock()
+	return metrics.counters[key]
+}
+
+//metricKey renders name{label="value",...} with labels sorted so the same set always maps to one key
+func metricKey(name string, labels map[string]string) string {
+	if len(labels) == 0 {
+		return name
+	}
+	names := make([]string, 0, len(labels))
+	for label := range labels {
+		names = append(names, label)
+	}
+	sort.Strings(names)
+	pairs := make([]string, 0, len(names))
+	for _, label := range names {
+		pairs = append(pairs, fmt.Sprintf("%v=%v", label, strconv.Quote(labels[label])))
+	}
+	return fmt.Sprintf("%v{%v}", name, strings.Join(pairs, ","))
+}
+
+//statusRecorder captures the status code written by a handler
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (s *statusRecorder) WriteHeader(status int) {
+	s.status = status
+	s.ResponseWriter.WriteHeader(status)
+}
+
+//metricsMiddleware counts every routed request by route, caller identity, tenant and response status
+func metricsMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		recorder := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(recorder, r)
+
+		route := ""
+		if current := mux.CurrentRoute(r); current != nil {
+			route, _ = current.GetPathTemplate()
+		}
+		identity := RequestIdentity(r)
+		if identity == "" {
+			identity = "anonymous"
+		}
+		IncCounter("whitelist_requests_total", tenantLabels(RequestTenant(r), map[string]string{
+			"route":    route,
+			"identity": identity,
+			"status":   strconv.Itoa(recorder.status),
+		}))
+	})
+}
+
+//metricsHandler writes the counters in the prometheus text exposition format. callers only get the
+//series of their own tenant, the default tenant's being the ones without a tenant label. every
+//tenant's series are only written for admin keys of the default tenant
+func metricsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Add("Content-Type", "text/plain; version=0.0.4")
+	tenant := RequestTenant(r)
+	everyTenant := tenant == DefaultTenant && RequestHasScope(r, ScopeAdmin)
+	metrics.Lock()
+	keys := make([]string, 0, len(metrics.counters))
+	for key := range metrics.counters {
+		if everyTenant || tenantMetric(key, tenant) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		fmt.Fprintf(w, "%v %v\n", key, metrics.counters[key])
+	}
+	metrics.Unlock()
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/suite"
+)
+
+func TestMetricsSuite(t *testing.T) {
+	metricsSuite := new(MetricsSuite)
+	suite.Run(t, metricsSuite)
+}
+
+type MetricsSuite struct {
+	suite.Suite
+}
+
+func (suite *MetricsSuite) SetupSuite() {
+	setLogPath("./logs/")
+	Log(log.InfoLevel, "=============== Running Metrics Suite ======================", true)
+}
+
+func (suite *MetricsSuite) TearDownSuite() {
+	Log(log.InfoLevel, "========== Metrics Testsuite completed ===========", true)
+	fmt.Println("========== Metrics Testsuite completed ===========")
+}
+
+func (suite *MetricsSuite) TestMetricKey() {
+	Log(log.InfoLevel, "====== Running TestMetricKey ===========", true)
+	tt := []struct {
+		name     string
+		labels   map[string]string
+		expected string
+	}{
+		{"plain_total", nil, "plain_total"},
+		{"labelled_total", map[string]string{"b": "2", "a": "1"}, `labelled_total{a="1",b="2"}`},
+		{"quoted_total", map[string]string{"identity": `CN="x"`}, `quoted_total{identity="CN=\"x\""}`},
+	}
+	for _, tc := range tt {
+		received := metricKey(tc.name, tc.labels)
+		if !suite.Equal(tc.expected, received) {
+			Log(log.InfoLevel, fmt.Sprintf("was expecting %v, received %v", tc.expected, received), true)
+		}
+	}
+}
+
+func (suite *MetricsSuite) TestCounters() {
+	Log(log.InfoLevel, "====== Running TestCounters ===========", true)
+	labels := map[string]string{"test": "counters"}
+	before := CounterValue("metrics_test_total", labels)
+	IncCounter("metrics_test_total", labels)
+	AddCounter("metrics_test_total", labels, 2)
+	suite.Equal(before+3, CounterValue("metrics_test_total", labels))
+
+	rec := httptest.NewRecorder()
+	metricsHandler(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	if !suite.True(strings.Contains(rec.Body.String(), fmt.Sprintf(`metrics_test_total{test="counters"} %v`, before+3))) {
+		Log(log.InfoLevel, fmt.Sprintf("metrics output missing counter: %v", rec.Body.String()), true)
+	}
+}
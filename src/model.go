@@ -4,93 +4,271 @@ import (
 	"flag"
 	"fmt"
 	"net"
+	"net/netip"
 	"os"
+	"strconv"
 	"strings"
 
 	maxminddb "github.com/oschwald/maxminddb-golang"
 	log "github.com/sirupsen/logrus"
 )
 
-//CountryDatabase Persistant database for country data from maxmind mmdb file
-var CountryDatabase *maxminddb.Reader
-
 //Country is the model for our country data, currently we only care about the english name value from
 //mmdb's country dataset
 type Country struct {
 	Name    string `json:"name"`
 	IsoCode string `json:"iso_code"`
+	Source  string `json:"source"`
+}
+
+//Decision is the outcome of validating an ip against whitelist/blacklist entries, along with the
+//data the decision was based on
+type Decision struct {
+	Allowed bool
+	Country Country
+	ASN     ASN
+}
+
+//ASNDatabase is the optional GeoLite2-ASN database, nil when no asn database path is configured
+var ASNDatabase *maxminddb.Reader
+
+//asnEntryPrefix marks whitelist/blacklist entries that match an autonomous system number
+const asnEntryPrefix = "asn:"
+
+//ASN is the model for autonomous system data from the GeoLite2-ASN dataset. a zero number means the
+//ip wasn't found in the database
+type ASN struct {
+	Number       uint   `maxminddb:"autonomous_system_number" json:"number"`
+	Organization string `maxminddb:"autonomous_system_organization" json:"organization"`
+}
+
+//EntryError rejects a whitelist/blacklist entry that can't be matched: a malformed asn entry, or an
+//asn entry when no asn database is loaded. it is the caller's to fix, so handlers answer it with a 400
+type EntryError struct {
+	Entry  string
+	Reason string
+}
+
+func (e *EntryError) Error() string {
+	return fmt.Sprintf("%v %q", e.Reason, e.Entry)
 }
 
 //CheckWhitelist pulls ip country information through the GetCountryData call and validates if it
 //is found in the passed whitelisted country string slice. if found, it will return true
 func CheckWhitelist(ipString string, whitelistedCountry []string) (bool, error) {
-	whitelisted := false
-	country, err := GetCountryData(ipString)
+	return CheckRules(ipString, whitelistedCountry, nil)
+}
+
+//CheckRules validates an ip against whitelist and blacklist entries, which are either country names
+//or asn:<number>. a blacklist match always denies. otherwise the ip has to match a whitelist entry,
+//unless only a blacklist was passed, in which case everything not blacklisted is allowed
+func CheckRules(ipString string, whitelist []string, blacklist []string) (bool, error) {
+	decision, err := Evaluate(ipString, whitelist, blacklist)
+	return decision.Allowed, err
+}
+
+//Evaluate runs the CheckRules validation and returns the full decision
+func Evaluate(ipString string, whitelist []string, blacklist []string) (Decision, error) {
+	return EvaluateTenant(DefaultTenant, ipString, whitelist, blacklist)
+}
+
+//EvaluateTenant is Evaluate with the tenant's corrections applied to the country data
+func EvaluateTenant(tenant string, ipString string, whitelist []string, blacklist []string) (Decision, error) {
+	var decision Decision
+	country, err := GetTenantCountryData(tenant, ipString)
 	if err != nil {
 		Log(log.ErrorLevel, err.Error(), flag.Lookup("test.v") == nil)
-		return whitelisted, err
+		return decision, err
 	}
-	for _, v := range whitelistedCountry {
-		if strings.ToUpper(v) == strings.ToUpper(country.Name) {
+	decision.Country = country
+
+	//the asn database is only consulted when an asn entry needs it
+	var asn ASN
+	if entry, ok := firstASNEntry(whitelist, blacklist); ok {
+		if ASNDatabase == nil {
+			err = &EntryError{Entry: entry, Reason: "no asn database loaded for asn entry"}
+			Log(log.ErrorLevel, err.Error(), flag.Lookup("test.v") == nil)
+			return decision, err
+		}
+		asn, err = GetASNData(ipString)
+		if err != nil {
+			Log(log.ErrorLevel, err.Error(), flag.Lookup("test.v") == nil)
+			return decision, err
+		}
+		decision.ASN = asn
+	}
+
+	decision.Allowed, err = decide(whitelist, blacklist, country, asn)
+	return decision, err
+}
+
+//decide applies the whitelist/blacklist rules described on CheckRules to an ip's country and asn
+func decide(whitelist []string, blacklist []string, country Country, asn ASN) (bool, error) {
+	for _, v := range blacklist {
+		matched, err := matchEntry(v, country, asn)
+		if err != nil {
+			return false, err
+		}
+		if matched {
+			return false, nil
+		}
+	}
+	if len(whitelist) == 0 && len(blacklist) > 0 {
+		return true, nil
+	}
+	whitelisted := false
+	for _, v := range whitelist {
+		matched, err := matchEntry(v, country, asn)
+		if err != nil {
+			return false, err
+		}
+		if matched {
 			whitelisted = true
 		}
 	}
 	return whitelisted, nil
 }
 
-//GetCountryData parses the IP string value and returns a populated Country struct for use from the
-//mmdb file
+//hasASNEntry reports whether any of the entries is an asn entry
+func hasASNEntry(entries []string) bool {
+	_, ok := firstASNEntry(entries)
+	return ok
+}
+
+//firstASNEntry returns the first asn entry of the lists
+func firstASNEntry(lists ...[]string) (string, bool) {
+	for _, entries := range lists {
+		for _, v := range entries {
+			if strings.HasPrefix(strings.ToLower(strings.TrimSpace(v)), asnEntryPrefix) {
+				return v, true
+			}
+		}
+	}
+	return "", false
+}
+
+//matchEntry compares a single whitelist/blacklist entry against the ip's country and asn. country
+//aliases and iso codes are compared by iso code, anything else by english name
+func matchEntry(entry string, country Country, asn ASN) (bool, error) {
+	entry = strings.TrimSpace(entry)
+	if number, ok, err := parseASNEntry(entry); ok {
+		if err != nil {
+			Log(log.ErrorLevel, err.Error(), flag.Lookup("test.v") == nil)
+			return false, err
+		}
+		return asn.Number != 0 && number == asn.Number, nil
+	}
+	if iso, ok := resolveCountryAlias(entry); ok {
+		return iso == strings.ToUpper(country.IsoCode), nil
+	}
+	return strings.ToUpper(entry) == strings.ToUpper(country.Name), nil
+}
+
+//parseASNEntry reads the number of an asn:<number> entry. ok is false for entries that aren't asn
+//entries, and the error is set for asn entries without a valid 32 bit number
+func parseASNEntry(entry string) (uint, bool, error) {
+	entry = strings.TrimSpace(entry)
+	if !strings.HasPrefix(strings.ToLower(entry), asnEntryPrefix) {
+		return 0, false, nil
+	}
+	number, err := strconv.ParseUint(strings.TrimSpace(entry[len(asnEntryPrefix):]), 10, 32)
+	if err != nil {
+		return 0, true, &EntryError{Entry: entry, Reason: "invalid asn entry"}
+	}
+	return uint(number), true, nil
+}
+
+//ParseAddr parses an ip the way every lookup reads it. IPv4-mapped IPv6 addresses are unmapped to the
+//IPv4 address, and addresses that can't belong to a single host somewhere are rejected: zoned
+//link-local addresses, the unspecified address and multicast groups
+func ParseAddr(ipString string) (netip.Addr, error) {
+	addr, err := netip.ParseAddr(ipString)
+	switch {
+	case err != nil:
+		return netip.Addr{}, fmt.Errorf("invalid ip value")
+	case addr.Zone() != "":
+		return netip.Addr{}, fmt.Errorf("ip addresses with a zone aren't supported")
+	}
+	addr = addr.Unmap()
+	switch {
+	case addr.IsUnspecified():
+		return netip.Addr{}, fmt.Errorf("the unspecified address %v has no location", addr)
+	case addr.IsMulticast():
+		return netip.Addr{}, fmt.Errorf("multicast address %v has no location", addr)
+	}
+	return addr, nil
+}
+
+//checkIPVersion rejects IPv6 addresses for a database that only holds IPv4 data, which would
+//otherwise fail with a less helpful reader error
+func checkIPVersion(db *maxminddb.Reader, addr netip.Addr) error {
+	if db != nil && db.Metadata.IPVersion == 4 && addr.Is6() {
+		return fmt.Errorf("%v is an ipv6 address and the %v database only holds ipv4 data", addr, db.Metadata.DatabaseType)
+	}
+	return nil
+}
+
+//GetCountryData parses the IP string value and returns a populated Country struct, from the local
+//corrections overlay when a correction covers the ip and otherwise from the loaded provider
 func GetCountryData(ipString string) (Country, error) {
+	return GetTenantCountryData(DefaultTenant, ipString)
+}
+
+//GetTenantCountryData is GetCountryData with only the tenant's corrections in the overlay
+func GetTenantCountryData(tenant string, ipString string) (Country, error) {
 	var country Country
-	var record map[string]interface{}
-	ip := net.ParseIP(ipString)
-	err := CountryDatabase.Lookup(ip, &record)
+	addr, err := ParseAddr(ipString)
 	if err != nil {
 		Log(log.ErrorLevel, err.Error(), flag.Lookup("test.v") == nil)
 		return country, err
 	}
-
-	//this solution is assuming that the maxmind records will always have this uniform data structure on returning,
-	// the way this is implemented, it allows for safe unboxing in the off-chance that there are missing map values
-	countryData, ok := record["country"].(map[string]interface{})
-	if !ok {
-		err := fmt.Errorf("failed to find country value")
+	if correction, ok := findCorrection(tenant, net.IP(addr.AsSlice())); ok {
+		return Country{Name: correction.Name, IsoCode: correction.IsoCode, Source: SourceOverlay}, nil
+	}
+	provider, err := loadedProvider()
+	if err == nil {
+		country, err = provider.Lookup(addr)
+	}
+	if err != nil {
 		Log(log.ErrorLevel, err.Error(), flag.Lookup("test.v") == nil)
 		return country, err
 	}
-	countryNames, ok := countryData["names"].(map[string]interface{})
-	if !ok {
-		err := fmt.Errorf("failed to find country names value")
+	return country, nil
+}
+
+//GetASNData parses the IP string value and returns the autonomous system the ip belongs to from the
+//asn mmdb file
+func GetASNData(ipString string) (ASN, error) {
+	var asn ASN
+	if ASNDatabase == nil {
+		err := fmt.Errorf("no asn database loaded")
 		Log(log.ErrorLevel, err.Error(), flag.Lookup("test.v") == nil)
-		return country, err
+		return asn, err
 	}
-	name, ok := countryNames["en"].(string)
-	if !ok {
-		err := fmt.Errorf("failed to find country name english value")
+	addr, err := ParseAddr(ipString)
+	if err == nil {
+		err = checkIPVersion(ASNDatabase, addr)
+	}
+	if err != nil {
 		Log(log.ErrorLevel, err.Error(), flag.Lookup("test.v") == nil)
-		return country, err
+		return asn, err
 	}
-
-	country.Name = name
-
-	//version 1.0.0 calls for a list of regular names, so this data is supplementary; however
-	//we may want to look toward this in the future since it seems to be a more uniform datatype,
-	//allowing universal support for non-english users
-	isoCode, ok := countryData["iso_code"].(string)
-	if !ok {
-		country.IsoCode = "UNKNOWN"
-	} else {
-		country.IsoCode = isoCode
+	err = ASNDatabase.Lookup(net.IP(addr.AsSlice()), &asn)
+	if err != nil {
+		Log(log.ErrorLevel, err.Error(), flag.Lookup("test.v") == nil)
+		return asn, err
 	}
-
-	return country, nil
+	return asn, nil
 }
 
-//Log is a basic logging function. look to implement rolling logs in the future releases
+//Log is a basic logging function. look to implement rolling logs in the future releases. messages
+//less severe than the configured log level are dropped, fatal and panic messages never are. msg is written as it is,
+//never used as a format string
 func Log(level log.Level, msg string, runLog bool) error {
-	if runLog {
+	state := currentRuntime()
+	if runLog && (level <= state.logLevel || level <= log.FatalLevel) {
 		log.SetLevel(level)
-		logpath := fmt.Sprintf("%v%v.log", LogPath, level)
+		logpath := fmt.Sprintf("%v%v.log", state.logPath, level)
 		f, logErr := os.OpenFile(logpath, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0755)
 		if logErr != nil {
 			fmt.Println(logErr)
@@ -100,17 +278,17 @@ func Log(level log.Level, msg string, runLog bool) error {
 		log.SetOutput(f)
 		switch level {
 		case log.PanicLevel:
-			log.Panicf(msg)
+			log.Panic(msg)
 		case log.FatalLevel:
-			log.Fatalf(msg)
+			log.Fatal(msg)
 		case log.ErrorLevel:
-			log.Errorf(msg)
+			log.Error(msg)
 		case log.WarnLevel:
-			log.Warnf(msg)
+			log.Warn(msg)
 		case log.InfoLevel:
-			log.Infof(msg)
+			log.Info(msg)
 		case log.DebugLevel:
-			log.Debugf(msg)
+			log.Debug(msg)
 		}
 	}
 	return nil
@@ -1,9 +1,14 @@
 package main
 
 import (
+	"errors"
 	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
 	"testing"
 
+	jsoniter "github.com/json-iterator/go"
 	log "github.com/sirupsen/logrus"
 	"github.com/stretchr/testify/suite"
 )
@@ -19,15 +24,18 @@ func TestModelSuite(t *testing.T) {
 }
 
 func (suite *ModelSuite) SetupSuite() {
-	LogPath = "./logs/"
+	setLogPath("./logs/")
 	Log(log.InfoLevel, "=============== Running Model Suite ======================", true)
 	setupDB("./test-data/test-data.mmdb")
+	setupASNDB("./test-data/test-asn.mmdb")
 }
 
 func (suite *ModelSuite) TearDownSuite() {
 	fmt.Println("========== Model Testsuite completed ===========")
 	Log(log.InfoLevel, "=============== Model Testsuite completed ======================", true)
-	CountryDatabase.Close()
+	testProvider().Close()
+	ASNDatabase.Close()
+	ASNDatabase = nil
 }
 
 func (suite *ModelSuite) TestInvalidCheckWhitelist() {
@@ -51,7 +59,7 @@ func (suite *ModelSuite) TestInvalidCheckWhitelist() {
 		}
 	}
 
-	CountryDatabase.Close()
+	testProvider().Close()
 
 	_, err := CheckWhitelist(validIP, validCountryList)
 
@@ -84,7 +92,7 @@ func (suite *ModelSuite) TestInvalidGetCountryData() {
 		}
 	}
 
-	CountryDatabase.Close()
+	testProvider().Close()
 
 	_, err := GetCountryData(validIP)
 
@@ -153,6 +161,173 @@ func (suite *ModelSuite) TestCheckWhitelist() {
 	fmt.Println("================ TestGetCountryData Completed =================")
 }
 
+func (suite *ModelSuite) TestGetASNData() {
+	Log(log.InfoLevel, fmt.Sprintf("====== Running TestGetASNData ==========="), true)
+	//test constants from static test-asn.mmdb file
+	testCases := []struct {
+		casename string
+		ip       string
+		expected ASN
+	}{
+		{"China Telecom", "1.207.235.255", ASN{Number: 4134, Organization: "CHINANET-BACKBONE"}},
+		{"Cloudflare", "1.1.1.1", ASN{Number: 13335, Organization: "CLOUDFLARENET"}},
+		{"IPv6", "2001:4860::8888", ASN{Number: 15169, Organization: "GOOGLE"}},
+		{"Not In Database", "9.9.9.9", ASN{}},
+	}
+
+	for _, testcase := range testCases {
+		result, err := GetASNData(testcase.ip)
+		if !suite.NoError(err, "was expecting no error, returned %v", err) {
+			Log(log.InfoLevel, fmt.Sprintf("was expecting no error, returned %v on case %v", err, testcase.casename), true)
+		}
+		if !suite.Equal(testcase.expected, result) {
+			Log(log.InfoLevel, fmt.Sprintf("was expecting %v, returned %v on case %v", testcase.expected, result, testcase.casename), true)
+		}
+	}
+
+	asnDatabase := ASNDatabase
+	ASNDatabase = nil
+	_, err := GetASNData("1.1.1.1")
+	if !suite.Error(err, "was expecting an error without an asn database, returned ok") {
+		Log(log.InfoLevel, "was expecting an error without an asn database, returned ok", true)
+	}
+	ASNDatabase = asnDatabase
+
+	fmt.Println("============ TestGetASNData Completed ==================")
+}
+
+func (suite *ModelSuite) TestIPv6CountryData() {
+	Log(log.InfoLevel, fmt.Sprintf("====== Running TestIPv6CountryData ==========="), true)
+	//2001:200::/32 is Japan and 2001:220::/32 South Korea in the static test data
+	testCases := []struct {
+		casename string
+		ip       string
+		expected string
+		err      string
+	}{
+		{"IPv6", "2001:200::1", "JP", ""},
+		{"IPv6 Uppercase", "2001:220::ABCD", "KR", ""},
+		{"IPv4-Mapped", "::ffff:1.207.235.255", "CN", ""},
+		{"IPv4-Mapped Hex", "::ffff:1cf:ebff", "CN", ""},
+		{"Zoned", "fe80::1%eth0", "", "ip addresses with a zone aren't supported"},
+		{"Zoned IPv4-Mapped", "::ffff:1.207.235.255%1", "", "ip addresses with a zone aren't supported"},
+		{"Unspecified IPv6", "::", "", "the unspecified address :: has no location"},
+		{"Unspecified IPv4", "0.0.0.0", "", "the unspecified address 0.0.0.0 has no location"},
+		{"Unspecified IPv4-Mapped", "::ffff:0.0.0.0", "", "the unspecified address 0.0.0.0 has no location"},
+		{"Multicast IPv6", "ff02::1", "", "multicast address ff02::1 has no location"},
+		{"Multicast IPv4", "224.0.0.1", "", "multicast address 224.0.0.1 has no location"},
+		{"Bracketed", "[2001:200::1]", "", "invalid ip value"},
+		{"With Port", "1.207.235.255:80", "", "invalid ip value"},
+	}
+
+	for _, testcase := range testCases {
+		result, err := GetCountryData(testcase.ip)
+		if testcase.err != "" {
+			if !suite.EqualError(err, testcase.err, "unexpected error on case %v", testcase.casename) {
+				Log(log.InfoLevel, fmt.Sprintf("was expecting error %v, returned %v on case %v", testcase.err, err, testcase.casename), true)
+			}
+			continue
+		}
+		if !suite.NoError(err, "was expecting no error, returned %v", err) {
+			Log(log.InfoLevel, fmt.Sprintf("was expecting no error, returned %v on case %v", err, testcase.casename), true)
+		}
+		if !suite.Equal(testcase.expected, result.IsoCode, "unexpected country on case %v", testcase.casename) {
+			Log(log.InfoLevel, fmt.Sprintf("was expecting %v, returned %v on case %v", testcase.expected, result.IsoCode, testcase.casename), true)
+		}
+	}
+
+	//an IPv4 only database can't answer for IPv6 addresses, but mapped IPv4 addresses still work
+	testProvider().(*maxmindProvider).reader.Metadata.IPVersion = 4
+	_, err := GetCountryData("2001:200::1")
+	if !suite.EqualError(err, "2001:200::1 is an ipv6 address and the GeoLite2-Country database only holds ipv4 data") {
+		Log(log.InfoLevel, fmt.Sprintf("was expecting an ip version error, returned %v", err), true)
+	}
+	result, err := GetCountryData("::ffff:1.207.235.255")
+	suite.NoError(err, "was expecting no error on a mapped address, returned %v", err)
+	suite.Equal("CN", result.IsoCode)
+	testProvider().(*maxmindProvider).reader.Metadata.IPVersion = 6
+
+	allowed, err := CheckRules("::ffff:1.207.235.255", []string{"china"}, nil)
+	suite.NoError(err)
+	suite.True(allowed, "a mapped address should be decided as its IPv4 address")
+	asn, err := GetASNData("::ffff:1.207.235.255")
+	suite.NoError(err)
+	suite.Equal(uint(4134), asn.Number)
+
+	fmt.Println("============ TestIPv6CountryData Completed ==================")
+}
+
+func (suite *ModelSuite) TestCheckRules() {
+	Log(log.InfoLevel, fmt.Sprintf("====== Running TestCheckRules ==========="), true)
+	//1.207.235.255 is China on AS4134, 1.1.1.1 is Australia on AS13335 in the static test data
+	testCases := []struct {
+		casename  string
+		ip        string
+		whitelist []string
+		blacklist []string
+		expected  bool
+	}{
+		{"Country Whitelisted", "1.207.235.255", []string{"china"}, nil, true},
+		{"ASN Whitelisted", "1.1.1.1", []string{"united states", "asn:13335"}, nil, true},
+		{"ASN Not Whitelisted", "1.1.1.1", []string{"asn:4134"}, nil, false},
+		{"ASN Blacklisted Overrides Country", "1.207.235.255", []string{"china"}, []string{"ASN:4134"}, false},
+		{"Country Blacklisted", "1.207.235.255", []string{"asn:4134"}, []string{"China"}, false},
+		{"Blacklist Only Allows Others", "1.1.1.1", nil, []string{"china", "asn:4134"}, true},
+		{"Blacklist Only Denies Match", "1.207.235.255", nil, []string{"asn:4134"}, false},
+		{"Unknown ASN Never Matches", "9.9.9.9", []string{"asn:0"}, nil, false},
+	}
+
+	for _, testcase := range testCases {
+		result, err := CheckRules(testcase.ip, testcase.whitelist, testcase.blacklist)
+		if !suite.NoError(err, "was expecting no error, returned %v", err) {
+			Log(log.InfoLevel, fmt.Sprintf("was expecting no error, returned %v on case %v", err, testcase.casename), true)
+		}
+		if !suite.Equal(testcase.expected, result, "unexpected result on case %v", testcase.casename) {
+			Log(log.InfoLevel, fmt.Sprintf("was expecting %v, returned %v on case %v", testcase.expected, result, testcase.casename), true)
+		}
+	}
+
+	_, err := CheckRules("1.1.1.1", []string{"asn:cloudflare"}, nil)
+	if !suite.Error(err, "was expecting an error on an invalid asn entry, returned ok") {
+		Log(log.InfoLevel, "was expecting an error on an invalid asn entry, returned ok", true)
+	}
+	var entryErr *EntryError
+	suite.True(errors.As(err, &entryErr), "was expecting an entry error, returned %v", err)
+
+	fmt.Println("============ TestCheckRules Completed ==================")
+}
+
+//TestEntryErrors validates entries that can't be matched are answered as the caller's error
+func (suite *ModelSuite) TestEntryErrors() {
+	Log(log.InfoLevel, "====== Running TestEntryErrors ===========", true)
+	asnDB := ASNDatabase
+	defer func() { ASNDatabase = asnDB }()
+	tt := []struct {
+		testName string
+		path     string
+		body     string
+		noASN    bool
+		response string
+	}{
+		{"Invalid ASN Entry", "/checkWhitelist/1.1.1.1?lenient=true", `{"whitelisted_countries": ["asn:cloudflare"]}`, false, `invalid asn entry "asn:cloudflare"`},
+		{"No ASN Database", "/checkWhitelist/1.1.1.1", `{"whitelisted_countries": ["Australia", "asn:13335"]}`, true, `no asn database loaded for asn entry "asn:13335"`},
+	}
+	for _, tc := range tt {
+		ASNDatabase = asnDB
+		if tc.noASN {
+			ASNDatabase = nil
+		}
+		rec := httptest.NewRecorder()
+		setupRouter().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, tc.path, strings.NewReader(tc.body)))
+		var response ResponseStruct
+		jsoniter.NewDecoder(rec.Body).Decode(&response)
+		if !suite.Equal(http.StatusBadRequest, rec.Code, "was expecting a 400 on %v, received %v", tc.testName, rec.Code) {
+			Log(log.InfoLevel, fmt.Sprintf("was expecting a 400 on %v, received %v", tc.testName, rec.Code), true)
+		}
+		suite.Equal(tc.response, response.Response, "unexpected response on %v", tc.testName)
+	}
+}
+
 func (suite *ModelSuite) TestLog() {
 
 	err := Log(log.DebugLevel, "testing", true)
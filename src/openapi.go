@@ -0,0 +1,283 @@
+package main
+
+import (
+	"bytes"
+	_ "embed"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	jsoniter "github.com/json-iterator/go"
+)
+
+//openAPIDocument is the OpenAPI 3 description of every route, served at /openapi.json and used to
+//validate request bodies
+//
+//go:embed api/openapi.json
+var openAPIDocument []byte
+
+//docsPage renders openAPIDocument in the browser at /docs
+//
+//go:embed api/docs.html
+var docsPage []byte
+
+//openAPISpec is the parsed openAPIDocument
+var openAPISpec = parseOpenAPI(openAPIDocument)
+
+//openAPIPatterns holds every schema pattern of openAPISpec compiled, keyed by the pattern
+var openAPIPatterns = mustCompilePatterns(openAPISpec)
+
+//parseOpenAPI parses the embedded document, panicking at startup if it isn't valid json
+func parseOpenAPI(document []byte) map[string]interface{} {
+	var spec map[string]interface{}
+	if err := jsoniter.Unmarshal(document, &spec); err != nil {
+		panic(fmt.Sprintf("invalid openapi document: %v", err))
+	}
+	return spec
+}
+
+//mustCompilePatterns compiles the patterns of the document, panicking at startup if one is invalid
+func mustCompilePatterns(spec map[string]interface{}) map[string]*regexp.Regexp {
+	patterns := map[string]*regexp.Regexp{}
+	if err := compilePatterns(spec, patterns); err != nil {
+		panic(fmt.Sprintf("invalid openapi document: %v", err))
+	}
+	return patterns
+}
+
+//compilePatterns compiles every pattern found under node into patterns
+func compilePatterns(node interface{}, patterns map[string]*regexp.Regexp) error {
+	switch v := node.(type) {
+	case map[string]interface{}:
+		for key, child := range v {
+			pattern, ok := child.(string)
+			if key != "pattern" || !ok {
+				if err := compilePatterns(child, patterns); err != nil {
+					return err
+				}
+				continue
+			}
+			if _, compiled := patterns[pattern]; compiled {
+				continue
+			}
+			re, err := regexp.Compile(pattern)
+			if err != nil {
+				return fmt.Errorf("invalid pattern %q: %v", pattern, err)
+			}
+			patterns[pattern] = re
+		}
+	case []interface{}:
+		for _, child := range v {
+			if err := compilePatterns(child, patterns); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+//openAPIHandler serves the OpenAPI document
+func openAPIHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Add("Content-Type", "application/json")
+	w.Write(openAPIDocument)
+}
+
+//docsHandler serves the api viewer
+func docsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Add("Content-Type", "text/html; charset=utf-8")
+	w.Write(docsPage)
+}
+
+//FieldError is a request body that doesn't match its schema in the OpenAPI document. field is the
+//path to the failing value, e.g. whitelisted_countries[1], and empty when the body as a whole is wrong
+type FieldError struct {
+	Field   string
+	Message string
+	Err     error
+}
+
+func (e *FieldError) Error() string {
+	if e.Field == "" {
+		return fmt.Sprintf("invalid request body: %v", e.Message)
+	}
+	return fmt.Sprintf("invalid request body: %v %v", e.Field, e.Message)
+}
+
+//Unwrap returns the read error behind the FieldError, if any
+func (e *FieldError) Unwrap() error {
+	return e.Err
+}
+
+//decodeRequest validates the request body against the named schema in components/schemas of the
+//OpenAPI document and then decodes it into v
+func decodeRequest(r *http.Request, schemaName string, v interface{}) error {
+	body, err := io.ReadAll(r.Body)
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		return &FieldError{Message: fmt.Sprintf("must be at most %v bytes", tooLarge.Limit), Err: err}
+	}
+	if err != nil {
+		return &FieldError{Message: err.Error(), Err: err}
+	}
+	if len(bytes.TrimSpace(body)) == 0 {
+		return &FieldError{Message: "is required"}
+	}
+	var value interface{}
+	if err := jsoniter.Unmarshal(body, &value); err != nil {
+		return &FieldError{Message: "is not valid json"}
+	}
+	schema := resolveSchema(map[string]interface{}{"$ref": "#/components/schemas/" + schemaName})
+	if schema == nil {
+		return fmt.Errorf("no schema %v in the openapi document", schemaName)
+	}
+	if err := validateSchema(schema, value, ""); err != nil {
+		return err
+	}
+	if err := jsoniter.Unmarshal(body, v); err != nil {
+		return &FieldError{Message: err.Error()}
+	}
+	return nil
+}
+
+//resolveSchema follows local $refs such as #/components/schemas/Policy, returning nil for a ref
+//that doesn't exist
+func resolveSchema(schema map[string]interface{}) map[string]interface{} {
+	for schema != nil {
+		ref, ok := schema["$ref"].(string)
+		if !ok {
+			return schema
+		}
+		var node interface{} = openAPISpec
+		for _, key := range strings.Split(strings.TrimPrefix(ref, "#/"), "/") {
+			parent, _ := node.(map[string]interface{})
+			node = parent[key]
+		}
+		schema, _ = node.(map[string]interface{})
+	}
+	return nil
+}
+
+//jsonType names the json type of a decoded value the way schemas do
+func jsonType(value interface{}) string {
+	switch v := value.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return "boolean"
+	case float64:
+		if v == math.Trunc(v) {
+			return "integer"
+		}
+		return "number"
+	case string:
+		return "string"
+	case []interface{}:
+		return "array"
+	}
+	return "object"
+}
+
+//validateSchema checks a decoded json value against the subset of OpenAPI schemas the document uses:
+//type, nullable, properties, required, additionalProperties, items, enum, pattern, format date-time
+//and allOf
+func validateSchema(schema map[string]interface{}, value interface{}, field string) *FieldError {
+	schema = resolveSchema(schema)
+	if schema == nil {
+		return nil
+	}
+	if all, ok := schema["allOf"].([]interface{}); ok {
+		for _, sub := range all {
+			subSchema, _ := sub.(map[string]interface{})
+			if err := validateSchema(subSchema, value, field); err != nil {
+				return err
+			}
+		}
+	}
+	expected, _ := schema["type"].(string)
+	if expected == "" {
+		return nil
+	}
+	actual := jsonType(value)
+	if actual == "null" && schema["nullable"] == true {
+		return nil
+	}
+	if actual != expected && !(expected == "number" && actual == "integer") {
+		return &FieldError{Field: field, Message: fmt.Sprintf("must be %v %v, got %v", article(expected), expected, actual)}
+	}
+
+	switch v := value.(type) {
+	case map[string]interface{}:
+		properties, _ := schema["properties"].(map[string]interface{})
+		required, _ := schema["required"].([]interface{})
+		for _, name := range required {
+			if _, ok := v[name.(string)]; !ok {
+				return &FieldError{Field: joinField(field, name.(string)), Message: "is required"}
+			}
+		}
+		names := make([]string, 0, len(v))
+		for name := range v {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			property, ok := properties[name].(map[string]interface{})
+			if !ok {
+				if schema["additionalProperties"] == false {
+					return &FieldError{Field: joinField(field, name), Message: "is not a known field"}
+				}
+				continue
+			}
+			if err := validateSchema(property, v[name], joinField(field, name)); err != nil {
+				return err
+			}
+		}
+	case []interface{}:
+		items, _ := schema["items"].(map[string]interface{})
+		for i, item := range v {
+			if err := validateSchema(items, item, fmt.Sprintf("%v[%v]", field, i)); err != nil {
+				return err
+			}
+		}
+	case string:
+		if enum, ok := schema["enum"].([]interface{}); ok {
+			found := false
+			for _, allowed := range enum {
+				found = found || allowed == v
+			}
+			if !found {
+				return &FieldError{Field: field, Message: fmt.Sprintf("must be one of %v", enum)}
+			}
+		}
+		if pattern, ok := schema["pattern"].(string); ok && !openAPIPatterns[pattern].MatchString(v) {
+			return &FieldError{Field: field, Message: fmt.Sprintf("must match %v", pattern)}
+		}
+		if schema["format"] == "date-time" {
+			if _, err := time.Parse(time.RFC3339, v); err != nil {
+				return &FieldError{Field: field, Message: "must be an RFC 3339 date-time"}
+			}
+		}
+	}
+	return nil
+}
+
+//joinField appends a property name to a field path
+func joinField(field string, name string) string {
+	if field == "" {
+		return name
+	}
+	return field + "." + name
+}
+
+//article returns the indefinite article for a json type name
+func article(typeName string) string {
+	if strings.ContainsAny(typeName[:1], "aeiou") {
+		return "an"
+	}
+	return "a"
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+	jsoniter "github.com/json-iterator/go"
+	log "github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/suite"
+)
+
+func TestOpenAPISuite(t *testing.T) {
+	openAPISuite := new(OpenAPISuite)
+	suite.Run(t, openAPISuite)
+}
+
+type OpenAPISuite struct {
+	suite.Suite
+}
+
+func (suite *OpenAPISuite) SetupSuite() {
+	setLogPath("./logs/")
+	Log(log.InfoLevel, "=============== Running OpenAPI Suite ======================", true)
+}
+
+func (suite *OpenAPISuite) TearDownSuite() {
+	Log(log.InfoLevel, "========== OpenAPI Testsuite completed ===========", true)
+	fmt.Println("========== OpenAPI Testsuite completed ===========")
+}
+
+//TestDocumentCoversRoutes validates every route in the router is described in the document and the
+//document describes no route the router doesn't serve
+func (suite *OpenAPISuite) TestDocumentCoversRoutes() {
+	Log(log.InfoLevel, "====== Running TestDocumentCoversRoutes ===========", true)
+	paths := openAPISpec["paths"].(map[string]interface{})
+	//mux templates carry variable patterns, {network:.+}, that OpenAPI paths don't
+	variablePattern := regexp.MustCompile(`\{(\w+):[^}]*\}`)
+	served := map[string]bool{}
+	setupRouter().Walk(func(route *mux.Route, router *mux.Router, ancestors []*mux.Route) error {
+		template, _ := route.GetPathTemplate()
+		path := variablePattern.ReplaceAllString(template, "{$1}")
+		methods, err := route.GetMethods()
+		if err != nil {
+			//routes without a method restriction only answer gets
+			methods = []string{http.MethodGet}
+		}
+		for _, method := range methods {
+			method = strings.ToLower(method)
+			served[path+" "+method] = true
+			item, _ := paths[path].(map[string]interface{})
+			if !suite.Contains(item, method, "was expecting %v %v in the openapi document", method, path) {
+				Log(log.InfoLevel, fmt.Sprintf("was expecting %v %v in the openapi document", method, path), true)
+			}
+		}
+		return nil
+	})
+	for path, item := range paths {
+		for method := range item.(map[string]interface{}) {
+			if method != "parameters" {
+				suite.True(served[path+" "+method], "the openapi document describes %v %v, which isn't routed", method, path)
+			}
+		}
+	}
+}
+
+//TestCompilePatterns validates every pattern of the document is compiled up front and invalid ones
+//are reported
+func (suite *OpenAPISuite) TestCompilePatterns() {
+	Log(log.InfoLevel, "====== Running TestCompilePatterns ===========", true)
+	suite.Len(openAPIPatterns, 3)
+	suite.Contains(openAPIPatterns, "^[A-Za-z]{2}$")
+
+	err := compilePatterns(map[string]interface{}{"properties": map[string]interface{}{
+		"pattern": map[string]interface{}{"type": "string", "pattern": "["}}}, map[string]*regexp.Regexp{})
+	if !suite.Error(err) {
+		Log(log.InfoLevel, "was expecting an invalid pattern to be reported", true)
+		return
+	}
+	suite.Contains(err.Error(), `invalid pattern "["`)
+	suite.Panics(func() { mustCompilePatterns(map[string]interface{}{"pattern": "("}) })
+}
+
+func (suite *OpenAPISuite) TestDecodeRequest() {
+	Log(log.InfoLevel, "====== Running TestDecodeRequest ===========", true)
+	tt := []struct {
+		testName string
+		schema   string
+		body     string
+		field    string
+		expected string
+	}{
+		{"Valid Request", "WhitelistRequest", `{"whitelisted_countries": ["china"], "blacklisted_countries": null}`, "", ""},
+		{"Valid Policy Request", "WhitelistRequest", `{"policy": "asia"}`, "", ""},
+		{"Empty Body", "WhitelistRequest", ``, "", "invalid request body: is required"},
+		{"Invalid Json", "WhitelistRequest", `INVALID#!`, "", "invalid request body: is not valid json"},
+		{"Not An Object", "WhitelistRequest", `["china"]`, "", "invalid request body: must be an object, got array"},
+		{"Wrong Type", "WhitelistRequest", `{"whitelisted_countries": "china"}`, "whitelisted_countries", "invalid request body: whitelisted_countries must be an array, got string"},
+		{"Wrong Item Type", "WhitelistRequest", `{"whitelisted_countries": ["china", 7]}`, "whitelisted_countries[1]", "invalid request body: whitelisted_countries[1] must be a string, got integer"},
+		{"Unknown Field", "WhitelistRequest", `{"whitelist": ["china"]}`, "whitelist", "invalid request body: whitelist is not a known field"},
+		{"Invalid Policy Name", "WhitelistRequest", `{"policy": "../etc"}`, "policy", "invalid request body: policy must match ^[A-Za-z0-9_-]*$"},
+		{"Valid Correction", "Correction", `{"network": "1.207.235.0/24", "iso_code": "US", "expires": "2030-01-01T00:00:00Z"}`, "", ""},
+		{"Missing Required", "Correction", `{"iso_code": "US"}`, "network", "invalid request body: network is required"},
+		{"Invalid Date", "Correction", `{"network": "1.207.235.0/24", "iso_code": "US", "expires": "tomorrow"}`, "expires", "invalid request body: expires must be an RFC 3339 date-time"},
+		{"Invalid Version", "Policy", `{"version": 1.5}`, "version", "invalid request body: version must be an integer, got number"},
+	}
+	for _, tc := range tt {
+		var decoded interface{}
+		switch tc.schema {
+		case "WhitelistRequest":
+			decoded = &WhitelistRequest{}
+		case "Correction":
+			decoded = &Correction{}
+		case "Policy":
+			decoded = &Policy{}
+		}
+		req := httptest.NewRequest(http.MethodGet, "/", bytes.NewBufferString(tc.body))
+		err := decodeRequest(req, tc.schema, decoded)
+		if tc.expected == "" {
+			if !suite.NoError(err, "was expecting no error on %v, returned %v", tc.testName, err) {
+				Log(log.InfoLevel, fmt.Sprintf("was expecting no error on %v, returned %v", tc.testName, err), true)
+			}
+			continue
+		}
+		if !suite.Error(err, "was expecting an error on %v, returned ok", tc.testName) {
+			Log(log.InfoLevel, fmt.Sprintf("was expecting an error on %v, returned ok", tc.testName), true)
+			continue
+		}
+		suite.Equal(tc.expected, err.Error(), "unexpected error on %v", tc.testName)
+		suite.Equal(tc.field, err.(*FieldError).Field, "unexpected field on %v", tc.testName)
+	}
+
+	var req WhitelistRequest
+	decodeRequest(httptest.NewRequest(http.MethodGet, "/", bytes.NewBufferString(`{"whitelisted_countries": ["china"]}`)), "WhitelistRequest", &req)
+	suite.Equal([]string{"china"}, req.WhitelistedCountries)
+}
+
+//TestOpenAPIHandlers validates the document, the viewer and field errors are served through the router
+func (suite *OpenAPISuite) TestOpenAPIHandlers() {
+	Log(log.InfoLevel, "====== Running TestOpenAPIHandlers ===========", true)
+	router := setupRouter()
+
+	rec := httptest.NewRecorder()
+	router.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/openapi.json", nil))
+	var document map[string]interface{}
+	err := jsoniter.NewDecoder(rec.Body).Decode(&document)
+	if !suite.NoError(err, "was expecting the document to be json, returned %v", err) {
+		Log(log.InfoLevel, fmt.Sprintf("was expecting the document to be json, returned %v", err), true)
+	}
+	suite.Equal(http.StatusOK, rec.Code)
+	suite.Equal("3.0.3", document["openapi"])
+
+	rec = httptest.NewRecorder()
+	router.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/docs", nil))
+	suite.Equal(http.StatusOK, rec.Code)
+	suite.Contains(rec.Header().Get("Content-Type"), "text/html")
+	suite.Contains(rec.Body.String(), `fetch("openapi.json")`)
+
+	rec = httptest.NewRecorder()
+	router.ServeHTTP(rec, httptest.NewRequest(http.MethodPut, "/admin/policies/asia", bytes.NewBufferString(`{"whitelist": "china"}`)))
+	var resp ResponseStruct
+	jsoniter.NewDecoder(rec.Body).Decode(&resp)
+	suite.Equal(http.StatusBadRequest, rec.Code)
+	suite.Equal(ResponseStruct{Response: "invalid request body: whitelist must be an array, got string", Field: "whitelist"}, resp)
+}
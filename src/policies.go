@@ -0,0 +1,236 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"regexp"
+	"sort"
+	"sync"
+
+	jsoniter "github.com/json-iterator/go"
+)
+
+//Policy is a named set of whitelist/blacklist entries that callers can check against instead of
+//passing the lists on every request. version is bumped on every change. a policy with shadow set is a
+//candidate for the policy it names: it is evaluated on every check against that policy and where
+//it would decide differently is recorded, but it is never enforced. schedules are entries that are
+//only part of the lists while their schedule is active. names are unique per tenant, and a shadow
+//always shadows a policy of its own tenant
+type Policy struct {
+	Name      string           `json:"name"`
+	Version   int              `json:"version"`
+	Whitelist []string         `json:"whitelist"`
+	Blacklist []string         `json:"blacklist"`
+	Shadow    string           `json:"shadow,omitempty"`
+	Schedules []ScheduledEntry `json:"schedules,omitempty"`
+	Tenant    string           `json:"tenant,omitempty"`
+}
+
+//policyNamePattern restricts policy names to values that are safe in paths and file names
+var policyNamePattern = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+
+//policies is the policy store, persisted to the policies file and keyed by policyKey
+var policies = struct {
+	sync.RWMutex
+	path    string
+	entries map[string]Policy
+}{entries: map[string]Policy{}}
+
+//setupPolicies loads the policies file and compiles every policy against the loaded database. a
+//missing file is an empty store, it is created on the first change made through the admin api
+func setupPolicies(path string) error {
+	entries, err := readPolicies(path)
+	if err != nil {
+		return err
+	}
+	policies.Lock()
+	policies.path = path
+	policies.entries = entries
+	policies.Unlock()
+	//versions restart with the file, so decisions compiled from the previous one can't be kept
+	compiledPolicies.Lock()
+	compiledPolicies.entries = map[string]*compiledPolicy{}
+	compiledPolicies.Unlock()
+	recompilePolicies()
+	return nil
+}
+
+//readPolicies parses and validates the policies file into policies keyed by policyKey, without
+//touching the store
+func readPolicies(path string) (map[string]Policy, error) {
+	var list []Policy
+	data, err := os.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	if len(data) > 0 {
+		if err := jsoniter.Unmarshal(data, &list); err != nil {
+			return nil, fmt.Errorf("failed to parse policies file: %v", err)
+		}
+	}
+	entries := map[string]Policy{}
+	for _, policy := range list {
+		if err := validatePolicy(policy); err != nil {
+			return nil, err
+		}
+		policy.Schedules = parsedSchedules(policy.Schedules)
+		entries[policyKey(policy.Tenant, policy.Name)] = policy
+	}
+	return entries, nil
+}
+
+//policyKey is the store key of a tenant's policy. policy and tenant names can't contain a slash
+func policyKey(tenant string, name string) string {
+	return tenant + "/" + name
+}
+
+//validatePolicy checks the policy, shadowed policy and tenant names, that every asn entry parses and
+//that every schedule is valid
+func validatePolicy(policy Policy) error {
+	if !policyNamePattern.MatchString(policy.Name) {
+		return fmt.Errorf("invalid policy name %q", policy.Name)
+	}
+	if policy.Tenant != DefaultTenant && !policyNamePattern.MatchString(policy.Tenant) {
+		return fmt.Errorf("invalid tenant name %q for policy %v", policy.Tenant, policy.Name)
+	}
+	if policy.Shadow != "" && (!policyNamePattern.MatchString(policy.Shadow) || policy.Shadow == policy.Name) {
+		return fmt.Errorf("invalid shadowed policy name %q", policy.Shadow)
+	}
+	for _, entry := range append(append([]string{}, policy.Whitelist...), policy.Blacklist...) {
+		if _, err := matchEntry(entry, Country{}, ASN{}); err != nil {
+			return err
+		}
+	}
+	for _, scheduled := range policy.Schedules {
+		if err := scheduled.validate(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+//GetPolicy returns the tenant's named policy
+func GetPolicy(tenant string, name string) (Policy, bool) {
+	policies.RLock()
+	defer policies.RUnlock()
+	policy, ok := policies.entries[policyKey(tenant, name)]
+	return policy, ok
+}
+
+//ListPolicies returns every policy of the tenant sorted by name
+func ListPolicies(tenant string) []Policy {
+	list := []Policy{}
+	for _, policy := range allPolicies() {
+		if policy.Tenant == tenant {
+			list = append(list, policy)
+		}
+	}
+	return list
+}
+
+//allPolicies returns the policies of every tenant sorted by tenant and name
+func allPolicies() []Policy {
+	policies.RLock()
+	defer policies.RUnlock()
+	list := make([]Policy, 0, len(policies.entries))
+	for _, policy := range policies.entries {
+		list = append(list, policy)
+	}
+	sortPolicies(list)
+	return list
+}
+
+//sortPolicies sorts policies by tenant and name
+func sortPolicies(list []Policy) {
+	sort.Slice(list, func(i, j int) bool {
+		if list[i].Tenant != list[j].Tenant {
+			return list[i].Tenant < list[j].Tenant
+		}
+		return list[i].Name < list[j].Name
+	})
+}
+
+//countPolicies returns how many policies the tenant has. callers must hold the lock
+func countPolicies(tenant string) int {
+	count := 0
+	for _, policy := range policies.entries {
+		if policy.Tenant == tenant {
+			count++
+		}
+	}
+	return count
+}
+
+//SavePolicy creates or replaces a policy of the policy's tenant, bumping its version, persists the
+//store and recompiles it. creating a policy fails with a QuotaError when the tenant has no room left
+func SavePolicy(policy Policy) (Policy, error) {
+	if err := validatePolicy(policy); err != nil {
+		return policy, err
+	}
+	policy.Schedules = parsedSchedules(policy.Schedules)
+	key := policyKey(policy.Tenant, policy.Name)
+	policies.Lock()
+	previous, existed := policies.entries[key]
+	if !existed {
+		if err := checkTenantQuota(policy.Tenant, "policies", countPolicies(policy.Tenant)); err != nil {
+			policies.Unlock()
+			return policy, err
+		}
+	}
+	policy.Version = previous.Version + 1
+	policies.entries[key] = policy
+	if err := savePolicies(); err != nil {
+		if existed {
+			policies.entries[key] = previous
+		} else {
+			delete(policies.entries, key)
+		}
+		policies.Unlock()
+		return policy, err
+	}
+	policies.Unlock()
+	compileInBackground(policy)
+	return policy, nil
+}
+
+//DeletePolicy removes a tenant's policy and its compiled decisions
+func DeletePolicy(tenant string, name string) error {
+	key := policyKey(tenant, name)
+	policies.Lock()
+	previous, ok := policies.entries[key]
+	if !ok {
+		policies.Unlock()
+		return fmt.Errorf("policy %v not found", name)
+	}
+	delete(policies.entries, key)
+	if err := savePolicies(); err != nil {
+		policies.entries[key] = previous
+		policies.Unlock()
+		return err
+	}
+	policies.Unlock()
+	dropCompiledPolicy(key)
+	dropShadowStats(key)
+	return nil
+}
+
+//savePolicies writes the store back to its file through a temp file. callers must hold the write lock
+func savePolicies() error {
+	if policies.path == "" {
+		return fmt.Errorf("no policies path configured")
+	}
+	list := make([]Policy, 0, len(policies.entries))
+	for _, policy := range policies.entries {
+		list = append(list, policy)
+	}
+	sortPolicies(list)
+	data, err := jsoniter.MarshalIndent(list, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := policies.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, policies.path)
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/suite"
+)
+
+func TestPoliciesSuite(t *testing.T) {
+	policiesSuite := new(PoliciesSuite)
+	suite.Run(t, policiesSuite)
+}
+
+type PoliciesSuite struct {
+	suite.Suite
+	dir string
+}
+
+func (suite *PoliciesSuite) SetupSuite() {
+	setLogPath("./logs/")
+	Log(log.InfoLevel, "=============== Running Policies Suite ======================", true)
+	setupDB("./test-data/test-data.mmdb")
+	suite.dir, _ = os.MkdirTemp("", "policies-test")
+}
+
+func (suite *PoliciesSuite) SetupTest() {
+	os.Remove(filepath.Join(suite.dir, "policies.json"))
+	setupPolicies(filepath.Join(suite.dir, "policies.json"))
+}
+
+func (suite *PoliciesSuite) TearDownSuite() {
+	setupPolicies("")
+	compiling.Wait()
+	testProvider().Close()
+	os.RemoveAll(suite.dir)
+	Log(log.InfoLevel, "========== Policies Testsuite completed ===========", true)
+	fmt.Println("========== Policies Testsuite completed ===========")
+}
+
+func (suite *PoliciesSuite) TestSetupPolicies() {
+	Log(log.InfoLevel, "====== Running TestSetupPolicies ===========", true)
+	path := filepath.Join(suite.dir, "load.json")
+	os.WriteFile(path, []byte(`[{"name": "emea", "version": 3, "whitelist": ["germany", "france"]}]`), 0644)
+	err := setupPolicies(path)
+	if !suite.NoError(err, "was expecting no error, returned %v", err) {
+		Log(log.InfoLevel, fmt.Sprintf("was expecting no error, returned %v", err), true)
+	}
+	policy, ok := GetPolicy(DefaultTenant, "emea")
+	suite.True(ok)
+	suite.Equal(Policy{Name: "emea", Version: 3, Whitelist: []string{"germany", "france"}}, policy)
+
+	tt := []struct {
+		testName string
+		contents string
+	}{
+		{"Invalid Json", `INVALID#!`},
+		{"Invalid Name", `[{"name": "../etc"}]`},
+		{"Invalid ASN Entry", `[{"name": "partners", "whitelist": ["asn:partner"]}]`},
+		{"Shadow Of Itself", `[{"name": "emea", "shadow": "emea"}]`},
+	}
+	for _, tc := range tt {
+		os.WriteFile(path, []byte(tc.contents), 0644)
+		err := setupPolicies(path)
+		if !suite.Error(err, "was expecting an error on %v, returned ok", tc.testName) {
+			Log(log.InfoLevel, fmt.Sprintf("was expecting an error on %v, returned ok", tc.testName), true)
+		}
+	}
+}
+
+func (suite *PoliciesSuite) TestSaveDeletePolicy() {
+	Log(log.InfoLevel, "====== Running TestSaveDeletePolicy ===========", true)
+	policy, err := SavePolicy(Policy{Name: "americas", Whitelist: []string{"united states"}})
+	suite.NoError(err)
+	suite.Equal(1, policy.Version)
+	policy, err = SavePolicy(Policy{Name: "americas", Whitelist: []string{"united states", "canada"}})
+	suite.NoError(err)
+	suite.Equal(2, policy.Version, "was expecting the version to be bumped")
+
+	_, err = SavePolicy(Policy{Name: "bad name"})
+	if !suite.Error(err, "was expecting an error on an invalid name, returned ok") {
+		Log(log.InfoLevel, "was expecting an error on an invalid name, returned ok", true)
+	}
+
+	//changes are persisted and survive a reload
+	setupPolicies(filepath.Join(suite.dir, "policies.json"))
+	suite.Equal([]Policy{policy}, ListPolicies(DefaultTenant))
+
+	suite.NoError(DeletePolicy(DefaultTenant, "americas"))
+	suite.Empty(ListPolicies(DefaultTenant))
+	err = DeletePolicy(DefaultTenant, "americas")
+	if !suite.Error(err, "was expecting an error deleting a missing policy, returned ok") {
+		Log(log.InfoLevel, "was expecting an error deleting a missing policy, returned ok", true)
+	}
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"fmt"
+	"net/netip"
+	"sort"
+	"strings"
+	"sync/atomic"
+)
+
+//location provider names, selected with the provider key of the config
+const (
+	ProviderMaxMind = "maxmind"
+)
+
+//LocationProvider looks up the country of an address. every country lookup, database walk and
+//status report goes through the loaded provider, so other sources can be added next to the maxmind
+//database by implementing it and registering an opener in locationProviders
+type LocationProvider interface {
+	//Lookup returns the country of an address, with the provider as its source
+	Lookup(addr netip.Addr) (Country, error)
+	//Networks calls fn for every network with a country that overlaps within, in address order, or
+	//for every network when within is the zero prefix. networks overlapping an IPv6 prefix are in
+	//IPv6 form, so IPv4 networks are in the ::/96 subtree that holds them. an error returned by fn
+	//stops the walk and is returned
+	Networks(within netip.Prefix, fn func(network netip.Prefix, country Country) error) error
+	//Info describes the data the provider serves, and fails when it can't be read
+	Info() (ProviderInfo, error)
+	Close() error
+}
+
+//ProviderInfo describes the data a provider serves. the build epoch is when the data was built, and
+//node count is only set for providers that are a search tree
+type ProviderInfo struct {
+	Provider   string
+	Type       string
+	IPVersion  uint
+	BuildEpoch uint
+	NodeCount  uint
+}
+
+//providerDatabase is a loaded provider with the index of its countries and its network table, built
+//together when the provider is loaded so neither requests nor policy compiles walk the database
+type providerDatabase struct {
+	provider LocationProvider
+	networks *networkTable
+}
+
+//activeDatabase is the provider country data is looked up in. it's swapped while requests and
+//background compiles read it, so it's only read through loadedDatabase and loadedProvider
+var activeDatabase atomic.Pointer[providerDatabase]
+
+//locationProviders open each provider from the database path of the config
+var locationProviders = map[string]func(path string) (LocationProvider, error){
+	ProviderMaxMind: openMaxMindProvider,
+}
+
+//checkProviderName rejects a provider there is no opener for
+func checkProviderName(name string) error {
+	if _, ok := locationProviders[name]; ok {
+		return nil
+	}
+	names := make([]string, 0, len(locationProviders))
+	for known := range locationProviders {
+		names = append(names, known)
+	}
+	sort.Strings(names)
+	return fmt.Errorf("unknown provider %q, expected one of %v", name, strings.Join(names, ", "))
+}
+
+//setupProvider opens the named provider from a database path and loads it
+func setupProvider(name string, databasePath string) error {
+	if err := checkProviderName(name); err != nil {
+		return err
+	}
+	provider, err := locationProviders[name](databasePath)
+	if err != nil {
+		return err
+	}
+	if err := useProvider(provider); err != nil {
+		provider.Close()
+		return err
+	}
+	return nil
+}
+
+//useProvider indexes the countries and networks of a provider and makes it the one country data is
+//looked up in
+func useProvider(provider LocationProvider) error {
+	networks, err := buildNetworkTable(provider)
+	if err != nil {
+		return fmt.Errorf("failed to index the database: %v", err)
+	}
+	activeDatabase.Store(&providerDatabase{provider: provider, networks: networks})
+	//compiled policy decisions are tied to the provider they were built from
+	recompilePolicies()
+	return nil
+}
+
+//loadedDatabase returns the loaded provider with its network table, failing when there is none
+func loadedDatabase() (*providerDatabase, error) {
+	database := activeDatabase.Load()
+	if database == nil {
+		return nil, fmt.Errorf("no country database loaded")
+	}
+	return database, nil
+}
+
+//loadedProvider returns the loaded provider, failing when there is none
+func loadedProvider() (LocationProvider, error) {
+	database, err := loadedDatabase()
+	if err != nil {
+		return nil, err
+	}
+	return database.provider, nil
+}
+
+//checkProviderIPVersion rejects IPv6 addresses for a provider that only holds IPv4 data, which would
+//otherwise fail with a less helpful provider error
+func checkProviderIPVersion(provider LocationProvider, addr netip.Addr) error {
+	if provider == nil {
+		return nil
+	}
+	info, err := provider.Info()
+	if err == nil && info.IPVersion == 4 && addr.Is6() {
+		return fmt.Errorf("%v is an ipv6 address and the %v database only holds ipv4 data", addr, info.Type)
+	}
+	return nil
+}
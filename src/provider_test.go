@@ -0,0 +1,269 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/suite"
+)
+
+func TestProviderSuite(t *testing.T) {
+	providerSuite := new(ProviderSuite)
+	suite.Run(t, providerSuite)
+}
+
+type ProviderSuite struct {
+	suite.Suite
+	dir     string
+	maxmind LocationProvider
+}
+
+//memoryNetwork is a network of the in-memory provider with its country
+type memoryNetwork struct {
+	prefix  netip.Prefix
+	country Country
+}
+
+//memoryProvider serves countries from a list of networks held in memory, so handlers can be tested
+//without a binary mmdb file
+type memoryProvider struct {
+	networks []memoryNetwork
+	closed   bool
+}
+
+func newMemoryProvider(networks ...memoryNetwork) *memoryProvider {
+	sort.Slice(networks, func(i, j int) bool { return networks[i].prefix.Addr().Less(networks[j].prefix.Addr()) })
+	return &memoryProvider{networks: networks}
+}
+
+func (p *memoryProvider) Lookup(addr netip.Addr) (Country, error) {
+	if p.closed {
+		return Country{}, fmt.Errorf("provider closed")
+	}
+	found, bits := Country{}, -1
+	for _, network := range p.networks {
+		if network.prefix.Contains(addr.Unmap()) && network.prefix.Bits() > bits {
+			found, bits = network.country, network.prefix.Bits()
+		}
+	}
+	if bits < 0 {
+		return Country{}, fmt.Errorf("failed to find country value")
+	}
+	return found, nil
+}
+
+func (p *memoryProvider) Networks(within netip.Prefix, fn func(network netip.Prefix, country Country) error) error {
+	if p.closed {
+		return fmt.Errorf("provider closed")
+	}
+	for _, network := range p.networks {
+		prefix := network.prefix
+		if within.IsValid() && within.Addr().Is6() && prefix.Addr().Is4() {
+			var mapped [16]byte
+			copy(mapped[12:], prefix.Addr().AsSlice())
+			prefix = netip.PrefixFrom(netip.AddrFrom16(mapped), prefix.Bits()+96)
+		}
+		if within.IsValid() && !within.Overlaps(prefix) {
+			continue
+		}
+		if err := fn(prefix, network.country); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (p *memoryProvider) Info() (ProviderInfo, error) {
+	if p.closed {
+		return ProviderInfo{}, fmt.Errorf("provider closed")
+	}
+	return ProviderInfo{Provider: "memory", Type: "memory", IPVersion: 6, BuildEpoch: 1700000000}, nil
+}
+
+func (p *memoryProvider) Close() error {
+	p.closed = true
+	return nil
+}
+
+//testProvider returns the loaded provider, nil when there is none
+func testProvider() LocationProvider {
+	provider, _ := loadedProvider()
+	return provider
+}
+
+var testMemoryNetworks = []memoryNetwork{
+	{netip.MustParsePrefix("198.51.100.0/24"), Country{Name: "Germany", IsoCode: "DE", Source: "memory"}},
+	{netip.MustParsePrefix("192.0.2.0/24"), Country{Name: "France", IsoCode: "FR", Source: "memory"}},
+	{netip.MustParsePrefix("2001:db8::/32"), Country{Name: "Japan", IsoCode: "JP", Source: "memory"}},
+}
+
+func (suite *ProviderSuite) SetupSuite() {
+	setLogPath("./logs/")
+	Log(log.InfoLevel, "=============== Running Provider Suite ======================", true)
+	setupDB("./test-data/test-data.mmdb")
+	suite.maxmind = testProvider()
+	suite.dir, _ = os.MkdirTemp("", "provider-test")
+}
+
+func (suite *ProviderSuite) SetupTest() {
+	os.Remove(filepath.Join(suite.dir, "policies.json"))
+	setupPolicies(filepath.Join(suite.dir, "policies.json"))
+	useProvider(newMemoryProvider(append([]memoryNetwork{}, testMemoryNetworks...)...))
+}
+
+func (suite *ProviderSuite) TearDownSuite() {
+	setupPolicies("")
+	useProvider(suite.maxmind)
+	compiling.Wait()
+	testProvider().Close()
+	os.RemoveAll(suite.dir)
+	Log(log.InfoLevel, "========== Provider Testsuite completed ===========", true)
+	fmt.Println("========== Provider Testsuite completed ===========")
+}
+
+func (suite *ProviderSuite) TestCheck() {
+	Log(log.InfoLevel, "====== Running TestCheck ===========", true)
+	tt := []struct {
+		testName string
+		ip       string
+		body     string
+		status   int
+		response string
+	}{
+		{"Whitelisted", "192.0.2.10", `{"whitelisted_countries": ["France"]}`, http.StatusOK, "whitelisted"},
+		{"Not Whitelisted", "198.51.100.7", `{"whitelisted_countries": ["France"]}`, http.StatusOK, "not whitelisted"},
+		{"Iso Code", "198.51.100.7", `{"whitelisted_countries": ["DE"]}`, http.StatusOK, "whitelisted"},
+		{"IPv6", "2001:db8::1", `{"whitelisted_countries": ["Japan"]}`, http.StatusOK, "whitelisted"},
+		{"Unknown Address", "203.0.113.1", `{"whitelisted_countries": ["France"]}`, http.StatusInternalServerError, "failed to find country value"},
+		{"Policy", "192.0.2.10", `{"policy": "europe"}`, http.StatusOK, "whitelisted"},
+		{"Policy Denied", "2001:db8::1", `{"policy": "europe"}`, http.StatusOK, "not whitelisted"},
+	}
+	_, err := SavePolicy(Policy{Name: "europe", Whitelist: []string{"France", "Germany"}})
+	suite.NoError(err)
+	compiling.Wait()
+	for _, tc := range tt {
+		var response ResponseStruct
+		status := serveJSON(http.MethodGet, "/checkWhitelist/"+tc.ip, tc.body, &response)
+		if !suite.Equal(tc.status, status, "was expecting status %v on %v, received %v", tc.status, tc.testName, status) {
+			Log(log.InfoLevel, fmt.Sprintf("was expecting status %v on %v, received %v", tc.status, tc.testName, status), true)
+		}
+		suite.Equal(tc.response, response.Response, "unexpected response on %v", tc.testName)
+	}
+}
+
+func (suite *ProviderSuite) TestLookup() {
+	Log(log.InfoLevel, "====== Running TestLookup ===========", true)
+	var lookup LookupResponse
+	status := serveJSON(http.MethodGet, "/lookup/192.0.2.10", "", &lookup)
+	suite.Equal(http.StatusOK, status)
+	suite.Equal(Country{Name: "France", IsoCode: "FR", Source: "memory"}, lookup.Country)
+
+	var ranges RangeLookup
+	status = serveJSON(http.MethodGet, "/lookup/range/192.0.2.0/23", "", &ranges)
+	suite.Equal(http.StatusOK, status)
+	suite.Equal([]string{"192.0.2.0/24 FR"}, networks(ranges))
+	suite.Equal([]string{"192.0.3.0/24"}, ranges.Unknown)
+
+	ranges = RangeLookup{}
+	status = serveJSON(http.MethodGet, "/lookup/range/2001:db8::/31", "", &ranges)
+	suite.Equal(http.StatusOK, status)
+	suite.Equal([]string{"2001:db8::/32 JP"}, networks(ranges))
+	suite.Equal([]string{"2001:db9::/32"}, ranges.Unknown)
+}
+
+func (suite *ProviderSuite) TestAdmin() {
+	Log(log.InfoLevel, "====== Running TestAdmin ===========", true)
+	var countries []Country
+	status := serveJSON(http.MethodGet, "/admin/countries", "", &countries)
+	suite.Equal(http.StatusOK, status)
+	suite.Equal([]Country{
+		{Name: "France", IsoCode: "FR", Source: "memory"},
+		{Name: "Germany", IsoCode: "DE", Source: "memory"},
+		{Name: "Japan", IsoCode: "JP", Source: "memory"},
+	}, countries)
+
+	var database DatabaseStatus
+	status = serveJSON(http.MethodGet, "/admin/database", "", &database)
+	suite.Equal(http.StatusOK, status)
+	suite.True(database.Country.Healthy)
+	suite.Equal("memory", database.Country.Provider)
+
+	testProvider().Close()
+	status = serveJSON(http.MethodGet, "/admin/database", "", &database)
+	suite.Equal(http.StatusOK, status)
+	suite.False(database.Country.Healthy)
+	suite.Equal("provider closed", database.Country.Error)
+}
+
+func (suite *ProviderSuite) TestSetupProvider() {
+	Log(log.InfoLevel, "====== Running TestSetupProvider ===========", true)
+	err := setupProvider("ip2location", "./test-data/test-data.mmdb")
+	suite.EqualError(err, `unknown provider "ip2location", expected one of maxmind`)
+	suite.Equal("memory", testProvider().(*memoryProvider).networks[0].country.Source, "was expecting a failed setup to keep the loaded provider")
+
+	config := defaultConfig
+	config.DatabasePath = "./test-data/test-data.mmdb"
+	config.LogPath = suite.dir
+	config.Provider = "ip2location"
+	err = validateConfig(config)
+	if suite.Error(err) {
+		suite.Contains(err.Error(), "provider")
+	}
+}
+
+//TestCountryIndex validates the countries are indexed when a provider is loaded, and a provider that
+//can't be walked isn't loaded
+func (suite *ProviderSuite) TestCountryIndex() {
+	Log(log.InfoLevel, "====== Running TestCountryIndex ===========", true)
+	countries, err := KnownCountries()
+	suite.NoError(err)
+	suite.Len(countries, 3)
+	suite.Equal("Germany", countries["DE"].Name)
+
+	closed, _ := openMaxMindProvider("./test-data/test-data.mmdb")
+	closed.Close()
+	err = useProvider(closed)
+	if !suite.Error(err, "was expecting a closed database to fail indexing") {
+		Log(log.InfoLevel, "was expecting a closed database to fail indexing", true)
+	}
+	suite.Equal("memory", testProvider().(*memoryProvider).networks[0].country.Source, "was expecting a failed index to keep the loaded provider")
+}
+
+func (suite *ProviderSuite) TestMaxMindNetworks() {
+	Log(log.InfoLevel, "====== Running TestMaxMindNetworks ===========", true)
+	provider, err := openMaxMindProvider("./test-data/test-data.mmdb")
+	suite.Require().NoError(err)
+	collect := func(within string) []string {
+		var values []string
+		err := provider.Networks(netip.MustParsePrefix(within), func(network netip.Prefix, country Country) error {
+			values = append(values, network.String()+" "+country.IsoCode)
+			return nil
+		})
+		suite.NoError(err)
+		return values
+	}
+	suite.Equal([]string{"1.0.16.0/20 JP"}, collect("1.0.16.0/20"))
+	suite.Equal([]string{netip.MustParsePrefix("::1.0.16.0/116").String() + " JP"}, collect("::1.0.16.0/116"),
+		"was expecting IPv4 networks in the ::/96 subtree under an IPv6 prefix")
+	suite.Equal([]string{"2001:200::/32 JP"}, collect("2001:200::/32"))
+
+	country, err := provider.Lookup(netip.MustParseAddr("1.207.235.255"))
+	suite.NoError(err)
+	suite.Equal(Country{Name: "China", IsoCode: "CN", Source: SourceMaxMind}, country)
+	_, err = provider.Lookup(netip.MustParseAddr("10.0.0.1"))
+	suite.EqualError(err, "failed to find country value")
+
+	info, err := provider.Info()
+	suite.NoError(err)
+	suite.Equal(ProviderMaxMind, info.Provider)
+	suite.Equal(uint(6), info.IPVersion)
+
+	provider.Close()
+	suite.Error(provider.Networks(netip.Prefix{}, func(netip.Prefix, Country) error { return nil }))
+}
@@ -0,0 +1,329 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/netip"
+	"sort"
+	"time"
+
+	"github.com/gorilla/mux"
+	jsoniter "github.com/json-iterator/go"
+)
+
+//maxRangeNetworks is the most database networks a range query walks, so one request can't walk the
+//whole database
+const maxRangeNetworks = 10000
+
+//RangeNetwork is a network within a queried range with the country it is in
+type RangeNetwork struct {
+	Network string  `json:"network"`
+	Country Country `json:"country"`
+}
+
+//RangeLookup is the country of every network of the database that overlaps a range. networks are
+//cut to the range, and unknown lists the parts of the range the database has no country for
+type RangeLookup struct {
+	Network  string         `json:"network"`
+	Networks []RangeNetwork `json:"networks"`
+	Unknown  []string       `json:"unknown,omitempty"`
+}
+
+//RangeDecision is a network within a checked range with its decision
+type RangeDecision struct {
+	RangeNetwork
+	Allowed bool `json:"allowed"`
+}
+
+//RangeCheck is the decision for every network of a range. response is "whitelisted" when the whole
+//range is allowed, "not whitelisted" when none of it is and "partially whitelisted" otherwise. the
+//unknown parts of the range are never allowed
+type RangeCheck struct {
+	Network  string          `json:"network"`
+	Response string          `json:"response"`
+	Networks []RangeDecision `json:"networks"`
+	Unknown  []string        `json:"unknown,omitempty"`
+	Aliases  []AppliedAlias  `json:"aliases,omitempty"`
+	Warnings []UnknownEntry  `json:"warnings,omitempty"`
+}
+
+//RangeTooLargeError rejects a range that overlaps more than maxRangeNetworks database networks
+type RangeTooLargeError struct {
+	Network string
+	Limit   int
+}
+
+func (e *RangeTooLargeError) Error() string {
+	return fmt.Sprintf("%v overlaps more than %v networks, query a smaller range", e.Network, e.Limit)
+}
+
+//addrRange is an inclusive range of addresses of one family, all in the same country
+type addrRange struct {
+	first   netip.Addr
+	last    netip.Addr
+	country Country
+}
+
+//ParsePrefix parses a cidr the way range queries read it. IPv4-mapped IPv6 networks are unmapped to
+//the IPv4 network and host bits are cleared, so 1.2.3.4/24 is 1.2.3.0/24
+func ParsePrefix(value string) (netip.Prefix, error) {
+	prefix, err := netip.ParsePrefix(value)
+	if err != nil {
+		return netip.Prefix{}, fmt.Errorf("invalid network value")
+	}
+	if prefix.Addr().Is4In6() && prefix.Bits() >= 96 {
+		prefix = netip.PrefixFrom(prefix.Addr().Unmap(), prefix.Bits()-96)
+	}
+	prefix = prefix.Masked()
+	provider, _ := loadedProvider()
+	if err := checkProviderIPVersion(provider, prefix.Addr()); err != nil {
+		return netip.Prefix{}, err
+	}
+	return prefix, nil
+}
+
+//lastAddr returns the last address of a prefix
+func lastAddr(prefix netip.Prefix) netip.Addr {
+	bytes := prefix.Masked().Addr().AsSlice()
+	for bit := prefix.Bits(); bit < len(bytes)*8; bit++ {
+		bytes[bit/8] |= 1 << uint(7-bit%8)
+	}
+	addr, _ := netip.AddrFromSlice(bytes)
+	return addr
+}
+
+//rangePrefixes returns the fewest prefixes that exactly cover the addresses from first to last
+func rangePrefixes(first netip.Addr, last netip.Addr) []netip.Prefix {
+	var prefixes []netip.Prefix
+	for first.IsValid() && first.Compare(last) <= 0 {
+		//widen the prefix while first is still its first address and it doesn't run past last
+		bits := first.BitLen()
+		for bits > 0 {
+			wider := netip.PrefixFrom(first, bits-1).Masked()
+			if wider.Addr() != first || lastAddr(wider).Compare(last) > 0 {
+				break
+			}
+			bits--
+		}
+		prefix := netip.PrefixFrom(first, bits)
+		prefixes = append(prefixes, prefix)
+		//Next is invalid past the last address of the family, which ends the loop
+		first = lastAddr(prefix).Next()
+	}
+	return prefixes
+}
+
+//countryRanges returns the country of every part of the prefix the database or the tenant's
+//corrections know about, in address order. the corrections overlay wins over the database, and
+//more specific corrections over less specific ones, as in single lookups
+func countryRanges(tenant string, prefix netip.Prefix) ([]addrRange, error) {
+	provider, err := loadedProvider()
+	if err != nil {
+		return nil, err
+	}
+	first, last := prefix.Addr(), lastAddr(prefix)
+	var ranges []addrRange
+	//networks without a country fail single lookups, so the provider leaves them out and they are
+	//unknown here too
+	err = provider.Networks(prefix, func(network netip.Prefix, country Country) error {
+		if len(ranges) == maxRangeNetworks {
+			return &RangeTooLargeError{Network: prefix.String(), Limit: maxRangeNetworks}
+		}
+		ranges = append(ranges, clipRange(addrRange{first: network.Addr(), last: lastAddr(network), country: country}, first, last))
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	corrections := ListCorrections(tenant)
+	//corrections are listed most specific first, so they are painted in reverse
+	for i := len(corrections) - 1; i >= 0; i-- {
+		correction := corrections[i]
+		network, err := netip.ParsePrefix(correction.Network)
+		if err != nil || correction.expired(now) || network.Addr().Is6() != first.Is6() {
+			continue
+		}
+		corrected := addrRange{first: network.Masked().Addr(), last: lastAddr(network),
+			country: Country{Name: correction.Name, IsoCode: correction.IsoCode, Source: SourceOverlay}}
+		if corrected.first.Compare(last) > 0 || corrected.last.Compare(first) < 0 {
+			continue
+		}
+		ranges = paintRange(ranges, clipRange(corrected, first, last))
+	}
+	return ranges, nil
+}
+
+//clipRange cuts a range to the addresses from first to last, which it must overlap
+func clipRange(r addrRange, first netip.Addr, last netip.Addr) addrRange {
+	if r.first.Less(first) {
+		r.first = first
+	}
+	if last.Less(r.last) {
+		r.last = last
+	}
+	return r
+}
+
+//paintRange lays a range over sorted, non overlapping ranges, cutting away the parts it covers
+func paintRange(ranges []addrRange, painted addrRange) []addrRange {
+	var result []addrRange
+	for _, r := range ranges {
+		if r.last.Less(painted.first) || painted.last.Less(r.first) {
+			result = append(result, r)
+			continue
+		}
+		if r.first.Less(painted.first) {
+			result = append(result, addrRange{first: r.first, last: painted.first.Prev(), country: r.country})
+		}
+		if painted.last.Less(r.last) {
+			result = append(result, addrRange{first: painted.last.Next(), last: r.last, country: r.country})
+		}
+	}
+	result = append(result, painted)
+	sort.Slice(result, func(i, j int) bool { return result[i].first.Less(result[j].first) })
+	return result
+}
+
+//rangeGaps returns the prefixes of the addresses from first to last that no range covers
+func rangeGaps(ranges []addrRange, first netip.Addr, last netip.Addr) []string {
+	var gaps []string
+	next := first
+	for _, r := range ranges {
+		if next.Less(r.first) {
+			gaps = append(gaps, prefixStrings(rangePrefixes(next, r.first.Prev()))...)
+		}
+		next = r.last.Next()
+		if !next.IsValid() {
+			return gaps
+		}
+	}
+	if next.Compare(last) <= 0 {
+		gaps = append(gaps, prefixStrings(rangePrefixes(next, last))...)
+	}
+	return gaps
+}
+
+//prefixStrings returns prefixes in their cidr form
+func prefixStrings(prefixes []netip.Prefix) []string {
+	values := make([]string, len(prefixes))
+	for i, prefix := range prefixes {
+		values[i] = prefix.String()
+	}
+	return values
+}
+
+//LookupRange returns the country of every part of the prefix with the tenant's corrections applied
+func LookupRange(tenant string, prefix netip.Prefix) (RangeLookup, error) {
+	ranges, err := countryRanges(tenant, prefix)
+	if err != nil {
+		return RangeLookup{}, err
+	}
+	lookup := RangeLookup{Network: prefix.String(), Networks: []RangeNetwork{},
+		Unknown: rangeGaps(ranges, prefix.Addr(), lastAddr(prefix))}
+	for _, r := range ranges {
+		for _, network := range rangePrefixes(r.first, r.last) {
+			lookup.Networks = append(lookup.Networks, RangeNetwork{Network: network.String(), Country: r.country})
+		}
+	}
+	return lookup, nil
+}
+
+//CheckRange decides every part of the prefix against whitelist/blacklist entries, with the rules
+//of CheckRules and the tenant's corrections applied. asn entries can't be decided for a range
+func CheckRange(tenant string, prefix netip.Prefix, whitelist []string, blacklist []string) (RangeCheck, error) {
+	ranges, err := countryRanges(tenant, prefix)
+	if err != nil {
+		return RangeCheck{}, err
+	}
+	check := RangeCheck{Network: prefix.String(), Networks: []RangeDecision{},
+		Unknown: rangeGaps(ranges, prefix.Addr(), lastAddr(prefix))}
+	allowed, denied := false, len(check.Unknown) > 0
+	for _, r := range ranges {
+		decision, err := decide(whitelist, blacklist, r.country, ASN{})
+		if err != nil {
+			return RangeCheck{}, err
+		}
+		allowed, denied = allowed || decision, denied || !decision
+		for _, network := range rangePrefixes(r.first, r.last) {
+			check.Networks = append(check.Networks, RangeDecision{
+				RangeNetwork: RangeNetwork{Network: network.String(), Country: r.country}, Allowed: decision})
+		}
+	}
+	switch {
+	case allowed && !denied:
+		check.Response = "whitelisted"
+	case allowed:
+		check.Response = "partially whitelisted"
+	default:
+		check.Response = "not whitelisted"
+	}
+	return check, nil
+}
+
+//rangeErrorStatus is the status for an error of a range query. ranges that are too large and entries
+//that can't be matched are the caller's to fix, anything else is the database's
+func rangeErrorStatus(err error) int {
+	var tooLarge *RangeTooLargeError
+	var badEntry *EntryError
+	if errors.As(err, &tooLarge) || errors.As(err, &badEntry) {
+		return http.StatusBadRequest
+	}
+	return http.StatusInternalServerError
+}
+
+//lookupRangeHandler returns the country of every network of the database overlapping the cidr in the
+//path
+func lookupRangeHandler(w http.ResponseWriter, r *http.Request) {
+	prefix, err := ParsePrefix(mux.Vars(r)["network"])
+	if err != nil {
+		respondError(w, r, http.StatusBadRequest, err)
+		return
+	}
+	lookup, err := LookupRange(RequestTenant(r), prefix)
+	if err != nil {
+		respondError(w, r, rangeErrorStatus(err), err)
+		return
+	}
+	w.Header().Add("Content-Type", "application/json")
+	jsoniter.NewEncoder(w).Encode(lookup)
+}
+
+//checkRangeHandler decides every network overlapping the cidr in the path against the entries or
+//policy of the request, and whether the range as a whole is allowed. the decision on the range is
+//audited but not notified or compared against shadows
+func checkRangeHandler(w http.ResponseWriter, r *http.Request) {
+	prefix, err := ParsePrefix(mux.Vars(r)["network"])
+	if err != nil {
+		respondError(w, r, http.StatusBadRequest, err)
+		return
+	}
+	req, warnings, err := decodeWhitelistRequest(r)
+	var policy *Policy
+	if err == nil {
+		policy, err = requestPolicy(r, req)
+	}
+	whitelist, blacklist := req.WhitelistedCountries, req.BlacklistedCountries
+	if policy != nil {
+		whitelist, blacklist = policy.activeEntries(Clock())
+	}
+	if err == nil && (hasASNEntry(whitelist) || hasASNEntry(blacklist)) {
+		err = fmt.Errorf("asn entries can't be checked against a range")
+	}
+	if err != nil {
+		respondError(w, r, http.StatusBadRequest, err)
+		return
+	}
+	check, err := CheckRange(RequestTenant(r), prefix, whitelist, blacklist)
+	if err != nil {
+		respondError(w, r, rangeErrorStatus(err), err)
+		return
+	}
+	check.Aliases = AppliedAliases(whitelist, blacklist)
+	check.Warnings = warnings
+	recordRangeCheck(r, check, policy, req)
+	w.Header().Add("Content-Type", "application/json")
+	jsoniter.NewEncoder(w).Encode(check)
+}
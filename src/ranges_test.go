@@ -0,0 +1,216 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"testing"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/suite"
+)
+
+func TestRangesSuite(t *testing.T) {
+	rangesSuite := new(RangesSuite)
+	suite.Run(t, rangesSuite)
+}
+
+type RangesSuite struct {
+	suite.Suite
+	dir string
+}
+
+func (suite *RangesSuite) SetupSuite() {
+	setLogPath("./logs/")
+	Log(log.InfoLevel, "=============== Running Ranges Suite ======================", true)
+	setupDB("./test-data/test-data.mmdb")
+	suite.dir, _ = os.MkdirTemp("", "ranges-test")
+}
+
+func (suite *RangesSuite) SetupTest() {
+	os.Remove(filepath.Join(suite.dir, "corrections.json"))
+	setupCorrections(filepath.Join(suite.dir, "corrections.json"))
+	os.Remove(filepath.Join(suite.dir, "policies.json"))
+	setupPolicies(filepath.Join(suite.dir, "policies.json"))
+}
+
+func (suite *RangesSuite) TearDownSuite() {
+	setupCorrections("")
+	setupPolicies("")
+	compiling.Wait()
+	testProvider().Close()
+	os.RemoveAll(suite.dir)
+	Log(log.InfoLevel, "========== Ranges Testsuite completed ===========", true)
+	fmt.Println("========== Ranges Testsuite completed ===========")
+}
+
+//networks returns the networks of a lookup as "cidr iso" values
+func networks(lookup RangeLookup) []string {
+	values := make([]string, len(lookup.Networks))
+	for i, network := range lookup.Networks {
+		values[i] = network.Network + " " + network.Country.IsoCode
+	}
+	return values
+}
+
+func (suite *RangesSuite) TestRangePrefixes() {
+	Log(log.InfoLevel, "====== Running TestRangePrefixes ===========", true)
+	tt := []struct {
+		testName string
+		first    string
+		last     string
+		expected []string
+	}{
+		{"Single Address", "1.0.0.1", "1.0.0.1", []string{"1.0.0.1/32"}},
+		{"Unaligned", "1.0.0.1", "1.0.0.6", []string{"1.0.0.1/32", "1.0.0.2/31", "1.0.0.4/31", "1.0.0.6/32"}},
+		{"Aligned", "10.0.0.0", "10.255.255.255", []string{"10.0.0.0/8"}},
+		{"Whole IPv4 Space", "0.0.0.0", "255.255.255.255", []string{"0.0.0.0/0"}},
+		{"End Of IPv6 Space", "ffff::", "ffff:ffff:ffff:ffff:ffff:ffff:ffff:ffff", []string{"ffff::/16"}},
+		{"IPv6", "2001:201::", "2001:207:ffff:ffff:ffff:ffff:ffff:ffff", []string{"2001:201::/32", "2001:202::/31", "2001:204::/30"}},
+	}
+	for _, tc := range tt {
+		prefixes := prefixStrings(rangePrefixes(netip.MustParseAddr(tc.first), netip.MustParseAddr(tc.last)))
+		if !suite.Equal(tc.expected, prefixes, "unexpected prefixes on %v", tc.testName) {
+			Log(log.InfoLevel, fmt.Sprintf("was expecting %v on %v, received %v", tc.expected, tc.testName, prefixes), true)
+		}
+	}
+}
+
+func (suite *RangesSuite) TestParsePrefix() {
+	Log(log.InfoLevel, "====== Running TestParsePrefix ===========", true)
+	tt := []struct {
+		testName string
+		value    string
+		expected string
+		err      string
+	}{
+		{"IPv4", "1.0.16.0/20", "1.0.16.0/20", ""},
+		{"Host Bits", "1.0.16.1/20", "1.0.16.0/20", ""},
+		{"IPv4-Mapped", "::ffff:1.0.16.0/116", "1.0.16.0/20", ""},
+		{"IPv6", "2001:200::/29", "2001:200::/29", ""},
+		{"No Length", "1.0.16.0", "", "invalid network value"},
+		{"Invalid", "1.0.16.0/33", "", "invalid network value"},
+	}
+	for _, tc := range tt {
+		prefix, err := ParsePrefix(tc.value)
+		if tc.err != "" {
+			suite.EqualError(err, tc.err, "unexpected error on %v", tc.testName)
+			continue
+		}
+		if !suite.NoError(err, "was expecting no error on %v, returned %v", tc.testName, err) {
+			Log(log.InfoLevel, fmt.Sprintf("was expecting no error on %v, returned %v", tc.testName, err), true)
+		}
+		suite.Equal(tc.expected, prefix.String(), "unexpected network on %v", tc.testName)
+	}
+}
+
+func (suite *RangesSuite) TestLookupRange() {
+	Log(log.InfoLevel, "====== Running TestLookupRange ===========", true)
+	//the static test data splits 1.0.0.0/19 between Australia, China and Japan, and only has
+	//2001:200::/32 in 2001:200::/29
+	tt := []struct {
+		testName string
+		network  string
+		expected []string
+		unknown  []string
+	}{
+		{"Database Networks", "1.0.0.0/19", []string{"1.0.0.0/24 AU", "1.0.1.0/24 CN", "1.0.2.0/23 CN", "1.0.4.0/22 AU",
+			"1.0.8.0/21 CN", "1.0.16.0/20 JP"}, nil},
+		{"Within A Database Network", "1.207.235.0/24", []string{"1.207.235.0/24 CN"}, nil},
+		{"Unknown Parts", "2001:200::/29", []string{"2001:200::/32 JP"}, []string{"2001:201::/32", "2001:202::/31", "2001:204::/30"}},
+	}
+	for _, tc := range tt {
+		lookup, err := LookupRange(DefaultTenant, netip.MustParsePrefix(tc.network))
+		if !suite.NoError(err, "was expecting no error on %v, returned %v", tc.testName, err) {
+			Log(log.InfoLevel, fmt.Sprintf("was expecting no error on %v, returned %v", tc.testName, err), true)
+		}
+		suite.Equal(tc.network, lookup.Network)
+		suite.Equal(tc.expected, networks(lookup), "unexpected networks on %v", tc.testName)
+		suite.Equal(tc.unknown, lookup.Unknown, "unexpected unknown networks on %v", tc.testName)
+	}
+
+	_, err := LookupRange(DefaultTenant, netip.MustParsePrefix("0.0.0.0/0"))
+	suite.EqualError(err, "0.0.0.0/0 overlaps more than 10000 networks, query a smaller range")
+}
+
+func (suite *RangesSuite) TestLookupRangeCorrections() {
+	Log(log.InfoLevel, "====== Running TestLookupRangeCorrections ===========", true)
+	AddCorrection(Correction{Network: "1.0.16.0/21", IsoCode: "CN"})
+	AddCorrection(Correction{Network: "1.0.16.128/25", IsoCode: "AU"})
+	AddCorrection(Correction{Network: "1.0.24.0/21", IsoCode: "CN", Tenant: "acme"})
+
+	lookup, err := LookupRange(DefaultTenant, netip.MustParsePrefix("1.0.16.0/20"))
+	suite.NoError(err)
+	suite.Equal([]string{"1.0.16.0/25 CN", "1.0.16.128/25 AU", "1.0.17.0/24 CN", "1.0.18.0/23 CN", "1.0.20.0/22 CN", "1.0.24.0/21 JP"},
+		networks(lookup), "the most specific correction should win")
+	suite.Equal(SourceOverlay, lookup.Networks[0].Country.Source)
+	suite.Equal(SourceMaxMind, lookup.Networks[5].Country.Source)
+
+	lookup, _ = LookupRange("acme", netip.MustParsePrefix("1.0.16.0/20"))
+	suite.Equal([]string{"1.0.16.0/21 JP", "1.0.24.0/21 CN"}, networks(lookup), "only the tenant's corrections should apply")
+
+	//a correction of a part of the range the database doesn't know fills that part
+	AddCorrection(Correction{Network: "2001:201::/32", IsoCode: "JP"})
+	lookup, _ = LookupRange(DefaultTenant, netip.MustParsePrefix("2001:200::/30"))
+	suite.Equal([]string{"2001:200::/32 JP", "2001:201::/32 JP"}, networks(lookup))
+	suite.Equal([]string{"2001:202::/31"}, lookup.Unknown)
+}
+
+func (suite *RangesSuite) TestCheckRange() {
+	Log(log.InfoLevel, "====== Running TestCheckRange ===========", true)
+	SavePolicy(Policy{Name: "asia", Whitelist: []string{"japan", "china"}})
+
+	tt := []struct {
+		testName string
+		path     string
+		body     string
+		status   int
+		response string
+	}{
+		{"Whole Range Allowed", "/checkWhitelist/range/1.0.16.0/20", `{"whitelisted_countries": ["japan"]}`, http.StatusOK, "whitelisted"},
+		{"Part Allowed", "/checkWhitelist/range/1.0.0.0/19", `{"whitelisted_countries": ["japan"]}`, http.StatusOK, "partially whitelisted"},
+		{"Blacklist Only", "/checkWhitelist/range/1.0.0.0/19", `{"blacklisted_countries": ["au"]}`, http.StatusOK, "partially whitelisted"},
+		{"Nothing Allowed", "/checkWhitelist/range/1.0.16.0/20", `{"whitelisted_countries": ["china"]}`, http.StatusOK, "not whitelisted"},
+		{"Unknown Parts Denied", "/checkWhitelist/range/2001:200::/29", `{"whitelisted_countries": ["japan"]}`, http.StatusOK, "partially whitelisted"},
+		{"Policy", "/checkWhitelist/range/1.0.0.0/19", `{"policy": "asia"}`, http.StatusOK, "partially whitelisted"},
+		{"Invalid Network", "/checkWhitelist/range/1.0.16.0/33", `{"whitelisted_countries": ["japan"]}`, http.StatusBadRequest, "invalid network value"},
+		{"ASN Entries", "/checkWhitelist/range/1.0.16.0/20", `{"whitelisted_countries": ["asn:13335"]}`, http.StatusBadRequest,
+			"asn entries can't be checked against a range"},
+		{"Too Large", "/checkWhitelist/range/0.0.0.0/0", `{"whitelisted_countries": ["japan"]}`, http.StatusBadRequest,
+			"0.0.0.0/0 overlaps more than 10000 networks, query a smaller range"},
+	}
+	for _, tc := range tt {
+		var check RangeCheck
+		status := serveJSON(http.MethodGet, tc.path, tc.body, &check)
+		if !suite.Equal(tc.status, status, "was expecting status %v on %v, received %v", tc.status, tc.testName, status) {
+			Log(log.InfoLevel, fmt.Sprintf("was expecting status %v on %v, received %v", tc.status, tc.testName, status), true)
+		}
+		suite.Equal(tc.response, check.Response, "unexpected response on %v", tc.testName)
+	}
+
+	var check RangeCheck
+	serveJSON(http.MethodGet, "/checkWhitelist/range/1.0.0.0/21", `{"whitelisted_countries": ["cn"]}`, &check)
+	suite.Equal([]RangeDecision{
+		{RangeNetwork{"1.0.0.0/24", Country{Name: "Australia", IsoCode: "AU", Source: SourceMaxMind}}, false},
+		{RangeNetwork{"1.0.1.0/24", Country{Name: "China", IsoCode: "CN", Source: SourceMaxMind}}, true},
+		{RangeNetwork{"1.0.2.0/23", Country{Name: "China", IsoCode: "CN", Source: SourceMaxMind}}, true},
+		{RangeNetwork{"1.0.4.0/22", Country{Name: "Australia", IsoCode: "AU", Source: SourceMaxMind}}, false},
+	}, check.Networks)
+	suite.Equal([]AppliedAlias{{Entry: "cn", IsoCode: "CN", Country: "China"}}, check.Aliases)
+}
+
+func (suite *RangesSuite) TestLookupRangeHandler() {
+	Log(log.InfoLevel, "====== Running TestLookupRangeHandler ===========", true)
+	var lookup RangeLookup
+	status := serveJSON(http.MethodGet, "/lookup/range/::ffff:1.0.16.0/116", "", &lookup)
+	suite.Equal(http.StatusOK, status)
+	suite.Equal("1.0.16.0/20", lookup.Network)
+	suite.Equal([]string{"1.0.16.0/20 JP"}, networks(lookup))
+
+	var response ResponseStruct
+	status = serveJSON(http.MethodGet, "/lookup/range/not-a-network", "", &response)
+	suite.Equal(http.StatusBadRequest, status)
+	suite.Equal("invalid network value", response.Response)
+}
@@ -0,0 +1,228 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/mux"
+	jsoniter "github.com/json-iterator/go"
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/time/rate"
+)
+
+//RateLimit is a token bucket definition. a zero requests per second means unlimited
+type RateLimit struct {
+	RequestsPerSecond float64 `mapstructure:"requests per second"`
+	Burst             int     `mapstructure:"burst"`
+}
+
+//RateLimitConfig is the "rate limit" section of config.yaml. the top level limit is one bucket per
+//client shared by every route that doesn't have its own entry under routes, keyed by the route's path
+//template. auth failures limits failed api key attempts per client ip
+type RateLimitConfig struct {
+	RateLimit    `mapstructure:",squash"`
+	MaxInFlight  int                  `mapstructure:"max in flight"`
+	Routes       map[string]RateLimit `mapstructure:"routes"`
+	AuthFailures RateLimit            `mapstructure:"auth failures"`
+}
+
+//sharedBucket keys the client buckets of the top level limit, which every route without its own
+//limit draws from
+const sharedBucket = "*"
+
+//authFailureBucket keys the client ip buckets failed api key attempts draw from
+const authFailureBucket = "auth failures"
+
+//idleBucketTTL is how long an unused client bucket is kept before it is swept
+const idleBucketTTL = 10 * time.Minute
+
+//rateLimiter holds the client buckets for one rate limit configuration
+type rateLimiter struct {
+	config   RateLimitConfig
+	inFlight int64
+
+	mu        sync.Mutex
+	buckets   map[string]*clientBucket
+	lastSweep time.Time
+}
+
+type clientBucket struct {
+	limiter  *rate.Limiter
+	lastSeen time.Time
+}
+
+//setupRateLimits makes a limiter built from the configuration the active one, replacing any existing
+//client buckets
+func setupRateLimits(config RateLimitConfig) error {
+	limiter, err := newRateLimiter(config)
+	if err != nil {
+		return err
+	}
+	updateRuntime(func(state *runtimeState) { state.rateLimiter = limiter })
+	return nil
+}
+
+//newRateLimiter builds a limiter from the configuration
+func newRateLimiter(config RateLimitConfig) (*rateLimiter, error) {
+	limits := []RateLimit{config.RateLimit, config.AuthFailures}
+	routes := map[string]RateLimit{}
+	for route, limit := range config.Routes {
+		limits = append(limits, limit)
+		//viper lowercases map keys, so routes are matched case-insensitively
+		routes[strings.ToLower(route)] = limit
+	}
+	for _, limit := range limits {
+		if limit.RequestsPerSecond < 0 || limit.Burst < 0 {
+			return nil, fmt.Errorf("rate limits can't be negative")
+		}
+	}
+	if config.MaxInFlight < 0 {
+		return nil, fmt.Errorf("max in flight can't be negative")
+	}
+	config.Routes = routes
+	return &rateLimiter{config: config, buckets: map[string]*clientBucket{}, lastSweep: time.Now()}, nil
+}
+
+//limitFor returns the limit for a route template, falling back to the top level limit
+func (l *rateLimiter) limitFor(route string) RateLimit {
+	_, limit := l.bucketFor(route)
+	return limit
+}
+
+//bucketFor returns the bucket a route draws from and its limit. routes without their own limit share
+//the top level bucket, so it caps a client across all of them
+func (l *rateLimiter) bucketFor(route string) (string, RateLimit) {
+	if limit, ok := l.config.Routes[strings.ToLower(route)]; ok {
+		return route, limit
+	}
+	return sharedBucket, l.config.RateLimit
+}
+
+//reserve takes a token from the client's bucket. when the bucket is empty it returns false and how
+//long until the next token is available
+func (l *rateLimiter) reserve(bucketName string, client string, limit RateLimit) (bool, time.Duration) {
+	now := time.Now()
+	bucket := l.bucket(bucketName, client, limit, now)
+	reservation := bucket.limiter.ReserveN(now, 1)
+	if !reservation.OK() {
+		return false, time.Second
+	}
+	if delay := reservation.DelayFrom(now); delay > 0 {
+		reservation.CancelAt(now)
+		return false, delay
+	}
+	return true, 0
+}
+
+//authLocked reports whether a client ip has used up its failed api key attempts, and how long until
+//it gets another one. locked clients are turned away before their key is checked, so guessing
+//can't go on at the rate a valid key would be served
+func (l *rateLimiter) authLocked(client string) (bool, time.Duration) {
+	limit := l.config.AuthFailures
+	if limit.RequestsPerSecond <= 0 {
+		return false, 0
+	}
+	now := time.Now()
+	bucket := l.bucket(authFailureBucket, client, limit, now)
+	if tokens := bucket.limiter.TokensAt(now); tokens < 1 {
+		return true, time.Duration((1 - tokens) / limit.RequestsPerSecond * float64(time.Second))
+	}
+	return false, 0
+}
+
+//recordAuthFailure takes a token from the failed attempts bucket of a client ip
+func (l *rateLimiter) recordAuthFailure(client string) {
+	limit := l.config.AuthFailures
+	if limit.RequestsPerSecond <= 0 {
+		return
+	}
+	now := time.Now()
+	l.bucket(authFailureBucket, client, limit, now).limiter.AllowN(now, 1)
+}
+
+//bucket returns the client's bucket, creating it with the limit. idle buckets are swept on the way
+func (l *rateLimiter) bucket(bucketName string, client string, limit RateLimit, now time.Time) *clientBucket {
+	key := bucketName + "|" + client
+
+	l.mu.Lock()
+	if now.Sub(l.lastSweep) > idleBucketTTL {
+		for k, bucket := range l.buckets {
+			if now.Sub(bucket.lastSeen) > idleBucketTTL {
+				delete(l.buckets, k)
+			}
+		}
+		l.lastSweep = now
+	}
+	bucket, ok := l.buckets[key]
+	if !ok {
+		burst := limit.Burst
+		if burst < 1 {
+			burst = int(math.Max(1, math.Ceil(limit.RequestsPerSecond)))
+		}
+		bucket = &clientBucket{limiter: rate.NewLimiter(rate.Limit(limit.RequestsPerSecond), burst)}
+		l.buckets[key] = bucket
+	}
+	bucket.lastSeen = now
+	l.mu.Unlock()
+	return bucket
+}
+
+//rateLimitMiddleware sheds load once the global in-flight cap is reached (503) and applies token
+//buckets keyed by api key identity, or by client ip for anonymous callers (429). routes with their
+//own limit have their own buckets, every other route draws from the top level one. both carry a
+//Retry-After header
+func rateLimitMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		limiter := requestRuntime(r).rateLimiter
+		if limiter == nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		if limiter.config.MaxInFlight > 0 {
+			if atomic.AddInt64(&limiter.inFlight, 1) > int64(limiter.config.MaxInFlight) {
+				atomic.AddInt64(&limiter.inFlight, -1)
+				IncCounter("whitelist_shed_requests_total", nil)
+				rejectRequest(w, r, http.StatusServiceUnavailable, time.Second, fmt.Errorf("server is at capacity"))
+				return
+			}
+			defer atomic.AddInt64(&limiter.inFlight, -1)
+		}
+
+		route := ""
+		if current := mux.CurrentRoute(r); current != nil {
+			route, _ = current.GetPathTemplate()
+		}
+		bucketName, limit := limiter.bucketFor(route)
+		if limit.RequestsPerSecond > 0 {
+			client := RequestIdentity(r)
+			if client == "" {
+				client, _ = ClientIP(r)
+			}
+			if client == "" {
+				client = r.RemoteAddr
+			}
+			if ok, retry := limiter.reserve(bucketName, client, limit); !ok {
+				IncCounter("whitelist_rate_limited_total", map[string]string{"route": route})
+				rejectRequest(w, r, http.StatusTooManyRequests, retry, fmt.Errorf("rate limit exceeded"))
+				return
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+//rejectRequest writes a limit error with a Retry-After header rounded up to whole seconds
+func rejectRequest(w http.ResponseWriter, r *http.Request, status int, retry time.Duration, err error) {
+	logRequest(r, log.WarnLevel, err.Error())
+	w.Header().Add("Content-Type", "application/json")
+	w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(retry.Seconds()))))
+	w.WriteHeader(status)
+	jsoniter.NewEncoder(w).Encode(ResponseStruct{Response: err.Error()})
+}
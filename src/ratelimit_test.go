@@ -0,0 +1,171 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"github.com/gorilla/mux"
+	log "github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/suite"
+)
+
+func TestRateLimitSuite(t *testing.T) {
+	rateLimitSuite := new(RateLimitSuite)
+	suite.Run(t, rateLimitSuite)
+}
+
+type RateLimitSuite struct {
+	suite.Suite
+}
+
+func (suite *RateLimitSuite) SetupSuite() {
+	setLogPath("./logs/")
+	Log(log.InfoLevel, "=============== Running Rate Limit Suite ======================", true)
+}
+
+func (suite *RateLimitSuite) TearDownSuite() {
+	updateRuntime(func(state *runtimeState) { state.rateLimiter = nil })
+	setupAPIKeys("")
+	Log(log.InfoLevel, "========== Rate Limit Testsuite completed ===========", true)
+	fmt.Println("========== Rate Limit Testsuite completed ===========")
+}
+
+//limitedRouter returns a router with three plain routes behind the auth and rate limit middlewares
+func (suite *RateLimitSuite) limitedRouter(handler http.HandlerFunc) *mux.Router {
+	router := mux.NewRouter()
+	router.HandleFunc("/checkWhitelist/{ip}", handler)
+	router.HandleFunc("/checkWhitelist", handler)
+	router.HandleFunc("/lookup/{ip}", handler)
+	router.Use(authMiddleware, rateLimitMiddleware)
+	return router
+}
+
+func (suite *RateLimitSuite) TestSetupRateLimits() {
+	Log(log.InfoLevel, "====== Running TestSetupRateLimits ===========", true)
+	err := setupRateLimits(RateLimitConfig{RateLimit: RateLimit{RequestsPerSecond: -1}})
+	if !suite.Error(err, "was expecting an error, returned ok") {
+		Log(log.InfoLevel, "was expecting an error on negative limits, returned ok", true)
+	}
+	err = setupRateLimits(RateLimitConfig{Routes: map[string]RateLimit{"/checkWhitelist/{ip}": {RequestsPerSecond: 1}}})
+	suite.NoError(err)
+	suite.Equal(1.0, currentRuntime().rateLimiter.limitFor("/checkWhitelist/{ip}").RequestsPerSecond)
+	suite.Equal(0.0, currentRuntime().rateLimiter.limitFor("/lookup/{ip}").RequestsPerSecond)
+}
+
+//TestTokenBucket validates callers are limited independently and get a Retry-After once empty
+func (suite *RateLimitSuite) TestTokenBucket() {
+	Log(log.InfoLevel, "====== Running TestTokenBucket ===========", true)
+	setupRateLimits(RateLimitConfig{
+		RateLimit: RateLimit{RequestsPerSecond: 0.01, Burst: 2},
+		Routes:    map[string]RateLimit{"/lookup/{ip}": {RequestsPerSecond: 0}},
+	})
+	router := suite.limitedRouter(func(w http.ResponseWriter, r *http.Request) {})
+
+	tt := []struct {
+		testName   string
+		path       string
+		remoteAddr string
+		status     int
+	}{
+		{"First Token", "/checkWhitelist/1.1.1.1", "8.8.8.8:1000", http.StatusOK},
+		{"Second Token", "/checkWhitelist/1.1.1.1", "8.8.8.8:1000", http.StatusOK},
+		{"Bucket Empty", "/checkWhitelist/1.1.1.1", "8.8.8.8:1000", http.StatusTooManyRequests},
+		{"Shared Across Routes", "/checkWhitelist", "8.8.8.8:1000", http.StatusTooManyRequests},
+		{"Other Client", "/checkWhitelist/1.1.1.1", "9.9.9.9:1000", http.StatusOK},
+		{"Unlimited Route", "/lookup/1.1.1.1", "8.8.8.8:1000", http.StatusOK},
+	}
+	for _, tc := range tt {
+		req := httptest.NewRequest(http.MethodGet, tc.path, nil)
+		req.RemoteAddr = tc.remoteAddr
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, req)
+		if !suite.Equal(tc.status, rec.Code, "was expecting %v on %v, received %v", tc.status, tc.testName, rec.Code) {
+			Log(log.InfoLevel, fmt.Sprintf("was expecting %v on %v, received %v", tc.status, tc.testName, rec.Code), true)
+		}
+		if tc.status == http.StatusTooManyRequests {
+			suite.NotEmpty(rec.Header().Get("Retry-After"), "was expecting a Retry-After header")
+		}
+	}
+}
+
+//TestAuthFailures validates a client ip that keeps sending invalid keys is locked out, even with a
+//valid key, while other clients aren't
+func (suite *RateLimitSuite) TestAuthFailures() {
+	Log(log.InfoLevel, "====== Running TestAuthFailures ===========", true)
+	keys := map[string]APIKey{HashAPIKey("valid-key"): {ID: "checker", Scopes: []string{ScopeCheck}}}
+	updateRuntime(func(state *runtimeState) { state.apiKeys = keys })
+	defer setupAPIKeys("")
+	setupRateLimits(RateLimitConfig{AuthFailures: RateLimit{RequestsPerSecond: 0.01, Burst: 2}})
+	router := suite.limitedRouter(func(w http.ResponseWriter, r *http.Request) {})
+
+	tt := []struct {
+		testName   string
+		key        string
+		remoteAddr string
+		status     int
+	}{
+		{"Valid Key", "valid-key", "8.8.8.8:1000", http.StatusOK},
+		{"First Failure", "guess-1", "8.8.8.8:1000", http.StatusUnauthorized},
+		{"Second Failure", "guess-2", "8.8.8.8:1000", http.StatusUnauthorized},
+		{"Locked Out", "guess-3", "8.8.8.8:1000", http.StatusTooManyRequests},
+		{"Locked Out With Valid Key", "valid-key", "8.8.8.8:1000", http.StatusTooManyRequests},
+		{"Other Client", "valid-key", "9.9.9.9:1000", http.StatusOK},
+		{"Missing Key Not Counted", "", "7.7.7.7:1000", http.StatusUnauthorized},
+		{"Missing Key Again", "", "7.7.7.7:1000", http.StatusUnauthorized},
+		{"Missing Key Third Time", "", "7.7.7.7:1000", http.StatusUnauthorized},
+	}
+	for _, tc := range tt {
+		req := httptest.NewRequest(http.MethodGet, "/checkWhitelist/1.1.1.1", nil)
+		req.RemoteAddr = tc.remoteAddr
+		if tc.key != "" {
+			req.Header.Set("X-API-Key", tc.key)
+		}
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, req)
+		if !suite.Equal(tc.status, rec.Code, "was expecting %v on %v, received %v", tc.status, tc.testName, rec.Code) {
+			Log(log.InfoLevel, fmt.Sprintf("was expecting %v on %v, received %v", tc.status, tc.testName, rec.Code), true)
+		}
+		if tc.status == http.StatusTooManyRequests {
+			suite.NotEmpty(rec.Header().Get("Retry-After"), "was expecting a Retry-After header")
+		}
+	}
+}
+
+//TestMaxInFlight holds requests open and validates the next one is shed
+func (suite *RateLimitSuite) TestMaxInFlight() {
+	Log(log.InfoLevel, "====== Running TestMaxInFlight ===========", true)
+	setupRateLimits(RateLimitConfig{MaxInFlight: 2})
+	started := make(chan struct{})
+	release := make(chan struct{})
+	router := suite.limitedRouter(func(w http.ResponseWriter, r *http.Request) {
+		started <- struct{}{}
+		<-release
+	})
+
+	var wg sync.WaitGroup
+	for i := 0; i < 2; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			router.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/lookup/1.1.1.1", nil))
+		}()
+		<-started
+	}
+
+	rec := httptest.NewRecorder()
+	router.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/lookup/1.1.1.1", nil))
+	if !suite.Equal(http.StatusServiceUnavailable, rec.Code) {
+		Log(log.InfoLevel, fmt.Sprintf("was expecting 503 over the in-flight cap, received %v", rec.Code), true)
+	}
+	suite.Equal("1", rec.Header().Get("Retry-After"))
+
+	close(release)
+	wg.Wait()
+	rec = httptest.NewRecorder()
+	go func() { <-started }()
+	router.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/lookup/1.1.1.1", nil))
+	suite.Equal(http.StatusOK, rec.Code, "was expecting requests to be accepted once in-flight requests complete")
+}
@@ -0,0 +1,343 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"reflect"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+//restartKeys are the config keys that are only read at startup. changes to them are logged and
+//ignored until the process restarts
+var restartKeys = map[string]bool{
+	"port":               true,
+	"socket path":        true,
+	"socket mode":        true,
+	"database path":      true,
+	"provider":           true,
+	"asn database path":  true,
+	"proxy protocol":     true,
+	"tls cert path":      true,
+	"tls key path":       true,
+	"tls min version":    true,
+	"tls client ca path": true,
+	//the server timeouts and header limit are fixed when the server is built
+	"server.read header timeout": true,
+	"server.read timeout":        true,
+	"server.write timeout":       true,
+	"server.idle timeout":        true,
+	"server.max header bytes":    true,
+}
+
+//activeConfig is the configuration in effect. revision starts at 1 and is bumped every time a
+//reload changes it
+var activeConfig = struct {
+	sync.Mutex
+	args     []string
+	config   Config
+	revision int
+	loaded   time.Time
+}{}
+
+//runtimeState is every reloadable setting the request path reads. a reload builds a complete state
+//and publishes it with a single swap, so a request sees either the old or the new settings, never a
+//mix, and a reload that fails leaves the running state untouched
+type runtimeState struct {
+	logPath         string
+	logLevel        log.Level
+	maxBodyBytes    int64
+	maxEntries      int
+	unknownEntries  string
+	forwardedHeader string
+	trustedProxies  []*net.IPNet
+	//a nil map means authentication is disabled
+	apiKeys map[string]APIKey
+	//nil disables rate limiting, auditing and webhooks respectively
+	rateLimiter *rateLimiter
+	auditLog    *auditLog
+	webhooks    *webhookDispatcher
+}
+
+//defaultRuntime is the state before any config is applied
+var defaultRuntime = &runtimeState{
+	logLevel:        log.DebugLevel,
+	maxBodyBytes:    defaultConfig.Server.MaxBodyBytes,
+	maxEntries:      defaultConfig.Server.MaxEntries,
+	unknownEntries:  defaultConfig.UnknownEntries,
+	forwardedHeader: defaultConfig.ForwardedHeader,
+}
+
+//activeRuntime is the published state, nil until the first one is published
+var activeRuntime atomic.Pointer[runtimeState]
+
+const runtimeContextKey contextKey = "runtime"
+
+//currentRuntime returns the published state
+func currentRuntime() *runtimeState {
+	if state := activeRuntime.Load(); state != nil {
+		return state
+	}
+	return defaultRuntime
+}
+
+//requestRuntime returns the state a request was started with, so everything it reads comes from the
+//same config even if a reload lands while it's running
+func requestRuntime(r *http.Request) *runtimeState {
+	if state, ok := r.Context().Value(runtimeContextKey).(*runtimeState); ok {
+		return state
+	}
+	return currentRuntime()
+}
+
+//runtimeMiddleware loads the published state once for the request
+func runtimeMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), runtimeContextKey, currentRuntime())))
+	})
+}
+
+//updateRuntime publishes a copy of the current state changed by update
+func updateRuntime(update func(state *runtimeState)) {
+	for {
+		current := activeRuntime.Load()
+		next := *currentRuntime()
+		update(&next)
+		if activeRuntime.CompareAndSwap(current, &next) {
+			handOver(currentOrDefault(current), &next)
+			return
+		}
+	}
+}
+
+//publishRuntime replaces the published state with next
+func publishRuntime(next *runtimeState) {
+	handOver(currentOrDefault(activeRuntime.Swap(next)), next)
+}
+
+//currentOrDefault returns the default state in place of no state
+func currentOrDefault(state *runtimeState) *runtimeState {
+	if state == nil {
+		return defaultRuntime
+	}
+	return state
+}
+
+//handOver closes the audit log and dispatcher of a replaced state that the new one doesn't use, and
+//starts the new dispatcher once the replaced one has queued everything it collected. writes that
+//still reach the closed ones are passed on to the published state
+func handOver(replaced *runtimeState, next *runtimeState) {
+	if replaced.auditLog != nil && replaced.auditLog != next.auditLog {
+		replaced.auditLog.Close()
+	}
+	if replaced.webhooks != next.webhooks {
+		if replaced.webhooks != nil {
+			replaced.webhooks.Close()
+		}
+		if next.webhooks != nil {
+			next.webhooks.start()
+		}
+	}
+}
+
+//setLogPath sets the directory for logs
+func setLogPath(path string) {
+	updateRuntime(func(state *runtimeState) { state.logPath = path })
+}
+
+//ConfigRevision returns the revision of the active configuration and when it was applied
+func ConfigRevision() (int, time.Time) {
+	activeConfig.Lock()
+	defer activeConfig.Unlock()
+	return activeConfig.revision, activeConfig.loaded
+}
+
+//applyConfig sets up every reloadable setting. previous is nil at startup; on a reload only the
+//sections that changed are rebuilt, except the api keys, corrections and policies files which are
+//always read again. the runtime state is built in full and only published once everything else was
+//set up
+func applyConfig(config Config, previous *Config) (err error) {
+	changed := func(section func(Config) interface{}) bool {
+		return previous == nil || !reflect.DeepEqual(section(config), section(*previous))
+	}
+	level, err := log.ParseLevel(config.LogLevel)
+	if err != nil {
+		return err
+	}
+	current := currentRuntime()
+	next := &runtimeState{
+		logPath:         config.LogPath,
+		logLevel:        level,
+		maxBodyBytes:    config.Server.MaxBodyBytes,
+		maxEntries:      config.Server.MaxEntries,
+		unknownEntries:  config.UnknownEntries,
+		forwardedHeader: config.ForwardedHeader,
+		trustedProxies:  current.trustedProxies,
+		rateLimiter:     current.rateLimiter,
+		auditLog:        current.auditLog,
+		webhooks:        current.webhooks,
+	}
+	//an audit log opened here holds a file, so it's closed again if the state isn't published. a new
+	//dispatcher only starts once published
+	defer func() {
+		if err != nil && next.auditLog != current.auditLog && next.auditLog != nil {
+			next.auditLog.Close()
+		}
+	}()
+	if changed(func(c Config) interface{} { return c.TrustedProxies }) {
+		if next.trustedProxies, err = parseTrustedProxies(config.TrustedProxies); err != nil {
+			return err
+		}
+	}
+	if next.apiKeys, err = loadAPIKeys(config.APIKeysPath); err != nil {
+		return err
+	}
+	if changed(func(c Config) interface{} { return c.RateLimit }) {
+		if next.rateLimiter, err = newRateLimiter(config.RateLimit); err != nil {
+			return err
+		}
+	}
+	resizeAudit := false
+	if changed(func(c Config) interface{} { return []interface{}{c.AuditPath, c.AuditMaxSegmentSize} }) {
+		//a second log on the same directory would fork the chain, so only the segment size changes
+		if previous != nil && previous.AuditPath == config.AuditPath && current.auditLog != nil {
+			resizeAudit = true
+		} else if next.auditLog, err = openAuditLog(config.AuditPath, config.AuditMaxSegmentSize); err != nil {
+			return err
+		}
+	}
+	if changed(func(c Config) interface{} { return c.Webhooks }) {
+		if next.webhooks, err = newWebhookDispatcher(config.Webhooks); err != nil {
+			return err
+		}
+	}
+	if changed(func(c Config) interface{} { return c.Resolver }) {
+		if err := setupResolver(config.Resolver); err != nil {
+			return err
+		}
+	}
+	if changed(func(c Config) interface{} { return c.Tenants }) {
+		if err := setupTenants(config.Tenants); err != nil {
+			return err
+		}
+	}
+	//policies are compiled against the alias table, so it is set up before them
+	if changed(func(c Config) interface{} { return c.CountryAliases }) {
+		if err := setupCountryAliases(config.CountryAliases); err != nil {
+			return err
+		}
+	}
+	if err := setupCorrections(config.CorrectionsPath); err != nil {
+		return err
+	}
+	if err := setupPolicies(config.PoliciesPath); err != nil {
+		return err
+	}
+	if changed(func(c Config) interface{} { return c.ShadowPath }) {
+		if err := setupShadowLog(config.ShadowPath); err != nil {
+			return err
+		}
+	}
+	publishRuntime(next)
+	if resizeAudit {
+		next.auditLog.setMaxSize(config.AuditMaxSegmentSize)
+	}
+	return nil
+}
+
+//startConfig applies the startup configuration as revision 1. args are kept so reloads read the
+//config the same way, with the same flag overrides
+func startConfig(config Config, args []string) error {
+	if err := applyConfig(config, nil); err != nil {
+		return err
+	}
+	activeConfig.Lock()
+	defer activeConfig.Unlock()
+	activeConfig.args = args
+	activeConfig.config = config
+	activeConfig.revision = 1
+	activeConfig.loaded = time.Now()
+	return nil
+}
+
+//reloadConfig reads and validates the config again and applies it. an invalid config is rejected and
+//the active one kept; if applying fails part way, the active config is applied again so no mix of
+//the two is left running
+func reloadConfig() error {
+	activeConfig.Lock()
+	defer activeConfig.Unlock()
+	current := activeConfig.config
+
+	next, err := loadConfig(activeConfig.args)
+	if err == nil {
+		err = validateConfig(next)
+	}
+	if err != nil {
+		return fmt.Errorf("config reload rejected, keeping revision %v: %v", activeConfig.revision, err)
+	}
+	if ignored := keepRestartSettings(&next, current); len(ignored) > 0 {
+		Log(log.WarnLevel, fmt.Sprintf("changes to %v take effect after a restart", strings.Join(ignored, ", ")), flag.Lookup("test.v") == nil)
+	}
+	if err := applyConfig(next, &current); err != nil {
+		if restoreErr := applyConfig(current, &next); restoreErr != nil {
+			Log(log.ErrorLevel, fmt.Sprintf("failed to restore config revision %v: %v", activeConfig.revision, restoreErr), flag.Lookup("test.v") == nil)
+		}
+		return fmt.Errorf("config reload rejected, keeping revision %v: %v", activeConfig.revision, err)
+	}
+	if !reflect.DeepEqual(next, current) {
+		activeConfig.revision++
+		activeConfig.loaded = time.Now()
+	}
+	activeConfig.config = next
+	return nil
+}
+
+//keepRestartSettings resets the startup only settings of next to their current values and returns
+//the keys that were changed
+func keepRestartSettings(next *Config, current Config) []string {
+	var ignored []string
+	currentSettings := configSettings(reflect.ValueOf(current), "")
+	for i, setting := range configSettings(reflect.ValueOf(next).Elem(), "") {
+		if restartKeys[setting.key] && !reflect.DeepEqual(setting.value.Interface(), currentSettings[i].value.Interface()) {
+			ignored = append(ignored, setting.key)
+			setting.value.Set(currentSettings[i].value)
+		}
+	}
+	return ignored
+}
+
+//watchConfig reloads the config when the process receives SIGHUP and, when the config came from a
+//file, whenever that file changes
+func watchConfig(v *viper.Viper) {
+	reload := func(trigger string) {
+		if err := reloadConfig(); err != nil {
+			Log(log.ErrorLevel, err.Error(), flag.Lookup("test.v") == nil)
+			return
+		}
+		revision, _ := ConfigRevision()
+		Log(log.InfoLevel, fmt.Sprintf("config reloaded on %v, revision %v", trigger, revision), flag.Lookup("test.v") == nil)
+	}
+	if v != nil && v.ConfigFileUsed() != "" {
+		v.OnConfigChange(func(event fsnotify.Event) { reload("change to " + event.Name) })
+		v.WatchConfig()
+	}
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGHUP)
+	go func() {
+		for range signals {
+			reload("SIGHUP")
+		}
+	}()
+}
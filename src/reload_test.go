@@ -0,0 +1,248 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+
+	jsoniter "github.com/json-iterator/go"
+	log "github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/suite"
+)
+
+func TestReloadSuite(t *testing.T) {
+	reloadSuite := new(ReloadSuite)
+	suite.Run(t, reloadSuite)
+}
+
+type ReloadSuite struct {
+	suite.Suite
+	dir  string
+	path string
+}
+
+func (suite *ReloadSuite) SetupSuite() {
+	setLogPath("./logs/")
+	Log(log.InfoLevel, "=============== Running Reload Suite ======================", true)
+	setupDB("./test-data/test-data.mmdb")
+	suite.dir, _ = os.MkdirTemp("", "reload-test")
+	suite.path = filepath.Join(suite.dir, "config.yaml")
+}
+
+func (suite *ReloadSuite) SetupTest() {
+	suite.writeConfig("")
+	config, err := loadConfig([]string{"-config", suite.path})
+	suite.Require().NoError(err)
+	suite.Require().NoError(startConfig(config, []string{"-config", suite.path}))
+}
+
+func (suite *ReloadSuite) TearDownSuite() {
+	//late file events or signals reload from a missing file and are rejected
+	activeConfig.Lock()
+	activeConfig.args = []string{"-config", filepath.Join(suite.dir, "missing.yaml")}
+	activeConfig.revision = 0
+	activeConfig.Unlock()
+	updateRuntime(func(state *runtimeState) { state.rateLimiter = nil })
+	setupTrustedProxies(nil)
+	updateRuntime(func(state *runtimeState) { state.logLevel = log.DebugLevel })
+	setupPolicies("")
+	setupCorrections("")
+	compiling.Wait()
+	testProvider().Close()
+	os.RemoveAll(suite.dir)
+	Log(log.InfoLevel, "========== Reload Testsuite completed ===========", true)
+	fmt.Println("========== Reload Testsuite completed ===========")
+}
+
+//writeConfig writes the test config file with extra appended to the base settings
+func (suite *ReloadSuite) writeConfig(extra string) {
+	base := fmt.Sprintf("database path: \"./test-data/test-data.mmdb\"\nlog path: \"./logs/\"\n"+
+		"corrections path: %q\npolicies path: %q\naudit path: \"\"\n",
+		filepath.Join(suite.dir, "corrections.json"), filepath.Join(suite.dir, "policies.json"))
+	os.WriteFile(suite.path, []byte(base+extra), 0644)
+}
+
+func (suite *ReloadSuite) TestReloadConfig() {
+	Log(log.InfoLevel, "====== Running TestReloadConfig ===========", true)
+	revision, _ := ConfigRevision()
+	suite.Equal(1, revision)
+
+	suite.writeConfig("log level: \"warn\"\nrate limit:\n  requests per second: 10\n  burst: 20\n")
+	err := reloadConfig()
+	if !suite.NoError(err, "was expecting no error, returned %v", err) {
+		Log(log.InfoLevel, fmt.Sprintf("was expecting no error, returned %v", err), true)
+	}
+	revision, _ = ConfigRevision()
+	suite.Equal(2, revision)
+	suite.Equal(log.WarnLevel, currentRuntime().logLevel)
+	suite.Equal(float64(10), currentRuntime().rateLimiter.config.RequestsPerSecond)
+	limiter := currentRuntime().rateLimiter
+
+	//reloading an unchanged config keeps the revision and the rate limit buckets
+	suite.NoError(reloadConfig())
+	revision, _ = ConfigRevision()
+	suite.Equal(2, revision)
+	suite.True(limiter == currentRuntime().rateLimiter, "was expecting unchanged sections to be left alone")
+
+	tt := []struct {
+		testName string
+		extra    string
+		expected string
+	}{
+		{"Invalid Port", "port: \"http\"\n", "port: must be a number"},
+		{"Unknown Key", "LogPath: \"./logs/\"\n", "logpath"},
+		{"Invalid Log Level", "log level: \"loud\"\n", "log level"},
+		{"Invalid Trusted Proxy", "trusted proxies: [\"proxy.internal\"]\n", "invalid trusted proxy"},
+	}
+	for _, tc := range tt {
+		suite.writeConfig(tc.extra)
+		err := reloadConfig()
+		if !suite.Error(err, "was expecting an error on %v, returned ok", tc.testName) {
+			Log(log.InfoLevel, fmt.Sprintf("was expecting an error on %v, returned ok", tc.testName), true)
+			continue
+		}
+		suite.Contains(err.Error(), "keeping revision 2", "unexpected error on %v", tc.testName)
+		suite.Contains(err.Error(), tc.expected, "unexpected error on %v", tc.testName)
+		revision, _ = ConfigRevision()
+		suite.Equal(2, revision, "was expecting %v to keep the active config", tc.testName)
+		suite.Equal(log.WarnLevel, currentRuntime().logLevel)
+		suite.Equal(float64(10), currentRuntime().rateLimiter.config.RequestsPerSecond)
+	}
+}
+
+//TestReloadRollback validates a failure part way through applying restores the sections already applied
+func (suite *ReloadSuite) TestReloadRollback() {
+	Log(log.InfoLevel, "====== Running TestReloadRollback ===========", true)
+	os.WriteFile(filepath.Join(suite.dir, "policies.json"), []byte(`INVALID#!`), 0644)
+	defer os.Remove(filepath.Join(suite.dir, "policies.json"))
+	suite.writeConfig("rate limit:\n  requests per second: 3\n")
+	err := reloadConfig()
+	if !suite.Error(err, "was expecting an error on an invalid policies file, returned ok") {
+		Log(log.InfoLevel, "was expecting an error on an invalid policies file, returned ok", true)
+	}
+	suite.Equal(float64(0), currentRuntime().rateLimiter.config.RequestsPerSecond, "was expecting the rate limit to be restored")
+	revision, _ := ConfigRevision()
+	suite.Equal(1, revision)
+}
+
+//TestReloadWhileServing reloads configs that rebuild the whole runtime state while checks are
+//running. run with -race, it validates requests never read a state that is being replaced, and that
+//every decision ends up in an intact audit chain even when its log was swapped out mid request
+func (suite *ReloadSuite) TestReloadWhileServing() {
+	Log(log.InfoLevel, "====== Running TestReloadWhileServing ===========", true)
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer receiver.Close()
+	auditDirs := []string{filepath.Join(suite.dir, "audit-a"), filepath.Join(suite.dir, "audit-b")}
+	writeConfig := func(i int) {
+		config := fmt.Sprintf("database path: \"./test-data/test-data.mmdb\"\nlog path: \"./logs/\"\n"+
+			"corrections path: %q\npolicies path: %q\naudit path: %q\n"+
+			"trusted proxies: [\"10.%v.0.0/16\"]\nunknown entries: %v\n"+
+			"rate limit:\n  requests per second: %v\n  burst: 100000\n"+
+			"webhooks:\n  queue path: %q\n  max attempts: %v\n  endpoints:\n  - url: %q\n    secret: \"secret\"\n",
+			filepath.Join(suite.dir, "corrections.json"), filepath.Join(suite.dir, "policies.json"), auditDirs[i%2],
+			i, []string{UnknownEntriesReject, UnknownEntriesWarn}[i%2], 10000+i,
+			filepath.Join(suite.dir, "webhooks"), 2+i%2, receiver.URL)
+		os.WriteFile(suite.path, []byte(config), 0644)
+	}
+	writeConfig(0)
+	suite.Require().NoError(reloadConfig())
+	defer func() {
+		suite.writeConfig("")
+		suite.NoError(reloadConfig())
+	}()
+
+	var served int64
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	router := setupRouter()
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				req := httptest.NewRequest(http.MethodGet, "/checkWhitelist/1.207.235.255", bytes.NewBufferString(`{"whitelisted_countries": ["germany"]}`))
+				rec := httptest.NewRecorder()
+				router.ServeHTTP(rec, req)
+				if rec.Code == http.StatusOK {
+					atomic.AddInt64(&served, 1)
+				}
+			}
+		}()
+	}
+	for i := 1; i <= 20; i++ {
+		writeConfig(i)
+		if err := reloadConfig(); !suite.NoError(err, "was expecting reload %v to be applied, returned %v", i, err) {
+			Log(log.InfoLevel, fmt.Sprintf("was expecting reload %v to be applied, returned %v", i, err), true)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	close(stop)
+	wg.Wait()
+
+	suite.Equal(UnknownEntriesReject, currentRuntime().unknownEntries)
+	suite.Equal(float64(10020), currentRuntime().rateLimiter.config.RequestsPerSecond)
+	recorded := uint64(0)
+	for _, dir := range auditDirs {
+		verified, err := VerifyAuditLog(dir)
+		suite.NoError(err, "was expecting the chain in %v to be intact", dir)
+		recorded += verified
+	}
+	suite.NotZero(served)
+	suite.Equal(uint64(served), recorded, "was expecting every decision to be audited")
+}
+
+//TestRestartSettings validates startup only settings are left as they are on a reload
+func (suite *ReloadSuite) TestRestartSettings() {
+	Log(log.InfoLevel, "====== Running TestRestartSettings ===========", true)
+	suite.writeConfig("port: \"9999\"\ntls min version: \"1.3\"\n")
+	suite.NoError(reloadConfig())
+	revision, _ := ConfigRevision()
+	suite.Equal(1, revision, "was expecting ignored changes to keep the revision")
+	activeConfig.Lock()
+	suite.Equal("8080", activeConfig.config.Port)
+	suite.Equal("1.2", activeConfig.config.TLSMinVersion)
+	activeConfig.Unlock()
+}
+
+//TestWatchConfig validates a SIGHUP and a change to the config file both reload the config, and that
+//the status endpoint reports the revision
+func (suite *ReloadSuite) TestWatchConfig() {
+	Log(log.InfoLevel, "====== Running TestWatchConfig ===========", true)
+	_, v, err := readConfig([]string{"-config", suite.path})
+	suite.Require().NoError(err)
+	watchConfig(v)
+
+	//give the file watcher time to start before writing
+	time.Sleep(100 * time.Millisecond)
+	suite.writeConfig("rate limit:\n  burst: 7\n")
+	suite.Eventually(func() bool { revision, _ := ConfigRevision(); return revision == 2 }, 5*time.Second, 20*time.Millisecond,
+		"was expecting the file change to be applied")
+
+	activeConfig.Lock()
+	activeConfig.args = []string{"-config", suite.path, "-rate-limit-burst", "9"}
+	activeConfig.Unlock()
+	syscall.Kill(os.Getpid(), syscall.SIGHUP)
+	suite.Eventually(func() bool { revision, _ := ConfigRevision(); return revision == 3 }, 5*time.Second, 20*time.Millisecond,
+		"was expecting SIGHUP to reload the config")
+	suite.Equal(9, currentRuntime().rateLimiter.config.Burst)
+
+	rec := httptest.NewRecorder()
+	getStatusHandler(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+	var status map[string]string
+	jsoniter.NewDecoder(rec.Body).Decode(&status)
+	suite.Equal("3", status["config_revision"])
+	suite.NotEmpty(status["config_loaded"])
+}
@@ -0,0 +1,366 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	//zone names have to resolve even on hosts without a zoneinfo database
+	_ "time/tzdata"
+)
+
+//Clock returns the current time for scheduled entries and tenant quota periods. tests replace it to
+//move through schedules and periods
+var Clock = time.Now
+
+//maxScheduledChanges bounds how many upcoming changes are returned for a single entry
+const maxScheduledChanges = 1000
+
+//maxScheduleWindow is the furthest ahead upcoming changes can be listed
+const maxScheduleWindow = 366 * 24 * time.Hour
+
+//ScheduledEntry is a whitelist or blacklist entry of a policy that only applies some of the time:
+//between start and end when they are set, and, when cron is set, for duration after every time the
+//5 field cron expression (minute hour day-of-month month day-of-week) matches in the time zone
+type ScheduledEntry struct {
+	List     string     `json:"list"`
+	Entry    string     `json:"entry"`
+	Start    *time.Time `json:"start,omitempty"`
+	End      *time.Time `json:"end,omitempty"`
+	Cron     string     `json:"cron,omitempty"`
+	Duration string     `json:"duration,omitempty"`
+	TimeZone string     `json:"time_zone,omitempty"`
+
+	//the parsed cron expression and duration, set when the entry is stored so checks only evaluate them
+	cron   *cronSchedule
+	window time.Duration
+}
+
+//ScheduledChange is a point in time where a scheduled entry of a policy starts or stops applying
+type ScheduledChange struct {
+	Time   time.Time `json:"time"`
+	Policy string    `json:"policy"`
+	List   string    `json:"list"`
+	Entry  string    `json:"entry"`
+	Active bool      `json:"active"`
+}
+
+//cronSchedule is a parsed cron expression. each field is the set of values it matches
+type cronSchedule struct {
+	minutes, hours, days, months, weekdays map[int]bool
+	//cron matches either day field when both are restricted
+	anyDay, anyWeekday bool
+	location           *time.Location
+}
+
+//validate checks the list name, the entry, the bounds and the recurrence of a scheduled entry
+func (s ScheduledEntry) validate() error {
+	if s.List != "whitelist" && s.List != "blacklist" {
+		return fmt.Errorf("scheduled entry %q: list must be whitelist or blacklist, got %q", s.Entry, s.List)
+	}
+	if _, err := matchEntry(s.Entry, Country{}, ASN{}); err != nil {
+		return err
+	}
+	if s.Start != nil && s.End != nil && !s.Start.Before(*s.End) {
+		return fmt.Errorf("scheduled entry %q: start must be before end", s.Entry)
+	}
+	if s.Cron == "" {
+		if s.Duration != "" || s.TimeZone != "" {
+			return fmt.Errorf("scheduled entry %q: duration and time zone need a cron schedule", s.Entry)
+		}
+		return nil
+	}
+	_, err := s.parsed()
+	return err
+}
+
+//parsed returns the entry with its cron expression and duration parsed
+func (s ScheduledEntry) parsed() (ScheduledEntry, error) {
+	if s.Cron == "" {
+		return s, nil
+	}
+	schedule, err := s.schedule()
+	if err != nil {
+		return s, fmt.Errorf("scheduled entry %q: %v", s.Entry, err)
+	}
+	duration, err := time.ParseDuration(s.Duration)
+	if err != nil || duration <= 0 {
+		return s, fmt.Errorf("scheduled entry %q: duration must be a positive duration such as 8h, got %q", s.Entry, s.Duration)
+	}
+	s.cron, s.window = schedule, duration
+	return s, nil
+}
+
+//parsedSchedules returns a copy of validated scheduled entries with their recurrence parsed
+func parsedSchedules(schedules []ScheduledEntry) []ScheduledEntry {
+	if len(schedules) == 0 {
+		return schedules
+	}
+	parsed := make([]ScheduledEntry, len(schedules))
+	for i, scheduled := range schedules {
+		parsed[i], _ = scheduled.parsed()
+	}
+	return parsed
+}
+
+//recurrence returns the parsed cron schedule and duration of the entry, parsing them for entries
+//that weren't stored
+func (s ScheduledEntry) recurrence() (*cronSchedule, time.Duration, bool) {
+	if s.cron != nil {
+		return s.cron, s.window, true
+	}
+	parsed, err := s.parsed()
+	return parsed.cron, parsed.window, err == nil
+}
+
+//schedule parses the cron expression in the entry's time zone, UTC when none is set
+func (s ScheduledEntry) schedule() (*cronSchedule, error) {
+	location, err := time.LoadLocation(s.TimeZone)
+	if err != nil {
+		return nil, fmt.Errorf("invalid time zone %q", s.TimeZone)
+	}
+	return parseCron(s.Cron, location)
+}
+
+//ActiveAt reports whether the entry applies at t. entries that fail to validate never apply
+func (s ScheduledEntry) ActiveAt(t time.Time) bool {
+	if (s.Start != nil && t.Before(*s.Start)) || (s.End != nil && !t.Before(*s.End)) {
+		return false
+	}
+	if s.Cron == "" {
+		return true
+	}
+	schedule, duration, ok := s.recurrence()
+	if !ok {
+		return false
+	}
+	//a window is open when the schedule matched within the last duration
+	next, ok := schedule.next(t.Add(-duration))
+	return ok && !next.After(t)
+}
+
+//changes returns the times in [from, to] at which the entry starts or stops applying
+func (s ScheduledEntry) changes(from time.Time, to time.Time) []time.Time {
+	var candidates []time.Time
+	for _, bound := range []*time.Time{s.Start, s.End} {
+		if bound != nil {
+			candidates = append(candidates, *bound)
+		}
+	}
+	if s.Cron != "" {
+		schedule, duration, ok := s.recurrence()
+		if !ok {
+			return nil
+		}
+		//windows that opened before from can still close inside the range
+		at := from.Add(-duration)
+		for len(candidates) < maxScheduledChanges {
+			next, ok := schedule.next(at)
+			if !ok || next.After(to) {
+				break
+			}
+			candidates = append(candidates, next, next.Add(duration))
+			at = next
+		}
+	}
+	sort.Slice(candidates, func(i, j int) bool { return candidates[i].Before(candidates[j]) })
+
+	var changes []time.Time
+	for _, candidate := range candidates {
+		if candidate.Before(from) || candidate.After(to) || (len(changes) > 0 && candidate.Equal(changes[len(changes)-1])) {
+			continue
+		}
+		if s.ActiveAt(candidate) != s.ActiveAt(candidate.Add(-time.Nanosecond)) {
+			changes = append(changes, candidate)
+		}
+	}
+	return changes
+}
+
+//activeEntries returns the policy's whitelist and blacklist with the scheduled entries that apply at t
+func (p Policy) activeEntries(t time.Time) ([]string, []string) {
+	if len(p.Schedules) == 0 {
+		return p.Whitelist, p.Blacklist
+	}
+	return p.entriesIn(p.scheduleState(t))
+}
+
+//scheduleState returns which of the policy's scheduled entries apply at t, a 1 or 0 per entry
+func (p Policy) scheduleState(t time.Time) string {
+	state := make([]byte, len(p.Schedules))
+	for i, scheduled := range p.Schedules {
+		state[i] = '0'
+		if scheduled.ActiveAt(t) {
+			state[i] = '1'
+		}
+	}
+	return string(state)
+}
+
+//currentScheduleState is scheduleState now. the clock is only read for policies with schedules
+func (p Policy) currentScheduleState() string {
+	if len(p.Schedules) == 0 {
+		return ""
+	}
+	return p.scheduleState(Clock())
+}
+
+//entriesIn returns the policy's whitelist and blacklist with the scheduled entries applying in state
+func (p Policy) entriesIn(state string) ([]string, []string) {
+	whitelist := append([]string{}, p.Whitelist...)
+	blacklist := append([]string{}, p.Blacklist...)
+	for i, scheduled := range p.Schedules {
+		if state[i] != '1' {
+			continue
+		}
+		if scheduled.List == "whitelist" {
+			whitelist = append(whitelist, scheduled.Entry)
+		} else {
+			blacklist = append(blacklist, scheduled.Entry)
+		}
+	}
+	return whitelist, blacklist
+}
+
+//allEntries returns every entry of the policy, scheduled ones included
+func (p Policy) allEntries() []string {
+	entries := append(append([]string{}, p.Whitelist...), p.Blacklist...)
+	for _, scheduled := range p.Schedules {
+		entries = append(entries, scheduled.Entry)
+	}
+	return entries
+}
+
+//UpcomingChanges returns the scheduled changes of every policy of the tenant, or only of the named
+//one, between now and now+within, in time order
+func UpcomingChanges(tenant string, name string, within time.Duration) []ScheduledChange {
+	from := Clock()
+	to := from.Add(within)
+	changes := []ScheduledChange{}
+	for _, policy := range ListPolicies(tenant) {
+		if name != "" && policy.Name != name {
+			continue
+		}
+		for _, scheduled := range policy.Schedules {
+			for _, at := range scheduled.changes(from, to) {
+				changes = append(changes, ScheduledChange{Time: at, Policy: policy.Name, List: scheduled.List,
+					Entry: scheduled.Entry, Active: scheduled.ActiveAt(at)})
+			}
+		}
+	}
+	sort.SliceStable(changes, func(i, j int) bool { return changes[i].Time.Before(changes[j].Time) })
+	return changes
+}
+
+//parseCron parses a 5 field cron expression. fields accept *, single values, ranges (1-5), lists
+//(1,15) and steps (*/15, 0-30/10). day-of-week is 0-6 from sunday, with 7 also sunday
+func parseCron(expression string, location *time.Location) (*cronSchedule, error) {
+	fields := strings.Fields(expression)
+	if len(fields) != 5 {
+		return nil, fmt.Errorf("cron %q must have 5 fields: minute hour day-of-month month day-of-week", expression)
+	}
+	bounds := [5][2]int{{0, 59}, {0, 23}, {1, 31}, {1, 12}, {0, 7}}
+	var sets [5]map[int]bool
+	for i, field := range fields {
+		set, err := parseCronField(field, bounds[i][0], bounds[i][1])
+		if err != nil {
+			return nil, fmt.Errorf("cron %q: %v", expression, err)
+		}
+		sets[i] = set
+	}
+	if sets[4][7] {
+		sets[4][0] = true
+	}
+	return &cronSchedule{
+		minutes:    sets[0],
+		hours:      sets[1],
+		days:       sets[2],
+		months:     sets[3],
+		weekdays:   sets[4],
+		anyDay:     fields[2] == "*",
+		anyWeekday: fields[4] == "*",
+		location:   location,
+	}, nil
+}
+
+//parseCronField parses one comma separated cron field into the set of values it matches
+func parseCronField(field string, min int, max int) (map[int]bool, error) {
+	set := map[int]bool{}
+	for _, part := range strings.Split(field, ",") {
+		span, stepValue, hasStep := strings.Cut(part, "/")
+		step := 1
+		if hasStep {
+			var err error
+			if step, err = strconv.Atoi(stepValue); err != nil || step <= 0 {
+				return nil, fmt.Errorf("invalid step in %q", part)
+			}
+		}
+		low, high := min, max
+		if span != "*" {
+			first, last, isRange := strings.Cut(span, "-")
+			var err error
+			if low, err = strconv.Atoi(first); err != nil {
+				return nil, fmt.Errorf("invalid value in %q", part)
+			}
+			high = low
+			if isRange {
+				if high, err = strconv.Atoi(last); err != nil {
+					return nil, fmt.Errorf("invalid value in %q", part)
+				}
+			} else if hasStep {
+				high = max
+			}
+		}
+		if low < min || high > max || low > high {
+			return nil, fmt.Errorf("%q is outside %v-%v", part, min, max)
+		}
+		for value := low; value <= high; value += step {
+			set[value] = true
+		}
+	}
+	return set, nil
+}
+
+//matchesDay applies cron's rule that a restricted day-of-month or day-of-week matches on either
+func (c *cronSchedule) matchesDay(t time.Time) bool {
+	day, weekday := c.days[t.Day()], c.weekdays[int(t.Weekday())]
+	switch {
+	case c.anyDay && c.anyWeekday:
+		return true
+	case c.anyDay:
+		return weekday
+	case c.anyWeekday:
+		return day
+	}
+	return day || weekday
+}
+
+//next returns the first minute after t the schedule matches, skipping whole months, days and hours
+//that can't match. it gives up after five years, for schedules such as february 30th
+func (c *cronSchedule) next(t time.Time) (time.Time, bool) {
+	t = t.In(c.location).Truncate(time.Minute).Add(time.Minute)
+	limit := t.AddDate(5, 0, 0)
+	for t.Before(limit) {
+		var skipTo time.Time
+		switch {
+		case !c.months[int(t.Month())]:
+			skipTo = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, c.location)
+		case !c.matchesDay(t):
+			skipTo = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, c.location)
+		case !c.hours[t.Hour()]:
+			skipTo = time.Date(t.Year(), t.Month(), t.Day(), t.Hour()+1, 0, 0, 0, c.location)
+		case !c.minutes[t.Minute()]:
+			skipTo = t.Add(time.Minute)
+		default:
+			return t, true
+		}
+		//a local time skipped by a daylight saving change can resolve to before t, so step to the
+		//next hour on the clock instead
+		if !skipTo.After(t) {
+			skipTo = t.Add(time.Duration(60-t.Minute()) * time.Minute)
+		}
+		t = skipTo
+	}
+	return time.Time{}, false
+}
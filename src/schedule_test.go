@@ -0,0 +1,235 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	jsoniter "github.com/json-iterator/go"
+	log "github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/suite"
+)
+
+func TestScheduleSuite(t *testing.T) {
+	scheduleSuite := new(ScheduleSuite)
+	suite.Run(t, scheduleSuite)
+}
+
+type ScheduleSuite struct {
+	suite.Suite
+	dir string
+	now time.Time
+}
+
+func (suite *ScheduleSuite) SetupSuite() {
+	setLogPath("./logs/")
+	Log(log.InfoLevel, "=============== Running Schedule Suite ======================", true)
+	setupDB("./test-data/test-data.mmdb")
+	suite.dir, _ = os.MkdirTemp("", "schedule-test")
+}
+
+func (suite *ScheduleSuite) SetupTest() {
+	os.Remove(filepath.Join(suite.dir, "policies.json"))
+	setupPolicies(filepath.Join(suite.dir, "policies.json"))
+	//a monday
+	suite.now = time.Date(2026, 3, 2, 12, 0, 0, 0, time.UTC)
+	Clock = func() time.Time { return suite.now }
+}
+
+func (suite *ScheduleSuite) TearDownTest() {
+	//background compiles of scheduled policies read the clock
+	compiling.Wait()
+	Clock = time.Now
+}
+
+func (suite *ScheduleSuite) TearDownSuite() {
+	setupPolicies("")
+	compiling.Wait()
+	testProvider().Close()
+	os.RemoveAll(suite.dir)
+	Log(log.InfoLevel, "========== Schedule Testsuite completed ===========", true)
+	fmt.Println("========== Schedule Testsuite completed ===========")
+}
+
+//at parses an RFC 3339 time for the test tables
+func at(value string) time.Time {
+	t, _ := time.Parse(time.RFC3339, value)
+	return t
+}
+
+func (suite *ScheduleSuite) TestCronNext() {
+	Log(log.InfoLevel, "====== Running TestCronNext ===========", true)
+	tt := []struct {
+		testName string
+		cron     string
+		zone     string
+		from     string
+		expected string
+	}{
+		{"Every Minute", "* * * * *", "", "2026-03-02T12:00:30Z", "2026-03-02T12:01:00Z"},
+		{"Hourly Step", "*/15 * * * *", "", "2026-03-02T12:50:00Z", "2026-03-02T13:00:00Z"},
+		{"Weekdays", "0 9 * * 1-5", "", "2026-03-06T10:00:00Z", "2026-03-09T09:00:00Z"},
+		{"Sunday As 7", "0 0 * * 7", "", "2026-03-02T00:00:00Z", "2026-03-08T00:00:00Z"},
+		{"Day Or Weekday", "0 0 15 * 0", "", "2026-03-09T00:00:00Z", "2026-03-15T00:00:00Z"},
+		{"Next Month", "30 6 1 * *", "", "2026-03-02T00:00:00Z", "2026-04-01T06:30:00Z"},
+		{"List And Range", "0 8,20 * 6-7 *", "", "2026-03-02T00:00:00Z", "2026-06-01T08:00:00Z"},
+		{"Time Zone", "0 9 * * *", "Europe/Berlin", "2026-03-02T00:00:00Z", "2026-03-02T08:00:00Z"},
+		{"Daylight Saving", "0 9 * * *", "America/New_York", "2026-03-08T00:00:00Z", "2026-03-08T13:00:00Z"},
+		{"Skipped Hour", "30 2 * * *", "America/New_York", "2026-03-08T00:00:00Z", "2026-03-09T06:30:00Z"},
+		{"Repeated Hour", "30 1 * * *", "America/New_York", "2026-11-01T04:00:00Z", "2026-11-01T05:30:00Z"},
+	}
+	for _, tc := range tt {
+		location, _ := time.LoadLocation(tc.zone)
+		schedule, err := parseCron(tc.cron, location)
+		if !suite.NoError(err, "was expecting no error on %v, returned %v", tc.testName, err) {
+			Log(log.InfoLevel, fmt.Sprintf("was expecting no error on %v, returned %v", tc.testName, err), true)
+			continue
+		}
+		next, ok := schedule.next(at(tc.from))
+		suite.True(ok, "was expecting a match on %v", tc.testName)
+		suite.True(at(tc.expected).Equal(next), "was expecting %v on %v, got %v", tc.expected, tc.testName, next.UTC())
+	}
+
+	schedule, _ := parseCron("0 0 30 2 *", time.UTC)
+	_, ok := schedule.next(suite.now)
+	suite.False(ok, "was expecting february 30th to never match")
+}
+
+func (suite *ScheduleSuite) TestValidate() {
+	Log(log.InfoLevel, "====== Running TestValidate ===========", true)
+	start, end := at("2026-03-01T00:00:00Z"), at("2026-03-10T00:00:00Z")
+	tt := []struct {
+		testName string
+		entry    ScheduledEntry
+		expected string
+	}{
+		{"Window", ScheduledEntry{List: "blacklist", Entry: "china", Start: &start, End: &end}, ""},
+		{"Recurring", ScheduledEntry{List: "whitelist", Entry: "japan", Cron: "0 9 * * 1-5", Duration: "8h", TimeZone: "Asia/Tokyo"}, ""},
+		{"Unknown List", ScheduledEntry{List: "greylist", Entry: "china"}, "list must be whitelist or blacklist"},
+		{"Invalid Entry", ScheduledEntry{List: "whitelist", Entry: "asn:partner"}, "invalid asn entry"},
+		{"End Before Start", ScheduledEntry{List: "whitelist", Entry: "china", Start: &end, End: &start}, "start must be before end"},
+		{"Wrong Field Count", ScheduledEntry{List: "whitelist", Entry: "china", Cron: "0 9 * *", Duration: "1h"}, "must have 5 fields"},
+		{"Out Of Range", ScheduledEntry{List: "whitelist", Entry: "china", Cron: "0 24 * * *", Duration: "1h"}, "outside 0-23"},
+		{"Invalid Step", ScheduledEntry{List: "whitelist", Entry: "china", Cron: "*/0 * * * *", Duration: "1h"}, "invalid step"},
+		{"Missing Duration", ScheduledEntry{List: "whitelist", Entry: "china", Cron: "0 9 * * *"}, "duration must be a positive duration"},
+		{"Duration Without Cron", ScheduledEntry{List: "whitelist", Entry: "china", Duration: "1h"}, "need a cron schedule"},
+		{"Unknown Time Zone", ScheduledEntry{List: "whitelist", Entry: "china", Cron: "0 9 * * *", Duration: "1h", TimeZone: "Mars/Olympus"}, "invalid time zone"},
+	}
+	for _, tc := range tt {
+		_, err := SavePolicy(Policy{Name: "launch", Schedules: []ScheduledEntry{tc.entry}})
+		if tc.expected == "" {
+			suite.NoError(err, "was expecting no error on %v, returned %v", tc.testName, err)
+			continue
+		}
+		if !suite.Error(err, "was expecting an error on %v, returned ok", tc.testName) {
+			Log(log.InfoLevel, fmt.Sprintf("was expecting an error on %v, returned ok", tc.testName), true)
+			continue
+		}
+		suite.Contains(err.Error(), tc.expected, "unexpected error on %v", tc.testName)
+	}
+}
+
+//TestScheduledPolicy validates checks against a policy follow its schedules as the clock moves
+func (suite *ScheduleSuite) TestScheduledPolicy() {
+	Log(log.InfoLevel, "====== Running TestScheduledPolicy ===========", true)
+	start, end := at("2026-03-03T00:00:00Z"), at("2026-03-05T00:00:00Z")
+	_, err := SavePolicy(Policy{Name: "launch", Whitelist: []string{"china", "japan"}, Schedules: []ScheduledEntry{
+		//an embargo window
+		{List: "blacklist", Entry: "china", Start: &start, End: &end},
+		//japan only during tokyo office hours
+		{List: "blacklist", Entry: "japan", Cron: "0 18 * * *", Duration: "15h", TimeZone: "Asia/Tokyo"},
+	}})
+	suite.Require().NoError(err)
+	compiling.Wait()
+	stored, _ := GetPolicy(DefaultTenant, "launch")
+	suite.NotNil(stored.Schedules[1].cron, "was expecting the stored schedule to be parsed")
+	suite.Nil(stored.Schedules[0].cron)
+
+	tt := []struct {
+		testName string
+		now      string
+		ip       string
+		expected string
+	}{
+		{"Before Embargo", "2026-03-02T12:00:00Z", "1.207.235.255", "whitelisted"},
+		{"Embargo Starts", "2026-03-03T00:00:00Z", "1.207.235.255", "not whitelisted"},
+		{"During Embargo", "2026-03-04T23:59:00Z", "1.207.235.255", "not whitelisted"},
+		{"Embargo Ends", "2026-03-05T00:00:00Z", "1.207.235.255", "whitelisted"},
+		{"Tokyo Office Hours", "2026-03-02T03:00:00Z", "1.0.16.1", "whitelisted"},
+		{"Tokyo Evening", "2026-03-02T09:00:00Z", "1.0.16.1", "not whitelisted"},
+		{"Tokyo Night", "2026-03-02T20:00:00Z", "1.0.16.1", "not whitelisted"},
+		{"Tokyo Morning", "2026-03-03T00:00:00Z", "1.0.16.1", "whitelisted"},
+	}
+	for _, tc := range tt {
+		suite.now = at(tc.now)
+		rec := httptest.NewRecorder()
+		setupRouter().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/checkWhitelist/"+tc.ip, bytes.NewBufferString(`{"policy": "launch"}`)))
+		var resp ResponseStruct
+		jsoniter.NewDecoder(rec.Body).Decode(&resp)
+		if !suite.Equal(tc.expected, resp.Response, "unexpected decision on %v", tc.testName) {
+			Log(log.InfoLevel, fmt.Sprintf("unexpected decision on %v: %v", tc.testName, resp.Response), true)
+		}
+		_, compiled := lookupCompiled(stored, net.ParseIP(tc.ip))
+		suite.True(compiled, "was expecting %v to be decided from the compiled table", tc.testName)
+	}
+}
+
+func (suite *ScheduleSuite) TestUpcomingChanges() {
+	Log(log.InfoLevel, "====== Running TestUpcomingChanges ===========", true)
+	start, end := at("2026-03-03T00:00:00Z"), at("2026-03-05T00:00:00Z")
+	SavePolicy(Policy{Name: "embargo", Schedules: []ScheduledEntry{{List: "blacklist", Entry: "china", Start: &start, End: &end}}})
+	SavePolicy(Policy{Name: "nightly", Schedules: []ScheduledEntry{{List: "whitelist", Entry: "japan", Cron: "0 22 * * *", Duration: "4h"}}})
+	compiling.Wait()
+
+	rec := httptest.NewRecorder()
+	setupRouter().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/admin/schedule?within=48h", nil))
+	var changes []ScheduledChange
+	jsoniter.NewDecoder(rec.Body).Decode(&changes)
+	suite.Equal(http.StatusOK, rec.Code)
+	expected := []ScheduledChange{
+		{Time: at("2026-03-02T22:00:00Z"), Policy: "nightly", List: "whitelist", Entry: "japan", Active: true},
+		{Time: at("2026-03-03T00:00:00Z"), Policy: "embargo", List: "blacklist", Entry: "china", Active: true},
+		{Time: at("2026-03-03T02:00:00Z"), Policy: "nightly", List: "whitelist", Entry: "japan", Active: false},
+		{Time: at("2026-03-03T22:00:00Z"), Policy: "nightly", List: "whitelist", Entry: "japan", Active: true},
+		{Time: at("2026-03-04T02:00:00Z"), Policy: "nightly", List: "whitelist", Entry: "japan", Active: false},
+	}
+	if suite.Len(changes, len(expected)) {
+		for i := range expected {
+			suite.True(expected[i].Time.Equal(changes[i].Time), "unexpected time for change %v: %v", i, changes[i].Time)
+			changes[i].Time = expected[i].Time
+		}
+		suite.Equal(expected, changes)
+	}
+
+	//a window that is already open still reports when it closes
+	suite.now = at("2026-03-03T23:00:00Z")
+	changes = UpcomingChanges(DefaultTenant, "nightly", 6*time.Hour)
+	if suite.Len(changes, 1) {
+		suite.True(at("2026-03-04T02:00:00Z").Equal(changes[0].Time))
+		suite.False(changes[0].Active)
+	}
+
+	tt := []struct {
+		testName string
+		query    string
+		status   int
+	}{
+		{"Invalid Within", "within=soon", http.StatusBadRequest},
+		{"Within Too Far", "within=10000h", http.StatusBadRequest},
+		{"Unknown Policy", "policy=europe", http.StatusNotFound},
+		{"Single Policy", "policy=embargo", http.StatusOK},
+	}
+	for _, tc := range tt {
+		rec := httptest.NewRecorder()
+		setupRouter().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/admin/schedule?"+tc.query, nil))
+		if !suite.Equal(tc.status, rec.Code, "unexpected status on %v", tc.testName) {
+			Log(log.InfoLevel, fmt.Sprintf("unexpected status on %v: %v", tc.testName, rec.Code), true)
+		}
+	}
+}
@@ -0,0 +1,234 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	jsoniter "github.com/json-iterator/go"
+	log "github.com/sirupsen/logrus"
+)
+
+//ShadowDisagreement is one check where a shadow policy decided differently from the policy it
+//shadows. it is written as a json line to the shadow log
+type ShadowDisagreement struct {
+	Time           time.Time `json:"time"`
+	IP             string    `json:"ip"`
+	Country        string    `json:"country"`
+	IsoCode        string    `json:"iso_code"`
+	Policy         string    `json:"policy"`
+	PolicyVersion  int       `json:"policy_version"`
+	Shadow         string    `json:"shadow"`
+	ShadowVersion  int       `json:"shadow_version"`
+	Decision       string    `json:"decision"`
+	ShadowDecision string    `json:"shadow_decision"`
+	Caller         string    `json:"caller"`
+	Tenant         string    `json:"tenant,omitempty"`
+}
+
+//ShadowCountry counts the disagreements for one country
+type ShadowCountry struct {
+	Country string `json:"country"`
+	IsoCode string `json:"iso_code"`
+	Count   uint64 `json:"count"`
+}
+
+//ShadowReport summarises how a shadow policy would have changed the checks made against the policy
+//it shadows since its current version was saved or the service started
+type ShadowReport struct {
+	Policy        string          `json:"policy"`
+	Version       int             `json:"version"`
+	Shadow        string          `json:"shadow"`
+	Since         time.Time       `json:"since"`
+	Checks        uint64          `json:"checks"`
+	Disagreements uint64          `json:"disagreements"`
+	WouldBlock    []ShadowCountry `json:"would_block"`
+	WouldAllow    []ShadowCountry `json:"would_allow"`
+}
+
+//shadowStats are the running totals behind a ShadowReport
+type shadowStats struct {
+	version    int
+	since      time.Time
+	checks     uint64
+	wouldBlock map[string]*ShadowCountry
+	wouldAllow map[string]*ShadowCountry
+}
+
+//shadows holds the stats per shadow policy, keyed by policyKey, and the open shadow log. nil file disables the log
+var shadows = struct {
+	sync.Mutex
+	stats map[string]*shadowStats
+	file  *os.File
+}{stats: map[string]*shadowStats{}}
+
+//setupShadowLog opens the shadow log for appending. an empty path disables it, the reports and
+//metrics are kept either way
+func setupShadowLog(path string) error {
+	var file *os.File
+	if path != "" {
+		if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+			return err
+		}
+		var err error
+		file, err = os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+		if err != nil {
+			return err
+		}
+	}
+	shadows.Lock()
+	defer shadows.Unlock()
+	if shadows.file != nil {
+		shadows.file.Close()
+	}
+	shadows.file = file
+	return nil
+}
+
+//ShadowPolicies returns the tenant's policies shadowing the named policy, sorted by name
+func ShadowPolicies(tenant string, name string) []Policy {
+	var list []Policy
+	for _, policy := range ListPolicies(tenant) {
+		if policy.Shadow == name {
+			list = append(list, policy)
+		}
+	}
+	return list
+}
+
+//evaluateShadows decides the ip against every shadow of the active policy and records where they
+//disagree with the active decision. the caller's response is never affected
+func evaluateShadows(r *http.Request, ip string, active Policy, decision Decision) {
+	for _, shadow := range ShadowPolicies(active.Tenant, active.Name) {
+		shadowDecision, err := EvaluatePolicy(ip, shadow)
+		if err != nil {
+			Log(log.ErrorLevel, fmt.Sprintf("failed to evaluate shadow policy %v: %v", shadow.Name, err), flag.Lookup("test.v") == nil)
+			continue
+		}
+		labels := tenantLabels(active.Tenant, map[string]string{"policy": active.Name, "shadow": shadow.Name})
+		IncCounter("whitelist_shadow_checks_total", labels)
+		agrees := shadowDecision.Allowed == decision.Allowed
+		if !agrees {
+			labels["shadow_decision"] = decisionName(shadowDecision.Allowed)
+			IncCounter("whitelist_shadow_disagreements_total", labels)
+		}
+		recordShadow(shadow, decision.Country, agrees, shadowDecision.Allowed)
+		if !agrees {
+			writeShadowLog(ShadowDisagreement{
+				Time:           time.Now(),
+				IP:             ip,
+				Country:        decision.Country.Name,
+				IsoCode:        decision.Country.IsoCode,
+				Policy:         active.Name,
+				PolicyVersion:  active.Version,
+				Shadow:         shadow.Name,
+				ShadowVersion:  shadow.Version,
+				Decision:       decisionName(decision.Allowed),
+				ShadowDecision: decisionName(shadowDecision.Allowed),
+				Caller:         RequestIdentity(r),
+				Tenant:         active.Tenant,
+			})
+		}
+	}
+}
+
+//decisionName is the allow/deny name of a decision used in the audit and shadow logs
+func decisionName(allowed bool) string {
+	if allowed {
+		return "allow"
+	}
+	return "deny"
+}
+
+//recordShadow adds a check to the stats of a shadow policy, starting them over when the shadow
+//policy has changed since they were started
+func recordShadow(shadow Policy, country Country, agrees bool, shadowAllowed bool) {
+	shadows.Lock()
+	defer shadows.Unlock()
+	key := policyKey(shadow.Tenant, shadow.Name)
+	stats, ok := shadows.stats[key]
+	if !ok || stats.version != shadow.Version {
+		stats = &shadowStats{
+			version:    shadow.Version,
+			since:      time.Now(),
+			wouldBlock: map[string]*ShadowCountry{},
+			wouldAllow: map[string]*ShadowCountry{},
+		}
+		shadows.stats[key] = stats
+	}
+	stats.checks++
+	if agrees {
+		return
+	}
+	counts := stats.wouldAllow
+	if !shadowAllowed {
+		counts = stats.wouldBlock
+	}
+	count, ok := counts[country.IsoCode]
+	if !ok {
+		count = &ShadowCountry{Country: country.Name, IsoCode: country.IsoCode}
+		counts[country.IsoCode] = count
+	}
+	count.Count++
+}
+
+//dropShadowStats forgets the stats stored under the policy key of a deleted policy
+func dropShadowStats(key string) {
+	shadows.Lock()
+	delete(shadows.stats, key)
+	shadows.Unlock()
+}
+
+//writeShadowLog appends a disagreement to the shadow log
+func writeShadowLog(disagreement ShadowDisagreement) {
+	line, err := jsoniter.Marshal(disagreement)
+	if err != nil {
+		Log(log.ErrorLevel, err.Error(), flag.Lookup("test.v") == nil)
+		return
+	}
+	shadows.Lock()
+	defer shadows.Unlock()
+	if shadows.file == nil {
+		return
+	}
+	if _, err := shadows.file.Write(append(line, '\n')); err != nil {
+		Log(log.ErrorLevel, fmt.Sprintf("failed to write shadow log: %v", err), flag.Lookup("test.v") == nil)
+	}
+}
+
+//GetShadowReport returns the report for a shadow policy. the country lists are sorted by count,
+//most disagreements first
+func GetShadowReport(shadow Policy) ShadowReport {
+	report := ShadowReport{Policy: shadow.Shadow, Version: shadow.Version, Shadow: shadow.Name,
+		WouldBlock: []ShadowCountry{}, WouldAllow: []ShadowCountry{}}
+	shadows.Lock()
+	defer shadows.Unlock()
+	stats, ok := shadows.stats[policyKey(shadow.Tenant, shadow.Name)]
+	if !ok || stats.version != shadow.Version {
+		return report
+	}
+	report.Since = stats.since
+	report.Checks = stats.checks
+	for _, count := range stats.wouldBlock {
+		report.WouldBlock = append(report.WouldBlock, *count)
+		report.Disagreements += count.Count
+	}
+	for _, count := range stats.wouldAllow {
+		report.WouldAllow = append(report.WouldAllow, *count)
+		report.Disagreements += count.Count
+	}
+	for _, counts := range [][]ShadowCountry{report.WouldBlock, report.WouldAllow} {
+		sort.Slice(counts, func(i, j int) bool {
+			if counts[i].Count != counts[j].Count {
+				return counts[i].Count > counts[j].Count
+			}
+			return counts[i].IsoCode < counts[j].IsoCode
+		})
+	}
+	return report
+}
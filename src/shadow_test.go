@@ -0,0 +1,156 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+
+	jsoniter "github.com/json-iterator/go"
+	log "github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/suite"
+)
+
+func TestShadowSuite(t *testing.T) {
+	shadowSuite := new(ShadowSuite)
+	suite.Run(t, shadowSuite)
+}
+
+type ShadowSuite struct {
+	suite.Suite
+	dir string
+}
+
+func (suite *ShadowSuite) SetupSuite() {
+	setLogPath("./logs/")
+	Log(log.InfoLevel, "=============== Running Shadow Suite ======================", true)
+	setupDB("./test-data/test-data.mmdb")
+	suite.dir, _ = os.MkdirTemp("", "shadow-test")
+}
+
+func (suite *ShadowSuite) SetupTest() {
+	os.Remove(filepath.Join(suite.dir, "policies.json"))
+	os.Remove(filepath.Join(suite.dir, "shadow.log"))
+	setupPolicies(filepath.Join(suite.dir, "policies.json"))
+	setupShadowLog(filepath.Join(suite.dir, "shadow.log"))
+	SavePolicy(Policy{Name: "asia", Whitelist: []string{"china", "japan"}})
+	SavePolicy(Policy{Name: "asia-strict", Whitelist: []string{"japan"}, Shadow: "asia"})
+	compiling.Wait()
+}
+
+func (suite *ShadowSuite) TearDownSuite() {
+	setupPolicies("")
+	setupShadowLog("")
+	compiling.Wait()
+	testProvider().Close()
+	os.RemoveAll(suite.dir)
+	Log(log.InfoLevel, "========== Shadow Testsuite completed ===========", true)
+	fmt.Println("========== Shadow Testsuite completed ===========")
+}
+
+//TestShadowEvaluation validates checks against a policy return its decision while its shadow's
+//disagreements are logged, counted and reported
+func (suite *ShadowSuite) TestShadowEvaluation() {
+	Log(log.InfoLevel, "====== Running TestShadowEvaluation ===========", true)
+	labels := map[string]string{"policy": "asia", "shadow": "asia-strict"}
+	checks := CounterValue("whitelist_shadow_checks_total", labels)
+	blocked := CounterValue("whitelist_shadow_disagreements_total", map[string]string{"policy": "asia", "shadow": "asia-strict", "shadow_decision": "deny"})
+
+	tt := []struct {
+		testName string
+		ip       string
+		expected string
+	}{
+		{"Shadow Would Block", "1.207.235.255", "whitelisted"},
+		{"Shadow Agrees", "1.0.16.1", "whitelisted"},
+		{"Shadow Would Block Again", "1.207.235.255", "whitelisted"},
+	}
+	for _, tc := range tt {
+		rec := serveRequest(http.MethodGet, "/checkWhitelist/"+tc.ip, `{"policy": "asia"}`)
+		var resp ResponseStruct
+		jsoniter.NewDecoder(rec.Body).Decode(&resp)
+		if !suite.Equal(tc.expected, resp.Response, "was expecting the active decision on %v", tc.testName) {
+			Log(log.InfoLevel, fmt.Sprintf("was expecting the active decision on %v, received %v", tc.testName, resp.Response), true)
+		}
+	}
+	suite.Equal(checks+3, CounterValue("whitelist_shadow_checks_total", labels))
+	suite.Equal(blocked+2, CounterValue("whitelist_shadow_disagreements_total", map[string]string{"policy": "asia", "shadow": "asia-strict", "shadow_decision": "deny"}))
+
+	rec := serveRequest(http.MethodGet, "/admin/policies/asia-strict/shadow-report", "")
+	var report ShadowReport
+	jsoniter.NewDecoder(rec.Body).Decode(&report)
+	suite.Equal(http.StatusOK, rec.Code)
+	suite.Equal("asia", report.Policy)
+	suite.Equal("asia-strict", report.Shadow)
+	suite.Equal(1, report.Version)
+	suite.Equal(uint64(3), report.Checks)
+	suite.Equal(uint64(2), report.Disagreements)
+	suite.Equal([]ShadowCountry{{Country: "China", IsoCode: "CN", Count: 2}}, report.WouldBlock)
+	suite.Empty(report.WouldAllow)
+	suite.False(report.Since.IsZero())
+
+	file, err := os.Open(filepath.Join(suite.dir, "shadow.log"))
+	suite.Require().NoError(err)
+	defer file.Close()
+	var disagreements []ShadowDisagreement
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		var disagreement ShadowDisagreement
+		suite.NoError(jsoniter.Unmarshal(scanner.Bytes(), &disagreement))
+		disagreements = append(disagreements, disagreement)
+	}
+	if !suite.Len(disagreements, 2, "was expecting only disagreements to be logged") {
+		return
+	}
+	suite.Equal("1.207.235.255", disagreements[0].IP)
+	suite.Equal("CN", disagreements[0].IsoCode)
+	suite.Equal("allow", disagreements[0].Decision)
+	suite.Equal("deny", disagreements[0].ShadowDecision)
+	suite.Equal(1, disagreements[0].ShadowVersion)
+}
+
+//TestShadowReport validates the report starts over for a new shadow version and only exists for
+//shadow policies
+func (suite *ShadowSuite) TestShadowReport() {
+	Log(log.InfoLevel, "====== Running TestShadowReport ===========", true)
+	serveRequest(http.MethodGet, "/checkWhitelist/1.207.235.255", `{"policy": "asia"}`)
+	SavePolicy(Policy{Name: "asia-strict", Blacklist: []string{"japan"}, Shadow: "asia"})
+	compiling.Wait()
+	serveRequest(http.MethodGet, "/checkWhitelist/1.0.16.1", `{"policy": "asia"}`)
+
+	policy, _ := GetPolicy(DefaultTenant, "asia-strict")
+	report := GetShadowReport(policy)
+	suite.Equal(2, report.Version)
+	suite.Equal(uint64(1), report.Checks, "was expecting the report to start over for the new version")
+	suite.Equal([]ShadowCountry{{Country: "Japan", IsoCode: "JP", Count: 1}}, report.WouldBlock)
+
+	tt := []struct {
+		testName string
+		method   string
+		path     string
+		body     string
+		status   int
+		expected string
+	}{
+		{"Not A Shadow", http.MethodGet, "/admin/policies/asia/shadow-report", "", http.StatusBadRequest, "policy asia is not a shadow policy"},
+		{"Missing Policy", http.MethodGet, "/admin/policies/europe/shadow-report", "", http.StatusNotFound, "policy europe not found"},
+		{"Check Against Shadow", http.MethodGet, "/checkWhitelist/1.0.16.1", `{"policy": "asia-strict"}`, http.StatusBadRequest, "policy asia-strict is a shadow of asia and is never enforced"},
+	}
+	for _, tc := range tt {
+		rec := serveRequest(tc.method, tc.path, tc.body)
+		var resp ResponseStruct
+		jsoniter.NewDecoder(rec.Body).Decode(&resp)
+		if !suite.Equal(tc.status, rec.Code, "unexpected status on %v", tc.testName) {
+			Log(log.InfoLevel, fmt.Sprintf("unexpected status on %v: %v", tc.testName, rec.Code), true)
+		}
+		suite.Equal(tc.expected, resp.Response, "unexpected response on %v", tc.testName)
+	}
+
+	//deleting the shadow drops its report
+	suite.NoError(DeletePolicy(DefaultTenant, "asia-strict"))
+	SavePolicy(Policy{Name: "asia-strict", Whitelist: []string{"japan"}, Shadow: "asia"})
+	policy, _ = GetPolicy(DefaultTenant, "asia-strict")
+	suite.Equal(uint64(0), GetShadowReport(policy).Checks)
+}
@@ -0,0 +1,232 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	jsoniter "github.com/json-iterator/go"
+)
+
+//DefaultTenant is the tenant of api keys that don't name one, and of every request when
+//authentication is disabled. it is never limited by quotas
+const DefaultTenant = ""
+
+//TenantQuota limits how many policies and corrections a tenant can store and how many requests it
+//can make per period. zero is unlimited
+type TenantQuota struct {
+	MaxPolicies    int           `mapstructure:"max policies" json:"max_policies"`
+	MaxCorrections int           `mapstructure:"max corrections" json:"max_corrections"`
+	MaxRequests    int           `mapstructure:"max requests" json:"max_requests"`
+	Period         time.Duration `mapstructure:"period" json:"-"`
+}
+
+//TenantConfig is the "tenants" section of config.yaml. the top level quota applies to every tenant
+//that doesn't have its own entry under quotas, keyed by tenant name. entries without a period use
+//the top level one
+type TenantConfig struct {
+	TenantQuota `mapstructure:",squash"`
+	Quotas      map[string]TenantQuota `mapstructure:"quotas"`
+}
+
+//TenantUsage is a tenant's stored entries and requests in the current period against its quota
+type TenantUsage struct {
+	Tenant      string      `json:"tenant"`
+	Policies    int         `json:"policies"`
+	Corrections int         `json:"corrections"`
+	Requests    int         `json:"requests"`
+	PeriodStart time.Time   `json:"period_start"`
+	PeriodEnd   time.Time   `json:"period_end"`
+	Quota       TenantQuota `json:"quota"`
+}
+
+//QuotaError is returned when a change would take a tenant over one of its quotas
+type QuotaError struct {
+	Tenant   string
+	Resource string
+	Limit    int
+}
+
+func (e *QuotaError) Error() string {
+	return fmt.Sprintf("tenant %v has reached its quota of %v %v", e.Tenant, e.Limit, e.Resource)
+}
+
+//tenantRequests counts a tenant's requests in the period that started at start
+type tenantRequests struct {
+	start time.Time
+	count int
+}
+
+//tenants holds the quota configuration and the request counts per tenant. counts are kept in memory
+//and start over when the service restarts
+var tenants = struct {
+	sync.Mutex
+	config   TenantConfig
+	requests map[string]*tenantRequests
+}{config: defaultConfig.Tenants, requests: map[string]*tenantRequests{}}
+
+//setupTenants applies a quota configuration. request counts are kept, so a reload doesn't reset them
+func setupTenants(config TenantConfig) error {
+	quotas, err := tenantQuotas(config)
+	if err != nil {
+		return err
+	}
+	config.Quotas = quotas
+	tenants.Lock()
+	tenants.config = config
+	tenants.Unlock()
+	return nil
+}
+
+//tenantQuotas validates the quotas of a configuration and returns the per tenant ones keyed by
+//lowercase tenant name, with missing periods filled in from the top level quota
+func tenantQuotas(config TenantConfig) (map[string]TenantQuota, error) {
+	quotas := map[string]TenantQuota{}
+	checked := []TenantQuota{config.TenantQuota}
+	for tenant, quota := range config.Quotas {
+		//viper lowercases map keys, so tenants are matched case-insensitively
+		tenant = strings.ToLower(tenant)
+		if !policyNamePattern.MatchString(tenant) {
+			return nil, fmt.Errorf("invalid tenant name %q", tenant)
+		}
+		if quota.Period <= 0 {
+			quota.Period = config.Period
+		}
+		quotas[tenant] = quota
+		checked = append(checked, quota)
+	}
+	for _, quota := range checked {
+		if quota.MaxPolicies < 0 || quota.MaxCorrections < 0 || quota.MaxRequests < 0 {
+			return nil, fmt.Errorf("tenant quotas can't be negative")
+		}
+		if quota.Period <= 0 {
+			return nil, fmt.Errorf("tenant quota period must be positive")
+		}
+	}
+	return quotas, nil
+}
+
+//TenantQuotaFor returns the quota of a tenant. the default tenant keeps the period so its requests
+//are still reported, but has no limits
+func TenantQuotaFor(tenant string) TenantQuota {
+	tenants.Lock()
+	defer tenants.Unlock()
+	return tenantQuota(tenant)
+}
+
+//tenantQuota is TenantQuotaFor for callers holding the lock
+func tenantQuota(tenant string) TenantQuota {
+	if tenant == DefaultTenant {
+		return TenantQuota{Period: tenants.config.Period}
+	}
+	if quota, ok := tenants.config.Quotas[strings.ToLower(tenant)]; ok {
+		return quota
+	}
+	return tenants.config.TenantQuota
+}
+
+//currentRequests returns the request count of a tenant's current period, starting a new one when the
+//last has ended. periods are aligned to multiples of the period since the zero time, so a 24h period
+//starts at midnight UTC. callers must hold the lock
+func currentRequests(tenant string, quota TenantQuota) *tenantRequests {
+	start := Clock().Truncate(quota.Period)
+	requests, ok := tenants.requests[tenant]
+	if !ok || !requests.start.Equal(start) {
+		requests = &tenantRequests{start: start}
+		tenants.requests[tenant] = requests
+	}
+	return requests
+}
+
+//countTenantRequest counts a request against the tenant's quota. when the quota for the period is
+//used up it returns false and how long until the next period starts
+func countTenantRequest(tenant string) (bool, time.Duration) {
+	tenants.Lock()
+	defer tenants.Unlock()
+	quota := tenantQuota(tenant)
+	requests := currentRequests(tenant, quota)
+	if quota.MaxRequests > 0 && requests.count >= quota.MaxRequests {
+		return false, requests.start.Add(quota.Period).Sub(Clock())
+	}
+	requests.count++
+	return true, 0
+}
+
+//checkTenantQuota returns a QuotaError when a tenant storing count entries of a resource has no room
+//for another one
+func checkTenantQuota(tenant string, resource string, count int) error {
+	quota := TenantQuotaFor(tenant)
+	limit := quota.MaxPolicies
+	if resource == "corrections" {
+		limit = quota.MaxCorrections
+	}
+	if limit > 0 && count >= limit {
+		IncCounter("whitelist_tenant_quota_exceeded_total", tenantLabels(tenant, map[string]string{"quota": resource}))
+		return &QuotaError{Tenant: tenant, Resource: resource, Limit: limit}
+	}
+	return nil
+}
+
+//GetTenantUsage returns the usage of a tenant in its current period
+func GetTenantUsage(tenant string) TenantUsage {
+	usage := TenantUsage{
+		Tenant:      tenant,
+		Policies:    len(ListPolicies(tenant)),
+		Corrections: len(ListCorrections(tenant)),
+	}
+	tenants.Lock()
+	defer tenants.Unlock()
+	usage.Quota = tenantQuota(tenant)
+	requests := currentRequests(tenant, usage.Quota)
+	usage.Requests = requests.count
+	usage.PeriodStart = requests.start
+	usage.PeriodEnd = requests.start.Add(usage.Quota.Period)
+	return usage
+}
+
+//tenantLabels adds the tenant label to a metric's labels. the default tenant's series carry no
+//tenant label, so they are unchanged from before tenants existed
+func tenantLabels(tenant string, labels map[string]string) map[string]string {
+	if tenant != DefaultTenant {
+		labels["tenant"] = tenant
+	}
+	return labels
+}
+
+//tenantQuotaMiddleware counts every request to a scoped route against its tenant's request quota and
+//rejects it with a 429 once the quota for the period is used up
+func tenantQuotaMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if current := mux.CurrentRoute(r); current != nil {
+			if route, _ := current.GetPathTemplate(); routeScopes[route] != "" {
+				tenant := RequestTenant(r)
+				if ok, retry := countTenantRequest(tenant); !ok {
+					IncCounter("whitelist_tenant_quota_exceeded_total", tenantLabels(tenant, map[string]string{"quota": "requests"}))
+					rejectRequest(w, r, http.StatusTooManyRequests, retry, fmt.Errorf("tenant %v has used its request quota", tenant))
+					return
+				}
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+//usageHandler returns the caller's tenant usage and quota
+func usageHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Add("Content-Type", "application/json")
+	jsoniter.NewEncoder(w).Encode(GetTenantUsage(RequestTenant(r)))
+}
+
+//tenantMetric reports whether a metric key carries the tenant's label, or no tenant label for the
+//default tenant
+func tenantMetric(key string, tenant string) bool {
+	if tenant == DefaultTenant {
+		return !strings.Contains(key, "{tenant=") && !strings.Contains(key, ",tenant=")
+	}
+	label := "tenant=" + strconv.Quote(tenant)
+	return strings.Contains(key, "{"+label) || strings.Contains(key, ","+label)
+}
@@ -0,0 +1,246 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	jsoniter "github.com/json-iterator/go"
+	log "github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/suite"
+)
+
+func TestTenantsSuite(t *testing.T) {
+	tenantsSuite := new(TenantsSuite)
+	suite.Run(t, tenantsSuite)
+}
+
+type TenantsSuite struct {
+	suite.Suite
+	dir string
+	now time.Time
+}
+
+func (suite *TenantsSuite) SetupSuite() {
+	setLogPath("./logs/")
+	Log(log.InfoLevel, "=============== Running Tenants Suite ======================", true)
+	setupDB("./test-data/test-data.mmdb")
+	suite.dir, _ = os.MkdirTemp("", "tenants-test")
+	keys := fmt.Sprintf(`[
+		{"id": "acme-ops", "hash": %q, "scopes": ["check", "lookup", "metrics", "admin"], "tenant": "acme"},
+		{"id": "globex-ops", "hash": %q, "scopes": ["check", "lookup", "metrics", "admin"], "tenant": "Globex"},
+		{"id": "operator", "hash": %q, "scopes": ["check", "lookup", "metrics", "admin"]},
+		{"id": "monitor", "hash": %q, "scopes": ["metrics"]}
+	]`, HashAPIKey("acme-key"), HashAPIKey("globex-key"), HashAPIKey("operator-key"), HashAPIKey("monitor-key"))
+	os.WriteFile(filepath.Join(suite.dir, "keys.json"), []byte(keys), 0600)
+}
+
+func (suite *TenantsSuite) SetupTest() {
+	os.Remove(filepath.Join(suite.dir, "policies.json"))
+	os.Remove(filepath.Join(suite.dir, "corrections.json"))
+	setupPolicies(filepath.Join(suite.dir, "policies.json"))
+	setupCorrections(filepath.Join(suite.dir, "corrections.json"))
+	setupAPIKeys(filepath.Join(suite.dir, "keys.json"))
+	setupTenants(defaultConfig.Tenants)
+	tenants.requests = map[string]*tenantRequests{}
+	suite.now = time.Date(2026, 3, 2, 12, 0, 0, 0, time.UTC)
+	Clock = func() time.Time { return suite.now }
+}
+
+func (suite *TenantsSuite) TearDownTest() {
+	Clock = time.Now
+	setupAPIKeys("")
+	setupTenants(defaultConfig.Tenants)
+}
+
+func (suite *TenantsSuite) TearDownSuite() {
+	setupPolicies("")
+	setupCorrections("")
+	compiling.Wait()
+	testProvider().Close()
+	os.RemoveAll(suite.dir)
+	Log(log.InfoLevel, "========== Tenants Testsuite completed ===========", true)
+	fmt.Println("========== Tenants Testsuite completed ===========")
+}
+
+func (suite *TenantsSuite) TestSetupAPIKeys() {
+	Log(log.InfoLevel, "====== Running TestSetupAPIKeys ===========", true)
+	key, ok := findAPIKey(currentRuntime().apiKeys, "globex-key")
+	suite.True(ok)
+	suite.Equal("globex", key.Tenant, "tenant names should be lowercased")
+
+	invalid := filepath.Join(suite.dir, "invalid.json")
+	os.WriteFile(invalid, []byte(fmt.Sprintf(`[{"id": "bad", "hash": %q, "tenant": "a/b"}]`, HashAPIKey("bad-key"))), 0600)
+	err := setupAPIKeys(invalid)
+	if !suite.Error(err, "was expecting an error for an invalid tenant name, returned ok") {
+		Log(log.InfoLevel, "was expecting an error for an invalid tenant name, returned ok", true)
+	}
+}
+
+//TestIsolation validates that tenants only see and change their own policies and corrections, and
+//that corrections only apply to their own tenant
+func (suite *TenantsSuite) TestIsolation() {
+	Log(log.InfoLevel, "====== Running TestIsolation ===========", true)
+	suite.Equal(http.StatusOK, serveRequest(http.MethodPut, "/admin/policies/asia", `{"whitelist": ["japan"]}`, "X-API-Key", "acme-key").Code)
+	suite.Equal(http.StatusCreated, serveRequest(http.MethodPost, "/admin/corrections",
+		`{"network": "1.207.235.0/24", "iso_code": "JP", "name": "Japan"}`, "X-API-Key", "acme-key").Code)
+
+	tt := []struct {
+		testName string
+		method   string
+		path     string
+		key      string
+		body     string
+		status   int
+		expected string
+	}{
+		{"Own Policy", http.MethodGet, "/admin/policies/asia", "acme-key", "", http.StatusOK, `"tenant":"acme"`},
+		{"Other Tenant Policy", http.MethodGet, "/admin/policies/asia", "globex-key", "", http.StatusNotFound, "policy asia not found"},
+		{"Default Tenant Policy", http.MethodGet, "/admin/policies/asia", "operator-key", "", http.StatusNotFound, "policy asia not found"},
+		{"Other Tenant List", http.MethodGet, "/admin/policies", "globex-key", "", http.StatusOK, "[]"},
+		{"Other Tenant Delete", http.MethodDelete, "/admin/policies/asia", "globex-key", "", http.StatusNotFound, "policy asia not found"},
+		{"Other Tenant Check", http.MethodGet, "/checkWhitelist/1.207.235.255", "globex-key", `{"policy": "asia"}`, http.StatusBadRequest, "policy asia not found"},
+		{"Own Check With Correction", http.MethodGet, "/checkWhitelist/1.207.235.255", "acme-key", `{"policy": "asia"}`, http.StatusOK, `"whitelisted"`},
+		{"Own Lookup With Correction", http.MethodGet, "/lookup/1.207.235.255", "acme-key", "", http.StatusOK, `"iso_code":"JP"`},
+		{"Other Tenant Lookup", http.MethodGet, "/lookup/1.207.235.255", "globex-key", "", http.StatusOK, `"iso_code":"CN"`},
+		{"Other Tenant Corrections", http.MethodGet, "/admin/corrections", "globex-key", "", http.StatusOK, "[]"},
+		{"Other Tenant Correction Delete", http.MethodDelete, "/admin/corrections/1.207.235.0/24", "globex-key", "", http.StatusNotFound, "no correction found"},
+	}
+	for _, tc := range tt {
+		rec := serveRequest(tc.method, tc.path, tc.body, "X-API-Key", tc.key)
+		if !suite.Equal(tc.status, rec.Code, "was expecting status %v on %v, received %v", tc.status, tc.testName, rec.Code) {
+			Log(log.InfoLevel, fmt.Sprintf("was expecting status %v on %v, received %v", tc.status, tc.testName, rec.Code), true)
+		}
+		suite.Contains(rec.Body.String(), tc.expected, "unexpected response on %v", tc.testName)
+	}
+
+	//the same name in another tenant is a separate policy with its own versions
+	suite.Equal(http.StatusOK, serveRequest(http.MethodPut, "/admin/policies/asia", `{"whitelist": ["china"]}`, "X-API-Key", "globex-key").Code)
+	acme, _ := GetPolicy("acme", "asia")
+	globex, _ := GetPolicy("globex", "asia")
+	suite.Equal([]string{"japan"}, acme.Whitelist)
+	suite.Equal([]string{"china"}, globex.Whitelist)
+	suite.Equal(1, globex.Version)
+	suite.Empty(ListPolicies(DefaultTenant))
+
+	//a tenant body can't claim another tenant
+	suite.Equal(http.StatusOK, serveRequest(http.MethodPut, "/admin/policies/emea", `{"whitelist": ["germany"], "tenant": "acme"}`, "X-API-Key", "globex-key").Code)
+	_, ok := GetPolicy("acme", "emea")
+	suite.False(ok)
+}
+
+func (suite *TenantsSuite) TestStorageQuotas() {
+	Log(log.InfoLevel, "====== Running TestStorageQuotas ===========", true)
+	setupTenants(TenantConfig{
+		TenantQuota: TenantQuota{MaxPolicies: 5, Period: 24 * time.Hour},
+		Quotas:      map[string]TenantQuota{"acme": {MaxPolicies: 1, MaxCorrections: 1}},
+	})
+
+	tt := []struct {
+		testName string
+		method   string
+		path     string
+		key      string
+		body     string
+		status   int
+	}{
+		{"First Policy", http.MethodPut, "/admin/policies/asia", "acme-key", `{"whitelist": ["japan"]}`, http.StatusOK},
+		{"Replacing Policy", http.MethodPut, "/admin/policies/asia", "acme-key", `{"whitelist": ["china"]}`, http.StatusOK},
+		{"Policy Over Quota", http.MethodPut, "/admin/policies/emea", "acme-key", `{"whitelist": ["germany"]}`, http.StatusForbidden},
+		{"Other Tenant Policy", http.MethodPut, "/admin/policies/emea", "globex-key", `{"whitelist": ["germany"]}`, http.StatusOK},
+		{"Default Tenant Unlimited", http.MethodPut, "/admin/policies/emea", "operator-key", `{"whitelist": ["germany"]}`, http.StatusOK},
+		{"First Correction", http.MethodPost, "/admin/corrections", "acme-key", `{"network": "1.207.235.0/24", "iso_code": "JP", "name": "Japan"}`, http.StatusCreated},
+		{"Replacing Correction", http.MethodPost, "/admin/corrections", "acme-key", `{"network": "1.207.235.0/24", "iso_code": "KR", "name": "South Korea"}`, http.StatusCreated},
+		{"Correction Over Quota", http.MethodPost, "/admin/corrections", "acme-key", `{"network": "1.0.16.0/24", "iso_code": "CN", "name": "China"}`, http.StatusForbidden},
+	}
+	for _, tc := range tt {
+		rec := serveRequest(tc.method, tc.path, tc.body, "X-API-Key", tc.key)
+		if !suite.Equal(tc.status, rec.Code, "was expecting status %v on %v, received %v", tc.status, tc.testName, rec.Code) {
+			Log(log.InfoLevel, fmt.Sprintf("was expecting status %v on %v, received %v", tc.status, tc.testName, rec.Code), true)
+		}
+	}
+	suite.Len(ListPolicies("acme"), 1)
+	suite.Len(ListCorrections("acme"), 1)
+	suite.GreaterOrEqual(CounterValue("whitelist_tenant_quota_exceeded_total", map[string]string{"tenant": "acme", "quota": "policies"}), uint64(1))
+
+	suite.Equal(map[string]string{"quota": "policies"}, tenantLabels(DefaultTenant, map[string]string{"quota": "policies"}))
+}
+
+func (suite *TenantsSuite) TestRequestQuota() {
+	Log(log.InfoLevel, "====== Running TestRequestQuota ===========", true)
+	setupTenants(TenantConfig{
+		TenantQuota: TenantQuota{Period: 24 * time.Hour},
+		Quotas:      map[string]TenantQuota{"ACME": {MaxRequests: 2}},
+	})
+
+	for i := 0; i < 2; i++ {
+		suite.Equal(http.StatusOK, serveRequest(http.MethodGet, "/lookup/1.0.16.1", "", "X-API-Key", "acme-key").Code)
+	}
+	rec := serveRequest(http.MethodGet, "/lookup/1.0.16.1", "", "X-API-Key", "acme-key")
+	if !suite.Equal(http.StatusTooManyRequests, rec.Code, "was expecting a 429 over the request quota, received %v", rec.Code) {
+		Log(log.InfoLevel, fmt.Sprintf("was expecting a 429 over the request quota, received %v", rec.Code), true)
+	}
+	//the period ends at midnight utc
+	suite.Equal("43200", rec.Header().Get("Retry-After"))
+	suite.Equal(http.StatusOK, serveRequest(http.MethodGet, "/lookup/1.0.16.1", "", "X-API-Key", "globex-key").Code)
+	suite.Equal(http.StatusOK, serveRequest(http.MethodGet, "/", "", "X-API-Key", "acme-key").Code, "open routes aren't counted")
+
+	suite.now = suite.now.Add(12 * time.Hour)
+	suite.Equal(http.StatusOK, serveRequest(http.MethodGet, "/lookup/1.0.16.1", "", "X-API-Key", "acme-key").Code)
+}
+
+func (suite *TenantsSuite) TestUsage() {
+	Log(log.InfoLevel, "====== Running TestUsage ===========", true)
+	setupTenants(TenantConfig{
+		TenantQuota: TenantQuota{MaxPolicies: 10, MaxRequests: 100, Period: time.Hour},
+	})
+	serveRequest(http.MethodPut, "/admin/policies/asia", `{"whitelist": ["japan"]}`, "X-API-Key", "acme-key")
+	serveRequest(http.MethodPost, "/admin/corrections", `{"network": "1.207.235.0/24", "iso_code": "JP", "name": "Japan"}`, "X-API-Key", "acme-key")
+	serveRequest(http.MethodPut, "/admin/policies/asia", `{"whitelist": ["japan"]}`, "X-API-Key", "globex-key")
+
+	rec := serveRequest(http.MethodGet, "/admin/usage", "", "X-API-Key", "acme-key")
+	suite.Equal(http.StatusOK, rec.Code)
+	var usage TenantUsage
+	jsoniter.NewDecoder(rec.Body).Decode(&usage)
+	suite.Equal(TenantUsage{
+		Tenant:      "acme",
+		Policies:    1,
+		Corrections: 1,
+		Requests:    3,
+		PeriodStart: suite.now,
+		PeriodEnd:   suite.now.Add(time.Hour),
+		Quota:       TenantQuota{MaxPolicies: 10, MaxRequests: 100},
+	}, usage)
+
+	usage = GetTenantUsage(DefaultTenant)
+	suite.Equal(0, usage.Quota.MaxPolicies, "the default tenant should have no quota")
+}
+
+//TestTenantMetrics validates that a tenant's /metrics only carries its own series
+func (suite *TenantsSuite) TestTenantMetrics() {
+	Log(log.InfoLevel, "====== Running TestTenantMetrics ===========", true)
+	serveRequest(http.MethodGet, "/lookup/1.0.16.1", "", "X-API-Key", "acme-key")
+	serveRequest(http.MethodGet, "/lookup/1.0.16.1", "", "X-API-Key", "globex-key")
+
+	acme := serveRequest(http.MethodGet, "/metrics", "", "X-API-Key", "acme-key").Body.String()
+	suite.Contains(acme, `whitelist_requests_total{identity="acme-ops",route="/lookup/{ip}",status="200",tenant="acme"}`)
+	suite.NotContains(acme, `tenant="globex"`)
+	suite.NotContains(acme, "whitelist_auth_failures_total")
+
+	operator := serveRequest(http.MethodGet, "/metrics", "", "X-API-Key", "operator-key").Body.String()
+	suite.Contains(operator, `tenant="acme"`)
+	suite.Contains(operator, `tenant="globex"`)
+
+	monitor := serveRequest(http.MethodGet, "/metrics", "", "X-API-Key", "monitor-key").Body.String()
+	suite.Contains(monitor, `whitelist_requests_total{identity="operator",route="/metrics",status="200"}`)
+	suite.NotContains(monitor, `tenant="acme"`)
+	suite.NotContains(monitor, `tenant="globex"`)
+
+	suite.True(tenantMetric(`whitelist_requests_total{route="/",tenant="acme"}`, "acme"))
+	suite.False(tenantMetric(`whitelist_requests_total{route="/",tenant="acme2"}`, "acme"))
+	suite.True(tenantMetric(`whitelist_requests_total{route="/"}`, DefaultTenant))
+	suite.False(tenantMetric(`whitelist_requests_total{route="/",tenant="acme"}`, DefaultTenant))
+}
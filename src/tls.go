@@ -0,0 +1,155 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+//certReloadInterval is how often the certificate files are checked for rotation
+var certReloadInterval = 30 * time.Second
+
+//certReloader serves the listener certificate and reloads it from disk when the cert or key file
+//changes, so rotated certificates are picked up without restarting the service
+type certReloader struct {
+	certPath string
+	keyPath  string
+
+	mu      sync.RWMutex
+	cert    *tls.Certificate
+	modTime time.Time
+	checked time.Time
+}
+
+//newCertReloader loads the initial key pair, failing if it can't be read
+func newCertReloader(certPath string, keyPath string) (*certReloader, error) {
+	reloader := &certReloader{certPath: certPath, keyPath: keyPath}
+	if err := reloader.reload(); err != nil {
+		return nil, err
+	}
+	return reloader, nil
+}
+
+//reload reads the key pair from disk and swaps it in
+func (c *certReloader) reload() error {
+	modTime, err := c.latestModTime()
+	if err != nil {
+		return err
+	}
+	cert, err := tls.LoadX509KeyPair(c.certPath, c.keyPath)
+	if err != nil {
+		return err
+	}
+	c.mu.Lock()
+	c.cert = &cert
+	c.modTime = modTime
+	c.checked = time.Now()
+	c.mu.Unlock()
+	return nil
+}
+
+//latestModTime returns the newest modification time of the cert and key files
+func (c *certReloader) latestModTime() (time.Time, error) {
+	var latest time.Time
+	for _, path := range []string{c.certPath, c.keyPath} {
+		info, err := os.Stat(path)
+		if err != nil {
+			return latest, err
+		}
+		if info.ModTime().After(latest) {
+			latest = info.ModTime()
+		}
+	}
+	return latest, nil
+}
+
+//GetCertificate is used as the tls.Config callback. a failed reload keeps serving the previous
+//certificate so a half-written rotation can't take the listener down
+func (c *certReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	c.mu.RLock()
+	due := time.Since(c.checked) >= certReloadInterval
+	c.mu.RUnlock()
+
+	if due {
+		c.mu.Lock()
+		c.checked = time.Now()
+		loaded := c.modTime
+		c.mu.Unlock()
+		modTime, err := c.latestModTime()
+		if err == nil && modTime.After(loaded) {
+			err = c.reload()
+		}
+		if err != nil {
+			Log(log.ErrorLevel, fmt.Sprintf("failed to reload tls certificate: %v", err), flag.Lookup("test.v") == nil)
+		}
+	}
+
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.cert, nil
+}
+
+//tlsVersion maps the configured minimum version string to its crypto/tls constant. an empty value
+//defaults to TLS 1.2
+func tlsVersion(version string) (uint16, error) {
+	switch version {
+	case "", "1.2":
+		return tls.VersionTLS12, nil
+	case "1.0":
+		return tls.VersionTLS10, nil
+	case "1.1":
+		return tls.VersionTLS11, nil
+	case "1.3":
+		return tls.VersionTLS13, nil
+	}
+	return 0, fmt.Errorf("unsupported tls min version %q", version)
+}
+
+//setupTLS builds the listener tls config. when a client CA bundle is passed, callers must present a
+//certificate signed by it
+func setupTLS(certPath string, keyPath string, minVersion string, clientCAPath string) (*tls.Config, error) {
+	version, err := tlsVersion(minVersion)
+	if err != nil {
+		return nil, err
+	}
+	reloader, err := newCertReloader(certPath, keyPath)
+	if err != nil {
+		return nil, err
+	}
+	//the listener is wrapped with tls.NewListener rather than served with ListenAndServeTLS, so h2 has
+	//to be offered here for HTTP/2 to be negotiated
+	config := &tls.Config{
+		MinVersion:     version,
+		GetCertificate: reloader.GetCertificate,
+		NextProtos:     []string{"h2", "http/1.1"},
+	}
+	if clientCAPath != "" {
+		bundle, err := os.ReadFile(clientCAPath)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(bundle) {
+			return nil, fmt.Errorf("no certificates found in client ca bundle %v", clientCAPath)
+		}
+		config.ClientCAs = pool
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return config, nil
+}
+
+//ClientCertSubject returns the subject of the verified client certificate, or an empty string when
+//the request didn't come over mutual TLS
+func ClientCertSubject(r *http.Request) string {
+	if r.TLS == nil || len(r.TLS.PeerCertificates) == 0 {
+		return ""
+	}
+	return r.TLS.PeerCertificates[0].Subject.String()
+}
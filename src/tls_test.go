@@ -0,0 +1,209 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/suite"
+)
+
+func TestTLSSuite(t *testing.T) {
+	tlsSuite := new(TLSSuite)
+	suite.Run(t, tlsSuite)
+}
+
+type TLSSuite struct {
+	suite.Suite
+	dir     string
+	caCert  *x509.Certificate
+	caKey   *ecdsa.PrivateKey
+	caPath  string
+	cert    string
+	key     string
+	client  tls.Certificate
+	caPool  *x509.CertPool
+	reloads time.Duration
+}
+
+func (suite *TLSSuite) SetupSuite() {
+	setLogPath("./logs/")
+	Log(log.InfoLevel, "=============== Running TLS Suite ======================", true)
+	suite.reloads = certReloadInterval
+	certReloadInterval = 0
+
+	suite.dir, _ = os.MkdirTemp("", "tls-test")
+	suite.caKey, _ = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test ca"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+	}
+	der, _ := x509.CreateCertificate(rand.Reader, template, template, &suite.caKey.PublicKey, suite.caKey)
+	suite.caCert, _ = x509.ParseCertificate(der)
+	suite.caPool = x509.NewCertPool()
+	suite.caPool.AddCert(suite.caCert)
+	suite.caPath = filepath.Join(suite.dir, "ca.pem")
+	os.WriteFile(suite.caPath, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600)
+
+	suite.cert = filepath.Join(suite.dir, "server.pem")
+	suite.key = filepath.Join(suite.dir, "server-key.pem")
+	suite.writeCert("server one", suite.cert, suite.key)
+
+	clientCert := filepath.Join(suite.dir, "client.pem")
+	clientKey := filepath.Join(suite.dir, "client-key.pem")
+	suite.writeCert("billing-service", clientCert, clientKey)
+	suite.client, _ = tls.LoadX509KeyPair(clientCert, clientKey)
+}
+
+func (suite *TLSSuite) TearDownSuite() {
+	certReloadInterval = suite.reloads
+	os.RemoveAll(suite.dir)
+	Log(log.InfoLevel, "========== TLS Testsuite completed ===========", true)
+	fmt.Println("========== TLS Testsuite completed ===========")
+}
+
+//writeCert issues a certificate for commonName from the test CA and writes the pem files
+func (suite *TLSSuite) writeCert(commonName string, certPath string, keyPath string) {
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: commonName, Organization: []string{"whitelist"}},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	der, _ := x509.CreateCertificate(rand.Reader, template, suite.caCert, &key.PublicKey, suite.caKey)
+	keyDer, _ := x509.MarshalECPrivateKey(key)
+	os.WriteFile(certPath, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600)
+	os.WriteFile(keyPath, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600)
+}
+
+func (suite *TLSSuite) TestTLSVersion() {
+	Log(log.InfoLevel, "====== Running TestTLSVersion ===========", true)
+	tt := []struct {
+		version  string
+		expected uint16
+		err      bool
+	}{
+		{"", tls.VersionTLS12, false},
+		{"1.2", tls.VersionTLS12, false},
+		{"1.3", tls.VersionTLS13, false},
+		{"1.0", tls.VersionTLS10, false},
+		{"SSLv3", 0, true},
+	}
+	for _, tc := range tt {
+		version, err := tlsVersion(tc.version)
+		if tc.err {
+			suite.Error(err, "was expecting an error for %q, returned ok", tc.version)
+			continue
+		}
+		suite.NoError(err, "was expecting no error for %q, returned %v", tc.version, err)
+		suite.Equal(tc.expected, version)
+	}
+}
+
+func (suite *TLSSuite) TestSetupTLSErrors() {
+	Log(log.InfoLevel, "====== Running TestSetupTLSErrors ===========", true)
+	_, err := setupTLS("INVALIDPATH#!", suite.key, "1.2", "")
+	if !suite.Error(err, "was expecting an error, returned ok") {
+		Log(log.InfoLevel, "was expecting an error on missing certificate, returned ok", true)
+	}
+	_, err = setupTLS(suite.cert, suite.key, "1.2", suite.key)
+	if !suite.Error(err, "was expecting an error, returned ok") {
+		Log(log.InfoLevel, "was expecting an error on an invalid ca bundle, returned ok", true)
+	}
+}
+
+//TestCertReload rotates the certificate on disk and validates the new one is served
+func (suite *TLSSuite) TestCertReload() {
+	Log(log.InfoLevel, "====== Running TestCertReload ===========", true)
+	cert := filepath.Join(suite.dir, "rotate.pem")
+	key := filepath.Join(suite.dir, "rotate-key.pem")
+	suite.writeCert("before rotation", cert, key)
+
+	reloader, err := newCertReloader(cert, key)
+	if !suite.NoError(err, "was expecting no error, returned %v", err) {
+		return
+	}
+	served, _ := reloader.GetCertificate(nil)
+	leaf, _ := x509.ParseCertificate(served.Certificate[0])
+	suite.Equal("before rotation", leaf.Subject.CommonName)
+
+	suite.writeCert("after rotation", cert, key)
+	future := time.Now().Add(time.Minute)
+	os.Chtimes(cert, future, future)
+
+	served, _ = reloader.GetCertificate(nil)
+	leaf, _ = x509.ParseCertificate(served.Certificate[0])
+	if !suite.Equal("after rotation", leaf.Subject.CommonName) {
+		Log(log.InfoLevel, "was expecting the rotated certificate to be served", true)
+	}
+
+	//a broken rotation keeps the last good certificate
+	os.WriteFile(key, []byte("garbage"), 0600)
+	os.Chtimes(key, future.Add(time.Minute), future.Add(time.Minute))
+	served, err = reloader.GetCertificate(nil)
+	suite.NoError(err)
+	leaf, _ = x509.ParseCertificate(served.Certificate[0])
+	suite.Equal("after rotation", leaf.Subject.CommonName)
+}
+
+//TestMutualTLS runs a listener that requires client certificates and validates the subject is
+//available to handlers and unauthenticated callers are rejected
+func (suite *TLSSuite) TestMutualTLS() {
+	Log(log.InfoLevel, "====== Running TestMutualTLS ===========", true)
+	config, err := setupTLS(suite.cert, suite.key, "1.2", suite.caPath)
+	if !suite.NoError(err, "was expecting no error, returned %v", err) {
+		return
+	}
+	inner, _ := net.Listen("tcp", "127.0.0.1:0")
+	//served the way main serves it, with the config on the server and the listener wrapped
+	srv := &http.Server{TLSConfig: config, Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(ClientCertSubject(r)))
+	})}
+	defer srv.Close()
+	go srv.Serve(tls.NewListener(inner, config))
+
+	url := fmt.Sprintf("https://%v/", inner.Addr())
+	client := &http.Client{Transport: &http.Transport{ForceAttemptHTTP2: true, TLSClientConfig: &tls.Config{
+		RootCAs:      suite.caPool,
+		Certificates: []tls.Certificate{suite.client},
+	}}}
+	resp, err := client.Get(url)
+	if suite.NoError(err, "was expecting no error, returned %v", err) {
+		body := make([]byte, 128)
+		n, _ := resp.Body.Read(body)
+		resp.Body.Close()
+		suite.Equal("CN=billing-service,O=whitelist", string(body[:n]))
+		if !suite.Equal(2, resp.ProtoMajor, "was expecting HTTP/2 to be negotiated, received %v", resp.Proto) {
+			Log(log.InfoLevel, fmt.Sprintf("was expecting HTTP/2 to be negotiated, received %v", resp.Proto), true)
+		}
+	}
+
+	anonymous := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: suite.caPool}}}
+	_, err = anonymous.Get(url)
+	if !suite.Error(err, "was expecting an error without a client certificate, returned ok") {
+		Log(log.InfoLevel, "was expecting an error without a client certificate, returned ok", true)
+	}
+
+	suite.Equal("", ClientCertSubject(&http.Request{}))
+}
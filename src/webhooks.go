@@ -0,0 +1,634 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	jsoniter "github.com/json-iterator/go"
+	log "github.com/sirupsen/logrus"
+)
+
+//webhook event types
+const (
+	EventDenied           = "check.denied"
+	EventPolicyUpdated    = "policy.updated"
+	EventDatabaseReloaded = "database.reloaded"
+	EventDatabaseStale    = "database.stale"
+)
+
+//WebhookEndpoint is a receiver of webhook events. an empty events list subscribes to every event,
+//and countries (names or iso codes) narrow check.denied events down to denials for those countries
+type WebhookEndpoint struct {
+	URL       string   `mapstructure:"url"`
+	Secret    string   `mapstructure:"secret"`
+	Events    []string `mapstructure:"events"`
+	Countries []string `mapstructure:"countries"`
+}
+
+//WebhookConfig is the "webhooks" section of config.yaml. denials are counted per tenant, country
+//and policy over the denied window, and a check.denied event is sent for every window in which the
+//count reached the denied threshold
+type WebhookConfig struct {
+	Endpoints       []WebhookEndpoint `mapstructure:"endpoints"`
+	QueuePath       string            `mapstructure:"queue path"`
+	MaxAttempts     int               `mapstructure:"max attempts"`
+	DatabaseMaxAge  time.Duration     `mapstructure:"database max age"`
+	DeniedThreshold int               `mapstructure:"denied threshold"`
+	DeniedWindow    time.Duration     `mapstructure:"denied window"`
+}
+
+//WebhookEvent is the json payload posted to endpoints
+type WebhookEvent struct {
+	ID   string                 `json:"id"`
+	Type string                 `json:"type"`
+	Time time.Time              `json:"time"`
+	Data map[string]interface{} `json:"data"`
+}
+
+//webhookDelivery is one event queued for one endpoint. every delivery is a file in the queue
+//directory until it succeeds or runs out of attempts, so pending events survive restarts
+type webhookDelivery struct {
+	ID          string       `json:"id"`
+	URL         string       `json:"url"`
+	Event       WebhookEvent `json:"event"`
+	Attempts    int          `json:"attempts"`
+	NextAttempt time.Time    `json:"next_attempt"`
+}
+
+//webhook retry backoff, doubled on every failed attempt up to the max
+var webhookBaseBackoff = 5 * time.Second
+var webhookMaxBackoff = 30 * time.Minute
+
+//staleCheckInterval is how often the database build date is compared against the max age
+var staleCheckInterval = time.Hour
+
+//deniedSampleSize is how many of the denied ips of a window are sent with its check.denied event
+const deniedSampleSize = 10
+
+//deniedKey is what denials are counted by
+type deniedKey struct {
+	tenant  string
+	isoCode string
+	policy  string
+}
+
+//deniedCount is the count of denials of one key in the current window
+type deniedCount struct {
+	country       string
+	source        string
+	policyVersion int
+	count         int
+	ips           []string
+	since         time.Time
+	until         time.Time
+}
+
+//webhookDispatcher queues events for the configured endpoints and delivers them in the background,
+//each endpoint on its own goroutine so a slow or unreachable one only delays its own events
+type webhookDispatcher struct {
+	config WebhookConfig
+	client *http.Client
+	//senders wakes the delivery goroutine of each endpoint url
+	senders    map[string]chan struct{}
+	delivering sync.WaitGroup
+
+	mu            sync.Mutex
+	pending       map[string]*webhookDelivery
+	staleNotified uint
+
+	//events and denials are only collected in memory on the request path, the delivery loop writes
+	//them to the queue. once closed, they are passed on to the active dispatcher
+	collected sync.Mutex
+	events    []WebhookEvent
+	denied    map[deniedKey]*deniedCount
+	closed    bool
+
+	wake chan struct{}
+	stop chan struct{}
+	done chan struct{}
+}
+
+//setupWebhooks makes a dispatcher for the endpoints the active one. no endpoints disables webhooks
+func setupWebhooks(config WebhookConfig) error {
+	dispatcher, err := newWebhookDispatcher(config)
+	if err != nil {
+		return err
+	}
+	updateRuntime(func(state *runtimeState) { state.webhooks = dispatcher })
+	return nil
+}
+
+//newWebhookDispatcher validates the endpoints and checks the deliveries left in the queue directory
+//can be read. it only starts delivering once published, after the dispatcher it replaces has
+//stopped, so the two never deliver the same files. no endpoints returns no dispatcher
+func newWebhookDispatcher(config WebhookConfig) (*webhookDispatcher, error) {
+	if len(config.Endpoints) == 0 {
+		return nil, nil
+	}
+	known := map[string]bool{EventDenied: true, EventPolicyUpdated: true, EventDatabaseReloaded: true, EventDatabaseStale: true}
+	for _, endpoint := range config.Endpoints {
+		if !strings.HasPrefix(endpoint.URL, "http://") && !strings.HasPrefix(endpoint.URL, "https://") {
+			return nil, fmt.Errorf("invalid webhook url %q", endpoint.URL)
+		}
+		if endpoint.Secret == "" {
+			return nil, fmt.Errorf("webhook %v has no secret", endpoint.URL)
+		}
+		for _, event := range endpoint.Events {
+			if !known[event] {
+				return nil, fmt.Errorf("unknown webhook event %q", event)
+			}
+		}
+	}
+	if config.QueuePath == "" {
+		return nil, fmt.Errorf("webhook queue path is required")
+	}
+	if config.MaxAttempts <= 0 {
+		return nil, fmt.Errorf("webhook max attempts must be positive")
+	}
+	if config.DeniedThreshold <= 0 || config.DeniedWindow <= 0 {
+		return nil, fmt.Errorf("webhook denied threshold and window must be positive")
+	}
+	if err := os.MkdirAll(config.QueuePath, 0700); err != nil {
+		return nil, err
+	}
+	dispatcher := &webhookDispatcher{
+		config:  config,
+		client:  &http.Client{Timeout: 10 * time.Second},
+		senders: map[string]chan struct{}{},
+		pending: map[string]*webhookDelivery{},
+		denied:  map[deniedKey]*deniedCount{},
+		wake:    make(chan struct{}, 1),
+		stop:    make(chan struct{}),
+		done:    make(chan struct{}),
+	}
+	for _, endpoint := range config.Endpoints {
+		dispatcher.senders[endpoint.URL] = make(chan struct{}, 1)
+	}
+	if err := dispatcher.loadQueue(); err != nil {
+		return nil, err
+	}
+	return dispatcher, nil
+}
+
+//loadQueue reads the deliveries in the queue directory
+func (d *webhookDispatcher) loadQueue() error {
+	files, err := filepath.Glob(filepath.Join(d.config.QueuePath, "*.json"))
+	if err != nil {
+		return err
+	}
+	pending := map[string]*webhookDelivery{}
+	for _, file := range files {
+		var delivery webhookDelivery
+		data, err := os.ReadFile(file)
+		if err == nil {
+			err = jsoniter.Unmarshal(data, &delivery)
+		}
+		if err != nil {
+			return fmt.Errorf("failed to read queued webhook %v: %v", filepath.Base(file), err)
+		}
+		pending[delivery.ID] = &delivery
+	}
+	d.mu.Lock()
+	d.pending = pending
+	d.mu.Unlock()
+	return nil
+}
+
+//start reads the queue again, now holding what the replaced dispatcher left in it, and starts delivering.
+//deliveries to endpoints removed from the configuration are dropped as delivered
+func (d *webhookDispatcher) start() {
+	if err := d.loadQueue(); err != nil {
+		Log(log.ErrorLevel, err.Error(), flag.Lookup("test.v") == nil)
+	}
+	d.mu.Lock()
+	for _, delivery := range d.pending {
+		if _, ok := d.senders[delivery.URL]; !ok {
+			d.remove(delivery)
+		}
+	}
+	d.mu.Unlock()
+	for url, wake := range d.senders {
+		d.delivering.Add(1)
+		go d.deliver(url, wake)
+	}
+	go d.run()
+}
+
+//closeWebhooks stops the active dispatcher, if any
+func closeWebhooks() {
+	updateRuntime(func(state *runtimeState) { state.webhooks = nil })
+}
+
+//EmitEvent queues an event for every endpoint subscribed to it
+func EmitEvent(eventType string, data map[string]interface{}) {
+	if dispatcher := currentRuntime().webhooks; dispatcher != nil {
+		dispatcher.emit(eventType, data)
+	}
+}
+
+//emit collects an event for the delivery loop to queue and wakes it
+func (d *webhookDispatcher) emit(eventType string, data map[string]interface{}) {
+	event := WebhookEvent{ID: randomID(), Type: eventType, Time: time.Now().UTC(), Data: data}
+	d.collected.Lock()
+	if d.closed {
+		d.collected.Unlock()
+		if active := currentRuntime().webhooks; active != nil && active != d {
+			active.emit(eventType, data)
+		}
+		return
+	}
+	d.events = append(d.events, event)
+	d.collected.Unlock()
+	d.wakeUp()
+}
+
+//wakeUp makes the delivery loop run without waiting for its timer
+func (d *webhookDispatcher) wakeUp() {
+	select {
+	case d.wake <- struct{}{}:
+	default:
+	}
+}
+
+//notifyDenied counts a denied check towards the check.denied event of its window
+func notifyDenied(r *http.Request, ip string, policy *Policy, decision Decision) {
+	if dispatcher := requestRuntime(r).webhooks; dispatcher != nil {
+		dispatcher.countDenied(RequestTenant(r), ip, policy, decision, time.Now())
+	}
+}
+
+//countDenied adds a denial to the count of its key, starting a window if there is none
+func (d *webhookDispatcher) countDenied(tenant string, ip string, policy *Policy, decision Decision, now time.Time) {
+	key := deniedKey{tenant: tenant, isoCode: decision.Country.IsoCode}
+	if policy != nil {
+		key.policy = policy.Name
+	}
+	d.collected.Lock()
+	if d.closed {
+		d.collected.Unlock()
+		if active := currentRuntime().webhooks; active != nil && active != d {
+			active.countDenied(tenant, ip, policy, decision, now)
+		}
+		return
+	}
+	count, ok := d.denied[key]
+	if !ok {
+		count = &deniedCount{country: decision.Country.Name, source: decision.Country.Source, since: now,
+			until: now.Add(d.config.DeniedWindow)}
+		d.denied[key] = count
+	}
+	if policy != nil {
+		count.policyVersion = policy.Version
+	}
+	count.count++
+	if len(count.ips) < deniedSampleSize {
+		count.ips = append(count.ips, ip)
+	}
+	d.collected.Unlock()
+	//a new window moves the next flush forward
+	if !ok {
+		d.wakeUp()
+	}
+}
+
+//flushDenied ends the windows that are over by now, all of them when closing, and emits an event
+//for each that reached the threshold. it returns how long until the next window ends
+func (d *webhookDispatcher) flushDenied(now time.Time, closing bool) time.Duration {
+	d.collected.Lock()
+	defer d.collected.Unlock()
+	next := webhookMaxBackoff
+	for key, count := range d.denied {
+		if wait := count.until.Sub(now); wait > 0 && !closing {
+			if wait < next {
+				next = wait
+			}
+			continue
+		}
+		delete(d.denied, key)
+		if count.count < d.config.DeniedThreshold {
+			continue
+		}
+		data := map[string]interface{}{
+			"tenant":   key.tenant,
+			"country":  count.country,
+			"iso_code": key.isoCode,
+			"source":   count.source,
+			"count":    count.count,
+			"ips":      count.ips,
+			"since":    count.since.UTC(),
+			"until":    count.until.UTC(),
+		}
+		if key.policy != "" {
+			data["policy"] = key.policy
+			data["policy_version"] = count.policyVersion
+		}
+		d.events = append(d.events, WebhookEvent{ID: randomID(), Type: EventDenied, Time: now.UTC(), Data: data})
+	}
+	return next
+}
+
+//queueEvents persists a delivery of every collected event per subscribed endpoint
+func (d *webhookDispatcher) queueEvents() {
+	d.collected.Lock()
+	events := d.events
+	d.events = nil
+	d.collected.Unlock()
+	for _, event := range events {
+		for _, endpoint := range d.config.Endpoints {
+			if !endpoint.subscribed(event) {
+				continue
+			}
+			delivery := &webhookDelivery{ID: randomID(), URL: endpoint.URL, Event: event, NextAttempt: event.Time}
+			if err := d.persist(delivery); err != nil {
+				Log(log.ErrorLevel, fmt.Sprintf("failed to queue webhook for %v: %v", endpoint.URL, err), flag.Lookup("test.v") == nil)
+				continue
+			}
+			d.mu.Lock()
+			d.pending[delivery.ID] = delivery
+			d.mu.Unlock()
+			select {
+			case d.senders[endpoint.URL] <- struct{}{}:
+			default:
+			}
+		}
+	}
+}
+
+//subscribed reports whether the endpoint wants the event
+func (endpoint WebhookEndpoint) subscribed(event WebhookEvent) bool {
+	if len(endpoint.Events) > 0 {
+		found := false
+		for _, subscribed := range endpoint.Events {
+			found = found || subscribed == event.Type
+		}
+		if !found {
+			return false
+		}
+	}
+	if event.Type != EventDenied || len(endpoint.Countries) == 0 {
+		return true
+	}
+	name, _ := event.Data["country"].(string)
+	isoCode, _ := event.Data["iso_code"].(string)
+	for _, country := range endpoint.Countries {
+		if strings.EqualFold(country, name) || strings.EqualFold(country, isoCode) {
+			return true
+		}
+	}
+	return false
+}
+
+//persist writes a delivery to the queue directory through a temp file. it's only called from the
+//delivery loop
+func (d *webhookDispatcher) persist(delivery *webhookDelivery) error {
+	data, err := jsoniter.Marshal(delivery)
+	if err != nil {
+		return err
+	}
+	path := filepath.Join(d.config.QueuePath, delivery.ID+".json")
+	if err := os.WriteFile(path+".tmp", data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(path+".tmp", path)
+}
+
+//run queues collected events for the endpoint senders until the dispatcher is closed, waking up for
+//new events, the end of denied windows and the periodic stale database check. on close, whatever
+//was collected is queued so it's delivered after the next start
+func (d *webhookDispatcher) run() {
+	defer close(d.done)
+	timer := time.NewTimer(0)
+	defer timer.Stop()
+	for {
+		select {
+		case <-d.stop:
+			d.collected.Lock()
+			d.closed = true
+			d.collected.Unlock()
+			d.flushDenied(time.Now(), true)
+			d.queueEvents()
+			d.delivering.Wait()
+			return
+		case <-d.wake:
+		case <-timer.C:
+		}
+		d.checkStale(time.Now())
+		wait := d.flushDenied(time.Now(), false)
+		d.queueEvents()
+		if wait > staleCheckInterval {
+			wait = staleCheckInterval
+		}
+		if !timer.Stop() {
+			select {
+			case <-timer.C:
+			default:
+			}
+		}
+		timer.Reset(wait)
+	}
+}
+
+//checkStale emits a database.stale event once per database build that is older than the max age
+func (d *webhookDispatcher) checkStale(now time.Time) {
+	if d.config.DatabaseMaxAge <= 0 {
+		return
+	}
+	provider, err := loadedProvider()
+	if err != nil {
+		return
+	}
+	info, err := provider.Info()
+	if err != nil {
+		return
+	}
+	epoch := info.BuildEpoch
+	built := time.Unix(int64(epoch), 0).UTC()
+	if now.Sub(built) <= d.config.DatabaseMaxAge {
+		return
+	}
+	d.mu.Lock()
+	notified := d.staleNotified == epoch
+	d.staleNotified = epoch
+	d.mu.Unlock()
+	if !notified {
+		d.emit(EventDatabaseStale, map[string]interface{}{"build_epoch": epoch, "built": built, "max_age": d.config.DatabaseMaxAge.String()})
+	}
+}
+
+//deliver attempts the due deliveries of one endpoint until the dispatcher is closed, waking up for
+//newly queued deliveries and retries
+func (d *webhookDispatcher) deliver(url string, wake chan struct{}) {
+	defer d.delivering.Done()
+	timer := time.NewTimer(0)
+	defer timer.Stop()
+	for {
+		select {
+		case <-d.stop:
+			return
+		case <-wake:
+		case <-timer.C:
+		}
+		wait := d.deliverDue(url, time.Now())
+		if !timer.Stop() {
+			select {
+			case <-timer.C:
+			default:
+			}
+		}
+		timer.Reset(wait)
+	}
+}
+
+//deliverDue attempts every delivery to the endpoint url that is due and returns how long until the
+//next one is. it stops early once the dispatcher is closed, leaving the rest queued
+func (d *webhookDispatcher) deliverDue(url string, now time.Time) time.Duration {
+	d.mu.Lock()
+	var due []*webhookDelivery
+	for _, delivery := range d.pending {
+		if delivery.URL == url && !delivery.NextAttempt.After(now) {
+			due = append(due, delivery)
+		}
+	}
+	d.mu.Unlock()
+	//oldest events first so receivers see them roughly in order
+	sort.Slice(due, func(i, j int) bool { return due[i].Event.Time.Before(due[j].Event.Time) })
+
+	for _, delivery := range due {
+		select {
+		case <-d.stop:
+			return 0
+		default:
+		}
+		err := d.send(delivery)
+		d.mu.Lock()
+		switch {
+		case err == nil:
+			IncCounter("whitelist_webhook_deliveries_total", map[string]string{"result": "delivered"})
+			d.remove(delivery)
+		case delivery.Attempts+1 >= d.config.MaxAttempts:
+			IncCounter("whitelist_webhook_deliveries_total", map[string]string{"result": "failed"})
+			Log(log.ErrorLevel, fmt.Sprintf("dropping webhook %v to %v after %v attempts: %v", delivery.Event.Type, delivery.URL, delivery.Attempts+1, err), flag.Lookup("test.v") == nil)
+			d.remove(delivery)
+		default:
+			IncCounter("whitelist_webhook_deliveries_total", map[string]string{"result": "retry"})
+			delivery.Attempts++
+			delivery.NextAttempt = now.Add(webhookBackoff(delivery.Attempts))
+			if err := d.persist(delivery); err != nil {
+				Log(log.ErrorLevel, fmt.Sprintf("failed to update queued webhook: %v", err), flag.Lookup("test.v") == nil)
+			}
+		}
+		d.mu.Unlock()
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	wait := webhookMaxBackoff
+	for _, delivery := range d.pending {
+		if until := delivery.NextAttempt.Sub(now); delivery.URL == url && until < wait {
+			wait = until
+		}
+	}
+	if wait < 0 {
+		wait = 0
+	}
+	return wait
+}
+
+//remove drops a delivery from the queue. callers must hold the lock
+func (d *webhookDispatcher) remove(delivery *webhookDelivery) {
+	delete(d.pending, delivery.ID)
+	os.Remove(filepath.Join(d.config.QueuePath, delivery.ID+".json"))
+}
+
+//webhookBackoff returns the wait after the given number of failed attempts
+func webhookBackoff(attempts int) time.Duration {
+	backoff := webhookBaseBackoff
+	for i := 1; i < attempts && backoff < webhookMaxBackoff; i++ {
+		backoff *= 2
+	}
+	if backoff > webhookMaxBackoff {
+		backoff = webhookMaxBackoff
+	}
+	return backoff
+}
+
+//send posts the event to its endpoint, signed with the endpoint secret over the time it is sent and
+//the body. endpoints removed from the configuration are treated as delivered
+func (d *webhookDispatcher) send(delivery *webhookDelivery) error {
+	var endpoint *WebhookEndpoint
+	for i := range d.config.Endpoints {
+		if d.config.Endpoints[i].URL == delivery.URL {
+			endpoint = &d.config.Endpoints[i]
+		}
+	}
+	if endpoint == nil {
+		return nil
+	}
+	body, err := jsoniter.Marshal(delivery.Event)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPost, endpoint.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Whitelist-Event", delivery.Event.Type)
+	req.Header.Set("X-Whitelist-Delivery", delivery.ID)
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	req.Header.Set("X-Whitelist-Timestamp", timestamp)
+	req.Header.Set("X-Whitelist-Signature", "sha256="+SignWebhook(endpoint.Secret, timestamp, body))
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("endpoint responded %v", resp.StatusCode)
+	}
+	return nil
+}
+
+//SignWebhook returns the hex hmac-sha256 of "timestamp.body", sent in the X-Whitelist-Signature header
+//with the unix timestamp in X-Whitelist-Timestamp, so receivers can verify the payload came from this
+//service and reject old deliveries replayed to them
+func SignWebhook(secret string, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp + "."))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+//Pending returns how many deliveries are queued
+func (d *webhookDispatcher) Pending() int {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return len(d.pending)
+}
+
+//Close stops delivering. queued deliveries stay on disk for the next start or the dispatcher that
+//replaces this one
+func (d *webhookDispatcher) Close() {
+	close(d.stop)
+	<-d.done
+}
+
+//randomID returns a random 128 bit hex id
+func randomID() string {
+	id := make([]byte, 16)
+	rand.Read(id)
+	return hex.EncodeToString(id)
+}
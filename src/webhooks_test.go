@@ -0,0 +1,342 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	jsoniter "github.com/json-iterator/go"
+	log "github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/suite"
+)
+
+func TestWebhookSuite(t *testing.T) {
+	webhookSuite := new(WebhookSuite)
+	suite.Run(t, webhookSuite)
+}
+
+type WebhookSuite struct {
+	suite.Suite
+	dir      string
+	server   *httptest.Server
+	status   int32
+	received chan receivedWebhook
+	//release unblocks the requests held by the /slow endpoint
+	release chan struct{}
+}
+
+//receivedWebhook is a request captured by the test receiver
+type receivedWebhook struct {
+	path      string
+	signature string
+	timestamp string
+	event     WebhookEvent
+	body      []byte
+}
+
+func (suite *WebhookSuite) SetupSuite() {
+	setLogPath("./logs/")
+	Log(log.InfoLevel, "=============== Running Webhook Suite ======================", true)
+	setupDB("./test-data/test-data.mmdb")
+	suite.server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/slow" {
+			<-suite.release
+		}
+		body, _ := io.ReadAll(r.Body)
+		var event WebhookEvent
+		jsoniter.Unmarshal(body, &event)
+		suite.received <- receivedWebhook{path: r.URL.Path, signature: r.Header.Get("X-Whitelist-Signature"),
+			timestamp: r.Header.Get("X-Whitelist-Timestamp"), event: event, body: body}
+		w.WriteHeader(int(atomic.LoadInt32(&suite.status)))
+	}))
+}
+
+func (suite *WebhookSuite) SetupTest() {
+	suite.dir, _ = os.MkdirTemp("", "webhook-test")
+	suite.received = make(chan receivedWebhook, 100)
+	suite.release = make(chan struct{})
+	atomic.StoreInt32(&suite.status, http.StatusOK)
+}
+
+func (suite *WebhookSuite) TearDownTest() {
+	//requests still held by the slow endpoint would keep the dispatcher from closing
+	select {
+	case <-suite.release:
+	default:
+		close(suite.release)
+	}
+	setupWebhooks(WebhookConfig{})
+	os.RemoveAll(suite.dir)
+}
+
+func (suite *WebhookSuite) TearDownSuite() {
+	suite.server.Close()
+	compiling.Wait()
+	testProvider().Close()
+	Log(log.InfoLevel, "========== Webhook Testsuite completed ===========", true)
+	fmt.Println("========== Webhook Testsuite completed ===========")
+}
+
+//config returns a webhook configuration for the given endpoints queued in the test directory
+func (suite *WebhookSuite) config(endpoints ...WebhookEndpoint) WebhookConfig {
+	return WebhookConfig{Endpoints: endpoints, QueuePath: suite.dir, MaxAttempts: 3, DeniedThreshold: 1, DeniedWindow: 20 * time.Millisecond}
+}
+
+//receive waits for the next webhook delivered to the test receiver
+func (suite *WebhookSuite) receive() (receivedWebhook, bool) {
+	select {
+	case hook := <-suite.received:
+		return hook, true
+	case <-time.After(5 * time.Second):
+		return receivedWebhook{}, false
+	}
+}
+
+//assertQuiet validates nothing else is delivered
+func (suite *WebhookSuite) assertQuiet() {
+	select {
+	case hook := <-suite.received:
+		suite.Fail("unexpected webhook", "received %v on %v", hook.event.Type, hook.path)
+	case <-time.After(200 * time.Millisecond):
+	}
+}
+
+func (suite *WebhookSuite) TestSetupWebhooks() {
+	Log(log.InfoLevel, "====== Running TestSetupWebhooks ===========", true)
+	suite.NoError(setupWebhooks(WebhookConfig{}))
+	suite.Nil(currentRuntime().webhooks, "was expecting no endpoints to disable webhooks")
+
+	tt := []struct {
+		testName string
+		config   WebhookConfig
+	}{
+		{"Invalid URL", suite.config(WebhookEndpoint{URL: "ftp://example.com", Secret: "s"})},
+		{"Missing Secret", suite.config(WebhookEndpoint{URL: suite.server.URL})},
+		{"Unknown Event", suite.config(WebhookEndpoint{URL: suite.server.URL, Secret: "s", Events: []string{"check.allowed"}})},
+		{"No Queue Path", WebhookConfig{Endpoints: []WebhookEndpoint{{URL: suite.server.URL, Secret: "s"}}, MaxAttempts: 3}},
+		{"No Attempts", WebhookConfig{Endpoints: []WebhookEndpoint{{URL: suite.server.URL, Secret: "s"}}, QueuePath: suite.dir}},
+	}
+	for _, tc := range tt {
+		err := setupWebhooks(tc.config)
+		if !suite.Error(err, "was expecting an error on %v, returned ok", tc.testName) {
+			Log(log.InfoLevel, fmt.Sprintf("was expecting an error on %v, returned ok", tc.testName), true)
+		}
+	}
+}
+
+//TestDelivery validates events are filtered per endpoint, signed and removed from the queue once delivered
+func (suite *WebhookSuite) TestDelivery() {
+	Log(log.InfoLevel, "====== Running TestDelivery ===========", true)
+	err := setupWebhooks(suite.config(
+		WebhookEndpoint{URL: suite.server.URL + "/denied", Secret: "denied-secret", Events: []string{EventDenied}, Countries: []string{"CN", "australia"}},
+		WebhookEndpoint{URL: suite.server.URL + "/policies", Secret: "policy-secret", Events: []string{EventPolicyUpdated}},
+	))
+	if !suite.NoError(err, "was expecting no error, returned %v", err) {
+		Log(log.InfoLevel, fmt.Sprintf("was expecting no error, returned %v", err), true)
+		return
+	}
+
+	//china is denied and watched, japan is denied but not watched
+	router := setupRouter()
+	for _, ip := range []string{"1.207.235.255", "1.0.16.1"} {
+		req := httptest.NewRequest(http.MethodGet, "/checkWhitelist/"+ip, bytes.NewBufferString(`{"whitelisted_countries": ["germany"]}`))
+		router.ServeHTTP(httptest.NewRecorder(), req)
+	}
+	hook, ok := suite.receive()
+	if suite.True(ok, "was expecting a check.denied webhook") {
+		suite.Equal("/denied", hook.path)
+		suite.Equal(EventDenied, hook.event.Type)
+		suite.Equal([]interface{}{"1.207.235.255"}, hook.event.Data["ips"])
+		suite.Equal(float64(1), hook.event.Data["count"])
+		suite.Equal("CN", hook.event.Data["iso_code"])
+		suite.Equal("sha256="+SignWebhook("denied-secret", hook.timestamp, hook.body), hook.signature)
+		sent, _ := strconv.ParseInt(hook.timestamp, 10, 64)
+		suite.InDelta(time.Now().Unix(), sent, 5, "was expecting the delivery time in the timestamp header")
+		suite.NotEqual("sha256="+SignWebhook("denied-secret", strconv.FormatInt(sent-600, 10), hook.body), hook.signature,
+			"was expecting the signature to cover the timestamp")
+	}
+	suite.assertQuiet()
+
+	EmitEvent(EventPolicyUpdated, map[string]interface{}{"policy": "asia", "version": 2})
+	hook, ok = suite.receive()
+	if suite.True(ok, "was expecting a policy.updated webhook") {
+		suite.Equal("/policies", hook.path)
+		suite.Equal("asia", hook.event.Data["policy"])
+		suite.Equal("sha256="+SignWebhook("policy-secret", hook.timestamp, hook.body), hook.signature)
+	}
+	suite.assertQuiet()
+
+	suite.Eventually(func() bool { return currentRuntime().webhooks.Pending() == 0 }, time.Second, 10*time.Millisecond)
+	files, _ := filepath.Glob(filepath.Join(suite.dir, "*.json"))
+	suite.Empty(files, "was expecting delivered webhooks to leave the queue")
+}
+
+//TestDeniedAggregation validates denials are counted per country and policy over the window, with
+//one event per window that reached the threshold
+func (suite *WebhookSuite) TestDeniedAggregation() {
+	Log(log.InfoLevel, "====== Running TestDeniedAggregation ===========", true)
+	config := suite.config(WebhookEndpoint{URL: suite.server.URL, Secret: "secret", Events: []string{EventDenied}})
+	config.DeniedThreshold = 3
+	config.DeniedWindow = 100 * time.Millisecond
+	suite.NoError(setupWebhooks(config))
+
+	router := setupRouter()
+	//four chinese denials reach the threshold, a single japanese one doesn't
+	for _, ip := range []string{"1.207.235.255", "1.207.235.254", "1.207.235.255", "1.207.235.253", "1.0.16.1"} {
+		req := httptest.NewRequest(http.MethodGet, "/checkWhitelist/"+ip, bytes.NewBufferString(`{"whitelisted_countries": ["germany"]}`))
+		router.ServeHTTP(httptest.NewRecorder(), req)
+	}
+	files, _ := filepath.Glob(filepath.Join(suite.dir, "*.json"))
+	suite.Empty(files, "was expecting nothing queued before the window ends")
+
+	hook, ok := suite.receive()
+	if suite.True(ok, "was expecting a check.denied webhook at the end of the window") {
+		suite.Equal("CN", hook.event.Data["iso_code"])
+		suite.Equal(float64(4), hook.event.Data["count"])
+		suite.Equal([]interface{}{"1.207.235.255", "1.207.235.254", "1.207.235.255", "1.207.235.253"}, hook.event.Data["ips"])
+	}
+	suite.assertQuiet()
+
+	//a window still open when the dispatcher closes is queued for the next start
+	config.DeniedThreshold = 1
+	config.DeniedWindow = time.Hour
+	atomic.StoreInt32(&suite.status, http.StatusServiceUnavailable)
+	suite.NoError(setupWebhooks(config))
+	req := httptest.NewRequest(http.MethodGet, "/checkWhitelist/1.0.16.1", bytes.NewBufferString(`{"whitelisted_countries": ["germany"]}`))
+	router.ServeHTTP(httptest.NewRecorder(), req)
+	setupWebhooks(WebhookConfig{})
+	files, _ = filepath.Glob(filepath.Join(suite.dir, "*.json"))
+	suite.Len(files, 1, "was expecting the open window to be queued on close")
+}
+
+//TestRetries validates failed deliveries are retried with backoff and dropped after max attempts
+func (suite *WebhookSuite) TestRetries() {
+	Log(log.InfoLevel, "====== Running TestRetries ===========", true)
+	defer func(base time.Duration) { webhookBaseBackoff = base }(webhookBaseBackoff)
+	webhookBaseBackoff = 20 * time.Millisecond
+	suite.Equal(20*time.Millisecond, webhookBackoff(1))
+	suite.Equal(80*time.Millisecond, webhookBackoff(3))
+	suite.Equal(webhookMaxBackoff, webhookBackoff(100))
+
+	atomic.StoreInt32(&suite.status, http.StatusInternalServerError)
+	failed := CounterValue("whitelist_webhook_deliveries_total", map[string]string{"result": "failed"})
+	suite.NoError(setupWebhooks(suite.config(WebhookEndpoint{URL: suite.server.URL, Secret: "secret"})))
+	EmitEvent(EventPolicyUpdated, map[string]interface{}{"policy": "asia"})
+
+	ids := map[string]bool{}
+	for i := 0; i < 3; i++ {
+		hook, ok := suite.receive()
+		if !suite.True(ok, "was expecting attempt %v", i+1) {
+			return
+		}
+		ids[hook.event.ID] = true
+	}
+	suite.Len(ids, 1, "was expecting every attempt to carry the same event")
+	suite.assertQuiet()
+	suite.Equal(0, currentRuntime().webhooks.Pending())
+	suite.Equal(failed+1, CounterValue("whitelist_webhook_deliveries_total", map[string]string{"result": "failed"}))
+}
+
+//TestSlowEndpoint validates an endpoint that doesn't answer doesn't hold up the others
+func (suite *WebhookSuite) TestSlowEndpoint() {
+	Log(log.InfoLevel, "====== Running TestSlowEndpoint ===========", true)
+	suite.NoError(setupWebhooks(suite.config(
+		WebhookEndpoint{URL: suite.server.URL + "/slow", Secret: "slow-secret"},
+		WebhookEndpoint{URL: suite.server.URL + "/fast", Secret: "fast-secret"},
+	)))
+	EmitEvent(EventPolicyUpdated, map[string]interface{}{"policy": "asia", "version": 1})
+	EmitEvent(EventPolicyUpdated, map[string]interface{}{"policy": "asia", "version": 2})
+	for version := 1; version <= 2; version++ {
+		hook, ok := suite.receive()
+		if !suite.True(ok, "was expecting the fast endpoint to receive version %v", version) {
+			Log(log.InfoLevel, fmt.Sprintf("was expecting the fast endpoint to receive version %v", version), true)
+			break
+		}
+		suite.Equal("/fast", hook.path)
+		suite.Equal(float64(version), hook.event.Data["version"])
+	}
+
+	close(suite.release)
+	for version := 1; version <= 2; version++ {
+		hook, ok := suite.receive()
+		if suite.True(ok, "was expecting the slow endpoint to receive version %v once released", version) {
+			suite.Equal("/slow", hook.path)
+		}
+	}
+}
+
+//TestQueuePersistence validates undelivered events are picked up again after a restart
+func (suite *WebhookSuite) TestQueuePersistence() {
+	Log(log.InfoLevel, "====== Running TestQueuePersistence ===========", true)
+	atomic.StoreInt32(&suite.status, http.StatusServiceUnavailable)
+	config := suite.config(WebhookEndpoint{URL: suite.server.URL, Secret: "secret"})
+	suite.NoError(setupWebhooks(config))
+	EmitEvent(EventDatabaseReloaded, map[string]interface{}{"build_epoch": 1})
+	first, ok := suite.receive()
+	suite.True(ok)
+	setupWebhooks(WebhookConfig{})
+
+	files, _ := filepath.Glob(filepath.Join(suite.dir, "*.json"))
+	suite.Len(files, 1, "was expecting the failed delivery to stay queued")
+
+	atomic.StoreInt32(&suite.status, http.StatusOK)
+	suite.NoError(setupWebhooks(config))
+	suite.Equal(1, currentRuntime().webhooks.Pending())
+	//the retry is scheduled after the backoff, so deliver as if it had passed
+	currentRuntime().webhooks.deliverDue(suite.server.URL, time.Now().Add(webhookBaseBackoff))
+	hook, ok := suite.receive()
+	if suite.True(ok, "was expecting the queued event to be delivered after the restart") {
+		suite.Equal(first.event.ID, hook.event.ID)
+	}
+	suite.Equal(0, currentRuntime().webhooks.Pending())
+}
+
+//TestDatabaseEvents validates reloads and stale databases are reported, stale only once per build
+func (suite *WebhookSuite) TestDatabaseEvents() {
+	Log(log.InfoLevel, "====== Running TestDatabaseEvents ===========", true)
+	config := suite.config(WebhookEndpoint{URL: suite.server.URL, Secret: "secret", Events: []string{EventDatabaseReloaded, EventDatabaseStale}})
+	config.DatabaseMaxAge = 30 * 24 * time.Hour
+	suite.NoError(setupWebhooks(config))
+
+	//the test database was built in 2021
+	hook, ok := suite.receive()
+	if suite.True(ok, "was expecting a database.stale webhook") {
+		suite.Equal(EventDatabaseStale, hook.event.Type)
+		info, _ := testProvider().Info()
+		suite.Equal(float64(info.BuildEpoch), hook.event.Data["build_epoch"])
+	}
+	currentRuntime().webhooks.checkStale(time.Now())
+	suite.assertQuiet()
+
+	//the server setup loads the database before the config sets up webhooks, and still reports it
+	server := defaultConfig
+	server.DatabasePath = "./test-data/test-data.mmdb"
+	server.CorrectionsPath = filepath.Join(suite.dir, "corrections.json")
+	server.PoliciesPath = filepath.Join(suite.dir, "policies.json")
+	server.AuditPath = ""
+	server.Webhooks = suite.config(WebhookEndpoint{URL: suite.server.URL, Secret: "secret", Events: []string{EventDatabaseReloaded}})
+	server.Webhooks.QueuePath = filepath.Join(suite.dir, "queue")
+	previous := testProvider()
+	compiling.Wait()
+	suite.NoError(setupServer(server, nil))
+	defer func() {
+		updateRuntime(func(state *runtimeState) { state.rateLimiter = nil })
+		updateRuntime(func(state *runtimeState) { state.logLevel = log.DebugLevel })
+		setupPolicies("")
+		setupCorrections("")
+	}()
+	previous.Close()
+	hook, ok = suite.receive()
+	if suite.True(ok, "was expecting a database.reloaded webhook") {
+		suite.Equal(EventDatabaseReloaded, hook.event.Type)
+		suite.Equal(server.DatabasePath, hook.event.Data["path"])
+	}
+}